@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"irctl/server/control"
+)
+
+const (
+	// numAlarmsVar is the server variable for the number of alarms.
+	numAlarmsVar = "NUM_ALARMS"
+	// clearAlarmsCmd is the server command that clears all alarms.
+	clearAlarmsCmd = "CLEAR_ALARMS"
+	// alarmsLogName is the log of current alarms under /logs/.
+	alarmsLogName = "alarms.log"
+	// errLogName is the error log file at errLogPath under /logs/.
+	errLogName = "errlog"
+)
+
+// alarmsHandler returns all alarms as JSON, or only their number with
+// count=true.
+func alarmsHandler(w http.ResponseWriter, r *http.Request) {
+	alarms, err := alarmStore.List()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("count") == "true" {
+		writeJSON(w, r, struct{ Count int }{len(alarms)})
+		return
+	}
+	writeJSON(w, r, alarms)
+}
+
+// alarmsClearHandler clears all alarms.
+func alarmsClearHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "clear must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := alarmStore.Clear(); err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// serverVarHandler returns the value of the server variable name as text.
+func serverVarHandler(w http.ResponseWriter, r *http.Request) {
+	switch name := r.FormValue("name"); name {
+	case numAlarmsVar:
+		n, err := alarmStore.Count()
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%d", n)
+	default:
+		httpError(w, r, fmt.Sprintf("unknown server variable %q", name), http.StatusBadRequest)
+	}
+}
+
+// serverCmdHandler runs the server command cmd.
+func serverCmdHandler(w http.ResponseWriter, r *http.Request) {
+	switch cmd := r.FormValue("cmd"); cmd {
+	case clearAlarmsCmd:
+		if err := alarmStore.Clear(); err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		httpError(w, r, fmt.Sprintf("unknown server command %q", cmd), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// logsHandler returns a server log as text. alarms.log has the current
+// alarms and errlog has all alarms, including cleared ones.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch name := path.Base(r.URL.Path); name {
+	case alarmsLogName:
+		alarms, err := alarmStore.List()
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var sb strings.Builder
+		for _, a := range alarms {
+			sb.WriteString(control.FormatAlarm(a))
+		}
+		fmt.Fprint(w, sb.String())
+	case errLogName:
+		if _, err := os.Stat(errLogPath); os.IsNotExist(err) {
+			// Nothing has been logged yet.
+			return
+		}
+		http.ServeFile(w, r, errLogPath)
+	default:
+		httpError(w, r, fmt.Sprintf("unknown log %q", name), http.StatusNotFound)
+	}
+}
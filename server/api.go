@@ -0,0 +1,605 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"irctl/server/control"
+)
+
+// apiPrefix is the path prefix of the versioned HTTP API.
+const apiPrefix = "/api/v1"
+
+// apiHandlerFunc handles an API request with path parameters params. It
+// returns the response body, or nil for no body, or an error with the status
+// from withStatus.
+type apiHandlerFunc func(r *http.Request, params map[string]string) (interface{}, error)
+
+// apiRoute is an API endpoint and its handler.
+type apiRoute struct {
+	op     *control.APIOperation
+	handle apiHandlerFunc
+}
+
+// statusError is an error with an HTTP status code.
+type statusError struct {
+	status int
+	err    error
+}
+
+// Error implements error#Error.
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// withStatus returns err with the HTTP status code status, or nil if err is
+// nil.
+func withStatus(status int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &statusError{status: status, err: err}
+}
+
+// errorStatus returns the HTTP status code for err, which is
+// http.StatusInternalServerError unless set with withStatus.
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return http.StatusInternalServerError
+}
+
+// zoneNumParam is the path parameter for a zone number.
+var zoneNumParam = &control.APIParam{Name: "n", In: "path", Description: "Zone number.", Type: "integer"}
+
+// revisionIDParam is the path parameter for a config revision.
+var revisionIDParam = &control.APIParam{Name: "id", In: "path", Description: "Config revision ID.", Type: "integer"}
+
+// dateRangeParams are the query parameters for a range of dates.
+var dateRangeParams = []*control.APIParam{
+	{Name: "from", In: "query", Description: "First date, e.g. 2019-3-17.", Required: true},
+	{Name: "to", In: "query", Description: "Last date, e.g. 2019-3-24.", Required: true},
+}
+
+// apiConfigDiff is a diff between two config revisions.
+type apiConfigDiff struct {
+	From, To int64
+	// Diff is in unified format, and empty if the configs are the same.
+	Diff string
+}
+
+// apiZoneRunRequest is the request body to run a zone.
+type apiZoneRunRequest struct {
+	Mins int
+	// Queue starts the run once the valves are free, rather than failing if
+	// they are in use.
+	Queue bool
+}
+
+// apiZoneRun is the response for a zone run.
+type apiZoneRun struct {
+	Zone   int
+	Mins   int
+	Queued bool
+}
+
+// apiZoneMins is a zone and the minutes to run it for.
+type apiZoneMins struct {
+	Zone int
+	Mins int
+}
+
+// apiRunRequest is the request body to queue a job of zone runs.
+type apiRunRequest struct {
+	// Zones are run in order.
+	Zones []apiZoneMins
+	// Schedule runs today's computed runtimes instead of Zones.
+	Schedule bool
+}
+
+// apiRoutes returns the API endpoints. Paths are relative to apiPrefix.
+func apiRoutes() []*apiRoute {
+	read, op := control.ReadOnlyRole, control.OperatorRole
+	return []*apiRoute{
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/zones", Role: read,
+			Summary:  "List the zones with their config, state and 30 day history.",
+			Response: struct{ Zones []*control.ZoneView }{},
+		}, apiListZones},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/zones/{n}", Role: read,
+			Summary:  "Get a zone with its config, state and 30 day history.",
+			Params:   []*control.APIParam{zoneNumParam},
+			Response: &control.ZoneView{},
+		}, apiGetZone},
+		{&control.APIOperation{
+			Method: http.MethodPatch, Path: "/zones/{n}", Role: op,
+			Summary:  "Change some of the config fields of a zone.",
+			Params:   []*control.APIParam{zoneNumParam},
+			Request:  &control.ZoneConfig{},
+			Response: &control.ZoneView{},
+		}, apiPatchZone},
+		{&control.APIOperation{
+			Method: http.MethodPost, Path: "/zones/{n}/run", Role: op,
+			Summary:  "Run a zone now, or once the valves are free if queued.",
+			Params:   []*control.APIParam{zoneNumParam},
+			Request:  &apiZoneRunRequest{},
+			Response: &apiZoneRun{},
+			Status:   http.StatusAccepted,
+		}, apiRunZone},
+		{&control.APIOperation{
+			Method: http.MethodDelete, Path: "/zones/{n}/run", Role: op,
+			Summary: "Close a zone's valve and stop any manual run.",
+			Params:  []*control.APIParam{zoneNumParam},
+			Status:  http.StatusNoContent,
+		}, apiStopZone},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/runs", Role: read,
+			Summary:  "List the jobs in the run queue.",
+			Response: struct{ Jobs []*control.Job }{},
+		}, apiListRuns},
+		{&control.APIOperation{
+			Method: http.MethodPost, Path: "/runs", Role: op,
+			Summary:  "Queue a job that runs zones in order.",
+			Request:  &apiRunRequest{},
+			Response: &control.Job{},
+			Status:   http.StatusCreated,
+		}, apiAddRun},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/runs/{id}", Role: read,
+			Summary:  "Get a job in the run queue.",
+			Params:   []*control.APIParam{{Name: "id", In: "path", Description: "Job ID.", Type: "integer"}},
+			Response: &control.Job{},
+		}, apiGetRun},
+		{&control.APIOperation{
+			Method: http.MethodDelete, Path: "/runs/{id}", Role: op,
+			Summary: "Cancel the queued and running items of a job.",
+			Params:  []*control.APIParam{{Name: "id", In: "path", Description: "Job ID.", Type: "integer"}},
+			Status:  http.StatusNoContent,
+		}, apiCancelRun},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/config", Role: read,
+			Summary:  "Get the config.",
+			Response: &control.SystemConfig{},
+		}, apiGetConfig},
+		{&control.APIOperation{
+			Method: http.MethodPut, Path: "/config", Role: op,
+			Summary:  "Replace the config, adding a revision.",
+			Request:  &control.SystemConfig{},
+			Response: &control.ConfigRevision{},
+		}, apiPutConfig},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/config/revisions", Role: read,
+			Summary:  "List the config revisions, newest first.",
+			Response: struct{ Revisions []*control.ConfigRevision }{},
+		}, apiListConfigRevisions},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/config/revisions/{id}", Role: read,
+			Summary:  "Get the config of a revision.",
+			Params:   []*control.APIParam{revisionIDParam},
+			Response: &control.SystemConfig{},
+		}, apiGetConfigRevision},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/config/revisions/{id}/diff", Role: read,
+			Summary: "Get a unified diff of the config from a revision to another.",
+			Params: []*control.APIParam{
+				revisionIDParam,
+				{Name: "to", In: "query", Description: "Revision ID to diff to. The latest if not set.", Type: "integer"},
+			},
+			Response: &apiConfigDiff{},
+		}, apiDiffConfigRevision},
+		{&control.APIOperation{
+			Method: http.MethodPost, Path: "/config/revisions/{id}/rollback", Role: op,
+			Summary:  "Write the config of a revision as a new revision.",
+			Params:   []*control.APIParam{revisionIDParam},
+			Response: &control.ConfigRevision{},
+			Status:   http.StatusCreated,
+		}, apiRollbackConfig},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/conditions", Role: read,
+			Summary:  "Get the logged conditions for a range of dates.",
+			Params:   dateRangeParams,
+			Response: &conditionsResponse{},
+		}, apiConditions},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/runtimes", Role: read,
+			Summary:  "Get the logged runtimes for a range of dates.",
+			Params:   dateRangeParams,
+			Response: &runtimesResponse{},
+		}, apiRuntimes},
+		{&control.APIOperation{
+			Method: http.MethodGet, Path: "/openapi.json", Role: read,
+			Summary: "Get this OpenAPI document.",
+		}, apiOpenAPI},
+	}
+}
+
+// apiHandler returns a handler that dispatches API requests to routes.
+func apiHandler(routes []*apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+		var allow []string
+		for _, rt := range routes {
+			params, ok := matchPath(rt.op.Path, path)
+			if !ok {
+				continue
+			}
+			if rt.op.Method != r.Method {
+				allow = append(allow, rt.op.Method)
+				continue
+			}
+			rt := rt
+			withRole(rt.op.Role, func(w http.ResponseWriter, r *http.Request) {
+				serveAPI(w, r, rt, params)
+			})(w, r)
+			return
+		}
+		if allow != nil {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			httpError(w, r, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		httpError(w, r, "not found", http.StatusNotFound)
+	}
+}
+
+// serveAPI calls the handler of rt and writes its response.
+func serveAPI(w http.ResponseWriter, r *http.Request, rt *apiRoute, params map[string]string) {
+	v, err := rt.handle(r, params)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	status := rt.op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+	writeAPIResponse(w, r, status, v)
+}
+
+// writeAPIResponse writes v to w as JSON with status.
+func writeAPIResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("%s: %s", r.URL.String(), err)
+		status = http.StatusInternalServerError
+		j, _ = json.Marshal(&control.APIError{Status: status, Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// isAPIRequest reports whether r is for the versioned API.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// matchPath returns the path parameters if path matches pattern, where
+// segments of pattern in braces match any non-empty segment.
+func matchPath(pattern, path string) (map[string]string, bool) {
+	ps, ss := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(ps) != len(ss) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, p := range ps {
+		switch {
+		case strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}"):
+			if ss[i] == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = ss[i]
+		case p != ss[i]:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// intParam returns the path parameter name as an int.
+func intParam(params map[string]string, name string) (int64, error) {
+	n, err := strconv.ParseInt(params[name], 10, 64)
+	if err != nil {
+		return 0, withStatus(http.StatusBadRequest, fmt.Errorf("%s: %s", name, err))
+	}
+	return n, nil
+}
+
+// decodeBody decodes the JSON request body of r into v. Unknown fields are
+// errors, to catch typos.
+func decodeBody(r *http.Request, v interface{}) error {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("bad request body: %s", err))
+	}
+	return nil
+}
+
+// apiListZones returns the zone views.
+func apiListZones(r *http.Request, params map[string]string) (interface{}, error) {
+	sc, _, err := configStore.Current()
+	if err != nil {
+		return nil, err
+	}
+	zones, err := control.NewZoneViews(time.Now(), sc, kvStore, zoneController, ledger)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Zones []*control.ZoneView }{Zones: zones}, nil
+}
+
+// apiGetZone returns the view of zone n.
+func apiGetZone(r *http.Request, params map[string]string) (interface{}, error) {
+	n, err := intParam(params, "n")
+	if err != nil {
+		return nil, err
+	}
+	sc, _, err := configStore.Current()
+	if err != nil {
+		return nil, err
+	}
+	return zoneView(sc, int(n))
+}
+
+// apiPatchZone replaces the config fields of zone n with those in the
+// request body, and returns the zone view.
+func apiPatchZone(r *http.Request, params map[string]string) (interface{}, error) {
+	n, err := intParam(params, "n")
+	if err != nil {
+		return nil, err
+	}
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	_, err = updateConfig(r, fmt.Sprintf("patch zone %d", n), func(conf []byte) ([]byte, error) {
+		sc := &control.SystemConfig{}
+		if err := sc.Parse(string(conf)); err != nil {
+			return nil, err
+		}
+		if _, ok := sc.ZoneConfigs[int(n)]; !ok {
+			return nil, withStatus(http.StatusNotFound, fmt.Errorf("no zone %d", n))
+		}
+		conf, err := control.PatchZone(conf, int(n), patch)
+		if err != nil {
+			return nil, withStatus(http.StatusBadRequest, err)
+		}
+		return conf, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sc, _, err := configStore.Current()
+	if err != nil {
+		return nil, err
+	}
+	return zoneView(sc, int(n))
+}
+
+// zoneView returns the view of zone n in sc, or a not found error.
+func zoneView(sc *control.SystemConfig, n int) (*control.ZoneView, error) {
+	if _, ok := sc.ZoneConfigs[n]; !ok {
+		return nil, withStatus(http.StatusNotFound, fmt.Errorf("no zone %d", n))
+	}
+	return control.NewZoneView(time.Now(), n, sc, kvStore, zoneController, ledger)
+}
+
+// apiRunZone runs zone n.
+func apiRunZone(r *http.Request, params map[string]string) (interface{}, error) {
+	n, err := intParam(params, "n")
+	if err != nil {
+		return nil, err
+	}
+	var req apiZoneRunRequest
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	if err := startZoneRun(int(n), req.Mins, req.Queue); err != nil {
+		return nil, err
+	}
+	return &apiZoneRun{Zone: int(n), Mins: req.Mins, Queued: req.Queue}, nil
+}
+
+// apiStopZone stops zone n.
+func apiStopZone(r *http.Request, params map[string]string) (interface{}, error) {
+	n, err := intParam(params, "n")
+	if err != nil {
+		return nil, err
+	}
+	return nil, stopZone(int(n))
+}
+
+// apiListRuns returns the jobs in the run queue.
+func apiListRuns(r *http.Request, params map[string]string) (interface{}, error) {
+	return struct{ Jobs []*control.Job }{Jobs: runQueue.Jobs()}, nil
+}
+
+// apiAddRun queues a job and returns it.
+func apiAddRun(r *http.Request, params map[string]string) (interface{}, error) {
+	var req apiRunRequest
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	var runs []control.ZoneRun
+	switch {
+	case req.Schedule && len(req.Zones) > 0:
+		return nil, withStatus(http.StatusBadRequest, errors.New("only one of Zones and Schedule may be set"))
+	case req.Schedule:
+		var err error
+		if runs, err = scheduledRuns(time.Now()); err != nil {
+			return nil, withStatus(http.StatusConflict, err)
+		}
+	case len(req.Zones) > 0:
+		for _, zm := range req.Zones {
+			zr, err := newZoneRun(zm.Zone, zm.Mins)
+			if err != nil {
+				return nil, withStatus(http.StatusBadRequest, err)
+			}
+			runs = append(runs, zr)
+		}
+	default:
+		return nil, withStatus(http.StatusBadRequest, errors.New("Zones or Schedule must be set"))
+	}
+	return runQueue.Add(runs)
+}
+
+// apiGetRun returns job id.
+func apiGetRun(r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := intParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	j := runQueue.Job(id)
+	if j == nil {
+		return nil, withStatus(http.StatusNotFound, fmt.Errorf("no job %d", id))
+	}
+	return j, nil
+}
+
+// apiCancelRun cancels job id.
+func apiCancelRun(r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := intParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	if runQueue.Job(id) == nil {
+		return nil, withStatus(http.StatusNotFound, fmt.Errorf("no job %d", id))
+	}
+	err = runQueue.CancelJob(id)
+	if err == control.ErrJobFinished {
+		return nil, withStatus(http.StatusConflict, err)
+	}
+	return nil, err
+}
+
+// apiGetConfig returns the config file.
+func apiGetConfig(r *http.Request, params map[string]string) (interface{}, error) {
+	b, err := configStore.Raw()
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(b), nil
+}
+
+// apiPutConfig replaces the config file, and returns the new revision.
+func apiPutConfig(r *http.Request, params map[string]string) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	return writeConfig(r, body)
+}
+
+// apiListConfigRevisions returns the config revisions.
+func apiListConfigRevisions(r *http.Request, params map[string]string) (interface{}, error) {
+	return struct{ Revisions []*control.ConfigRevision }{Revisions: configStore.Revisions()}, nil
+}
+
+// apiGetConfigRevision returns the config of revision id.
+func apiGetConfigRevision(r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := revisionID(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	_, b, err := configStore.Revision(id)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(b), nil
+}
+
+// apiDiffConfigRevision returns the diff from revision id to the "to" query
+// param revision, or the latest.
+func apiDiffConfigRevision(r *http.Request, params map[string]string) (interface{}, error) {
+	from, err := revisionID(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	revs := configStore.Revisions()
+	if len(revs) == 0 {
+		return nil, withStatus(http.StatusNotFound, errors.New("no config revisions"))
+	}
+	to := revs[0].ID
+	if s := r.FormValue("to"); s != "" {
+		if to, err = revisionID(s); err != nil {
+			return nil, err
+		}
+	}
+	diff, err := configStore.Diff(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &apiConfigDiff{From: from, To: to, Diff: diff}, nil
+}
+
+// apiRollbackConfig writes the config of revision id as a new revision, and
+// returns it.
+func apiRollbackConfig(r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := revisionID(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	rev, err := configStore.Rollback(id, requestUser(r))
+	if _, ok := err.(*control.InvalidConfigError); ok {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	return rev, err
+}
+
+// revisionID returns the ID of the config revision s, or a bad request or not
+// found error.
+func revisionID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, withStatus(http.StatusBadRequest, fmt.Errorf("revision ID: %s", err))
+	}
+	for _, rev := range configStore.Revisions() {
+		if rev.ID == id {
+			return id, nil
+		}
+	}
+	return 0, withStatus(http.StatusNotFound, fmt.Errorf("no config revision %d", id))
+}
+
+// apiConditions returns the logged conditions for the from and to dates.
+func apiConditions(r *http.Request, params map[string]string) (interface{}, error) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		return nil, err
+	}
+	return readConditions(from, to), nil
+}
+
+// apiRuntimes returns the logged runtimes for the from and to dates.
+func apiRuntimes(r *http.Request, params map[string]string) (interface{}, error) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		return nil, err
+	}
+	return readRuntimes(from, to), nil
+}
+
+// apiOpenAPI returns the OpenAPI document for the API.
+func apiOpenAPI(r *http.Request, params map[string]string) (interface{}, error) {
+	var ops []*control.APIOperation
+	for _, rt := range apiRoutes() {
+		ops = append(ops, rt.op)
+	}
+	return control.OpenAPI("irctl", "1", apiPrefix, ops), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"irctl/server/control"
+)
+
+// apiTestConfig is a config with one zone.
+const apiTestConfig = `{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1.0,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+
+// setUpConfigStore sets configStore to a store in dir with apiTestConfig.
+func setUpConfigStore(t *testing.T, dir string) {
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(apiTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := control.NewConfigStore(path, filepath.Join(dir, "revisions"), control.NewFakeClock(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configStore = s
+}
+
+// serveTestAPI returns the response to an API request for method and path,
+// with the JSON body if not empty, authenticated as user if not empty.
+func serveTestAPI(method, path, body, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	if user != "" {
+		r.SetBasicAuth(user, "pw")
+	}
+	w := httptest.NewRecorder()
+	apiHandler(apiRoutes())(w, r)
+	return w
+}
+
+func TestAPIHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setUpConfigStore(t, dir)
+	setUpUsers(t, dir)
+	valveController = control.NewRecordingValveController(1, control.NewFakeClock(time.Now()))
+
+	for _, tt := range []struct {
+		desc, method, path, body, user string
+		want                           int
+	}{
+		{"unknown path", http.MethodGet, "/nope", "", "bob", http.StatusNotFound},
+		{"trailing slash", http.MethodGet, "/config/", "", "bob", http.StatusNotFound},
+		{"anonymous", http.MethodGet, "/config", "", "", http.StatusUnauthorized},
+		{"read only change", http.MethodPut, "/config", "{}", "bob", http.StatusForbidden},
+		{"read only rollback", http.MethodPost, "/config/revisions/1/rollback", "", "bob", http.StatusForbidden},
+		{"bad method", http.MethodDelete, "/config", "", "alice", http.StatusMethodNotAllowed},
+		{"bad revision ID", http.MethodGet, "/config/revisions/x", "", "bob", http.StatusBadRequest},
+		{"missing revision", http.MethodGet, "/config/revisions/9", "", "bob", http.StatusNotFound},
+		{"missing revision diff", http.MethodGet, "/config/revisions/9/diff", "", "bob", http.StatusNotFound},
+		{"bad config", http.MethodPut, "/config", "{", "alice", http.StatusBadRequest},
+		{"missing zone", http.MethodPatch, "/zones/99", `{"MaxVWC": 25}`, "alice", http.StatusNotFound},
+		{"bad zone number", http.MethodGet, "/zones/x", "", "bob", http.StatusBadRequest},
+		{"zero run minutes", http.MethodPost, "/zones/0/run", `{"Mins": 0}`, "alice", http.StatusBadRequest},
+		{"bad run request", http.MethodPost, "/runs", `{"Zones": [], "Bogus": 1}`, "alice", http.StatusBadRequest},
+	} {
+		w := serveTestAPI(tt.method, tt.path, tt.body, tt.user)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.desc, w.Code, w.Body, tt.want)
+			continue
+		}
+		// Errors are JSON with the status.
+		var e control.APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Status != tt.want || e.Error == "" {
+			t.Errorf("%s: got body %s, %v, want an APIError with status %d", tt.desc, w.Body, err, tt.want)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want application/json", tt.desc, ct)
+		}
+	}
+
+	w := serveTestAPI(http.MethodDelete, "/config", "", "alice")
+	if got := w.Header().Get("Allow"); got != "GET, PUT" {
+		t.Errorf("got Allow %q, want GET, PUT", got)
+	}
+
+	w = serveTestAPI(http.MethodGet, "/config/revisions", "", "bob")
+	var revs struct{ Revisions []*control.ConfigRevision }
+	if err := json.Unmarshal(w.Body.Bytes(), &revs); err != nil || w.Code != http.StatusOK || len(revs.Revisions) != 1 {
+		t.Fatalf("got revisions %d %s, want 1", w.Code, w.Body)
+	}
+	w = serveTestAPI(http.MethodGet, "/config/revisions/1/diff", "", "bob")
+	var diff apiConfigDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil || w.Code != http.StatusOK || diff.From != 1 || diff.To != 1 || diff.Diff != "" {
+		t.Errorf("got diff %d %s, want an empty diff of revision 1", w.Code, w.Body)
+	}
+	if w := serveTestAPI(http.MethodGet, "/config/revisions/1/diff?to=9", "", "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("diff to missing revision: got %d %s, want 404", w.Code, w.Body)
+	}
+
+	// A config broken by hand can be rolled back.
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{broken`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveTestAPI(http.MethodGet, "/config", "", "bob"); w.Code != http.StatusInternalServerError {
+		t.Errorf("get broken config: got %d %s, want 500", w.Code, w.Body)
+	}
+	if w := serveTestAPI(http.MethodPost, "/config/revisions/1/rollback", "", "alice"); w.Code != http.StatusCreated {
+		t.Errorf("rollback from broken config: got %d %s, want 201", w.Code, w.Body)
+	}
+	if w := serveTestAPI(http.MethodGet, "/config", "", "bob"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"zone 0"`) {
+		t.Errorf("config after rollback: got %d %s, want zone 0", w.Code, w.Body)
+	}
+
+	// A store with no revisions has nothing to diff.
+	configStore = &control.ConfigStore{}
+	if w := serveTestAPI(http.MethodGet, "/config/revisions/1/diff", "", "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("diff with no revisions: got %d %s, want 404", w.Code, w.Body)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, path string
+		want          map[string]string
+	}{
+		{"/config", "/config", map[string]string{}},
+		{"/zones/{n}", "/zones/3", map[string]string{"n": "3"}},
+		{"/zones/{n}/run", "/zones/3/run", map[string]string{"n": "3"}},
+		{"/zones/{n}", "/zones/", nil},
+		{"/zones/{n}", "/zones/3/run", nil},
+		{"/config", "/configs", nil},
+	} {
+		got, ok := matchPath(tt.pattern, tt.path)
+		if ok != (tt.want != nil) || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("matchPath(%s, %s): got %v, %t, want %v", tt.pattern, tt.path, got, ok, tt.want)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	err := errors.New("x")
+	if got := errorStatus(err); got != http.StatusInternalServerError {
+		t.Errorf("plain error: got %d, want 500", got)
+	}
+	if got := errorStatus(withStatus(http.StatusConflict, err)); got != http.StatusConflict {
+		t.Errorf("withStatus error: got %d, want 409", got)
+	}
+	if got := errorStatus(fmt.Errorf("wrapped: %w", withStatus(http.StatusNotFound, err))); got != http.StatusNotFound {
+		t.Errorf("wrapped error: got %d, want 404", got)
+	}
+	if withStatus(http.StatusConflict, nil) != nil {
+		t.Errorf("withStatus(nil): got non-nil")
+	}
+}
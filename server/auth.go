@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"irctl/server/control"
+)
+
+// withRole returns a handler that calls h only if the request is
+// authenticated with a role that allows role.
+func withRole(role control.Role, h http.HandlerFunc) http.HandlerFunc {
+	return withRoleFunc(func(*http.Request) control.Role { return role }, h)
+}
+
+// withRoleFunc is like withRole, with the role needed for each request
+// returned by roleFor.
+func withRoleFunc(roleFor func(*http.Request) control.Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		need := roleFor(r)
+		if !userStore.Enabled() || (need == control.ReadOnlyRole && userStore.OpenReads()) {
+			h(w, r)
+			return
+		}
+		name, role, ok := authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="irctl"`)
+			httpError(w, r, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !role.Allows(need) {
+			httpError(w, r, fmt.Sprintf("%s has role %s, %s is needed", name, role, need), http.StatusForbidden)
+			return
+		}
+		log.Infof("%s %s by %s", r.Method, r.URL.Path, name)
+		h(w, r)
+	}
+}
+
+// authenticate returns the name and role for the basic auth user or bearer
+// token in r.
+func authenticate(r *http.Request) (string, control.Role, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		role, ok := userStore.CheckPassword(name, password)
+		return name, role, ok
+	}
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		return userStore.CheckToken(strings.TrimPrefix(a, "Bearer "))
+	}
+	return "", "", false
+}
+
+// requestUser returns the user or token name that made r, or the remote
+// address if r isn't authenticated.
+func requestUser(r *http.Request) string {
+	if name, _, ok := authenticate(r); ok {
+		return name
+	}
+	return r.RemoteAddr
+}
+
+// writeRole returns OperatorRole for requests that change state, i.e. that
+// are not GET or HEAD, and ReadOnlyRole otherwise.
+func writeRole(r *http.Request) control.Role {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return control.ReadOnlyRole
+	}
+	return control.OperatorRole
+}
+
+// recomputeRole returns OperatorRole if a ledger recompute is applied, and
+// ReadOnlyRole for a preview.
+func recomputeRole(r *http.Request) control.Role {
+	if r.FormValue("apply") == "true" {
+		return control.OperatorRole
+	}
+	return control.ReadOnlyRole
+}
+
+// users manages the users and API tokens in the users file, and returns the
+// exit code.
+func users(args []string) int {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	path := fs.String("file", usersPath, "Users file.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `usage: server users [-file path] command
+  add NAME ROLE     add or replace user NAME, reading the password from stdin
+  token NAME ROLE   add or replace API token NAME and print it
+  remove NAME       remove the user and token NAME
+  list              list users and tokens
+  open-reads BOOL   allow read-only requests without credentials
+ROLE is readonly or operator.`)
+	}
+	fs.Parse(args)
+	flag.CommandLine.Parse(nil)
+
+	s, err := control.NewUserStore(*path, control.RealClock{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	a := fs.Args()
+	if len(a) == 0 {
+		fs.Usage()
+		return 2
+	}
+	switch {
+	case a[0] == "add" && len(a) == 3:
+		fmt.Fprintf(os.Stderr, "Password for %s: ", a[1])
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		err = s.AddUser(a[1], strings.TrimRight(password, "\r\n"), control.Role(a[2]))
+	case a[0] == "token" && len(a) == 3:
+		var token string
+		if token, err = s.AddToken(a[1], control.Role(a[2])); err == nil {
+			fmt.Println(token)
+		}
+	case a[0] == "remove" && len(a) == 2:
+		var ok bool
+		if ok, err = s.Remove(a[1]); err == nil && !ok {
+			err = fmt.Errorf("no user or token %s", a[1])
+		}
+	case a[0] == "list" && len(a) == 1:
+		us, ts := s.List()
+		for _, u := range us {
+			fmt.Printf("user  %s %s\n", u.Name, u.Role)
+		}
+		for _, t := range ts {
+			fmt.Printf("token %s %s\n", t.Name, t.Role)
+		}
+		fmt.Printf("open reads: %t\n", s.OpenReads())
+	case a[0] == "open-reads" && len(a) == 2 && (a[1] == "true" || a[1] == "false"):
+		err = s.SetOpenReads(a[1] == "true")
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"irctl/server/control"
+)
+
+// setUpUsers sets userStore to a store in dir with the operator alice and the
+// read only bob, both with password "pw". It returns bob's read only token.
+func setUpUsers(t *testing.T, dir string) string {
+	s, err := control.NewUserStore(filepath.Join(dir, "users.json"), control.NewFakeClock(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUser("alice", "pw", control.OperatorRole); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUser("bob", "pw", control.ReadOnlyRole); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.AddToken("ci", control.ReadOnlyRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore = s
+	return token
+}
+
+// okHandler is a handler that writes "ok".
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func TestWithRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// With no users, requests aren't authenticated.
+	empty, err := control.NewUserStore(filepath.Join(dir, "none.json"), control.NewFakeClock(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore = empty
+	w := httptest.NewRecorder()
+	withRole(control.OperatorRole, okHandler)(w, httptest.NewRequest(http.MethodPost, "/runzone", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("anonymous with no users: got %d, want 200", w.Code)
+	}
+
+	token := setUpUsers(t, dir)
+	for _, tt := range []struct {
+		desc       string
+		role       control.Role
+		user, pass string
+		bearer     string
+		want       int
+	}{
+		{"anonymous read", control.ReadOnlyRole, "", "", "", http.StatusUnauthorized},
+		{"anonymous operate", control.OperatorRole, "", "", "", http.StatusUnauthorized},
+		{"wrong password", control.ReadOnlyRole, "bob", "bad", "", http.StatusUnauthorized},
+		{"unknown user", control.ReadOnlyRole, "eve", "pw", "", http.StatusUnauthorized},
+		{"read only reads", control.ReadOnlyRole, "bob", "pw", "", http.StatusOK},
+		{"read only operates", control.OperatorRole, "bob", "pw", "", http.StatusForbidden},
+		{"operator operates", control.OperatorRole, "alice", "pw", "", http.StatusOK},
+		{"operator reads", control.ReadOnlyRole, "alice", "pw", "", http.StatusOK},
+		{"read only token reads", control.ReadOnlyRole, "", "", token, http.StatusOK},
+		{"read only token operates", control.OperatorRole, "", "", token, http.StatusForbidden},
+		{"bad token", control.ReadOnlyRole, "", "", "bad", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		w := httptest.NewRecorder()
+		withRole(tt.role, okHandler)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.desc, w.Code, tt.want)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); (w.Code == http.StatusUnauthorized) != (got != "") {
+			t.Errorf("%s: got WWW-Authenticate %q with status %d", tt.desc, got, w.Code)
+		}
+	}
+
+	// Open reads allow anonymous reads, but not changes.
+	if err := userStore.SetOpenReads(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		method string
+		want   int
+	}{{http.MethodGet, http.StatusOK}, {http.MethodPost, http.StatusUnauthorized}} {
+		w := httptest.NewRecorder()
+		withRoleFunc(writeRole, okHandler)(w, httptest.NewRequest(tt.method, "/queue", nil))
+		if w.Code != tt.want {
+			t.Errorf("open reads %s: got %d, want %d", tt.method, w.Code, tt.want)
+		}
+	}
+}
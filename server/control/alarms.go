@@ -0,0 +1,170 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// AlarmsKey is the KV store key for the persisted alarms.
+	AlarmsKey = "Alarms"
+	// maxAlarms is the number of alarms kept. Older alarms are dropped.
+	maxAlarms = 100
+)
+
+// Alarm is a reported error that hasn't been cleared.
+type Alarm struct {
+	ID    int64
+	Time  time.Time
+	Error string
+}
+
+// alarmState is the persisted state of an AlarmStore.
+type alarmState struct {
+	NextID int64
+	Alarms []*Alarm
+}
+
+// AlarmStore keeps reported errors in the KV store until they are cleared,
+// and appends them to a log file that keeps them after clearing.
+type AlarmStore struct {
+	kv      KVStore
+	clock   Clock
+	logPath string
+
+	mu sync.Mutex
+}
+
+// NewAlarmStore returns a ptr to an AlarmStore that keeps alarms in kv and
+// appends them to the file at logPath, if not empty.
+func NewAlarmStore(kv KVStore, clock Clock, logPath string) *AlarmStore {
+	return &AlarmStore{
+		kv:      kv,
+		clock:   clock,
+		logPath: logPath,
+	}
+}
+
+// Add records err as a new alarm and returns it.
+func (s *AlarmStore) Add(err error) (*Alarm, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, lerr := s.load()
+	if lerr != nil {
+		return nil, lerr
+	}
+	a := &Alarm{ID: st.NextID, Time: s.clock.Now(), Error: err.Error()}
+	st.NextID++
+	st.Alarms = append(st.Alarms, a)
+	if len(st.Alarms) > maxAlarms {
+		st.Alarms = st.Alarms[len(st.Alarms)-maxAlarms:]
+	}
+	if err := s.save(st); err != nil {
+		return nil, err
+	}
+	return a, s.appendLog(a)
+}
+
+// List returns all alarms, oldest first.
+func (s *AlarmStore) List() ([]*Alarm, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return st.Alarms, nil
+}
+
+// Count returns the number of alarms.
+func (s *AlarmStore) Count() (int, error) {
+	a, err := s.List()
+	return len(a), err
+}
+
+// Clear removes all alarms. They remain in the log file.
+func (s *AlarmStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	st.Alarms = nil
+	return s.save(st)
+}
+
+// load returns the persisted state, which is empty if there is none.
+func (s *AlarmStore) load() (*alarmState, error) {
+	st := &alarmState{NextID: 1}
+	v, ok, err := s.kv.Get(AlarmsKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok && v != "" {
+		if err := json.Unmarshal([]byte(v), st); err != nil {
+			return nil, fmt.Errorf("bad alarms %s: %s", v, err)
+		}
+	}
+	return st, nil
+}
+
+// save persists st.
+func (s *AlarmStore) save(st *alarmState) error {
+	j, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(AlarmsKey, string(j))
+}
+
+// appendLog appends a to the log file, if there is one.
+func (s *AlarmStore) appendLog(a *Alarm) error {
+	if s.logPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(s.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(f, FormatAlarm(a)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// FormatAlarm returns a as a log line.
+func FormatAlarm(a *Alarm) string {
+	return fmt.Sprintf("%s %s\n", a.Time.Format(time.RFC3339), strings.TrimSpace(a.Error))
+}
+
+// AlarmErrorReporter is an ErrorReporter that records each error in an
+// AlarmStore before passing it to another ErrorReporter.
+type AlarmErrorReporter struct {
+	er    ErrorReporter
+	store *AlarmStore
+}
+
+// NewAlarmErrorReporter returns a ptr to an AlarmErrorReporter that records
+// errors in store and then reports them with er.
+func NewAlarmErrorReporter(er ErrorReporter, store *AlarmStore) *AlarmErrorReporter {
+	return &AlarmErrorReporter{
+		er:    er,
+		store: store,
+	}
+}
+
+// Report implements ErrorReporter#Report.
+func (er *AlarmErrorReporter) Report(sendErr error) error {
+	if _, err := er.store.Add(sendErr); err != nil {
+		log.Errorf("Couldn't record alarm: %s", err)
+	}
+	return er.er.Report(sendErr)
+}
@@ -0,0 +1,73 @@
+package control
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAlarmStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "errlog")
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	kv := NewTestKVStore()
+	s := NewAlarmStore(kv, NewFakeClock(now), logPath)
+	er := NewAlarmErrorReporter(&LogErrorReporter{}, s)
+
+	in := errors.New("first")
+	if got := er.Report(in); got != in {
+		t.Errorf("Report: got %v, want %v", got, in)
+	}
+	er.Report(errors.New("second"))
+	alarms, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms) != 2 || alarms[0].ID != 1 || alarms[0].Error != "first" || alarms[1].ID != 2 || !alarms[1].Time.Equal(now) {
+		t.Errorf("List: got %+v, want first and second", alarms)
+	}
+
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Count(); err != nil || n != 0 {
+		t.Errorf("Count after Clear: got %d, %v, want 0", n, err)
+	}
+	// IDs continue after a restart.
+	a, err := NewAlarmStore(kv, NewFakeClock(now), logPath).Add(errors.New("third"))
+	if err != nil || a.ID != 3 {
+		t.Errorf("Add after Clear: got %+v, %v, want ID 3", a, err)
+	}
+
+	b, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2019-03-17T09:00:00Z first\n2019-03-17T09:00:00Z second\n2019-03-17T09:00:00Z third\n"
+	if string(b) != want {
+		t.Errorf("log: got %q, want %q", b, want)
+	}
+}
+
+func TestAlarmStoreMax(t *testing.T) {
+	s := NewAlarmStore(NewTestKVStore(), NewFakeClock(time.Now()), "")
+	for i := 0; i < maxAlarms+5; i++ {
+		if _, err := s.Add(errors.New("err")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alarms, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms) != maxAlarms || alarms[0].ID != 6 {
+		t.Errorf("got %d alarms from ID %d, want %d from ID 6", len(alarms), alarms[0].ID, maxAlarms)
+	}
+}
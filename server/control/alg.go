@@ -65,6 +65,74 @@ type ETAlgorithm interface {
 	// CalculateRuntime returns a run time duration to increase VWC from fromVWC
 	// to toVWC, given the forecast precip amount.
 	CalculateRuntime(fromVWC, toVWC Pct, forecastPrecipIn float64, zconf *ZoneConfig) (time.Duration, error)
+	// CalculateVWCGain returns the increase in VWC from running the zone for
+	// runtime. It is the inverse of CalculateRuntime with no forecast precip.
+	CalculateVWCGain(runtime time.Duration, zconf *ZoneConfig) (Pct, error)
+}
+
+// ETMeasuredAlgorithm is an ETAlgorithm that can also use a measured reference
+// ET, rather than estimating ET from temperature.
+type ETMeasuredAlgorithm interface {
+	ETAlgorithm
+	// CalculateVWCFromET returns a new VWC, given the previous day's VWC,
+	// measured reference ET and precip.
+	CalculateVWCFromET(currentVWC Pct, etIn, precipIn float64, now time.Time, zconf *ZoneConfig) (Pct, error)
+}
+
+// WaterBalance is the breakdown of a change in VWC due to ET and rain.
+type WaterBalance struct {
+	StartVWC  Pct
+	ETRemoved Pct
+	RainAdded Pct
+	// Clamped is the amount added (if positive) or removed (if negative) to
+	// keep VWC between 0 and the zone MaxVWC.
+	Clamped Pct
+	EndVWC  Pct
+}
+
+// WaterBalanceAlgorithm is an ETAlgorithm that can report the breakdown of
+// the VWC change.
+type WaterBalanceAlgorithm interface {
+	ETAlgorithm
+	// WaterBalance returns the breakdown of the new VWC, given the previous
+	// day's VWC, temp, precip and measured reference ET. etIn is unknownET if
+	// there is no measured value.
+	WaterBalance(currentVWC Pct, tempF, etIn, precipIn float64, now time.Time, zconf *ZoneConfig) (*WaterBalance, error)
+}
+
+// newWaterBalance returns the WaterBalance for adding add to and removing
+// remove from startVWC, clamped to the range 0-maxVWC.
+func newWaterBalance(startVWC, add, remove, maxVWC Pct) *WaterBalance {
+	unclamped := startVWC + add - remove
+	end := min(max(0, unclamped), maxVWC)
+	return &WaterBalance{
+		StartVWC:  startVWC,
+		ETRemoved: remove,
+		RainAdded: add,
+		Clamped:   end - unclamped,
+		EndVWC:    end,
+	}
+}
+
+// calculateWaterBalance returns the breakdown of the new VWC for zconf using
+// alg. The measured reference ET etIn is used if it is not unknownET and alg
+// supports it. If alg doesn't report a breakdown, only the start and end VWC
+// are set.
+func calculateWaterBalance(alg ETAlgorithm, currentVWC Pct, tempF, etIn, precipIn float64, now time.Time, zconf *ZoneConfig) (*WaterBalance, error) {
+	if walg, ok := alg.(WaterBalanceAlgorithm); ok {
+		return walg.WaterBalance(currentVWC, tempF, etIn, precipIn, now, zconf)
+	}
+	var newVWC Pct
+	var err error
+	if malg, ok := alg.(ETMeasuredAlgorithm); ok && etIn != unknownET {
+		newVWC, err = malg.CalculateVWCFromET(currentVWC, etIn, precipIn, now, zconf)
+	} else {
+		newVWC, err = alg.CalculateVWC(currentVWC, tempF, precipIn, now, zconf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &WaterBalance{StartVWC: currentVWC, EndVWC: newVWC}, nil
 }
 
 // ETAlgorithmSimple is a simple linear ET model.
@@ -82,17 +150,30 @@ func NewETAlgorithmSimple(r *RangeMapper) *ETAlgorithmSimple {
 
 // CalculateVWC implements ETAlgorithm#CalculateVWC method.
 func (e *ETAlgorithmSimple) CalculateVWC(currentVWC Pct, tempF, precipIn float64, now time.Time, zconf *ZoneConfig) (Pct, error) {
+	wb, err := e.WaterBalance(currentVWC, tempF, unknownET, precipIn, now, zconf)
+	if err != nil {
+		return 0, err
+	}
+	return wb.EndVWC, nil
+}
+
+// WaterBalance implements WaterBalanceAlgorithm#WaterBalance method. ET is
+// always estimated from temp, so etIn is ignored.
+func (e *ETAlgorithmSimple) WaterBalance(currentVWC Pct, tempF, etIn, precipIn float64, now time.Time, zconf *ZoneConfig) (*WaterBalance, error) {
 	remove := Pct(e.etPct(tempF) * zconf.ZoneETRate * growthFactor[now.Month()])
 	add := Pct(precipIn * pctPerPrecipIn)
 	log.Infof("etPct=%f, ZoneETRate=%f, growthFactor=%f, removePct=%f, addPct=%f\n", e.etPct(tempF), zconf.ZoneETRate, growthFactor[now.Month()], remove, add)
-	return min(max(0, currentVWC+add-remove), zconf.MaxVWC), nil
+	return newWaterBalance(currentVWC, add, remove, zconf.MaxVWC), nil
 }
 
 // CalculateRuntime implements ETAlgorithm#CalculateRuntime method.
 func (e *ETAlgorithmSimple) CalculateRuntime(currentVWC, targetVWC Pct, forecastPrecipIn float64, zconf *ZoneConfig) (time.Duration, error) {
-	precipVWC := Pct(forecastPrecipIn * pctPerPrecipIn)
-	addVWC := float64(max(0, targetVWC-currentVWC-precipVWC))
-	return time.Duration((addVWC/nominalVWCIncrease)*(zconf.DepthIn/nominalDepthIn)*nominalRunTimeMin) * time.Minute, nil
+	return runtimeForVWC(currentVWC, targetVWC, forecastPrecipIn, zconf), nil
+}
+
+// CalculateVWCGain implements ETAlgorithm#CalculateVWCGain method.
+func (e *ETAlgorithmSimple) CalculateVWCGain(runtime time.Duration, zconf *ZoneConfig) (Pct, error) {
+	return vwcForRuntime(runtime, zconf), nil
 }
 
 // etPct returns an ET percentage for the given temp.
@@ -100,6 +181,77 @@ func (e *ETAlgorithmSimple) etPct(tempF float64) float64 {
 	return e.EtPctMap.GetY(tempF)
 }
 
+// ETAlgorithmETo is a linear ET model that uses a measured reference ET (ETo)
+// scaled by the zone crop coefficient.
+type ETAlgorithmETo struct {
+	// DefaultEtIn is the reference ET in inches per day used when no measured
+	// value is available.
+	DefaultEtIn float64
+}
+
+// NewETAlgorithmETo returns a new ETAlgorithmETo which uses defaultEtIn as
+// the reference ET when no measured value is available.
+func NewETAlgorithmETo(defaultEtIn float64) *ETAlgorithmETo {
+	return &ETAlgorithmETo{
+		DefaultEtIn: defaultEtIn,
+	}
+}
+
+// CalculateVWC implements ETAlgorithm#CalculateVWC method. Since no measured
+// ET is supplied, DefaultEtIn is used.
+func (e *ETAlgorithmETo) CalculateVWC(currentVWC Pct, tempF, precipIn float64, now time.Time, zconf *ZoneConfig) (Pct, error) {
+	log.Infof("No measured ET, using default of %.2f In", e.DefaultEtIn)
+	return e.CalculateVWCFromET(currentVWC, e.DefaultEtIn, precipIn, now, zconf)
+}
+
+// CalculateVWCFromET implements ETMeasuredAlgorithm#CalculateVWCFromET method.
+// ET and precip are both depths of water, so they are scaled the same way.
+func (e *ETAlgorithmETo) CalculateVWCFromET(currentVWC Pct, etIn, precipIn float64, now time.Time, zconf *ZoneConfig) (Pct, error) {
+	wb, err := e.WaterBalance(currentVWC, 0, etIn, precipIn, now, zconf)
+	if err != nil {
+		return 0, err
+	}
+	return wb.EndVWC, nil
+}
+
+// WaterBalance implements WaterBalanceAlgorithm#WaterBalance method. If etIn
+// is unknownET, DefaultEtIn is used. tempF is ignored.
+func (e *ETAlgorithmETo) WaterBalance(currentVWC Pct, tempF, etIn, precipIn float64, now time.Time, zconf *ZoneConfig) (*WaterBalance, error) {
+	if etIn == unknownET {
+		etIn = e.DefaultEtIn
+	}
+	remove := Pct(etIn * zconf.CropCoefficient * pctPerPrecipIn)
+	add := Pct(precipIn * pctPerPrecipIn)
+	log.Infof("etIn=%f, CropCoefficient=%f, removePct=%f, addPct=%f\n", etIn, zconf.CropCoefficient, remove, add)
+	return newWaterBalance(currentVWC, add, remove, zconf.MaxVWC), nil
+}
+
+// CalculateRuntime implements ETAlgorithm#CalculateRuntime method.
+func (e *ETAlgorithmETo) CalculateRuntime(currentVWC, targetVWC Pct, forecastPrecipIn float64, zconf *ZoneConfig) (time.Duration, error) {
+	return runtimeForVWC(currentVWC, targetVWC, forecastPrecipIn, zconf), nil
+}
+
+// CalculateVWCGain implements ETAlgorithm#CalculateVWCGain method.
+func (e *ETAlgorithmETo) CalculateVWCGain(runtime time.Duration, zconf *ZoneConfig) (Pct, error) {
+	return vwcForRuntime(runtime, zconf), nil
+}
+
+// runtimeForVWC returns the run time duration to increase VWC from currentVWC
+// to targetVWC, less the forecast precip amount. It is truncated to whole
+// minutes, so the zone doesn't run past targetVWC.
+func runtimeForVWC(currentVWC, targetVWC Pct, forecastPrecipIn float64, zconf *ZoneConfig) time.Duration {
+	precipVWC := Pct(forecastPrecipIn * pctPerPrecipIn)
+	addVWC := float64(max(0, targetVWC-currentVWC-precipVWC))
+	return time.Duration((addVWC/nominalVWCIncrease)*(zconf.DepthIn/nominalDepthIn)*nominalRunTimeMin) * time.Minute
+}
+
+// vwcForRuntime returns the increase in VWC from running the zone for runtime,
+// the inverse of runtimeForVWC. The gain is for the time actually run, so it is
+// less than the target of runtimeForVWC if that was truncated.
+func vwcForRuntime(runtime time.Duration, zconf *ZoneConfig) Pct {
+	return Pct((runtime.Minutes() / nominalRunTimeMin) * (nominalDepthIn / zconf.DepthIn) * nominalVWCIncrease)
+}
+
 // Range is a range of x values that map to a given y value.
 type Range struct {
 	X1 float64
@@ -1,6 +1,7 @@
 package control
 
 import (
+	"math"
 	"testing"
 	"time"
 )
@@ -77,8 +78,12 @@ func TestETAlgorithmSimpleCalculateVWC(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		// At 80 degF, ET removes 10% x ZoneETRate 0.5 x June growth factor 1.0.
+		sc.ZoneConfigs[0].ZoneETRate = 0.5
+		june := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+
 		alg := NewETAlgorithmSimple(sc.ETAlgorithmSimpleConfig.EtPctMap)
-		newVWC, err := alg.CalculateVWC(tt.inVWC, tt.inTemp, tt.inPrecip, time.Now(), sc.ZoneConfigs[0])
+		newVWC, err := alg.CalculateVWC(tt.inVWC, tt.inTemp, tt.inPrecip, june, sc.ZoneConfigs[0])
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -119,3 +124,89 @@ func TestETAlgorithmSimpleCalculateRuntime(t *testing.T) {
 		}
 	}
 }
+
+func TestETAlgorithmEToCalculateVWC(t *testing.T) {
+	zconf := &ZoneConfig{MaxVWC: 20, CropCoefficient: 0.5}
+	tests := []struct {
+		desc     string
+		inET     float64
+		inPrecip float64
+		inVWC    Pct
+		want     Pct
+	}{
+		{desc: "ET only", inET: 0.1, inVWC: 15, want: 10},
+		{desc: "ET and rain", inET: 0.1, inVWC: 15, inPrecip: 0.02, want: 12},
+		{desc: "clamp to max", inET: 0.1, inVWC: 15, inPrecip: 1, want: 20},
+		{desc: "clamp to zero", inET: 0.3, inVWC: 5, want: 0},
+		{desc: "default ET", inET: unknownET, inVWC: 15, want: 14},
+	}
+
+	alg := NewETAlgorithmETo(0.02)
+	for _, tt := range tests {
+		var newVWC Pct
+		var err error
+		if tt.inET == unknownET {
+			newVWC, err = alg.CalculateVWC(tt.inVWC, 80, tt.inPrecip, time.Now(), zconf)
+		} else {
+			newVWC, err = alg.CalculateVWCFromET(tt.inVWC, tt.inET, tt.inPrecip, time.Now(), zconf)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := newVWC, tt.want; math.Abs(float64(got-want)) > 1e-9 {
+			t.Errorf("%s: got %f, want: %f", tt.desc, got, want)
+		}
+	}
+}
+
+func TestETAlgorithmEToWaterBalance(t *testing.T) {
+	zconf := &ZoneConfig{MaxVWC: 20, CropCoefficient: 0.5}
+	tests := []struct {
+		desc     string
+		inET     float64
+		inPrecip float64
+		inVWC    Pct
+		want     WaterBalance
+	}{
+		{desc: "ET and rain", inET: 0.1, inVWC: 15, inPrecip: 0.02, want: WaterBalance{StartVWC: 15, ETRemoved: 5, RainAdded: 2, EndVWC: 12}},
+		{desc: "clamp to max", inET: 0.1, inVWC: 15, inPrecip: 1, want: WaterBalance{StartVWC: 15, ETRemoved: 5, RainAdded: 100, Clamped: -90, EndVWC: 20}},
+		{desc: "clamp to zero", inET: 0.3, inVWC: 5, want: WaterBalance{StartVWC: 5, ETRemoved: 15, Clamped: 10, EndVWC: 0}},
+		{desc: "default ET", inET: unknownET, inVWC: 15, want: WaterBalance{StartVWC: 15, ETRemoved: 1, EndVWC: 14}},
+	}
+
+	alg := NewETAlgorithmETo(0.02)
+	for _, tt := range tests {
+		got, err := alg.WaterBalance(tt.inVWC, 80, tt.inET, tt.inPrecip, time.Now(), zconf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range [][2]Pct{{got.StartVWC, tt.want.StartVWC}, {got.ETRemoved, tt.want.ETRemoved}, {got.RainAdded, tt.want.RainAdded}, {got.Clamped, tt.want.Clamped}, {got.EndVWC, tt.want.EndVWC}} {
+			if math.Abs(float64(v[0]-v[1])) > 1e-9 {
+				t.Errorf("%s: got %+v, want: %+v", tt.desc, *got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCalculateVWCGain(t *testing.T) {
+	z := &ZoneConfig{DepthIn: 16}
+	alg := NewETAlgorithmETo(0.1)
+	// The runtime for 12.5% is 12.5 minutes, truncated to 12, which adds 12%.
+	for _, tt := range []struct {
+		vwc, want Pct
+	}{{0, 0}, {5, 5}, {12.5, 12}} {
+		rt, err := alg.CalculateRuntime(0, tt.vwc, 0, z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gain, err := alg.CalculateVWCGain(rt, z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pctsEqual(gain, tt.want) {
+			t.Errorf("CalculateVWCGain(%s): got %3.2f, want %3.2f", rt, gain, tt.want)
+		}
+	}
+}
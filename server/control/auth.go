@@ -0,0 +1,369 @@
+package control
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is what an authenticated user or token is allowed to do.
+type Role string
+
+const (
+	// ReadOnlyRole can only read state, e.g. status, logs and the config.
+	ReadOnlyRole Role = "readonly"
+	// OperatorRole can also run zones and change the config.
+	OperatorRole Role = "operator"
+)
+
+// roleRank orders roles from least to most allowed.
+var roleRank = map[Role]int{
+	ReadOnlyRole: 1,
+	OperatorRole: 2,
+}
+
+// Allows reports whether r can do what need can.
+func (r Role) Allows(need Role) bool {
+	return roleRank[r] > 0 && roleRank[r] >= roleRank[need]
+}
+
+// VerifyRole returns an error if r is not a known role.
+func VerifyRole(r Role) error {
+	if _, ok := roleRank[r]; !ok {
+		return fmt.Errorf("unknown role %q, choices are %s and %s", r, ReadOnlyRole, OperatorRole)
+	}
+	return nil
+}
+
+const (
+	// pbkdf2Iterations is the number of PBKDF2 iterations for new password
+	// hashes.
+	pbkdf2Iterations = 100000
+	// pbkdf2Prefix identifies the password hash format.
+	pbkdf2Prefix = "pbkdf2-sha256"
+	// tokenPrefix identifies the token hash format.
+	tokenPrefix = "sha256"
+	// saltLen and keyLen are the lengths in bytes of the salt and the
+	// derived key of a password hash.
+	saltLen = 16
+	keyLen  = 32
+	// tokenLen is the length in bytes of a new API token.
+	tokenLen = 32
+	// verifiedTTL is how long a verified password is cached, so that basic
+	// auth doesn't hash on every request.
+	verifiedTTL = 10 * time.Minute
+)
+
+// Credential is a user or API token. Hash is the password hash for a user, or
+// the token hash for a token.
+type Credential struct {
+	Name string
+	Role Role
+	Hash string
+}
+
+// credentials is the credentials file.
+type credentials struct {
+	// OpenReads allows requests that only need ReadOnlyRole without
+	// credentials.
+	OpenReads bool
+	Users     []*Credential
+	Tokens    []*Credential
+}
+
+// UserStore keeps users and API tokens with hashed credentials in a local
+// JSON file.
+type UserStore struct {
+	path  string
+	clock Clock
+
+	mu    sync.Mutex
+	creds credentials
+	// verified caches passwords that were verified, by verifiedKey, until
+	// the time in the value.
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// NewUserStore returns a ptr to a UserStore loaded from the file at path. A
+// missing file is an empty store.
+func NewUserStore(path string, clock Clock) (*UserStore, error) {
+	s := &UserStore{
+		path:     path,
+		clock:    clock,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+	j, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("could not read users file at %s: %s", path, err)
+	default:
+		if err := json.Unmarshal(j, &s.creds); err != nil {
+			return nil, fmt.Errorf("could not parse users file at %s: %s", path, err)
+		}
+	}
+	return s, nil
+}
+
+// Enabled reports whether there are any users or tokens. If not, requests
+// aren't authenticated.
+func (s *UserStore) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.creds.Users)+len(s.creds.Tokens) > 0
+}
+
+// OpenReads reports whether requests that only need ReadOnlyRole are allowed
+// without credentials.
+func (s *UserStore) OpenReads() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.creds.OpenReads
+}
+
+// SetOpenReads sets whether requests that only need ReadOnlyRole are allowed
+// without credentials.
+func (s *UserStore) SetOpenReads(open bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds.OpenReads = open
+	return s.save()
+}
+
+// AddUser adds the user name with password and role, replacing any user with
+// the same name.
+func (s *UserStore) AddUser(name, password string, role Role) error {
+	if err := verifyCredential(name, role); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+	h, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds.Users = replaceCredential(s.creds.Users, &Credential{Name: name, Role: role, Hash: h})
+	return s.save()
+}
+
+// AddToken creates an API token called name with role, replacing any token
+// with the same name, and returns it. Only its hash is kept, so it can't be
+// shown again.
+func (s *UserStore) AddToken(name string, role Role) (string, error) {
+	if err := verifyCredential(name, role); err != nil {
+		return "", err
+	}
+	b := make([]byte, tokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds.Tokens = replaceCredential(s.creds.Tokens, &Credential{Name: name, Role: role, Hash: hashToken(token)})
+	return token, s.save()
+}
+
+// Remove removes the user and token called name. It returns false if there
+// were none.
+func (s *UserStore) Remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, tokens := removeCredential(s.creds.Users, name), removeCredential(s.creds.Tokens, name)
+	if len(users) == len(s.creds.Users) && len(tokens) == len(s.creds.Tokens) {
+		return false, nil
+	}
+	s.creds.Users, s.creds.Tokens = users, tokens
+	return true, s.save()
+}
+
+// List returns the users and tokens, without their hashes, sorted by name.
+func (s *UserStore) List() (users, tokens []*Credential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listCredentials(s.creds.Users), listCredentials(s.creds.Tokens)
+}
+
+// CheckPassword returns the role of the user name if password is correct. The
+// password is hashed without holding the lock, so that a slow check doesn't
+// hold up other requests.
+func (s *UserStore) CheckPassword(name, password string) (Role, bool) {
+	c, k, cached := s.findVerified(name, password)
+	if c == nil {
+		return "", false
+	}
+	if cached {
+		return c.Role, true
+	}
+	if !VerifyPassword(c.Hash, password) {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verified[k] = s.clock.Now().Add(verifiedTTL)
+	return c.Role, true
+}
+
+// findVerified returns a copy of the user name, or nil if there is none, the
+// cache key for password, and whether it was verified recently.
+func (s *UserStore) findVerified(name, password string) (*Credential, [sha256.Size]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.creds.Users {
+		if c.Name != name {
+			continue
+		}
+		cc := *c
+		k := verifiedKey(&cc, password)
+		exp, ok := s.verified[k]
+		return &cc, k, ok && s.clock.Now().Before(exp)
+	}
+	return nil, [sha256.Size]byte{}, false
+}
+
+// CheckToken returns the name and role of token if it is valid.
+func (s *UserStore) CheckToken(token string) (string, Role, bool) {
+	h := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.creds.Tokens {
+		if hmac.Equal([]byte(c.Hash), []byte(h)) {
+			return c.Name, c.Role, true
+		}
+	}
+	return "", "", false
+}
+
+// save writes the credentials file, readable only by the owner, and clears
+// the cache of verified passwords.
+func (s *UserStore) save() error {
+	s.verified = make(map[[sha256.Size]byte]time.Time)
+	j, err := json.MarshalIndent(&s.creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, j, 0600)
+}
+
+// verifiedKey returns the cache key for password for the user c. It includes
+// the hash, so that a changed password isn't found.
+func verifiedKey(c *Credential, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(c.Name + "\x00" + c.Hash + "\x00" + password))
+}
+
+// verifyCredential returns an error if name or role is not valid.
+func verifyCredential(name string, role Role) error {
+	if name == "" || strings.ContainsAny(name, ": \t") {
+		return fmt.Errorf("bad name %q, must not be empty or contain spaces or colons", name)
+	}
+	return VerifyRole(role)
+}
+
+// replaceCredential returns cs with c added, and any other with its name
+// removed.
+func replaceCredential(cs []*Credential, c *Credential) []*Credential {
+	return append(removeCredential(cs, c.Name), c)
+}
+
+// removeCredential returns cs without any called name.
+func removeCredential(cs []*Credential, name string) []*Credential {
+	var out []*Credential
+	for _, c := range cs {
+		if c.Name != name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// listCredentials returns copies of cs without hashes, sorted by name.
+func listCredentials(cs []*Credential) []*Credential {
+	var out []*Credential
+	for _, c := range cs {
+		out = append(out, &Credential{Name: c.Name, Role: c.Role})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// HashPassword returns a salted PBKDF2-HMAC-SHA256 hash of password, in the
+// form pbkdf2-sha256$iterations$salt$key with base64 salt and key.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, pbkdf2Iterations, keyLen)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", pbkdf2Prefix, pbkdf2Iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches hash from HashPassword.
+func VerifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != pbkdf2Prefix {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	return hmac.Equal(pbkdf2SHA256([]byte(password), salt, iter, len(want)), want)
+}
+
+// hashToken returns the hash of an API token. Tokens are random, so they
+// don't need a salt or a slow hash.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return tokenPrefix + "$" + hex.EncodeToString(h[:])
+}
+
+// pbkdf2SHA256 returns the PBKDF2 key of length keyLen for password and salt
+// with iter iterations of HMAC-SHA256, as in RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], block)
+		prf.Write(b[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
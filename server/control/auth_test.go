@@ -0,0 +1,192 @@
+package control
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors from RFC 7914 section 11.
+	tests := []struct {
+		password, salt string
+		iter, keyLen   int
+		want           string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iter, tt.keyLen)); got != tt.want {
+			t.Errorf("pbkdf2SHA256(%s, %s, %d): got %s, want %s", tt.password, tt.salt, tt.iter, got, tt.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	h, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h == h2 || !strings.HasPrefix(h, "pbkdf2-sha256$100000$") {
+		t.Errorf("got hashes %s and %s, want different salted PBKDF2 hashes", h, h2)
+	}
+	if !VerifyPassword(h, "secret") {
+		t.Errorf("VerifyPassword: got false for the right password")
+	}
+	for _, bad := range []struct{ hash, password string }{
+		{h, "Secret"},
+		{h, ""},
+		{"", "secret"},
+		{"md5$1$abc$def", "secret"},
+		{strings.Replace(h, "$100000$", "$0$", 1), "secret"},
+	} {
+		if VerifyPassword(bad.hash, bad.password) {
+			t.Errorf("VerifyPassword(%q, %q): got true", bad.hash, bad.password)
+		}
+	}
+}
+
+func TestUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	clock := NewFakeClock(time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC))
+
+	s, err := NewUserStore(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled() {
+		t.Errorf("Enabled: got true with no users file")
+	}
+	if err := s.AddUser("alice", "pw", OperatorRole); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.AddToken("ci", ReadOnlyRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []struct {
+		name string
+		role Role
+	}{{"", OperatorRole}, {"a b", OperatorRole}, {"a:b", OperatorRole}, {"bob", "admin"}} {
+		if err := s.AddUser(bad.name, "pw", bad.role); err == nil {
+			t.Errorf("AddUser(%q, %q): got nil error", bad.name, bad.role)
+		}
+	}
+	if err := s.AddUser("bob", "", ReadOnlyRole); err == nil {
+		t.Errorf("AddUser with empty password: got nil error")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), token) || strings.Contains(string(b), `"pw"`) {
+		t.Errorf("users file has plain text credentials: %s", b)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("users file mode: got %v, %v, want 0600", fi.Mode(), err)
+	}
+
+	// A new store reads the saved file.
+	s, err = NewUserStore(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Enabled() || s.OpenReads() {
+		t.Errorf("got Enabled %t, OpenReads %t, want true, false", s.Enabled(), s.OpenReads())
+	}
+	if role, ok := s.CheckPassword("alice", "pw"); !ok || role != OperatorRole {
+		t.Errorf("CheckPassword: got %s, %t, want operator", role, ok)
+	}
+	// The second check is from the cache.
+	if role, ok := s.CheckPassword("alice", "pw"); !ok || role != OperatorRole {
+		t.Errorf("cached CheckPassword: got %s, %t, want operator", role, ok)
+	}
+	if _, ok := s.CheckPassword("alice", "wrong"); ok {
+		t.Errorf("CheckPassword with wrong password: got true")
+	}
+	if _, ok := s.CheckPassword("ci", token); ok {
+		t.Errorf("CheckPassword with a token: got true")
+	}
+	if name, role, ok := s.CheckToken(token); !ok || name != "ci" || role != ReadOnlyRole {
+		t.Errorf("CheckToken: got %s, %s, %t, want ci readonly", name, role, ok)
+	}
+	if _, _, ok := s.CheckToken("bad"); ok {
+		t.Errorf("CheckToken with bad token: got true")
+	}
+
+	// Changing the password invalidates the cached one.
+	if err := s.AddUser("alice", "new", ReadOnlyRole); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.CheckPassword("alice", "pw"); ok {
+		t.Errorf("CheckPassword with old password: got true")
+	}
+	if role, ok := s.CheckPassword("alice", "new"); !ok || role != ReadOnlyRole {
+		t.Errorf("CheckPassword with new password: got %s, %t, want readonly", role, ok)
+	}
+
+	users, tokens := s.List()
+	if len(users) != 1 || users[0].Hash != "" || len(tokens) != 1 || tokens[0].Name != "ci" {
+		t.Errorf("List: got %+v, %+v, want alice and ci without hashes", users, tokens)
+	}
+	if ok, err := s.Remove("ci"); !ok || err != nil {
+		t.Errorf("Remove: got %t, %v", ok, err)
+	}
+	if ok, _ := s.Remove("ci"); ok {
+		t.Errorf("Remove twice: got true")
+	}
+	if _, _, ok := s.CheckToken(token); ok {
+		t.Errorf("CheckToken after Remove: got true")
+	}
+	if err := s.SetOpenReads(true); err != nil || !s.OpenReads() {
+		t.Errorf("SetOpenReads: got %v, %t", err, s.OpenReads())
+	}
+
+	// Passwords are checked at the same time, without the lock.
+	var wg sync.WaitGroup
+	for _, pw := range []string{"new", "wrong", "new", "pw"} {
+		wg.Add(1)
+		go func(pw string) {
+			defer wg.Done()
+			if _, ok := s.CheckPassword("alice", pw); ok != (pw == "new") {
+				t.Errorf("concurrent CheckPassword(%s): got %t", pw, ok)
+			}
+		}(pw)
+	}
+	wg.Wait()
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, need Role
+		want       bool
+	}{
+		{OperatorRole, OperatorRole, true},
+		{OperatorRole, ReadOnlyRole, true},
+		{ReadOnlyRole, ReadOnlyRole, true},
+		{ReadOnlyRole, OperatorRole, false},
+		{"", ReadOnlyRole, false},
+		{"admin", ReadOnlyRole, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Allows(tt.need); got != tt.want {
+			t.Errorf("%q.Allows(%q): got %t, want %t", tt.role, tt.need, got, tt.want)
+		}
+	}
+}
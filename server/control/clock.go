@@ -0,0 +1,75 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is a source of the current time that can also sleep. It allows the
+// control loop to run against simulated time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep pauses for duration d. It returns early with the ctx error if ctx
+	// is done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// RealClock is a Clock that uses the system time.
+type RealClock struct{}
+
+// Now implements Clock#Now.
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Sleep implements Clock#Sleep.
+func (RealClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FakeClock is a Clock where time only passes when Sleep is called, so that
+// sleeping returns immediately. Sleep doesn't advance the time if ctx is
+// already done.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a ptr to a FakeClock set to time t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{
+		now: t,
+	}
+}
+
+// Now implements Clock#Now.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep implements Clock#Sleep by advancing the time by d.
+func (c *FakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// Set sets the time to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
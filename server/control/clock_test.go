@@ -0,0 +1,33 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFakeClockRun(t *testing.T) {
+	start := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	tvc := &TestValveController{log: &TestLogger{}}
+	zc := NewZoneController(tvc, NewTestKVStore(), clock)
+	if err := zc.Run(context.Background(), 0, 20*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clock.Now(), start.Add(20*time.Minute); !got.Equal(want) {
+		t.Errorf("after Run: got time %s, want %s", got, want)
+	}
+
+	calls := 0
+	_, err := RetryThenFail(clock, func() (interface{}, error) {
+		calls++
+		return nil, fmt.Errorf("fail")
+	}, 3, time.Minute)
+	if err == nil || calls != 3 {
+		t.Errorf("RetryThenFail: got %d calls / %v, want 3 calls and error", calls, err)
+	}
+	if got, want := clock.Now(), start.Add(23*time.Minute); !got.Equal(want) {
+		t.Errorf("after RetryThenFail: got time %s, want %s", got, want)
+	}
+}
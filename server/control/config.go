@@ -3,7 +3,10 @@ package control
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"time"
+
+	"irctl/server/control/weather"
 )
 
 const (
@@ -11,6 +14,10 @@ const (
 	PosInf float64 = 1e99
 	// NegInf represents negative infinity.
 	NegInf float64 = -1e99
+
+	// maxRainDelayLookaheadHours is the longest allowed rain delay lookahead.
+	// Hourly forecasts are only reliable for a day or two.
+	maxRainDelayLookaheadHours = 48
 )
 
 // SystemConfig is a complete configuration.
@@ -18,7 +25,14 @@ type SystemConfig struct {
 	GlobalConfig            *GlobalConfig
 	ZoneConfigs             map[int]*ZoneConfig
 	ETAlgorithmSimpleConfig *ETAlgorithmSimple
+	ETAlgorithmEToConfig    *ETAlgorithmETo
 	SoilConfigMap           map[string]*SoilConfig
+	// WeatherProviders is the config for each weather provider, by name.
+	// API keys are not part of it, see weather.ProviderConfigs.LoadSecrets.
+	WeatherProviders weather.ProviderConfigs
+	// Notifications are the sinks that errors are sent to. Passwords and
+	// tokens are not part of it, see LoadNotificationSecrets.
+	Notifications []*NotificationConfig
 }
 
 // NumZones returns the number of zones in sc.
@@ -40,6 +54,29 @@ type GlobalConfig struct {
 	RunTimeAM   time.Time
 	RunTimePM   time.Time
 	AirportCode string
+	// Weather is the ordered list of weather providers to use, from
+	// weather.AvailableProviderNames. Later providers are only used if
+	// earlier ones fail. If empty, DefaultWeatherProviders is used.
+	Weather []string
+	// RainDelayLookaheadHours is how far ahead the hourly forecast is checked
+	// for rain before a scheduled run. If 0, runs are not postponed for rain.
+	RainDelayLookaheadHours int
+	// RainDelayThresholdIn is the forecast rain within the lookahead that
+	// postpones a run.
+	RainDelayThresholdIn float64
+}
+
+// DefaultWeatherProviders are the weather providers used if none are
+// configured.
+var DefaultWeatherProviders = []string{weather.AccuWeatherName}
+
+// WeatherProviderNames returns the configured weather provider names, or
+// DefaultWeatherProviders if none are configured.
+func (gc *GlobalConfig) WeatherProviderNames() []string {
+	if len(gc.Weather) == 0 {
+		return DefaultWeatherProviders
+	}
+	return gc.Weather
 }
 
 // ZoneConfig is the config for each zone.
@@ -54,6 +91,12 @@ type ZoneConfig struct {
 	RunTimeMultiplier float64
 	ZoneETRate        float64
 	DepthIn           float64
+	// CropCoefficient scales the reference ET for the zone. Used only with
+	// ETAlgorithmEToConfig.
+	CropCoefficient float64
+	// FlowGPM is the flow of the zone in gallons per minute, used to estimate
+	// water use in reports. If 0, water use is not estimated.
+	FlowGPM float64
 }
 
 // SoilConfig is the config for soils.
@@ -62,6 +105,19 @@ type SoilConfig struct {
 	MaxVWC Pct
 }
 
+// ReadConfigFile reads and parses the config file at path.
+func ReadConfigFile(path string) (*SystemConfig, error) {
+	scb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file at %s: %s", path, err)
+	}
+	sc := &SystemConfig{}
+	if err := sc.Parse(string(scb)); err != nil {
+		return nil, fmt.Errorf("could not parse config file at %s: %s", path, err)
+	}
+	return sc, nil
+}
+
 // Parse parses a configuration text block and populates sc with the parsed
 // values.
 func (sc *SystemConfig) Parse(conf string) error {
@@ -69,8 +125,12 @@ func (sc *SystemConfig) Parse(conf string) error {
 		return err
 	}
 
-	if sc.ETAlgorithmSimpleConfig == nil {
-		return fmt.Errorf("must specify algorithm")		
+	if sc.ETAlgorithmSimpleConfig == nil && sc.ETAlgorithmEToConfig == nil {
+		return fmt.Errorf("must specify algorithm")
+	}
+
+	if sc.ETAlgorithmEToConfig != nil && (sc.ETAlgorithmEToConfig.DefaultEtIn <= 0 || sc.ETAlgorithmEToConfig.DefaultEtIn > 1.0) {
+		return fmt.Errorf("ETAlgorithmEToConfig DefaultEtIn must be in the range 0 - 1.0, have %.3f", sc.ETAlgorithmEToConfig.DefaultEtIn)
 	}
 	
 	if sc.GlobalConfig == nil {
@@ -81,6 +141,22 @@ func (sc *SystemConfig) Parse(conf string) error {
 		return fmt.Errorf("must specify AirportCode")
 	}
 
+	if err := VerifyWeatherProviderNames(sc.GlobalConfig.Weather); err != nil {
+		return err
+	}
+
+	if gc := sc.GlobalConfig; gc.RainDelayLookaheadHours < 0 || gc.RainDelayLookaheadHours > maxRainDelayLookaheadHours {
+		return fmt.Errorf("RainDelayLookaheadHours must be in the range 0 - %d, have %d", maxRainDelayLookaheadHours, gc.RainDelayLookaheadHours)
+	}
+
+	if gc := sc.GlobalConfig; gc.RainDelayLookaheadHours > 0 && gc.RainDelayThresholdIn <= 0 {
+		return fmt.Errorf("RainDelayThresholdIn must be > 0 if RainDelayLookaheadHours is set, have %.3f", gc.RainDelayThresholdIn)
+	}
+
+	if err := verifyNotificationConfigs(sc.Notifications); err != nil {
+		return err
+	}
+
 	if len(sc.ZoneConfigs) == 0 {
 		return fmt.Errorf("must specify at least one zone")
 	}
@@ -95,11 +171,31 @@ func (sc *SystemConfig) Parse(conf string) error {
 		if err := verifyZoneConfig(zc); err != nil {
 			return err
 		}
+
+		if sc.ETAlgorithmEToConfig != nil && (zc.CropCoefficient < 0.1 || zc.CropCoefficient > 2.0) {
+			return fmt.Errorf("zone %d:%s CropCoefficient must be in the range 0.1 - 2.0, have %.3f", zc.Number, zc.Name, zc.CropCoefficient)
+		}
 	}
 	
 	return nil
 }
 
+// VerifyWeatherProviderNames returns an error if any of names is not an
+// available weather provider, or appears more than once.
+func VerifyWeatherProviderNames(names []string) error {
+	seen := make(map[string]bool)
+	for _, n := range names {
+		if !isInStringSlice(weather.AvailableProviderNames(), n) {
+			return fmt.Errorf("unknown weather provider %s, choices are %v", n, weather.AvailableProviderNames())
+		}
+		if seen[n] {
+			return fmt.Errorf("duplicate weather provider %s", n)
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
 func verifyZoneConfig(zc *ZoneConfig) error {
 	if zc.Name == "" {
 		return fmt.Errorf("must specify zone name for zone number %d", zc.Number)
@@ -109,6 +205,10 @@ func verifyZoneConfig(zc *ZoneConfig) error {
 		return fmt.Errorf("zone number %d cannot be negative", zc.Number)
 	}
 
+	if zc.FlowGPM < 0 {
+		return fmt.Errorf("zone %d:%s FlowGPM cannot be negative, have %.3f", zc.Number, zc.Name, zc.FlowGPM)
+	}
+
 	if zc.MaxVWC < 0 || zc.MaxVWC > 100.0 {
 		return fmt.Errorf("zone %d:%s MaxVWC must be in the range 0-100, have %.3f", zc.Number, zc.Name, zc.MaxVWC)
 	}
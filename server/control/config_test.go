@@ -1,7 +1,11 @@
 package control
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+
+	"irctl/server/control/weather"
 )
 
 func TestSystemConfigParse(t *testing.T) {
@@ -198,6 +202,114 @@ func TestSystemConfigParse(t *testing.T) {
     }
   }
 }			
+`,
+		},
+		{
+			desc:    "missing crop coefficient",
+			wantErr: `zone 0:zone 0 CropCoefficient must be in the range 0.1 - 2.0, have 0.000`,
+			configStr: `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.15
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`,
+		},
+		{
+			desc:    "unknown weather provider",
+			wantErr: `unknown weather provider Nowhere, choices are [AccuWeather NWS OpenMeteo Wunderground]`,
+			configStr: `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.15
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z",
+    "Weather": ["NWS", "Nowhere"]
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 0.8,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`,
+		},
+		{
+			desc:    "rain delay without threshold",
+			wantErr: `RainDelayThresholdIn must be > 0 if RainDelayLookaheadHours is set, have 0.000`,
+			configStr: `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.15
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z",
+    "RainDelayLookaheadHours": 6
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 0.8,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`,
+		},
+		{
+			desc: "good ETo",
+			configStr: `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.15
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 0.8,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
 `,
 		},
 	}
@@ -212,3 +324,20 @@ func TestSystemConfigParse(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfigFile(t *testing.T) {
+	sc, err := ReadConfigFile("../../www/conf/irctl_conf.json")
+	if err != nil {
+		t.Fatalf("ReadConfigFile: %v", err)
+	}
+	if got, want := sc.WeatherProviders.Get(weather.AccuWeatherName).LocationKey, "331979"; got != want {
+		t.Errorf("AccuWeather LocationKey: got %s, want %s", got, want)
+	}
+	if got, want := sc.GlobalConfig.WeatherProviderNames(), []string{weather.AccuWeatherName, weather.NWSName, weather.OpenMeteoName}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WeatherProviderNames: got %v, want %v", got, want)
+	}
+
+	if _, err := ReadConfigFile("missing.json"); err == nil || !strings.Contains(err.Error(), "could not read") {
+		t.Errorf("ReadConfigFile with missing file: got %v, want could not read error", err)
+	}
+}
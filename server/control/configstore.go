@@ -0,0 +1,486 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// configIndexFile is the file in the revisions dir that lists the
+	// revisions.
+	configIndexFile = "index.json"
+	// maxConfigRevisions is the number of config revisions kept.
+	maxConfigRevisions = 100
+	// diffContext is the number of unchanged lines around each change in a
+	// diff.
+	diffContext = 3
+	// fileAuthor is the author of revisions for changes made to the config
+	// file outside of a ConfigStore.
+	fileAuthor = "file"
+)
+
+// ConfigRevision is a version of the config that was written.
+type ConfigRevision struct {
+	ID     int64
+	Time   time.Time
+	Author string
+	// Comment is why the config changed, if known.
+	Comment string `json:",omitempty"`
+}
+
+// InvalidConfigError is returned by ConfigStore#Write for a config that
+// doesn't parse.
+type InvalidConfigError struct {
+	Err error
+}
+
+// Error implements error#Error.
+func (e *InvalidConfigError) Error() string {
+	return "Error in config: " + e.Err.Error()
+}
+
+// ConfigStore keeps the config file, the parsed current config and a numbered
+// revision of each version of the file.
+type ConfigStore struct {
+	path   string
+	revDir string
+	clock  Clock
+
+	mu  sync.Mutex
+	raw []byte
+	sc  *SystemConfig
+	alg ETAlgorithm
+	// invalid is the error from parsing the config file when it was last
+	// read, or nil if it parsed.
+	invalid error
+	// modTime and size are those of the config file when it was last read or
+	// written, to notice changes made by hand.
+	modTime time.Time
+	size    int64
+	// revs are the revisions, oldest first.
+	revs []*ConfigRevision
+}
+
+// NewConfigStore returns a ptr to a ConfigStore for the config file at path,
+// which keeps revisions in the dir revDir. If the file isn't the latest
+// revision, e.g. on first use, it is recorded as a new revision. A file that
+// doesn't parse is not an error here, it is returned by Current until the
+// config is fixed.
+func NewConfigStore(path, revDir string, clock Clock) (*ConfigStore, error) {
+	if err := os.MkdirAll(revDir, 0755); err != nil {
+		return nil, err
+	}
+	s := &ConfigStore{
+		path:   path,
+		revDir: revDir,
+		clock:  clock,
+	}
+	j, err := ioutil.ReadFile(filepath.Join(revDir, configIndexFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(j, &s.revs); err != nil {
+			return nil, fmt.Errorf("bad config revisions index: %s", err)
+		}
+	}
+	if _, err := s.reloadIfChanged(); err != nil && err != s.invalid {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Current returns the current config and its ETAlgorithm. If the file was
+// changed by hand, it is read again and recorded as a revision.
+func (s *ConfigStore) Current() (*SystemConfig, ETAlgorithm, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.reloadIfChanged(); err != nil {
+		return nil, nil, err
+	}
+	return s.sc, s.alg, nil
+}
+
+// Raw returns the contents of the current config file.
+func (s *ConfigStore) Raw() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return s.raw, nil
+}
+
+// Write checks that conf is a valid config, and writes it as a new revision
+// by author.
+func (s *ConfigStore) Write(conf []byte, author, comment string) (*ConfigRevision, error) {
+	return s.Update(author, comment, func([]byte) ([]byte, error) { return conf, nil })
+}
+
+// Update writes the config returned by update, which is called with the
+// current config, as a new revision by author. The config is written as it is,
+// keeping its formatting. No other write can happen in between. If the config
+// is unchanged, the latest revision is returned. The current config file
+// doesn't need to parse, so that a broken file can be replaced.
+func (s *ConfigStore) Update(author, comment string, update func(conf []byte) ([]byte, error)) (*ConfigRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.reloadIfChanged(); err != nil && err != s.invalid {
+		return nil, err
+	}
+	conf, err := update(s.raw)
+	if err != nil {
+		return nil, err
+	}
+	j := make(map[string]interface{})
+	if err := json.Unmarshal(conf, &j); err != nil {
+		return nil, &InvalidConfigError{Err: err}
+	}
+	sc := &SystemConfig{}
+	if err := sc.Parse(string(conf)); err != nil {
+		return nil, &InvalidConfigError{Err: err}
+	}
+	alg, err := NewETAlgorithm(sc)
+	if err != nil {
+		return nil, &InvalidConfigError{Err: err}
+	}
+	if bytes.Equal(conf, s.raw) && len(s.revs) > 0 {
+		return s.revs[len(s.revs)-1], nil
+	}
+
+	// The file is written first, so that a revision is only recorded for a
+	// config that was in use. If recording the revision fails, the file is
+	// recorded as changed outside irctl when it is next read.
+	if err := writeFileAtomic(s.path, conf, 0644); err != nil {
+		return nil, fmt.Errorf("Error writing file: %s", err)
+	}
+	rev, err := s.addRevision(conf, author, comment)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setCurrent(conf, sc, alg); err != nil {
+		return nil, err
+	}
+	log.Infof("Wrote config revision %d by %s.", rev.ID, author)
+	return rev, nil
+}
+
+// Revisions returns the revisions, newest first.
+func (s *ConfigStore) Revisions() []*ConfigRevision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]*ConfigRevision(nil), s.revs...)
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out
+}
+
+// Revision returns revision id and its config.
+func (s *ConfigStore) Revision(id int64) (*ConfigRevision, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revision(id)
+}
+
+// Diff returns a unified diff of the config from revision from to revision to.
+func (s *ConfigStore) Diff(from, to int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, err := s.revision(from)
+	if err != nil {
+		return "", err
+	}
+	_, b, err := s.revision(to)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(splitLines(a), splitLines(b), fmt.Sprintf("revision %d", from), fmt.Sprintf("revision %d", to)), nil
+}
+
+// Rollback writes the config of revision id as a new revision by author.
+func (s *ConfigStore) Rollback(id int64, author string) (*ConfigRevision, error) {
+	_, conf, err := s.Revision(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Write(conf, author, fmt.Sprintf("rollback to revision %d", id))
+}
+
+// revision returns revision id and its config.
+func (s *ConfigStore) revision(id int64) (*ConfigRevision, []byte, error) {
+	for _, r := range s.revs {
+		if r.ID == id {
+			b, err := ioutil.ReadFile(s.revisionPath(id))
+			return r, b, err
+		}
+	}
+	return nil, nil, fmt.Errorf("no config revision %d", id)
+}
+
+// reloadIfChanged reads the config file if it changed since it was last read
+// or written, and returns true if it did. A changed file that isn't the latest
+// revision is recorded as a new revision, even if it doesn't parse. If the file
+// doesn't parse, s.invalid is returned.
+func (s *ConfigStore) reloadIfChanged() (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return false, fmt.Errorf("could not read config file at %s: %s", s.path, err)
+	}
+	if !s.modTime.IsZero() && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return false, s.invalid
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return false, fmt.Errorf("could not read config file at %s: %s", s.path, err)
+	}
+	latest := []byte(nil)
+	if len(s.revs) > 0 {
+		if _, latest, err = s.revision(s.revs[len(s.revs)-1].ID); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if !bytes.Equal(b, latest) {
+		comment := "changed outside irctl"
+		if len(s.revs) == 0 {
+			comment = "first revision"
+		}
+		if _, err := s.addRevision(b, fileAuthor, comment); err != nil {
+			return false, err
+		}
+	}
+	sc := &SystemConfig{}
+	if err := sc.Parse(string(b)); err != nil {
+		return true, s.setInvalid(b, fmt.Errorf("could not parse config file: %s\n\n%s", err, b))
+	}
+	alg, err := NewETAlgorithm(sc)
+	if err != nil {
+		return true, s.setInvalid(b, err)
+	}
+	return true, s.setCurrent(b, sc, alg)
+}
+
+// setCurrent sets the current config, and the time and size of the file.
+func (s *ConfigStore) setCurrent(raw []byte, sc *SystemConfig, alg ETAlgorithm) error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.raw, s.sc, s.alg, s.invalid = raw, sc, alg, nil
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// setInvalid sets the current config file to raw, which doesn't parse with
+// the error invalid, and returns invalid.
+func (s *ConfigStore) setInvalid(raw []byte, invalid error) error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.raw, s.sc, s.alg, s.invalid = raw, nil, nil, invalid
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	return invalid
+}
+
+// addRevision saves conf as a new revision, and removes the oldest if there
+// are more than maxConfigRevisions.
+func (s *ConfigStore) addRevision(conf []byte, author, comment string) (*ConfigRevision, error) {
+	rev := &ConfigRevision{ID: 1, Time: s.clock.Now(), Author: author, Comment: comment}
+	if len(s.revs) > 0 {
+		rev.ID = s.revs[len(s.revs)-1].ID + 1
+	}
+	if err := writeFileAtomic(s.revisionPath(rev.ID), conf, 0644); err != nil {
+		return nil, err
+	}
+	revs := append(s.revs, rev)
+	var removed []*ConfigRevision
+	if len(revs) > maxConfigRevisions {
+		removed, revs = revs[:len(revs)-maxConfigRevisions], revs[len(revs)-maxConfigRevisions:]
+	}
+	j, err := json.MarshalIndent(revs, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(s.revDir, configIndexFile), j, 0644); err != nil {
+		return nil, err
+	}
+	s.revs = revs
+	for _, r := range removed {
+		if err := os.Remove(s.revisionPath(r.ID)); err != nil {
+			log.Warningf("Couldn't remove old config revision: %s", err)
+		}
+	}
+	return rev, nil
+}
+
+// revisionPath returns the path of the config of revision id.
+func (s *ConfigStore) revisionPath(id int64) string {
+	return filepath.Join(s.revDir, strconv.FormatInt(id, 10)+".json")
+}
+
+// writeFileAtomic writes data to a temp file in the dir of path and renames
+// it to path, so that after a crash path has either the old or the new data.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Persist the rename.
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// splitLines splits b into lines without their newlines.
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffOp is a line of a diff: ' ' for a line in both, '-' for a line only in
+// the old text and '+' for a line only in the new text.
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// unifiedDiff returns the diff from a to b in unified format, with the file
+// names fromName and toName. It is empty if a and b are the same.
+func unifiedDiff(a, b []string, fromName, toName string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	// aLine and bLine are the line numbers in a and b before ops[k].
+	aLine, bLine := 0, 0
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			aLine++
+			bLine++
+			k++
+			continue
+		}
+		// Start a hunk diffContext lines back, and end it once there are
+		// more than 2*diffContext unchanged lines.
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end, same := k, 0
+		for ; end < len(ops) && same <= 2*diffContext; end++ {
+			if ops[end].kind == ' ' {
+				same++
+			} else {
+				same = 0
+			}
+		}
+		end -= same - diffContext
+		if same < diffContext {
+			end = len(ops)
+		}
+		aStart, bStart := aLine-(k-start), bLine-(k-start)
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.text)
+		}
+		for _, op := range ops[k:end] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		k = end
+	}
+	return out.String()
+}
+
+// hunkRange returns the range of a hunk header for count lines from the
+// 0-based line start.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,203 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "conf.json")
+	revDir := filepath.Join(root, "revisions")
+	if err := ioutil.WriteFile(path, []byte(reportTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Date(2019, 3, 17, 10, 0, 0, 0, time.UTC))
+
+	s, err := NewConfigStore(path, revDir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revs := s.Revisions()
+	if len(revs) != 1 || revs[0].ID != 1 || revs[0].Author != fileAuthor {
+		t.Fatalf("got revisions %+v, want the file as revision 1", revs)
+	}
+	sc, _, err := s.Current()
+	if err != nil || sc.ZoneConfigs[1].MaxVWC != 20 {
+		t.Fatalf("got config %v, %v, want zone 1 MaxVWC 20", sc, err)
+	}
+
+	// Invalid configs aren't written.
+	for _, c := range []string{`{`, `{"ZoneConfigs": {"0": {"Number": 0}}}`} {
+		_, err := s.Write([]byte(c), "alice", "")
+		if _, ok := err.(*InvalidConfigError); !ok {
+			t.Errorf("Write(%s): got %v, want InvalidConfigError", c, err)
+		}
+	}
+	if len(s.Revisions()) != 1 {
+		t.Errorf("invalid config was recorded")
+	}
+
+	clock.Set(clock.Now().Add(time.Hour))
+	conf, err := PatchZone([]byte(reportTestConfig), 1, []byte(`{"MaxVWC": 25}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := s.Write(conf, "alice", "wetter beds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.ID != 2 || rev.Author != "alice" || rev.Comment != "wetter beds" || !rev.Time.Equal(clock.Now()) {
+		t.Errorf("got revision %+v, want 2 by alice now", rev)
+	}
+	if sc, _, _ := s.Current(); sc.ZoneConfigs[1].MaxVWC != 25 {
+		t.Errorf("got MaxVWC %.0f, want 25", sc.ZoneConfigs[1].MaxVWC)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != string(conf) {
+		t.Errorf("file is %s, want %s", b, conf)
+	}
+	// Writing the same config again doesn't add a revision.
+	if r, err := s.Write(conf, "bob", ""); err != nil || r.ID != 2 {
+		t.Errorf("got revision %+v, %v for unchanged config, want 2", r, err)
+	}
+	if fs, _ := filepath.Glob(filepath.Join(root, ".*tmp*")); len(fs) != 0 {
+		t.Errorf("temp files left: %v", fs)
+	}
+
+	diff, err := s.Diff(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(diff, "--- revision 1\n+++ revision 2\n@@ ") || !strings.Contains(diff, "\n+      \"MaxVWC\": 25,\n") {
+		t.Errorf("got diff\n%s", diff)
+	}
+	if _, err := s.Diff(1, 9); err == nil {
+		t.Errorf("got nil error for diff with missing revision")
+	}
+
+	rev, err = s.Rollback(1, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.ID != 3 || rev.Comment != "rollback to revision 1" {
+		t.Errorf("got revision %+v, want 3 rolling back to 1", rev)
+	}
+	if sc, _, _ := s.Current(); sc.ZoneConfigs[1].MaxVWC != 20 {
+		t.Errorf("got MaxVWC %.0f after rollback, want 20", sc.ZoneConfigs[1].MaxVWC)
+	}
+
+	// A change by hand is read and recorded.
+	conf, err = PatchZone([]byte(reportTestConfig), 0, []byte(`{"Name": "front lawn"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, conf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if sc, _, _ := s.Current(); sc.ZoneConfigs[0].Name != "front lawn" {
+		t.Errorf("got zone 0 %s, want front lawn", sc.ZoneConfigs[0].Name)
+	}
+	if r := s.Revisions()[0]; r.ID != 4 || r.Author != fileAuthor {
+		t.Errorf("got latest revision %+v, want 4 from the file", r)
+	}
+
+	// Revisions are kept across restarts.
+	s, err = NewConfigStore(path, revDir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revs := s.Revisions(); len(revs) != 4 || revs[0].ID != 4 || revs[3].ID != 1 {
+		t.Errorf("got %d revisions after restart, want 4 newest first", len(revs))
+	}
+	if _, b, err := s.Revision(2); err != nil || !strings.Contains(string(b), `"MaxVWC": 25`) {
+		t.Errorf("got revision 2 %s, %v", b, err)
+	}
+
+	// The config is written with its own formatting, and a change of only
+	// the formatting is a revision.
+	tabbed := []byte(strings.Replace(reportTestConfig, "  ", "\t", -1))
+	rev, err = s.Write(tabbed, "alice", "tabs")
+	if err != nil || rev.ID != 5 {
+		t.Fatalf("got revision %+v, %v, want 5", rev, err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != string(tabbed) {
+		t.Errorf("file is %s, want %s", b, tabbed)
+	}
+	if _, b, err := s.Revision(5); err != nil || string(b) != string(tabbed) {
+		t.Errorf("got revision 5 %s, %v, want %s", b, err, tabbed)
+	}
+
+	// A file broken by hand is recorded, and can be rolled back, also after a
+	// restart.
+	if err := ioutil.WriteFile(path, []byte(`{broken`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Current(); err == nil {
+		t.Error("Current: got nil error for broken file")
+	}
+	if r := s.Revisions()[0]; r.ID != 6 || r.Author != fileAuthor {
+		t.Errorf("got latest revision %+v, want 6 from the broken file", r)
+	}
+	s, err = NewConfigStore(path, revDir, clock)
+	if err != nil {
+		t.Fatalf("NewConfigStore with broken file: %v", err)
+	}
+	if _, _, err := s.Current(); err == nil {
+		t.Error("Current after restart: got nil error for broken file")
+	}
+	rev, err = s.Rollback(5, "alice")
+	if err != nil || rev.ID != 7 {
+		t.Fatalf("Rollback from broken file: got revision %+v, %v, want 7", rev, err)
+	}
+	if sc, _, err := s.Current(); err != nil || sc.ZoneConfigs[1].MaxVWC != 20 {
+		t.Errorf("Current after rollback: got %v, want MaxVWC 20", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != string(tabbed) {
+		t.Errorf("file is %s after rollback, want %s", b, tabbed)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := strings.Split("a b c d e f g h i j k l m n o p", " ")
+	b := strings.Split("a b c D e f g h i j k l m n p q", " ")
+	want := `--- a
++++ b
+@@ -1,7 +1,7 @@
+ a
+ b
+ c
+-d
++D
+ e
+ f
+ g
+@@ -12,5 +12,5 @@
+ l
+ m
+ n
+-o
+ p
++q
+`
+	if got := unifiedDiff(a, b, "a", "b"); got != want {
+		t.Errorf("got diff\n%s\nwant\n%s", got, want)
+	}
+	if got := unifiedDiff(a, a, "a", "b"); got != "" {
+		t.Errorf("got diff %q for same lines, want none", got)
+	}
+	if got, want := unifiedDiff(nil, []string{"x"}, "a", "b"), "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n"; got != want {
+		t.Errorf("got diff %q, want %q", got, want)
+	}
+}
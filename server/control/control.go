@@ -9,6 +9,8 @@
 package control
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -27,16 +29,8 @@ const (
 	dateFormat = "2006-Jan-02"
 	// timeOfDayFormat is the string format for time of day.
 	timeOfDayFormat = "15:04"
-)
-
-var (
-	// CommandRunning reports whether a manual or auto command is currently
-	// running. It should be set to true under lock before commencing an
-	// operation that can turn on a valve.
-	// Note this can race with HTTP handler for running zone manually but
-	// due to lack of CanLock functionality in sync.Mutex making this race
-	// free would be more trouble than it's worth.
-	CommandRunning = false
+	// unknownET is the ET value used when no measured ET is available.
+	unknownET = -1.0
 )
 
 // RunParams is a collection of run options.
@@ -46,10 +40,27 @@ type RunParams struct {
 	Config string
 	// ConfigPath is the file path of the config file.
 	ConfigPath string
+	// ConfigStore, if set, is used for the config instead of reading the file
+	// at ConfigPath, so that changes are seen without reading the file each
+	// run.
+	ConfigStore *ConfigStore
 	// DataLogPath is the root path of the data logs.
 	DataLogPath string
-	// DontSleep avoids sleep when set to true. Used for testing only.
-	DontSleep bool
+	// Clock is used for the time and to sleep. If nil, RealClock is used.
+	Clock Clock
+	// Coordinator controls access to the valves, and must be shared with
+	// anything else that runs zones. If nil, the Controller creates its own.
+	Coordinator *RunCoordinator
+	// Events receives RunOnce events from Run, if not nil.
+	Events *EventBus
+	// Reports receives a DailyReport as a ReportNotice after each daily run,
+	// if not nil.
+	Reports ErrorReporter
+	// ConditionsRetries is the number of times getting conditions is retried
+	// before falling back to logged conditions.
+	ConditionsRetries int
+	// ConditionsRetryInterval is the time between retries.
+	ConditionsRetryInterval time.Duration
 }
 
 // Keys for KVStore.
@@ -57,27 +68,63 @@ const (
 	ZoneStateKey   = "ZoneState"
 	LastRunDateKey = "LastRunDate"
 	CurrentVWCKey  = "CurrentVWC"
+	// RainDelayKey holds the most recent RainDelay as JSON.
+	RainDelayKey = "RainDelay"
+	// BalanceDateKey is the date that the daily water balance was last
+	// applied to the zone VWCs, so that it is only applied once a day.
+	BalanceDateKey = "BalanceDate"
 )
 
+// RainDelay is a record of a run that was postponed because of forecast rain.
+type RainDelay struct {
+	Time   time.Time
+	Reason string
+}
+
 // Run repeatedly runs the entire action, with a sleep interval of runInterval.
 // It uses:
 //   kv to persist run state
 //   cg to get current conditions
 //   zc to control zones
 //   er to report errors
-// Never exits.
-func Run(rparam *RunParams, kv KVStore, cg weather.ConditionsGetter, zc ZoneController, er ErrorReporter) {
+// It returns when ctx is done.
+func Run(ctx context.Context, rparam *RunParams, kv KVStore, cg weather.ConditionsGetter, zc ZoneController, er ErrorReporter) {
 	log.Infof("control.Run called with \n%v\nKV store (%T), ConditionsGetter(%T), ZoneController(%T), ErrorReporter(%T))",
 		pretty.Sprint(*rparam), kv, cg, zc, er)
 	ctrl := NewController(rparam, kv, cg, zc, er)
+	clock := rparam.clock()
 	for {
-		if err := ctrl.RunOnce(time.Now()); err != nil {
+		rparam.Events.Publish(&Event{Time: clock.Now(), Type: RunOnceStarted, Zone: -1})
+		err := ctrl.RunOnce(ctx, clock.Now())
+		e := &Event{Time: clock.Now(), Type: RunOnceFinished, Zone: -1}
+		if err != nil && ctx.Err() == nil {
 			er.Report(err)
+			e.Error = err.Error()
+		}
+		rparam.Events.Publish(e)
+		if err := clock.Sleep(ctx, runInterval); err != nil {
+			log.Infof("Control loop stopped: %s", err)
+			return
 		}
-		time.Sleep(runInterval)
 	}
 }
 
+// clock returns the Clock to use for rp.
+func (rp *RunParams) clock() Clock {
+	if rp.Clock == nil {
+		return RealClock{}
+	}
+	return rp.Clock
+}
+
+// coordinator returns the RunCoordinator to use for rp.
+func (rp *RunParams) coordinator() *RunCoordinator {
+	if rp.Coordinator == nil {
+		return NewRunCoordinator(rp.clock())
+	}
+	return rp.Coordinator
+}
+
 // Controller is the top level irrigation controller.
 type Controller struct {
 	rparam           *RunParams
@@ -87,7 +134,9 @@ type Controller struct {
 	conditionsGetter weather.ConditionsGetter
 	zoneController   ZoneController
 	dataLogger       *DataLogger
+	ledger           *Ledger
 	errorReporter    ErrorReporter
+	coordinator      *RunCoordinator
 }
 
 // NewController creates an initialized Controller and returns a pointer to it.
@@ -98,6 +147,7 @@ func NewController(rparam *RunParams, kv KVStore, cg weather.ConditionsGetter, z
 		conditionsGetter: cg,
 		zoneController:   zc,
 		errorReporter:    er,
+		coordinator:      rparam.coordinator(),
 	}
 }
 
@@ -117,32 +167,63 @@ func NewController(rparam *RunParams, kv KVStore, cg weather.ConditionsGetter, z
 // Idle. Zones can only go to Running from Idle state.
 // All state is stored in the KV store. If there's a crash when a zone is
 // running, upon restart its state is changed from Running to Complete.
-func (c *Controller) RunOnce(now time.Time) error {
+// If ctx is cancelled while a zone is running, it is stopped and set to
+// Interrupted, its VWC is increased for the time it ran, and it is run for
+// the rest of its runtime on the next loop. The same happens if the run is
+// cancelled through the RunCoordinator.
+// The loop holds the valves for the whole run, and doesn't run if a manual
+// run has them.
+func (c *Controller) RunOnce(ctx context.Context, now time.Time) error {
 	log.Infof("RunOnce at time %s.", now.Format("Mon 2 Jan 2006 15:04"))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if CommandRunning {
+	run, err := c.coordinator.Acquire(ctx, AutoRun, Reject)
+	if err == ErrBusy {
 		log.Infof("Manual command is running, will retry later.")
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	defer run.Release()
 
 	// Close all valves directly on the valve controller for safety/recovery.
 	// Nothing should be running at this point in the loop.
 	c.zoneController.TurnAllOff()
 
-	var err error
+	// Any manual run that is still recorded was stopped by a crash.
+	if recovered, err := c.zoneController.RecoverManualRuns(); err != nil {
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+	} else if len(recovered) > 0 {
+		c.errorReporter.Report(Tag(SourceValve, SeverityWarning, fmt.Errorf("manual runs of zones %v were interrupted, VWC was not updated", recovered)))
+	}
+
 	c.systemConfig, c.algorithm, err = readConfig(c.rparam)
 	if err != nil {
 		// can't do anything without a config, return and try again.
-		return err
+		return Tag(SourceConfig, SeverityCritical, err)
 	}
 	log.Infof("Read config from %s.", c.rparam.ConfigPath)
 
 	c.dataLogger = NewDataLogger(c.rparam.DataLogPath)
+	c.ledger = NewLedger(c.rparam.DataLogPath)
+
+	// Runs that were interrupted at shutdown are credited after the restart.
+	for znum := 0; znum < c.systemConfig.NumZones(); znum++ {
+		c.creditInterruptedRun(znum, now)
+	}
+	// A run interrupted on an earlier day isn't resumed, the zone runs again
+	// only if it needs water.
+	if err := c.zoneController.ResetInterruptedZones(c.systemConfig.NumZones(), now); err != nil {
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+	}
 
 	// alreadyRan will be true only if ALL zones were successfully completed.
 	alreadyRan, err := checkIfRanToday(c.kvStore, now)
 	if err != nil {
-		return err
+		return Tag(SourceKV, SeverityCritical, err)
 	}
 
 	// alreadyRan will be true only if ALL zones were successfully completed.
@@ -151,14 +232,14 @@ func (c *Controller) RunOnce(now time.Time) error {
 		// Since all ran successfully, transition states from Complete to Idle.
 		if err := c.zoneController.ResetZones(c.systemConfig.NumZones()); err != nil {
 			// If this fails, zones will not be able to run.
-			return err
+			return Tag(SourceKV, SeverityCritical, err)
 		}
 		// This is to show the predicted runtimes for tomorrow in the web UI. The times will be
 		// recalculated based on the most accurate conditions before they are run, so the actual
 		// runtimes may differ. This prediction can only be done after VWC is updated after
 		// today's run.
-		_, _, tempForecast, precipForecast := c.getConditions(now)
-		tomorrowRuntimes, _, err := c.calculateRuntimes(tempForecast, precipForecast, 0.0, now)
+		_, _, _, tempForecast, precipForecast := c.getConditions(ctx, now)
+		tomorrowRuntimes, _, err := c.calculateRuntimes(tempForecast, precipForecast, unknownET, 0.0, now, false)
 		if err != nil {
 			return err
 		} else if err := c.dataLogger.WriteRuntimes(tomorrow(now), c.systemConfig.NumZones(), tomorrowRuntimes); err != nil {
@@ -173,19 +254,46 @@ func (c *Controller) RunOnce(now time.Time) error {
 		return nil
 	}
 
-	tempYesterday, precipYesterday, _, precipForecast := c.getConditions(now)
-	runtimes, nonRunVWCs, err := c.calculateRuntimes(tempYesterday, precipYesterday, precipForecast, now)
+	// The water balance is applied once a day, even if the run is postponed,
+	// so that no day's ET is lost.
+	balanced, err := ranOnDate(c.kvStore, BalanceDateKey, now)
+	if err != nil {
+		return Tag(SourceKV, SeverityCritical, err)
+	}
+	tempYesterday, precipYesterday, etYesterday, _, precipForecast := c.getConditions(ctx, now)
+	runtimes, balances, err := c.calculateRuntimes(tempYesterday, precipYesterday, etYesterday, precipForecast, now, balanced)
 	if err != nil {
 		return err
 	}
+	if !balanced {
+		c.appendToLedger(balances)
+		c.updateVWC(balances)
+		if err := c.kvStore.Set(BalanceDateKey, now.Format(dateFormat)); err != nil {
+			c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+		}
+	}
 
-	// Update VWC in those zones that will not be run.
-	c.updateVWCInNonRunZones(nonRunVWCs)
+	// The run is retried each loop, so it resumes once the forecast clears.
+	if reason := c.checkRainDelay(now); reason != "" {
+		log.Infof("Postponing run: %s", reason)
+		j, err := json.Marshal(&RainDelay{Time: now, Reason: reason})
+		if err == nil {
+			err = c.kvStore.Set(RainDelayKey, string(j))
+		}
+		if err != nil {
+			c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+		}
+		return nil
+	}
 
 	// Returns success only if ALL zones ran correctly. If not, runtimes and ran today will not
 	// be updated and run loop will attempt to re-run any remaining zones.
-	if err := c.runZones(runtimes); err != nil {
-		return err
+	if err := c.runZones(run, now, runtimes, balances); err != nil {
+		if ctx.Err() == nil && run.Context().Err() != nil {
+			log.Infof("Run was cancelled, will resume later.")
+			return nil
+		}
+		return Tag(SourceValve, SeverityCritical, err)
 	}
 
 	log.Infof("Writing runtimes.")
@@ -197,28 +305,39 @@ func (c *Controller) RunOnce(now time.Time) error {
 	log.Infof("Updating last run time.")
 	// This causes alreadyRan to be true for the next time the loop runs.
 	if err := c.kvStore.Set(LastRunDateKey, now.Format(dateFormat)); err != nil {
-		c.errorReporter.Report(err)
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
 	}
 
+	c.sendReport(now)
 	return nil
 }
 
+// sendReport sends the DailyReport for now to rparam.Reports, if set.
+func (c *Controller) sendReport(now time.Time) {
+	if c.rparam.Reports == nil {
+		return
+	}
+	r, err := NewDailyReport(now, c.systemConfig, c.ledger, c.dataLogger)
+	if err != nil {
+		c.errorReporter.Report(err)
+		return
+	}
+	c.rparam.Reports.Report(&ReportNotice{Report: r})
+}
+
 // getConditions repeatedly tries to get current and forecast conditions. If it is unsuccessful
 // it returns the most recent past conditions read from the data log. If data log can't be read,
-// it returns a "reasonable" value.
-func (c *Controller) getConditions(now time.Time) (tempY, precipY, tempT, precipT float64) {
+// it returns a "reasonable" value. etY is the measured reference ET for yesterday if the
+// ConditionsGetter reports one, or unknownET otherwise.
+func (c *Controller) getConditions(ctx context.Context, now time.Time) (tempY, precipY, etY, tempT, precipT float64) {
 	log.Infof("Getting conditions.")
 	iy, ty, py, err := c.conditionsGetter.GetYesterday(c.systemConfig.GlobalConfig.AirportCode)
-	for retries := 10; err != nil && retries > 0; retries-- {
-		time.Sleep(time.Minute)
+	for retries := c.rparam.ConditionsRetries; err != nil && retries > 0 && c.sleepBeforeRetry(ctx, err); retries-- {
 		iy, ty, py, err = c.conditionsGetter.GetYesterday(c.systemConfig.GlobalConfig.AirportCode)
-		if err != nil {
-			log.Error(err)
-		}
 	}
 	if err != nil {
 		// Can't get online conditions, use most recent available conditions.
-		c.errorReporter.Report(err)
+		c.errorReporter.Report(Tag(SourceWeather, SeverityWarning, err))
 		ty, py = c.dataLogger.ReadMostRecentConditions(now)
 	} else {
 		if err := c.dataLogger.WriteConditions(yesterday(now), iy, ty, py); err != nil {
@@ -226,14 +345,13 @@ func (c *Controller) getConditions(now time.Time) (tempY, precipY, tempT, precip
 		}
 	}
 	icf, tf, pf, ict, tt, pt, err := c.conditionsGetter.GetForecast(c.systemConfig.GlobalConfig.AirportCode)
-	for retries := 10; err != nil && retries > 0; retries-- {
-		time.Sleep(time.Minute)
+	for retries := c.rparam.ConditionsRetries; err != nil && retries > 0 && c.sleepBeforeRetry(ctx, err); retries-- {
 		icf, tf, pf, ict, tt, pt, err = c.conditionsGetter.GetForecast(c.systemConfig.GlobalConfig.AirportCode)
 	}
 	if err != nil {
 		// Can't get forecast, use yesterday's conditions.
 		icf, tf, pf = iy, ty, py
-		c.errorReporter.Report(err)
+		c.errorReporter.Report(Tag(SourceWeather, SeverityWarning, err))
 	} else {
 		if err := c.dataLogger.WriteConditions(now, icf, tf, pf); err != nil {
 			c.errorReporter.Report(err)
@@ -243,34 +361,108 @@ func (c *Controller) getConditions(now time.Time) (tempY, precipY, tempT, precip
 		}
 	}
 
+	ety := unknownET
+	if etcg, ok := c.conditionsGetter.(weather.ETConditionsGetter); ok {
+		et, err := etcg.GetYesterdayET(c.systemConfig.GlobalConfig.AirportCode)
+		switch {
+		case err == weather.ErrNotSupported:
+			// No provider reports ET, use the algorithm estimate.
+		case err != nil:
+			// Fall back to the algorithm estimate.
+			c.errorReporter.Report(Tag(SourceWeather, SeverityInfo, err))
+		default:
+			ety = et
+			log.Infof("Yesterday measured ET: %1.2f In", ety)
+		}
+	}
+
 	log.Infof("Yesterday: %s %3.1f degF / %1.1f In, Forecast: %s /  %3.1f degF / %1.1f In", iy, ty, py, icf, tf, pf)
-	return ty, py, tf, pf
+	return ty, py, ety, tf, pf
+}
+
+// checkRainDelay returns the reason to postpone a run at time now if the
+// hourly forecast has more than the configured rain within the lookahead, or
+// an empty string otherwise. If the forecast can't be read, the run is not
+// postponed.
+func (c *Controller) checkRainDelay(now time.Time) string {
+	gc := c.systemConfig.GlobalConfig
+	if gc.RainDelayLookaheadHours <= 0 {
+		return ""
+	}
+	hfg, ok := c.conditionsGetter.(weather.HourlyForecastGetter)
+	if !ok {
+		return ""
+	}
+	hp, err := hfg.GetHourlyPrecip(gc.AirportCode)
+	if err == weather.ErrNotSupported {
+		return ""
+	}
+	if err != nil {
+		c.errorReporter.Report(Tag(SourceWeather, SeverityWarning, err))
+		return ""
+	}
+
+	end := now.Add(time.Duration(gc.RainDelayLookaheadHours) * time.Hour)
+	precipIn := 0.0
+	for _, h := range hp {
+		// Include the current, partly elapsed hour.
+		if h.Time.Add(time.Hour).After(now) && h.Time.Before(end) {
+			precipIn += h.PrecipIn
+		}
+	}
+	log.Infof("Forecast rain in the next %d hours: %1.2f In", gc.RainDelayLookaheadHours, precipIn)
+	if precipIn < gc.RainDelayThresholdIn {
+		return ""
+	}
+	return fmt.Sprintf("%1.2f In of rain forecast in the next %d hours, threshold is %1.2f In", precipIn, gc.RainDelayLookaheadHours, gc.RainDelayThresholdIn)
+}
+
+// sleepBeforeRetry logs err and sleeps for the conditions retry interval. It
+// returns false if ctx was cancelled, and there should be no retry.
+func (c *Controller) sleepBeforeRetry(ctx context.Context, err error) bool {
+	log.Error(err)
+	return c.rparam.clock().Sleep(ctx, c.rparam.ConditionsRetryInterval) == nil
 }
 
-func (c *Controller) calculateRuntimes(tempYesterday, precipYesterday, precipForecast float64, now time.Time) (map[int]time.Duration, map[int]Pct, error) {
-	runtimes, vwc := make(map[int]time.Duration), make(map[int]Pct)
+// calculateRuntimes calculates the new VWC and the runtime for each zone. It returns the
+// runtimes for all zones and a ledger entry with the water balance for all zones. If
+// etYesterday is not unknownET and the algorithm supports it, the measured ET is used to
+// calculate VWC. If balanced, the water balance was already applied today, and the current
+// VWC is used unchanged.
+func (c *Controller) calculateRuntimes(tempYesterday, precipYesterday, etYesterday, precipForecast float64, now time.Time, balanced bool) (map[int]time.Duration, map[int]*LedgerEntry, error) {
+	runtimes, balances := make(map[int]time.Duration), make(map[int]*LedgerEntry)
 	for znum := 0; znum < c.systemConfig.NumZones(); znum++ {
 		z, ok := c.systemConfig.ZoneConfigs[znum]
 		if !ok {
 			// zone is not defined in the config.
 			continue
 		}
-		vWC, err := GetVWC(c.kvStore, znum)
-		if err != nil {
-			c.errorReporter.Report(err)
+		zs, err := c.zoneController.State(znum)
+		if err == nil && zs == Complete {
+			// The zone already ran today and its VWC was updated.
 			continue
 		}
-		newVWC, err := c.algorithm.CalculateVWC(Pct(vWC), tempYesterday, precipYesterday, now, z)
+		vWC, err := GetVWC(c.kvStore, znum)
 		if err != nil {
-			c.errorReporter.Report(err)
+			c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
 			continue
 		}
+		wb := &WaterBalance{StartVWC: Pct(vWC), EndVWC: Pct(vWC)}
+		if !balanced {
+			wb, err = calculateWaterBalance(c.algorithm, Pct(vWC), tempYesterday, etYesterday, precipYesterday, now, z)
+			if err != nil {
+				c.errorReporter.Report(err)
+				continue
+			}
+		}
+		newVWC := wb.EndVWC
+		balances[znum] = newBalanceEntry(now, znum, tempYesterday, precipYesterday, etYesterday, wb)
 		log.Infof("Zone %d VWC: %3.2f -> %3.2f", znum, vWC, newVWC)
 		// Check if VWC is below the threshold. If so, run the zone, otherwise
-		// just update it to new value.
+		// just update it to new value. A run interrupted today is finished, as
+		// the time it ran was credited and VWC may be above the threshold.
 		zrunTime := time.Duration(0)
-		if newVWC >= z.MinVWC {
-			vwc[znum] = newVWC
+		if newVWC >= z.MinVWC && !c.zoneController.interruptedOn(znum, now) {
 			log.Infof("Zone new VWC %.2f is above minimum of %.2f, don't run zone.", newVWC, z.MinVWC)
 		} else {
 			runDuration, err := c.algorithm.CalculateRuntime(newVWC, z.MaxVWC, precipForecast, z)
@@ -279,30 +471,49 @@ func (c *Controller) calculateRuntimes(tempYesterday, precipYesterday, precipFor
 				continue
 			}
 			zrunTime = time.Duration(float64(runDuration.Nanoseconds()) * z.RunTimeMultiplier)
-			log.Infof("Below minimum of %3.2f, run time is %2.0f mins x mult of %1.1f = %3.0f minutes.", z.MinVWC, runDuration.Minutes(), z.RunTimeMultiplier, zrunTime.Minutes())
+			log.Infof("Below minimum of %3.2f or interrupted, run time is %2.0f mins x mult of %1.1f = %3.0f minutes.", z.MinVWC, runDuration.Minutes(), z.RunTimeMultiplier, zrunTime.Minutes())
 		}
 		runtimes[znum] = zrunTime
 	}
 
-	return runtimes, vwc, nil
+	return runtimes, balances, nil
 }
 
-// updateVWCInNonRunZones updates the VWC for the zones in the map to the supplied values.
-func (c *Controller) updateVWCInNonRunZones(vwcs map[int]Pct) {
-	for z, vwc := range vwcs {
-		if err := SetVWC(c.kvStore,z , float64(vwc)); err != nil {
+// appendToLedger appends the entries to the ledger in zone order. Errors are
+// reported but don't stop the run.
+func (c *Controller) appendToLedger(entries map[int]*LedgerEntry) {
+	for znum := 0; znum < c.systemConfig.NumZones(); znum++ {
+		e, ok := entries[znum]
+		if !ok {
+			continue
+		}
+		if err := c.ledger.Append(e); err != nil {
 			c.errorReporter.Report(err)
 		}
 	}
 }
 
+// updateVWC updates the VWC for the zones in the map to the end VWC of their
+// water balance.
+func (c *Controller) updateVWC(balances map[int]*LedgerEntry) {
+	for z, b := range balances {
+		if err := SetVWC(c.kvStore, z, float64(b.EndVWC)); err != nil {
+			c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+		}
+	}
+}
+
 // runZones runs the zones for the amount of time in the provided runtimes map.
 // It stops any zones that are currently running, as this condition indicates a crash.
-// It updates the VWC to the max for each zone that was run. The zone must be 
-// in Idle state to be run. 
-func (c *Controller) runZones(runtimes map[int]time.Duration) error {
+// It updates the VWC to the max for each zone that was run. Zones with no
+// runtime are marked Complete without running. The zone must be
+// in Idle state to be run, or in Interrupted state, in which case its runtime
+// is from the VWC that was credited for the interrupted run. Each run is added
+// to the ledger, starting from the VWC in balances. If run is cancelled, the
+// time the zone ran is credited, and it stops and returns the ctx error.
+func (c *Controller) runZones(run *RunHandle, now time.Time, runtimes map[int]time.Duration, balances map[int]*LedgerEntry) error {
 	log.Infof("runZones with %d zones.", c.systemConfig.NumZones())
-	CommandRunning = true
+	ctx := run.Context()
 	for znum := 0; znum < c.systemConfig.NumZones(); znum++ {
 		runtime, ok := runtimes[znum]
 		if !ok {
@@ -317,7 +528,7 @@ func (c *Controller) runZones(runtimes map[int]time.Duration) error {
 
 		zs, err := c.zoneController.State(znum)
 		if err != nil {
-			c.errorReporter.Report(err)
+			c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
 			continue
 		}
 		log.Infof("Zone %d state is %s.", znum, zs)
@@ -326,38 +537,108 @@ func (c *Controller) runZones(runtimes map[int]time.Duration) error {
 			// This zone already ran and VWC was updated.
 			continue
 		}
-		dontRun := false
 		if zs == Running || zs == Unknown {
 			log.Errorf("Zone %d still Running, turning off", znum)
 			c.zoneController.TurnOff(znum)
 			// It's not known how long the zone was running, therefore just
 			// shut it off and don't run it any more today.
-			dontRun = true
+			c.completeWithoutRun(znum, balances)
+			continue
+		}
+		if runtime == 0 {
+			// The zone doesn't need water today.
+			c.completeWithoutRun(znum, balances)
 			continue
 		}
+		if zs == Interrupted {
+			log.Infof("Zone %d was interrupted after %s, running for the rest of its runtime.", znum, c.zoneController.RanBeforeInterrupt(znum))
+		}
 
-		if !dontRun {
-			err = c.zoneController.Run(znum, runtime, c.rparam.DontSleep)
-			if err != nil {
-				c.errorReporter.Report(err)
-				continue
-			}
+		run.SetZone(znum, runtime)
+		err = c.zoneController.Run(ctx, znum, runtime)
+		run.ClearZone()
+		if ctx.Err() != nil {
+			c.creditInterruptedRun(znum, now)
+			return err
+		}
+		if err != nil {
+			c.errorReporter.Report(Tag(SourceValve, SeverityCritical, err))
+			continue
 		}
 		if err := updateStateAndVWC(c.zoneController, c.kvStore, znum, float64(z.MaxVWC)); err != nil {
-			c.errorReporter.Report(err)
+			c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
 			continue
 		}
 		log.Infof("Set VWC to max %3.2f after run.", z.MaxVWC)
+		startVWC := Pct(0)
+		if b, ok := balances[znum]; ok {
+			startVWC = b.EndVWC
+		}
+		if err := c.ledger.Append(newIrrigationEntry(now, znum, runtime, startVWC, z.MaxVWC)); err != nil {
+			c.errorReporter.Report(err)
+		}
 	}
-	CommandRunning = false
 	return nil
 }
 
+// creditInterruptedRun increases the VWC of zone znum by the gain for the time
+// it ran before being interrupted that wasn't credited yet, and adds the run
+// to the ledger.
+func (c *Controller) creditInterruptedRun(znum int, now time.Time) {
+	ran, err := c.zoneController.TakeUncredited(znum)
+	if err != nil {
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+		return
+	}
+	z, ok := c.systemConfig.ZoneConfigs[znum]
+	if ran == 0 || !ok {
+		return
+	}
+	vwc, err := GetVWC(c.kvStore, znum)
+	if err != nil {
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+		return
+	}
+	gain, err := runVWCGain(c.algorithm, ran, z)
+	if err != nil {
+		c.errorReporter.Report(err)
+		return
+	}
+	e := newInterruptedEntry(now, znum, ran, Pct(vwc), gain, z.MaxVWC)
+	log.Infof("Zone %d ran for %s before it was interrupted, VWC %3.2f -> %3.2f.", znum, ran, vwc, e.EndVWC)
+	if err := SetVWC(c.kvStore, znum, float64(e.EndVWC)); err != nil {
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+		return
+	}
+	if err := c.ledger.Append(e); err != nil {
+		c.errorReporter.Report(err)
+	}
+}
+
+// completeWithoutRun marks zone znum Complete without running it, with the
+// VWC from its water balance in balances, if any.
+func (c *Controller) completeWithoutRun(znum int, balances map[int]*LedgerEntry) {
+	var err error
+	if b, ok := balances[znum]; ok {
+		err = updateStateAndVWC(c.zoneController, c.kvStore, znum, float64(b.EndVWC))
+	} else {
+		err = c.zoneController.SetState(znum, Complete)
+	}
+	if err != nil {
+		c.errorReporter.Report(Tag(SourceKV, SeverityWarning, err))
+	}
+}
+
 // checkIfRanToday reports whether the action was already run today.
 func checkIfRanToday(kv KVStore, now time.Time) (bool, error) {
-	lrStr, found, err := kv.Get(LastRunDateKey)
+	return ranOnDate(kv, LastRunDateKey, now)
+}
+
+// ranOnDate reports whether the date in key is the date of now.
+func ranOnDate(kv KVStore, key string, now time.Time) (bool, error) {
+	lrStr, found, err := kv.Get(key)
 	if err != nil {
-		return false, fmt.Errorf("kv.Get(LastRunDateKey): %s", err)
+		return false, fmt.Errorf("kv.Get(%s): %s", key, err)
 	}
 	if found {
 		lrTime, err := time.Parse(dateFormat, lrStr)
@@ -374,6 +655,9 @@ func checkIfRanToday(kv KVStore, now time.Time) (bool, error) {
 // readConfig reads the config.
 func readConfig(rparam *RunParams) (*SystemConfig, ETAlgorithm, error) {
 	config := rparam.Config
+	if config == "" && rparam.ConfigStore != nil {
+		return rparam.ConfigStore.Current()
+	}
 	if config == "" {
 		scb, err := ioutil.ReadFile(rparam.ConfigPath)
 		if err != nil {
@@ -387,15 +671,22 @@ func readConfig(rparam *RunParams) (*SystemConfig, ETAlgorithm, error) {
 		return nil, nil, fmt.Errorf("could not parse config file: %s\n\n%s", err, config)
 	}
 
-	var alg ETAlgorithm
+	alg, err := NewETAlgorithm(sc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sc, alg, nil
+}
+
+// NewETAlgorithm returns the ETAlgorithm that is configured in sc.
+func NewETAlgorithm(sc *SystemConfig) (ETAlgorithm, error) {
 	switch {
 	case sc.ETAlgorithmSimpleConfig != nil:
-		alg = NewETAlgorithmSimple(sc.ETAlgorithmSimpleConfig.EtPctMap)
-	default:
-		return nil, nil, fmt.Errorf("unable to create an alg without parameters")
+		return NewETAlgorithmSimple(sc.ETAlgorithmSimpleConfig.EtPctMap), nil
+	case sc.ETAlgorithmEToConfig != nil:
+		return NewETAlgorithmETo(sc.ETAlgorithmEToConfig.DefaultEtIn), nil
 	}
-
-	return sc, alg, nil
+	return nil, fmt.Errorf("unable to create an alg without parameters")
 }
 
 // updateStateAndVWC updates both the state of zone znum to Complete and the
@@ -1,11 +1,16 @@
 package control
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"irctl/server/control/weather"
 )
 
 func errToString(err error) string {
@@ -53,11 +58,11 @@ type TestConditionsGetter struct {
 	ForecastPrecipIn  float64
 }
 
-func (w *TestConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
-	return w.YesterdayIcon, w.YesterdayTempF, w.YesterdayPrecipIn, nil
+func (w *TestConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	return w.ForecastIcon, w.ForecastTempF, w.ForecastPrecipIn, w.ForecastIcon, w.ForecastTempF, w.ForecastPrecipIn, nil
 }
 func (w *TestConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
-	return w.ForecastIcon, w.ForecastTempF, w.ForecastPrecipIn, nil
+	return w.YesterdayIcon, w.YesterdayTempF, w.YesterdayPrecipIn, nil
 }
 
 type ValveOperation struct {
@@ -67,7 +72,7 @@ type ValveOperation struct {
 
 type TestValveController struct {
 	ops []ValveOperation
-	log TestLogger
+	log *TestLogger
 }
 
 func (t *TestValveController) OpenValve(n int) error {
@@ -219,10 +224,12 @@ func TestRunOnce(t *testing.T) {
   }
 }
 `
+	// The times are in January, so at 80 degF ET removes 10% x ZoneETRate 0.1 x
+	// growth factor 0.5 = 0.5% VWC.
 	tests := []struct {
 		desc                  string
 		timeStr               string
-		condGetter            ConditionsGetter
+		condGetter            weather.ConditionsGetter
 		startVWC              []float64
 		startState            []ZoneState
 		wantDidRun            bool
@@ -251,7 +258,7 @@ func TestRunOnce(t *testing.T) {
 			startVWC:      []float64{10, 15},
 			startState:    []ZoneState{Idle, Idle},
 			wantDidRun:    true,
-			wantEndVWC:    []float64{20, 10},
+			wantEndVWC:    []float64{20, 14.5},
 			wantEndState:  []ZoneState{Complete, Complete},
 			wantValvesRan: []bool{true, false},
 		},
@@ -273,7 +280,7 @@ func TestRunOnce(t *testing.T) {
 			startVWC:              []float64{10, 15},
 			startState:            []ZoneState{Idle, Running},
 			wantDidRun:            true,
-			wantEndVWC:            []float64{20, 10},
+			wantEndVWC:            []float64{20, 14.5},
 			wantEndState:          []ZoneState{Complete, Complete},
 			wantValvesRan:         []bool{true, false},
 			wantValveControlError: `valve 1 was closed before it was opened`,
@@ -282,18 +289,25 @@ func TestRunOnce(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
+			dataLogPath, err := ioutil.TempDir("", "irctl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dataLogPath)
+
 			kv := NewTestKVStore()
 			er := &TestErrorReporter{}
 			log := &TestLogger{}
-			tcg := &TestConditionsGetter{"test", 80, 0, "test", 80, 0}
 			tvc := &TestValveController{log: log}
-			zc := *NewZoneController(tvc, kv, log)
+			clock := NewFakeClock(time.Time{})
+			zc := *NewZoneController(tvc, kv, clock)
 			now, _ := time.Parse("3:04pm", tt.timeStr)
 
-			kv.Set(LastZoneResetDateKey, now.Format(dateFormat))
 			setState(zc, tt.startVWC, tt.startState)
 
-			didRun, err := RunOnce(&RunParams{Config: testConfig, LogLevel: Debug, DontSleep: true}, kv, tcg, zc, er, log, now)
+			rparam := &RunParams{Config: testConfig, DataLogPath: dataLogPath, Clock: clock}
+			err = NewController(rparam, kv, tt.condGetter, zc, er).RunOnce(context.Background(), now)
+			_, didRun, _ := kv.Get(LastRunDateKey)
 			t.Log(tt.desc + "\n" + log.Contents())
 
 			if got, want := didRun, tt.wantDidRun; got != want {
@@ -338,3 +352,347 @@ func TestRunOnce(t *testing.T) {
 		})
 	}
 }
+
+type TestETConditionsGetter struct {
+	TestConditionsGetter
+	YesterdayETIn float64
+}
+
+func (w *TestETConditionsGetter) GetYesterdayET(airportCode string) (etIn float64, err error) {
+	return w.YesterdayETIn, nil
+}
+
+func TestRunOnceMeasuredET(t *testing.T) {
+	testConfig := `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.02
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1.0,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+	tests := []struct {
+		desc        string
+		condGetter  weather.ConditionsGetter
+		wantRuntime float64
+	}{
+		{
+			desc:        "measured ET",
+			condGetter:  &TestETConditionsGetter{TestConditionsGetter{"test", 80, 0, "test", 80, 0}, 0.1},
+			wantRuntime: 7,
+		},
+		{
+			desc:        "default ET",
+			condGetter:  &TestConditionsGetter{"test", 80, 0, "test", 80, 0},
+			wantRuntime: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			dataLogPath, err := ioutil.TempDir("", "irctl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dataLogPath)
+
+			kv := NewTestKVStore()
+			tvc := &TestValveController{log: &TestLogger{}}
+			clock := NewFakeClock(time.Time{})
+			zc := *NewZoneController(tvc, kv, clock)
+			setState(zc, []float64{15}, []ZoneState{Idle})
+			now, _ := time.Parse("3:04pm", "10:00am")
+
+			reports := &recordingReporter{}
+			rparam := &RunParams{Config: testConfig, DataLogPath: dataLogPath, Clock: clock, Reports: reports}
+			if err := NewController(rparam, kv, tt.condGetter, zc, &TestErrorReporter{}).RunOnce(context.Background(), now); err != nil {
+				t.Fatal(err)
+			}
+
+			rts, errs := NewDataLogger(dataLogPath).ReadRuntimes(now, now)
+			if errs != nil {
+				t.Fatal(errs)
+			}
+			if got, want := rts[0].Runtimes[0], tt.wantRuntime; got != want {
+				t.Errorf("%s: got runtime %.1f, want %.1f", tt.desc, got, want)
+			}
+			if len(reports.errs) != 1 {
+				t.Fatalf("%s: got reports %v, want 1", tt.desc, reports.errs)
+			}
+			if n, ok := reports.errs[0].(*ReportNotice); !ok || n.Report.Zones[0].RuntimeMins != tt.wantRuntime {
+				t.Errorf("%s: got report %v, want zone 0 runtime %.1f", tt.desc, reports.errs[0], tt.wantRuntime)
+			}
+		})
+	}
+}
+
+type TestHourlyConditionsGetter struct {
+	TestConditionsGetter
+	Hourly []*weather.HourlyPrecip
+}
+
+func (w *TestHourlyConditionsGetter) GetHourlyPrecip(airportCode string) ([]*weather.HourlyPrecip, error) {
+	return w.Hourly, nil
+}
+
+func TestRunOnceRainDelay(t *testing.T) {
+	testConfig := `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z",
+    "RainDelayLookaheadHours": 6,
+    "RainDelayThresholdIn": 0.1
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1.0,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+	now, _ := time.Parse("3:04pm", "10:30am")
+	hour := now.Truncate(time.Hour)
+	// rainAt returns an hourly forecast with precipIn at each of the hours
+	// from the current hour.
+	rainAt := func(precipIn float64, hours ...int) []*weather.HourlyPrecip {
+		var out []*weather.HourlyPrecip
+		for h := -2; h < 24; h++ {
+			p := 0.0
+			for _, rh := range hours {
+				if h == rh {
+					p = precipIn
+				}
+			}
+			out = append(out, &weather.HourlyPrecip{Time: hour.Add(time.Duration(h) * time.Hour), PrecipIn: p})
+		}
+		return out
+	}
+
+	tests := []struct {
+		desc      string
+		hourly    []*weather.HourlyPrecip
+		wantDelay bool
+	}{
+		{
+			desc:      "rain in current hour",
+			hourly:    rainAt(0.2, 0),
+			wantDelay: true,
+		},
+		{
+			desc:      "rain adds up within lookahead",
+			hourly:    rainAt(0.05, 2, 5),
+			wantDelay: true,
+		},
+		{
+			desc:   "rain in the past",
+			hourly: rainAt(0.5, -2, -1),
+		},
+		{
+			desc:   "rain after lookahead",
+			hourly: rainAt(0.5, 7, 8),
+		},
+		{
+			desc:   "rain below threshold",
+			hourly: rainAt(0.05, 3),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			dataLogPath, err := ioutil.TempDir("", "irctl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dataLogPath)
+
+			kv := NewTestKVStore()
+			tvc := &TestValveController{log: &TestLogger{}}
+			clock := NewFakeClock(time.Time{})
+			zc := *NewZoneController(tvc, kv, clock)
+			setState(zc, []float64{15}, []ZoneState{Idle})
+			cg := &TestHourlyConditionsGetter{TestConditionsGetter{"test", 80, 0, "test", 80, 0}, tt.hourly}
+
+			rparam := &RunParams{Config: testConfig, DataLogPath: dataLogPath, Clock: clock}
+			c := NewController(rparam, kv, cg, zc, &TestErrorReporter{})
+			if err := c.RunOnce(context.Background(), now); err != nil {
+				t.Fatal(err)
+			}
+
+			_, ran, _ := kv.Get(LastRunDateKey)
+			if ran == tt.wantDelay {
+				t.Errorf("%s: got ran %t, want %t", tt.desc, ran, !tt.wantDelay)
+			}
+			_, delayed, _ := kv.Get(RainDelayKey)
+			if delayed != tt.wantDelay {
+				t.Errorf("%s: got RainDelay set %t, want %t", tt.desc, delayed, tt.wantDelay)
+			}
+			if !tt.wantDelay {
+				return
+			}
+			// The day's ET is removed even though the run is postponed.
+			if vwc, _ := GetVWC(kv, 0); vwc != 5 {
+				t.Errorf("%s: got VWC %.1f while postponed, want 5", tt.desc, vwc)
+			}
+
+			// The run resumes when the forecast clears, without removing the
+			// day's ET again.
+			cg.Hourly = rainAt(0.0)
+			if err := c.RunOnce(context.Background(), now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if _, ran, _ := kv.Get(LastRunDateKey); !ran {
+				t.Errorf("%s: got not ran after forecast cleared, want ran", tt.desc)
+			}
+			es, err := NewLedger(dataLogPath).Read(0, now, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(es) != 2 || es[0].Kind != BalanceEntry || es[1].Kind != IrrigationEntry || es[1].StartVWC != 5 {
+				t.Errorf("%s: got ledger %v, want one balance and an irrigation from VWC 5", tt.desc, es)
+			}
+		})
+	}
+}
+
+// interruptedTestConfig is a config with one zone that takes 1 minute to
+// gain 2% VWC.
+const interruptedTestConfig = `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1.0,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+
+func TestRunOnceInterrupted(t *testing.T) {
+	dataLogPath, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataLogPath)
+
+	now := time.Date(2019, 3, 17, 10, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := &cancellingClock{FakeClock: NewFakeClock(now), after: 3 * time.Minute, cancel: cancel}
+	kv := NewTestKVStore()
+	zc := NewZoneController(&TestValveController{log: &TestLogger{}}, kv, clock)
+	setState(*zc, []float64{16}, []ZoneState{Idle})
+	rparam := &RunParams{Config: interruptedTestConfig, DataLogPath: dataLogPath, Clock: clock}
+	c := NewController(rparam, kv, &TestConditionsGetter{"test", 80, 0, "test", 80, 0}, *zc, &TestErrorReporter{})
+
+	// ET takes VWC to 6, for a 7 minute run that is interrupted after 3
+	// minutes, adding 6.
+	if err := c.RunOnce(ctx, now); err == nil {
+		t.Fatalf("got nil error for interrupted run")
+	}
+	if vwc, _ := GetVWC(kv, 0); vwc != 12 {
+		t.Errorf("got VWC %.1f after interrupted run, want 12", vwc)
+	}
+
+	// The rest of the run is from the credited VWC.
+	clock.cancel = nil
+	if err := c.RunOnce(context.Background(), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewLedger(dataLogPath).Read(0, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		kind             LedgerKind
+		runtime          time.Duration
+		startVWC, endVWC Pct
+	}{
+		{BalanceEntry, 0, 16, 6},
+		{InterruptedEntry, 3 * time.Minute, 6, 12},
+		{IrrigationEntry, 4 * time.Minute, 12, 20},
+	}
+	if len(es) != len(want) {
+		for _, e := range es {
+			t.Logf("%+v", *e)
+		}
+		t.Fatalf("got %d ledger entries, want %d", len(es), len(want))
+	}
+	for i, w := range want {
+		if e := es[i]; e.Kind != w.kind || e.Runtime != w.runtime || e.StartVWC != w.startVWC || e.EndVWC != w.endVWC {
+			t.Errorf("entry %d: got %s %s %.1f -> %.1f, want %s %s %.1f -> %.1f", i, e.Kind, e.Runtime, e.StartVWC, e.EndVWC, w.kind, w.runtime, w.startVWC, w.endVWC)
+		}
+	}
+}
+
+func TestRunOnceStaleInterrupted(t *testing.T) {
+	dataLogPath, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataLogPath)
+
+	now := time.Date(2019, 3, 17, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	kv := NewTestKVStore()
+	zc := NewZoneController(&TestValveController{log: &TestLogger{}}, kv, clock)
+	setState(*zc, []float64{20}, []ZoneState{Interrupted})
+	if err := zc.setInterruptedRun(0, &InterruptedRun{Time: now.AddDate(0, 0, -1), Ran: 3 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	rparam := &RunParams{Config: interruptedTestConfig, DataLogPath: dataLogPath, Clock: clock}
+	c := NewController(rparam, kv, &TestConditionsGetter{"test", 80, 0, "test", 80, 0}, *zc, &TestErrorReporter{})
+
+	// ET takes VWC to 10, which is not below the minimum, so the run that was
+	// interrupted yesterday is not resumed.
+	if err := c.RunOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewLedger(dataLogPath).Read(0, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].Kind != BalanceEntry {
+		t.Errorf("got ledger %v, want only a balance", es)
+	}
+	if s, err := zc.State(0); err != nil || s != Complete {
+		t.Errorf("got state %s / %v, want %s", s, err, Complete)
+	}
+}
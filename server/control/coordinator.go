@@ -0,0 +1,190 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RunSource is what requested a run.
+type RunSource string
+
+const (
+	// AutoRun is a run by the control loop.
+	AutoRun RunSource = "Auto"
+	// ManualRun is a run requested by a user.
+	ManualRun RunSource = "Manual"
+)
+
+// RunPolicy is what RunCoordinator#Acquire does when another run has the
+// valves.
+type RunPolicy int
+
+const (
+	// Reject returns ErrBusy.
+	Reject RunPolicy = iota
+	// Queue waits until the valves are released, or the ctx is done.
+	Queue
+)
+
+// ErrBusy is returned by Acquire with the Reject policy when another run has
+// the valves.
+var ErrBusy = errors.New("another manual or auto run is currently in progress")
+
+// ActiveRun is a snapshot of the run that has the valves.
+type ActiveRun struct {
+	ID      int64
+	Source  RunSource
+	Started time.Time
+	// Zone is the zone that is running, or -1 if no zone is running.
+	Zone int
+	// Until is when the running zone is expected to stop.
+	Until time.Time
+}
+
+// RunCoordinator owns exclusive access to the valves. Anything that can open a
+// valve or change VWC must first Acquire a RunHandle and Release it when done.
+type RunCoordinator struct {
+	clock Clock
+	// sem has a value while a run has the valves.
+	sem chan struct{}
+
+	mu     sync.Mutex
+	nextID int64
+	active *RunHandle
+}
+
+// NewRunCoordinator returns a ptr to an initialized RunCoordinator, which uses
+// clock to time runs.
+func NewRunCoordinator(clock Clock) *RunCoordinator {
+	return &RunCoordinator{
+		clock: clock,
+		sem:   make(chan struct{}, 1),
+	}
+}
+
+// RunHandle is a handle for exclusive access to the valves, returned by Acquire.
+type RunHandle struct {
+	ID     int64
+	Source RunSource
+	ctx    context.Context
+	cancel context.CancelFunc
+	rc     *RunCoordinator
+
+	// The fields below are protected by rc.mu.
+	started  time.Time
+	zone     int
+	until    time.Time
+	released bool
+}
+
+// Acquire returns a RunHandle with exclusive access to the valves for source. If
+// another run has the valves, it returns ErrBusy or waits depending on policy.
+// The RunHandle context is derived from ctx.
+func (rc *RunCoordinator) Acquire(ctx context.Context, source RunSource, policy RunPolicy) (*RunHandle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch policy {
+	case Queue:
+		select {
+		case rc.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	default:
+		select {
+		case rc.sem <- struct{}{}:
+		default:
+			return nil, ErrBusy
+		}
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.nextID++
+	r := &RunHandle{
+		ID:      rc.nextID,
+		Source:  source,
+		ctx:     rctx,
+		cancel:  cancel,
+		rc:      rc,
+		started: rc.clock.Now(),
+		zone:    -1,
+	}
+	rc.active = r
+	return r, nil
+}
+
+// Active returns a snapshot of the run that has the valves, or nil if there is
+// none.
+func (rc *RunCoordinator) Active() *ActiveRun {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	r := rc.active
+	if r == nil {
+		return nil
+	}
+	return &ActiveRun{
+		ID:      r.ID,
+		Source:  r.Source,
+		Started: r.started,
+		Zone:    r.zone,
+		Until:   r.until,
+	}
+}
+
+// Busy reports whether a run has the valves.
+func (rc *RunCoordinator) Busy() bool {
+	return rc.Active() != nil
+}
+
+// Cancel cancels the context of the run with the given ID if it has the
+// valves, and reports whether it did. The run still has the valves until its
+// owner stops and releases it.
+func (rc *RunCoordinator) Cancel(id int64) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.active == nil || rc.active.ID != id {
+		return false
+	}
+	rc.active.cancel()
+	return true
+}
+
+// Context returns the context of r, which is done when r is cancelled or
+// released.
+func (r *RunHandle) Context() context.Context {
+	return r.ctx
+}
+
+// SetZone records that zone n is running for duration d.
+func (r *RunHandle) SetZone(n int, d time.Duration) {
+	r.rc.mu.Lock()
+	defer r.rc.mu.Unlock()
+	r.zone, r.until = n, r.rc.clock.Now().Add(d)
+}
+
+// ClearZone records that no zone is running.
+func (r *RunHandle) ClearZone() {
+	r.rc.mu.Lock()
+	defer r.rc.mu.Unlock()
+	r.zone, r.until = -1, time.Time{}
+}
+
+// Release gives up access to the valves and cancels the context of r. It is
+// safe to call more than once.
+func (r *RunHandle) Release() {
+	r.rc.mu.Lock()
+	if r.released {
+		r.rc.mu.Unlock()
+		return
+	}
+	r.released = true
+	r.cancel()
+	r.rc.active = nil
+	r.rc.mu.Unlock()
+	<-r.rc.sem
+}
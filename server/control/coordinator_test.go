@@ -0,0 +1,218 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunCoordinatorReject(t *testing.T) {
+	start := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	rc := NewRunCoordinator(NewFakeClock(start))
+	if rc.Active() != nil {
+		t.Fatalf("Active: got %+v, want nil", rc.Active())
+	}
+	run, err := rc.Acquire(context.Background(), AutoRun, Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Acquire(context.Background(), ManualRun, Reject); err != ErrBusy {
+		t.Errorf("second Acquire: got error %v, want %v", err, ErrBusy)
+	}
+
+	run.SetZone(2, 10*time.Minute)
+	a := rc.Active()
+	if a == nil || a.ID != run.ID || a.Source != AutoRun || a.Zone != 2 || !a.Until.Equal(start.Add(10*time.Minute)) {
+		t.Errorf("Active: got %+v, want zone 2 until %s", a, start.Add(10*time.Minute))
+	}
+	run.ClearZone()
+	if a := rc.Active(); a.Zone != -1 {
+		t.Errorf("Active after ClearZone: got zone %d, want -1", a.Zone)
+	}
+
+	run.Release()
+	run.Release()
+	if run.Context().Err() == nil {
+		t.Errorf("Context after Release: got no error, want cancelled")
+	}
+	if rc.Busy() {
+		t.Errorf("Busy after Release: got true, want false")
+	}
+	run, err = rc.Acquire(context.Background(), ManualRun, Reject)
+	if err != nil {
+		t.Fatalf("Acquire after Release: %s", err)
+	}
+	run.Release()
+}
+
+func TestRunCoordinatorQueue(t *testing.T) {
+	rc := NewRunCoordinator(NewFakeClock(time.Time{}))
+	run, err := rc.Acquire(context.Background(), AutoRun, Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rc.Acquire(ctx, ManualRun, Queue); err != context.Canceled {
+		t.Errorf("Acquire with cancelled ctx: got error %v, want %v", err, context.Canceled)
+	}
+
+	got := make(chan *RunHandle)
+	go func() {
+		r, err := rc.Acquire(context.Background(), ManualRun, Queue)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- r
+	}()
+	select {
+	case <-got:
+		t.Fatalf("queued Acquire returned before Release")
+	case <-time.After(10 * time.Millisecond):
+	}
+	run.Release()
+	queued := <-got
+	if a := rc.Active(); a == nil || a.ID != queued.ID || a.Source != ManualRun {
+		t.Errorf("Active: got %+v, want the queued manual run", a)
+	}
+	queued.Release()
+}
+
+func TestRunCoordinatorCancel(t *testing.T) {
+	rc := NewRunCoordinator(NewFakeClock(time.Time{}))
+	run, err := rc.Acquire(context.Background(), ManualRun, Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Cancel(run.ID + 1) {
+		t.Errorf("Cancel with other ID: got true, want false")
+	}
+	if !rc.Cancel(run.ID) || run.Context().Err() == nil {
+		t.Errorf("Cancel: want run context cancelled")
+	}
+	// A cancelled run keeps the valves until it is released.
+	if !rc.Busy() {
+		t.Errorf("Busy after Cancel: got false, want true")
+	}
+	run.Release()
+	if rc.Cancel(run.ID) {
+		t.Errorf("Cancel after Release: got true, want false")
+	}
+}
+
+// exclusiveValveController is a ValveController that fails the test if it is
+// used without the valves, and races under the race detector if two runs use
+// it at the same time.
+type exclusiveValveController struct {
+	t    *testing.T
+	rc   *RunCoordinator
+	open map[int]bool
+}
+
+func (vc *exclusiveValveController) check(op string) {
+	if !vc.rc.Busy() {
+		vc.t.Errorf("%s without the valves", op)
+	}
+}
+
+func (vc *exclusiveValveController) OpenValve(n int) error {
+	vc.check("OpenValve")
+	vc.open[n] = true
+	return nil
+}
+
+func (vc *exclusiveValveController) CloseValve(n int) error {
+	vc.check("CloseValve")
+	delete(vc.open, n)
+	return nil
+}
+
+func (vc *exclusiveValveController) CloseAllValves() error {
+	vc.check("CloseAllValves")
+	vc.open = make(map[int]bool)
+	return nil
+}
+
+func (vc *exclusiveValveController) NumValves() int {
+	return 8
+}
+
+func TestRunCoordinatorConcurrent(t *testing.T) {
+	config := `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+	// Before the run time, so that RunOnce only closes all valves and reads
+	// the config.
+	clock := NewFakeClock(time.Date(2019, 3, 17, 8, 0, 0, 0, time.UTC))
+	rc := NewRunCoordinator(clock)
+	vc := &exclusiveValveController{t: t, rc: rc, open: make(map[int]bool)}
+	kv := NewTestKVStore()
+	zc := NewZoneController(vc, kv, clock)
+	rparam := &RunParams{Config: config, DataLogPath: "./testdata", Clock: clock, Coordinator: rc}
+	ctrl := NewController(rparam, kv, &TestConditionsGetter{}, *zc, &TestErrorReporter{})
+
+	const loops = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < loops; i++ {
+			if err := ctrl.RunOnce(context.Background(), clock.Now()); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for m := 0; m < 4; m++ {
+		policy := Reject
+		if m%2 == 0 {
+			policy = Queue
+		}
+		wg.Add(1)
+		go func(num int, policy RunPolicy) {
+			defer wg.Done()
+			for i := 0; i < loops; i++ {
+				run, err := rc.Acquire(context.Background(), ManualRun, policy)
+				if err == ErrBusy {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				run.SetZone(num, time.Minute)
+				vc.OpenValve(num)
+				if a := rc.Active(); a.ID != run.ID || a.Zone != num {
+					t.Errorf("Active: got %+v, want run %d in zone %d", a, run.ID, num)
+				}
+				vc.CloseValve(num)
+				run.Release()
+			}
+		}(m, policy)
+	}
+	wg.Wait()
+	if rc.Busy() {
+		t.Errorf("Busy after all runs: got true, want false")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"time"
 
+	"irctl/server/control/weather"
+
 	log "github.com/golang/glog"
 )
 
@@ -109,6 +111,51 @@ func (l *DataLogger) ReadMostRecentConditions(t time.Time) (temp, precip float64
 	return c.Temp, c.Precip
 }
 
+// BackfillConditions fills in conditions for any days in the date range
+// "from"-"to" that have no conditions entry, using the past conditions from hg
+// for airportCode. Existing entries are not modified. It returns the number of
+// days that were written.
+func (l *DataLogger) BackfillConditions(hg weather.HistoricalConditionsGetter, airportCode string, from, to time.Time) (int, error) {
+	log.Infof("BackfillConditions: %s to %s", dateStr(from), dateStr(to))
+	var missing []time.Time
+	after := dateOnly(to.AddDate(0, 0, 1))
+	for d := dateOnly(from); d.Before(after); d = d.AddDate(0, 0, 1) {
+		if _, err := l.readConditionsOneDay(d); err != nil {
+			missing = append(missing, d)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	// Fetch only the span that has gaps, in one request.
+	days, err := hg.GetHistory(airportCode, missing[0], missing[len(missing)-1])
+	if err != nil {
+		return 0, err
+	}
+	isMissing := make(map[time.Time]bool)
+	for _, d := range missing {
+		isMissing[d] = true
+	}
+
+	n := 0
+	var errs Errors
+	for _, dc := range days {
+		if !isMissing[dateOnly(dc.Date)] {
+			continue
+		}
+		if err := l.WriteConditions(dc.Date, dc.Icon, dc.TempF, dc.PrecipIn); err != nil {
+			errs = AppendErr(errs, err)
+			continue
+		}
+		n++
+	}
+	if errs != nil {
+		return n, errs
+	}
+	return n, nil
+}
+
 // readConditionsOneDay reads conditions for one day with the date in t.
 func (l *DataLogger) readConditionsOneDay(t time.Time) (*ConditionsEntry, error) {
 	log.Infof("readConditionsOneDay: %s", dateStr(t))
@@ -133,11 +180,14 @@ func (l *DataLogger) conditionsFilePath(t time.Time) string {
 type RuntimesEntry struct {
 	Date     time.Time
 	Runtimes []float64
+	// ManualRuntimes are the total minutes that each zone was run manually.
+	ManualRuntimes []float64 `json:",omitempty"`
 }
 
 // WriteRuntimes writes the given runtimes to a file that is determined by
 // the logger root and the date portion of Time t,
 //  e.g. ../data/conditions/2017/12/26.log
+// Any manual runtimes already logged for the day are kept.
 func (l *DataLogger) WriteRuntimes(t time.Time, numZones int, runtimesMap map[int]time.Duration) error {
 	fp := l.runtimesFilePath(t)
 	if err := createDirIfMissing(fp); err != nil {
@@ -152,7 +202,11 @@ func (l *DataLogger) WriteRuntimes(t time.Time, numZones int, runtimesMap map[in
 		}
 	}
 
-	j, err := json.Marshal(RuntimesEntry{dateOnly(t), runtimes})
+	re := &RuntimesEntry{Date: dateOnly(t), Runtimes: runtimes}
+	if prev, err := l.readRuntimesOneDay(t); err == nil {
+		re.ManualRuntimes = prev.ManualRuntimes
+	}
+	j, err := json.Marshal(re)
 	if err != nil {
 		return err
 	}
@@ -163,6 +217,37 @@ func (l *DataLogger) WriteRuntimes(t time.Time, numZones int, runtimesMap map[in
 	return nil
 }
 
+// AddManualRuntime adds runtime to the manual runtime of zone znum in the
+// runtimes log for the date in t.
+func (l *DataLogger) AddManualRuntime(t time.Time, numZones, znum int, runtime time.Duration) error {
+	fp := l.runtimesFilePath(t)
+	if err := createDirIfMissing(fp); err != nil {
+		return err
+	}
+	re, err := l.readRuntimesOneDay(t)
+	if err != nil {
+		re = &RuntimesEntry{Date: dateOnly(t), Runtimes: make([]float64, numZones)}
+	}
+	n := numZones
+	if znum >= n {
+		n = znum + 1
+	}
+	if len(re.ManualRuntimes) < n {
+		re.ManualRuntimes = append(re.ManualRuntimes, make([]float64, n-len(re.ManualRuntimes))...)
+	}
+	re.ManualRuntimes[znum] += runtime.Minutes()
+
+	j, err := json.Marshal(re)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fp, j, 0644); err != nil {
+		return err
+	}
+	log.Infof("AddManualRuntime for %s : %s", dateOnly(t), string(j))
+	return nil
+}
+
 // ReadRuntimes reads runtimes from files that is determined by the logger
 // root and the date portions of the date range "from"-"to". Any entries that
 // cannot be read result in errors being appended to the returned Errors.
@@ -3,13 +3,14 @@ package control
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
 	"reflect"
 	"testing"
 	"time"
-)
 
-const (
-	testPath = "../temp"
+	"irctl/server/control/weather"
 )
 
 func TestConditions(t *testing.T) {
@@ -28,8 +29,12 @@ func TestConditions(t *testing.T) {
 		},
 	}
 
-	log := &TestLogger{}
-	l := NewDataLogger(log, testPath)
+	testPath, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testPath)
+	l := NewDataLogger(testPath)
 
 	for _, c := range want {
 		if err := l.WriteConditions(c.Date, c.Icon, c.Temp, c.Precip); err != nil {
@@ -56,15 +61,23 @@ func TestConditions(t *testing.T) {
 
 func TestRuntimes(t *testing.T) {
 	want := []*RuntimesEntry{
-		{time.Date(1, 2, 3, 0, 0, 0, 0, time.UTC), []float64{1.0, 2.0, 3.0, 4.0}},
-		{time.Date(1, 2, 4, 0, 0, 0, 0, time.UTC), []float64{1.1, 2.1, 3.1, 4.1}},
+		{Date: time.Date(1, 2, 3, 0, 0, 0, 0, time.UTC), Runtimes: []float64{1.0, 2.0, 3.0, 4.0}},
+		{Date: time.Date(1, 2, 4, 0, 0, 0, 0, time.UTC), Runtimes: []float64{1.1, 2.1, 3.1, 4.1}},
 	}
 
-	log := &TestLogger{}
-	l := NewDataLogger(log, testPath)
+	testPath, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testPath)
+	l := NewDataLogger(testPath)
 
 	for _, r := range want {
-		if err := l.WriteRuntimes(r.Date, r.Runtimes); err != nil {
+		runtimes := make(map[int]time.Duration)
+		for z, rt := range r.Runtimes {
+			runtimes[z] = time.Duration(math.Round(rt * float64(time.Minute)))
+		}
+		if err := l.WriteRuntimes(r.Date, len(r.Runtimes), runtimes); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -85,3 +98,69 @@ func TestRuntimes(t *testing.T) {
 
 	fmt.Println(string(j))
 }
+
+type TestHistoricalConditionsGetter struct {
+	days       []*weather.DailyConditions
+	from, to   time.Time
+	numQueries int
+}
+
+func (g *TestHistoricalConditionsGetter) GetHistory(airportCode string, from, to time.Time) ([]*weather.DailyConditions, error) {
+	g.from, g.to = from, to
+	g.numQueries++
+	var out []*weather.DailyConditions
+	for _, d := range g.days {
+		if !d.Date.Before(from) && !d.Date.After(to) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func TestBackfillConditions(t *testing.T) {
+	testPath, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testPath)
+	l := NewDataLogger(testPath)
+
+	day := func(d int) time.Time { return time.Date(2019, 3, d, 0, 0, 0, 0, time.UTC) }
+	// Days 1 and 4 already exist, 2 and 3 are missing.
+	for _, d := range []int{1, 4} {
+		if err := l.WriteConditions(day(d), "existing", 50, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hg := &TestHistoricalConditionsGetter{}
+	for d := 1; d <= 4; d++ {
+		hg.days = append(hg.days, &weather.DailyConditions{Date: day(d), Icon: "archive", TempF: float64(60 + d), PrecipIn: 0.1})
+	}
+
+	n, err := l.BackfillConditions(hg, "KSJC", day(1), day(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d days backfilled, want 2", n)
+	}
+	if !hg.from.Equal(day(2)) || !hg.to.Equal(day(3)) {
+		t.Errorf("got query range %s-%s, want %s-%s", hg.from, hg.to, day(2), day(3))
+	}
+
+	got, errs := l.ReadConditions(day(1), day(4))
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	wantIcons := []string{"existing", "archive", "archive", "existing"}
+	for i, c := range got {
+		if c.Icon != wantIcons[i] {
+			t.Errorf("day %d: got icon %s, want %s", i+1, c.Icon, wantIcons[i])
+		}
+	}
+
+	// Nothing is missing now, so the getter is not queried again.
+	if n, err := l.BackfillConditions(hg, "KSJC", day(1), day(4)); err != nil || n != 0 || hg.numQueries != 1 {
+		t.Errorf("got %d days backfilled, error %v, %d queries, want 0, nil, 1", n, err, hg.numQueries)
+	}
+}
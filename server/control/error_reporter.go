@@ -1,8 +1,14 @@
 package control
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"mime"
+	"net"
 	"net/smtp"
+	"strings"
+	"time"
 
 	log "github.com/golang/glog"
 )
@@ -13,6 +19,9 @@ type ErrorReporter interface {
 	Report(err error) error
 }
 
+// mimeBoundary separates the text and HTML parts of a message.
+const mimeBoundary = "irctl-alternative-boundary"
+
 // SMTPErrorReporter is an ErrorReporter that uses SMTP.
 type SMTPErrorReporter struct {
 	sMTPServerAddr string
@@ -21,6 +30,8 @@ type SMTPErrorReporter struct {
 	recipientAddr  string
 	userName       string
 	password       string
+	// timeout is the time to connect and send a message.
+	timeout time.Duration
 }
 
 // NewSMTPErrorReporter returns a ptr to an intialized SMTPErrorReporter.
@@ -32,24 +43,103 @@ func NewSMTPErrorReporter(sMTPServerAddr string, sMTPServerPort uint, senderAddr
 		recipientAddr:  recipientAddr,
 		userName:       userName,
 		password:       password,
+		timeout:        notifyTimeout,
 	}
 }
 
 // Report implements ErrorReporter#Report.
 func (er *SMTPErrorReporter) Report(sendErr error) error {
 	log.Error(sendErr)
-	auth := smtp.PlainAuth("", er.userName, er.password, er.sMTPServerAddr)
 	addrPort := er.sMTPServerAddr + ":" + fmt.Sprint(er.sMTPServerPort)
+	// Servers without AUTH e.g. a local relay don't need a user name.
+	var auth smtp.Auth
+	if er.userName != "" {
+		auth = smtp.PlainAuth("", er.userName, er.password, er.sMTPServerAddr)
+	}
 
 	log.Infof("Sending to %s at %s:\n%s", er.recipientAddr, addrPort, sendErr)
 
-	if err := smtp.SendMail(addrPort, auth, er.senderAddr, []string{er.recipientAddr}, []byte(sendErr.Error())); err != nil {
+	if err := er.sendMail(addrPort, auth, er.message(sendErr)); err != nil {
 		log.Errorf("%s", err)
 	}
 
 	return sendErr
 }
 
+// sendMail sends msg like smtp.SendMail, but gives up if the server doesn't
+// accept it within the timeout, so that a stuck server doesn't block the
+// caller.
+func (er *SMTPErrorReporter) sendMail(addrPort string, auth smtp.Auth, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addrPort, er.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(er.timeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, er.sMTPServerAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: er.sMTPServerAddr}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(er.senderAddr); err != nil {
+		return err
+	}
+	if err := c.Rcpt(er.recipientAddr); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message returns the mail message with headers for sendErr.
+func (er *SMTPErrorReporter) message(sendErr error) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", er.senderAddr)
+	fmt.Fprintf(&b, "To: %s\r\n", er.recipientAddr)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subjectOf(sendErr)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "X-Irctl-Severity: %s\r\n", severityOf(sendErr))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	text := strings.Replace(sendErr.Error(), "\n", "\r\n", -1)
+	h, ok := sendErr.(interface{ HTML() string })
+	if !ok {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		b.WriteString(text)
+		b.WriteString("\r\n")
+		return []byte(b.String())
+	}
+	// Send both, so that clients without HTML show the text.
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mimeBoundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", mimeBoundary, text)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", mimeBoundary, strings.Replace(h.HTML(), "\n", "\r\n", -1))
+	fmt.Fprintf(&b, "--%s--\r\n", mimeBoundary)
+	return []byte(b.String())
+}
+
 // LogErrorReporter is an error reporter than logs to file.
 type LogErrorReporter struct {
 }
@@ -0,0 +1,135 @@
+package control
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// ValveOpened is published when a valve is opened.
+	ValveOpened EventType = "ValveOpened"
+	// ValveClosed is published when a valve is closed.
+	ValveClosed EventType = "ValveClosed"
+	// AllValvesClosed is published when all valves are closed.
+	AllValvesClosed EventType = "AllValvesClosed"
+	// RunOnceStarted is published when the control loop starts RunOnce.
+	RunOnceStarted EventType = "RunOnceStarted"
+	// RunOnceFinished is published when RunOnce returns.
+	RunOnceFinished EventType = "RunOnceFinished"
+)
+
+// Event is something that happened in the controller.
+type Event struct {
+	Time time.Time
+	Type EventType
+	// Zone is the valve number for valve events, or -1.
+	Zone  int
+	Error string `json:",omitempty"`
+}
+
+// EventBus delivers published events to all subscribers. A nil EventBus
+// drops all events.
+type EventBus struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]chan *Event
+}
+
+// NewEventBus returns a ptr to an initialized EventBus.
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[int]chan *Event),
+	}
+}
+
+// Publish sends e to all subscribers. It never blocks, so a subscriber that
+// falls more than its buffer size behind misses events.
+func (b *EventBus) Publish(e *Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives published events, buffering up to
+// size events, and a func that unsubscribes and closes the channel.
+func (b *EventBus) Subscribe(size int) (<-chan *Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	ch := make(chan *Event, size)
+	b.subs[id] = ch
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[id]; ok {
+			delete(b.subs, id)
+			close(ch)
+		}
+	}
+}
+
+// EventValveController is a ValveController that publishes an Event for each
+// valve operation on another ValveController.
+type EventValveController struct {
+	vc    ValveController
+	bus   *EventBus
+	clock Clock
+}
+
+// NewEventValveController returns a ptr to an initialized EventValveController
+// that controls vc and publishes to bus.
+func NewEventValveController(vc ValveController, bus *EventBus, clock Clock) *EventValveController {
+	return &EventValveController{
+		vc:    vc,
+		bus:   bus,
+		clock: clock,
+	}
+}
+
+// OpenValve implements ValveController method.
+func (vc *EventValveController) OpenValve(n int) error {
+	err := vc.vc.OpenValve(n)
+	vc.publish(ValveOpened, n, err)
+	return err
+}
+
+// CloseValve implements ValveController method.
+func (vc *EventValveController) CloseValve(n int) error {
+	err := vc.vc.CloseValve(n)
+	vc.publish(ValveClosed, n, err)
+	return err
+}
+
+// CloseAllValves implements ValveController method.
+func (vc *EventValveController) CloseAllValves() error {
+	err := vc.vc.CloseAllValves()
+	vc.publish(AllValvesClosed, -1, err)
+	return err
+}
+
+// NumValves implements ValveController method.
+func (vc *EventValveController) NumValves() int {
+	return vc.vc.NumValves()
+}
+
+// publish publishes an event of type t for valve n, with the error err if it
+// failed.
+func (vc *EventValveController) publish(t EventType, n int, err error) {
+	e := &Event{Time: vc.clock.Now(), Type: t, Zone: n}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	vc.bus.Publish(e)
+}
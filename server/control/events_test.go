@@ -0,0 +1,68 @@
+package control
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// failingValveController is a ValveController where every operation fails.
+type failingValveController struct {
+	TestValveController
+}
+
+func (vc *failingValveController) OpenValve(n int) error {
+	return fmt.Errorf("no valve %d", n)
+}
+
+func TestEventValveController(t *testing.T) {
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	bus := NewEventBus()
+	ch, unsubscribe := bus.Subscribe(10)
+	tvc := &TestValveController{log: &TestLogger{}}
+	vc := NewEventValveController(tvc, bus, NewFakeClock(now))
+	vc.OpenValve(2)
+	vc.CloseValve(2)
+	vc.CloseAllValves()
+	NewEventValveController(&failingValveController{}, bus, NewFakeClock(now)).OpenValve(3)
+
+	want := []Event{
+		{Time: now, Type: ValveOpened, Zone: 2},
+		{Time: now, Type: ValveClosed, Zone: 2},
+		{Time: now, Type: AllValvesClosed, Zone: -1},
+		{Time: now, Type: ValveOpened, Zone: 3, Error: "no valve 3"},
+	}
+	for i, w := range want {
+		if got := <-ch; *got != w {
+			t.Errorf("event %d: got %+v, want %+v", i, got, w)
+		}
+	}
+	if len(tvc.ops) != 2 {
+		t.Errorf("valve ops: got %v, want open and close", tvc.ops)
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Errorf("got event after unsubscribe")
+	}
+	bus.Publish(&Event{Type: RunOnceStarted})
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow, _ := bus.Subscribe(1)
+	fast, _ := bus.Subscribe(3)
+	for i := 0; i < 3; i++ {
+		bus.Publish(&Event{Type: RunOnceStarted, Zone: i})
+	}
+	if len(slow) != 1 || len(fast) != 3 {
+		t.Errorf("got %d and %d buffered events, want 1 and 3", len(slow), len(fast))
+	}
+	if e := <-slow; e.Zone != 0 {
+		t.Errorf("slow subscriber: got zone %d, want the first event", e.Zone)
+	}
+
+	var nilBus *EventBus
+	nilBus.Publish(&Event{Type: RunOnceStarted})
+}
@@ -0,0 +1,356 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// IncidentsKey is the KV store key for the persisted incidents.
+	IncidentsKey = "Incidents"
+	// incidentRetention is how long resolved incidents are kept.
+	incidentRetention = 30 * 24 * time.Hour
+	// incidentKeyLen is the maximum length of the message prefix in an
+	// incident key.
+	incidentKeyLen = 80
+)
+
+// numbers matches the numbers and lists of numbers in a message, which are
+// left out of the key.
+var numbers = regexp.MustCompile(`[0-9]+([ ,.]+[0-9]+)*`)
+
+// Severity is how bad an incident is.
+type Severity string
+
+const (
+	// SeverityInfo is an incident that needs no action.
+	SeverityInfo Severity = "Info"
+	// SeverityWarning is an incident that the controller works around, e.g.
+	// by using past conditions.
+	SeverityWarning Severity = "Warning"
+	// SeverityCritical is an incident that stops zones from being watered.
+	SeverityCritical Severity = "Critical"
+)
+
+// severityRank orders severities from least to most severe.
+var severityRank = map[Severity]int{
+	SeverityInfo:     0,
+	SeverityWarning:  1,
+	SeverityCritical: 2,
+}
+
+// Source is the part of the system an incident comes from.
+type Source string
+
+const (
+	// SourceWeather is a weather provider.
+	SourceWeather Source = "weather"
+	// SourceValve is the valve controller.
+	SourceValve Source = "valve"
+	// SourceKV is the KV store.
+	SourceKV Source = "kv"
+	// SourceConfig is the config file.
+	SourceConfig Source = "config"
+	// SourceOther is anything else.
+	SourceOther Source = "other"
+)
+
+// IncidentState is the state of an Incident.
+type IncidentState string
+
+const (
+	// IncidentOpen is an incident that hasn't been acknowledged.
+	IncidentOpen IncidentState = "Open"
+	// IncidentAcknowledged is an incident that someone is dealing with.
+	// Repeats don't send notifications unless it escalates.
+	IncidentAcknowledged IncidentState = "Acknowledged"
+	// IncidentResolved is an incident that is over. If the error happens
+	// again, it is a new incident.
+	IncidentResolved IncidentState = "Resolved"
+)
+
+// IncidentError is an error with the Source and Severity to record it with.
+type IncidentError struct {
+	Source   Source
+	Severity Severity
+	Err      error
+}
+
+// Error implements error#Error.
+func (e *IncidentError) Error() string {
+	return e.Err.Error()
+}
+
+// Tag returns err as an IncidentError from source with severity sev, or nil
+// if err is nil.
+func Tag(source Source, sev Severity, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IncidentError{Source: source, Severity: sev, Err: err}
+}
+
+// classify returns the source, severity and message of err. Untagged errors
+// are warnings from SourceOther.
+func classify(err error) (Source, Severity, string) {
+	var ie *IncidentError
+	if errors.As(err, &ie) {
+		return ie.Source, ie.Severity, ie.Err.Error()
+	}
+	return SourceOther, SeverityWarning, err.Error()
+}
+
+// incidentKey returns the key that repeats of an error from source have in
+// common. It is the source and the message up to the first ":", which is
+// usually before the wrapped error, with numbers left out.
+func incidentKey(source Source, msg string) string {
+	if i := strings.Index(msg, ":"); i > 0 {
+		msg = msg[:i]
+	}
+	msg = numbers.ReplaceAllString(strings.TrimSpace(msg), "#")
+	if len(msg) > incidentKeyLen {
+		msg = msg[:incidentKeyLen]
+	}
+	return fmt.Sprintf("%s/%s", source, msg)
+}
+
+// Incident is a deduplicated error. Repeats of an error with the same key
+// update the open incident rather than creating a new one.
+type Incident struct {
+	ID       int64
+	Key      string
+	Source   Source
+	Severity Severity
+	// Message is the message of the latest occurrence.
+	Message   string
+	State     IncidentState
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Count     int
+	// Updated is when the state last changed.
+	Updated time.Time
+}
+
+// incidentState is the persisted state of an IncidentStore.
+type incidentState struct {
+	NextID    int64
+	Incidents []*Incident
+}
+
+// IncidentStore keeps incidents in the KV store.
+type IncidentStore struct {
+	kv    KVStore
+	clock Clock
+
+	mu sync.Mutex
+}
+
+// NewIncidentStore returns a ptr to an IncidentStore that keeps incidents in
+// kv.
+func NewIncidentStore(kv KVStore, clock Clock) *IncidentStore {
+	return &IncidentStore{
+		kv:    kv,
+		clock: clock,
+	}
+}
+
+// Record records err, tagged with Tag or a warning from SourceOther. It
+// returns the incident, and notify true if the incident is new or escalated to
+// a higher severity.
+func (s *IncidentStore) Record(err error) (inc *Incident, notify bool, rerr error) {
+	source, sev, msg := classify(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, rerr := s.load()
+	if rerr != nil {
+		return nil, false, rerr
+	}
+	now := s.clock.Now()
+	key := incidentKey(source, msg)
+	for _, i := range st.Incidents {
+		if i.Key == "" {
+			// Incidents recorded before keys were added.
+			i.Key = incidentKey(i.Source, i.Message)
+		}
+		if i.State == IncidentResolved || i.Key != key {
+			continue
+		}
+		inc = i
+		break
+	}
+	switch {
+	case inc == nil:
+		inc = &Incident{
+			ID:        st.NextID,
+			Key:       key,
+			Source:    source,
+			Severity:  sev,
+			Message:   msg,
+			State:     IncidentOpen,
+			FirstSeen: now,
+			Updated:   now,
+		}
+		st.NextID++
+		st.Incidents = append(st.Incidents, inc)
+		notify = true
+	case severityRank[sev] > severityRank[inc.Severity]:
+		inc.Severity, inc.State, inc.Updated = sev, IncidentOpen, now
+		notify = true
+	}
+	inc.Message, inc.LastSeen = msg, now
+	inc.Count++
+	s.prune(st, now)
+	return inc, notify, s.save(st)
+}
+
+// List returns incidents, most recently seen first. Resolved incidents are
+// only included if all is true.
+func (s *IncidentStore) List(all bool) ([]*Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var out []*Incident
+	for _, i := range st.Incidents {
+		if all || i.State != IncidentResolved {
+			out = append(out, i)
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].LastSeen.After(out[b].LastSeen) })
+	return out, nil
+}
+
+// Acknowledge marks the unresolved incident id as acknowledged.
+func (s *IncidentStore) Acknowledge(id int64) (*Incident, error) {
+	return s.setState(id, IncidentAcknowledged)
+}
+
+// Resolve marks the incident id as resolved.
+func (s *IncidentStore) Resolve(id int64) (*Incident, error) {
+	return s.setState(id, IncidentResolved)
+}
+
+// setState sets the state of the unresolved incident id to state.
+func (s *IncidentStore) setState(id int64, state IncidentState) (*Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range st.Incidents {
+		if i.ID != id {
+			continue
+		}
+		if i.State == IncidentResolved {
+			return nil, fmt.Errorf("incident %d is already resolved", id)
+		}
+		i.State, i.Updated = state, s.clock.Now()
+		return i, s.save(st)
+	}
+	return nil, fmt.Errorf("no incident %d", id)
+}
+
+// prune removes incidents that were resolved more than incidentRetention ago.
+func (s *IncidentStore) prune(st *incidentState, now time.Time) {
+	var keep []*Incident
+	for _, i := range st.Incidents {
+		if i.State != IncidentResolved || now.Sub(i.Updated) < incidentRetention {
+			keep = append(keep, i)
+		}
+	}
+	st.Incidents = keep
+}
+
+// load returns the persisted state, which is empty if there is none.
+func (s *IncidentStore) load() (*incidentState, error) {
+	st := &incidentState{NextID: 1}
+	v, ok, err := s.kv.Get(IncidentsKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok && v != "" {
+		if err := json.Unmarshal([]byte(v), st); err != nil {
+			return nil, fmt.Errorf("bad incidents %s: %s", v, err)
+		}
+	}
+	return st, nil
+}
+
+// save persists st.
+func (s *IncidentStore) save(st *incidentState) error {
+	j, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(IncidentsKey, string(j))
+}
+
+// IncidentNotice is the error passed to the notifying ErrorReporter for a new
+// or escalated incident.
+type IncidentNotice struct {
+	Incident *Incident
+}
+
+// Error implements error#Error.
+func (n *IncidentNotice) Error() string {
+	i := n.Incident
+	if i.Count > 1 {
+		return fmt.Sprintf("%s %s incident %d: %s (seen %d times since %s)", i.Severity, i.Source, i.ID, i.Message, i.Count, i.FirstSeen.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s %s incident %d: %s", i.Severity, i.Source, i.ID, i.Message)
+}
+
+// Severity returns the severity of the incident.
+func (n *IncidentNotice) Severity() Severity {
+	return n.Incident.Severity
+}
+
+// Subject returns a short summary of the incident for a notification subject.
+func (n *IncidentNotice) Subject() string {
+	return fmt.Sprintf("irctl: %s %s incident", n.Incident.Severity, n.Incident.Source)
+}
+
+// IncidentErrorReporter is an ErrorReporter that records errors in an
+// IncidentStore, and only reports new or escalated incidents to another
+// ErrorReporter.
+type IncidentErrorReporter struct {
+	store    *IncidentStore
+	notifier ErrorReporter
+}
+
+// NewIncidentErrorReporter returns a ptr to an IncidentErrorReporter that
+// records errors in store and sends notices to notifier.
+func NewIncidentErrorReporter(store *IncidentStore, notifier ErrorReporter) *IncidentErrorReporter {
+	return &IncidentErrorReporter{
+		store:    store,
+		notifier: notifier,
+	}
+}
+
+// Report implements ErrorReporter#Report.
+func (er *IncidentErrorReporter) Report(sendErr error) error {
+	inc, notify, err := er.store.Record(sendErr)
+	if err != nil {
+		// Better to notify too often than to lose the error.
+		log.Errorf("Couldn't record incident: %s", err)
+		er.notifier.Report(sendErr)
+		return sendErr
+	}
+	if notify {
+		er.notifier.Report(&IncidentNotice{Incident: inc})
+	} else {
+		log.Errorf("Repeat of incident %d: %s", inc.ID, sendErr)
+	}
+	return sendErr
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recordingReporter is an ErrorReporter that keeps the reported errors.
+type recordingReporter struct {
+	errs []error
+}
+
+// Report implements ErrorReporter#Report.
+func (r *recordingReporter) Report(err error) error {
+	r.errs = append(r.errs, err)
+	return err
+}
+
+func TestIncidentErrorReporter(t *testing.T) {
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	s := NewIncidentStore(NewTestKVStore(), clock)
+	notifier := &recordingReporter{}
+	er := NewIncidentErrorReporter(s, notifier)
+	weatherErr := errors.New("no forecast")
+
+	in := Tag(SourceWeather, SeverityWarning, weatherErr)
+	if got := er.Report(in); got != in {
+		t.Errorf("Report: got %v, want %v", got, in)
+	}
+	clock.Set(now.Add(time.Hour))
+	er.Report(Tag(SourceWeather, SeverityWarning, weatherErr))
+	// Same message from another source is another incident.
+	er.Report(Tag(SourceKV, SeverityWarning, weatherErr))
+	// The details after the prefix change, but it is the same incident.
+	er.Report(Tag(SourceKV, SeverityWarning, fmt.Errorf("%s: dial tcp 10.0.0.1:443: i/o timeout", weatherErr)))
+	if len(notifier.errs) != 2 {
+		t.Fatalf("got notifications %v, want 2", notifier.errs)
+	}
+	incs, err := s.List(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incs) != 2 {
+		t.Fatalf("got incidents %+v, want 2", incs)
+	}
+	var w, kv *Incident
+	for _, i := range incs {
+		switch i.Source {
+		case SourceWeather:
+			w = i
+		case SourceKV:
+			kv = i
+		}
+	}
+	if w == nil || kv == nil {
+		t.Fatalf("got incidents %+v, want a weather and a KV incident", incs)
+	}
+	if kv.Count != 2 || kv.Message != "no forecast: dial tcp 10.0.0.1:443: i/o timeout" {
+		t.Errorf("got KV incident %+v, want 2 occurrences with the latest message", kv)
+	}
+	if w.Count != 2 || !w.FirstSeen.Equal(now) || !w.LastSeen.Equal(now.Add(time.Hour)) || w.State != IncidentOpen {
+		t.Errorf("got weather incident %+v, want 2 occurrences", w)
+	}
+
+	// Repeats of an acknowledged incident don't notify unless it escalates.
+	if _, err := s.Acknowledge(w.ID); err != nil {
+		t.Fatal(err)
+	}
+	er.Report(Tag(SourceWeather, SeverityInfo, weatherErr))
+	if len(notifier.errs) != 2 {
+		t.Errorf("got notifications %v after acknowledged repeat, want 2", notifier.errs)
+	}
+	er.Report(Tag(SourceWeather, SeverityCritical, weatherErr))
+	if len(notifier.errs) != 3 {
+		t.Fatalf("got notifications %v after escalation, want 3", notifier.errs)
+	}
+	n, ok := notifier.errs[2].(*IncidentNotice)
+	if !ok || n.Incident.Severity != SeverityCritical || n.Incident.State != IncidentOpen || n.Incident.Count != 4 {
+		t.Errorf("got escalation notice %v, want open Critical with 4 occurrences", notifier.errs[2])
+	}
+	if got, want := n.Subject(), "irctl: Critical weather incident"; got != want {
+		t.Errorf("Subject: got %q, want %q", got, want)
+	}
+
+	// A resolved incident that recurs is a new incident.
+	if _, err := s.Resolve(w.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Acknowledge(w.ID); err == nil {
+		t.Errorf("Acknowledge of resolved incident: got nil error")
+	}
+	er.Report(Tag(SourceWeather, SeverityWarning, weatherErr))
+	if len(notifier.errs) != 4 {
+		t.Errorf("got notifications %v after recurrence, want 4", notifier.errs)
+	}
+	all, err := s.List(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("got %d incidents including resolved, want 3", len(all))
+	}
+
+	// Resolved incidents are pruned after incidentRetention.
+	clock.Set(now.Add(time.Hour + incidentRetention))
+	er.Report(fmt.Errorf("untagged"))
+	all, err = s.List(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].Source != SourceOther || all[0].Severity != SeverityWarning {
+		t.Errorf("got incidents %+v after pruning, want 3 with an untagged warning first", all)
+	}
+	if _, err := s.Resolve(99); err == nil {
+		t.Errorf("Resolve of unknown incident: got nil error")
+	}
+}
+
+func TestIncidentKey(t *testing.T) {
+	for _, tt := range []struct {
+		source Source
+		a, b   string
+		same   bool
+	}{
+		{SourceWeather, "no forecast", "no forecast", true},
+		{SourceWeather, "Error getting yesterday's conditions: timeout", "Error getting yesterday's conditions: 503", true},
+		{SourceValve, "manual runs of zones [1] were interrupted", "manual runs of zones [2 3] were interrupted", true},
+		{SourceWeather, "no forecast", "no station", false},
+	} {
+		if got := incidentKey(tt.source, tt.a) == incidentKey(tt.source, tt.b); got != tt.same {
+			t.Errorf("incidentKey(%q) == incidentKey(%q): got %t, want %t", tt.a, tt.b, got, tt.same)
+		}
+	}
+	if incidentKey(SourceWeather, "x") == incidentKey(SourceKV, "x") {
+		t.Errorf("got the same key for different sources")
+	}
+}
@@ -1,7 +1,9 @@
 package control
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -26,8 +28,10 @@ type KVStore interface {
 	Close() error
 }
 
-// TestKVStore is an in memory KV store for testing.
+// TestKVStore is an in memory KV store for testing. It is safe for concurrent
+// use.
 type TestKVStore struct {
+	mu    sync.Mutex
 	kvmap map[string]string
 }
 
@@ -40,12 +44,16 @@ func NewTestKVStore() *TestKVStore {
 
 // Get implements KVStore#Get.
 func (kv *TestKVStore) Get(key string) (string, bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 	v, ok := kv.kvmap[key]
 	return v, ok, nil
 }
 
 // Set implements KVStore#Set.
 func (kv *TestKVStore) Set(key, value string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 	kv.kvmap[key] = value
 	return nil
 }
@@ -56,17 +64,19 @@ func (kv *TestKVStore) Close() error { return nil }
 // BadgerKVStore is a badger KV store.
 type BadgerKVStore struct {
 	db     *badger.DB
+	clock  Clock
 	lastGC time.Time
 }
 
-// NewBadgerKVStore creates a new BadgerKVStore and returns a ptr to it.
-func NewBadgerKVStore(dbPath string) (*BadgerKVStore, error) {
+// NewBadgerKVStore creates a new BadgerKVStore and returns a ptr to it. clock
+// is used for retries and GC scheduling.
+func NewBadgerKVStore(dbPath string, clock Clock) (*BadgerKVStore, error) {
 	opts := badger.DefaultOptions
 	opts.Dir = dbPath
 	opts.ValueDir = dbPath
 	opts.SyncWrites = true
 	var err error
-	ret := &BadgerKVStore{}
+	ret := &BadgerKVStore{clock: clock}
 	ret.db, err = badger.Open(opts)
 	if err != nil {
 		return nil, err
@@ -77,14 +87,14 @@ func NewBadgerKVStore(dbPath string) (*BadgerKVStore, error) {
 
 // runGC runs garbage collection if necessary.
 func (kv *BadgerKVStore) runGC() {
-	if time.Since(kv.lastGC) < kvGCInterval {
+	if kv.clock.Now().Sub(kv.lastGC) < kvGCInterval {
 		//log.Infof("skipping badger GC")
 		return
 	}
 	log.Infof("running badger GC")
 	kv.db.PurgeOlderVersions()
 	kv.db.RunValueLogGC(kvDiscardRatio)
-	kv.lastGC = time.Now()
+	kv.lastGC = kv.clock.Now()
 }
 
 // Get implements KVStore#Get.
@@ -114,7 +124,7 @@ func (kv *BadgerKVStore) Get(key string) (string, bool, error) {
 		return "", false, nil
 	}
 
-	if val, err = RetryThenFail(getFunc, kvNumAttempts, kvRetryInterval); err != nil {
+	if val, err = RetryThenFail(kv.clock, getFunc, kvNumAttempts, kvRetryInterval); err != nil {
 		return "", true, err
 	}
 
@@ -138,7 +148,7 @@ func (kv *BadgerKVStore) Set(key, value string) error {
 		})
 	})
 
-	_, err := RetryThenFail(setFunc, kvNumAttempts, kvRetryInterval)
+	_, err := RetryThenFail(kv.clock, setFunc, kvNumAttempts, kvRetryInterval)
 	kv.runGC()
 	return err
 }
@@ -152,9 +162,9 @@ func (kv *BadgerKVStore) Close() error {
 type RetryFunction func() (interface{}, error)
 
 // RetryThenFail retries the given function fn for the given number of attempts,
-// with a pause of retryMins in between attempts. It keeps retrying until
-// either fn returns nil or attempts is exceeded.
-func RetryThenFail(fn RetryFunction, attempts int, retryInterval time.Duration) (interface{}, error) {
+// with a pause of retryInterval on clock in between attempts. It keeps retrying
+// until either fn returns nil or attempts is exceeded.
+func RetryThenFail(clock Clock, fn RetryFunction, attempts int, retryInterval time.Duration) (interface{}, error) {
 	var err error
 	var ret interface{}
 	for a := 0; a < attempts; a++ {
@@ -163,7 +173,9 @@ func RetryThenFail(fn RetryFunction, attempts int, retryInterval time.Duration)
 			return ret, nil
 		}
 		log.Errorf("Call to %v failed, retrying: %s", fn, err)
-		time.Sleep(retryInterval)
+		// KV operations are not cancelled, so that state is saved during
+		// shutdown.
+		clock.Sleep(context.Background(), retryInterval)
 	}
 
 	return nil, fmt.Errorf("Call to %v failed after %d attempts: %s", fn, attempts, err)
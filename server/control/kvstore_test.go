@@ -16,8 +16,7 @@ func TestBadgerKVStore(t *testing.T) {
 	if err := os.RemoveAll(testKVStorePath); err != nil {
 		panic(err)
 	}
-	log := &TestLogger{}
-	kv, err := NewBadgerKVStore(testKVStorePath, log)
+	kv, err := NewBadgerKVStore(testKVStorePath, RealClock{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,7 +49,7 @@ func TestBadgerKVStore(t *testing.T) {
 	if err := kv.Close(); err != nil {
 		t.Fatal(err)
 	}
-	kv, err = NewBadgerKVStore(testKVStorePath, log)
+	kv, err = NewBadgerKVStore(testKVStorePath, RealClock{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,317 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// ledgerSubdir is subdir where the VWC ledger is written.
+	ledgerSubdir = "ledger"
+)
+
+// LedgerKind is the kind of change to VWC that a LedgerEntry records.
+type LedgerKind string
+
+const (
+	// BalanceEntry is the daily change in VWC due to ET and rain.
+	BalanceEntry LedgerKind = "Balance"
+	// IrrigationEntry is the change in VWC due to running the zone.
+	IrrigationEntry LedgerKind = "Irrigation"
+	// ManualEntry is the change in VWC due to running the zone manually.
+	ManualEntry LedgerKind = "Manual"
+	// InterruptedEntry is the change in VWC due to running the zone until
+	// the run was interrupted.
+	InterruptedEntry LedgerKind = "Interrupted"
+)
+
+// LedgerEntry is a record of one change to the VWC of a zone.
+type LedgerEntry struct {
+	// Time is when the change was made. It determines the day of the entry.
+	Time time.Time
+	Zone int
+	Kind LedgerKind
+
+	// TempF, PrecipIn and EtIn are the algorithm inputs for a BalanceEntry.
+	// EtIn is unknownET if there was no measured ET.
+	TempF    float64
+	PrecipIn float64
+	EtIn     float64
+	// Runtime is the zone run time for an IrrigationEntry, ManualEntry or
+	// InterruptedEntry.
+	Runtime time.Duration
+
+	StartVWC        Pct
+	ETRemoved       Pct
+	RainAdded       Pct
+	IrrigationAdded Pct
+	// Clamped is the amount added (if positive) or removed (if negative) to
+	// keep VWC between 0 and the zone MaxVWC.
+	Clamped Pct
+	EndVWC  Pct
+
+	// RecomputedAt is the time of the recompute for entries written by
+	// ApplyRecompute, and is not set for entries written by a run.
+	RecomputedAt *time.Time `json:",omitempty"`
+}
+
+// newBalanceEntry returns a BalanceEntry for zone znum at time t, with the
+// given algorithm inputs and water balance.
+func newBalanceEntry(t time.Time, znum int, tempF, precipIn, etIn float64, wb *WaterBalance) *LedgerEntry {
+	return &LedgerEntry{
+		Time:      t,
+		Zone:      znum,
+		Kind:      BalanceEntry,
+		TempF:     tempF,
+		PrecipIn:  precipIn,
+		EtIn:      etIn,
+		StartVWC:  wb.StartVWC,
+		ETRemoved: wb.ETRemoved,
+		RainAdded: wb.RainAdded,
+		Clamped:   wb.Clamped,
+		EndVWC:    wb.EndVWC,
+	}
+}
+
+// newIrrigationEntry returns an IrrigationEntry for zone znum at time t, for
+// a run of the given runtime that brings VWC from startVWC to maxVWC.
+func newIrrigationEntry(t time.Time, znum int, runtime time.Duration, startVWC, maxVWC Pct) *LedgerEntry {
+	return &LedgerEntry{
+		Time:            t,
+		Zone:            znum,
+		Kind:            IrrigationEntry,
+		Runtime:         runtime,
+		StartVWC:        startVWC,
+		IrrigationAdded: maxVWC - startVWC,
+		EndVWC:          maxVWC,
+	}
+}
+
+// newManualEntry returns a ManualEntry for zone znum at time t, for a manual
+// run of the given runtime that adds gain to startVWC, up to maxVWC.
+func newManualEntry(t time.Time, znum int, runtime time.Duration, startVWC, gain, maxVWC Pct) *LedgerEntry {
+	return newGainEntry(ManualEntry, t, znum, runtime, startVWC, gain, maxVWC)
+}
+
+// newInterruptedEntry returns an InterruptedEntry for zone znum at time t, for
+// the runtime of an automatic run before it was interrupted, that adds gain
+// to startVWC, up to maxVWC.
+func newInterruptedEntry(t time.Time, znum int, runtime time.Duration, startVWC, gain, maxVWC Pct) *LedgerEntry {
+	return newGainEntry(InterruptedEntry, t, znum, runtime, startVWC, gain, maxVWC)
+}
+
+// newGainEntry returns an entry of kind for zone znum at time t, for a run of
+// the given runtime that adds gain to startVWC, up to maxVWC.
+func newGainEntry(kind LedgerKind, t time.Time, znum int, runtime time.Duration, startVWC, gain, maxVWC Pct) *LedgerEntry {
+	end := min(max(0, startVWC+gain), maxVWC)
+	return &LedgerEntry{
+		Time:            t,
+		Zone:            znum,
+		Kind:            kind,
+		Runtime:         runtime,
+		StartVWC:        startVWC,
+		IrrigationAdded: gain,
+		Clamped:         end - (startVWC + gain),
+		EndVWC:          end,
+	}
+}
+
+// Ledger is an append-only log of the changes to the VWC of each zone. Entries
+// are written as JSON lines to one file per zone and day, e.g.
+// ../data/ledger/0/2017/12/26.log
+type Ledger struct {
+	root string
+	mu   sync.Mutex
+}
+
+// NewLedger returns a ptr to an initialized Ledger that writes under rootPath.
+func NewLedger(rootPath string) *Ledger {
+	return &Ledger{
+		root: rootPath,
+	}
+}
+
+// Append appends e to the ledger.
+func (l *Ledger) Append(e *LedgerEntry) error {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	fp := l.filePath(e.Zone, e.Time)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := createDirIfMissing(fp); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fp, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(j, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns the entries for zone znum in the date range "from"-"to", in the
+// order they were written. Days with no entries are skipped.
+func (l *Ledger) Read(znum int, from, to time.Time) ([]*LedgerEntry, error) {
+	var out []*LedgerEntry
+	after := dateOnly(to.AddDate(0, 0, 1))
+	for d := dateOnly(from); d.Before(after); d = d.AddDate(0, 0, 1) {
+		es, err := l.readOneDay(znum, d)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, es...)
+	}
+	return out, nil
+}
+
+// readOneDay returns the entries for zone znum on the date in t.
+func (l *Ledger) readOneDay(znum int, t time.Time) ([]*LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.filePath(znum, t))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*LedgerEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := &LedgerEntry{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			// A partially written line from a crash shouldn't lose the day.
+			log.Errorf("bad ledger entry %s: %s", s.Text(), err)
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, s.Err()
+}
+
+// filePath returns the file path for entries for zone znum on the date in t.
+func (l *Ledger) filePath(znum int, t time.Time) string {
+	return filepath.Join(l.root, ledgerSubdir, fmt.Sprint(znum), fmt.Sprint(t.Year()), fmt.Sprint(int(t.Month())), fmt.Sprint(t.Day())+logFileExtension)
+}
+
+// Recompute replays the ledger for each zone in sc for the date range
+// "from"-"to" with the config sc and algorithm alg, and returns the new
+// entries, which are not written. Each day starts from the VWC at the end of
+// the previous day, beginning with the recorded starting VWC of the first day
+// with entries. The recorded algorithm inputs are used for the day's water
+// balance, each recorded run sets VWC to the new MaxVWC, and each manual run
+// adds the VWC gain for its runtime. The entries are marked as recomputed at
+// time now.
+func (l *Ledger) Recompute(from, to time.Time, sc *SystemConfig, alg ETAlgorithm, now time.Time) ([]*LedgerEntry, error) {
+	var out []*LedgerEntry
+	after := dateOnly(to.AddDate(0, 0, 1))
+	for znum := 0; znum < sc.NumZones(); znum++ {
+		z, ok := sc.ZoneConfigs[znum]
+		if !ok {
+			continue
+		}
+		started := false
+		var vwc Pct
+		for d := dateOnly(from); d.Before(after); d = d.AddDate(0, 0, 1) {
+			es, err := l.readOneDay(znum, d)
+			if err != nil {
+				return nil, err
+			}
+			es = latestEntries(es)
+			if len(es) == 0 {
+				continue
+			}
+			if !started {
+				vwc, started = es[0].StartVWC, true
+			}
+			lastBalance := -1
+			for i, e := range es {
+				if e.Kind == BalanceEntry {
+					lastBalance = i
+				}
+			}
+			for i, e := range es {
+				var ne *LedgerEntry
+				switch {
+				case e.Kind == BalanceEntry && i == lastBalance:
+					// Failed runs are retried and recompute the balance, but
+					// ET and rain are only counted once per day.
+					wb, err := calculateWaterBalance(alg, vwc, e.TempF, e.EtIn, e.PrecipIn, e.Time, z)
+					if err != nil {
+						return nil, fmt.Errorf("zone %d %s: %s", znum, dateStr(e.Time), err)
+					}
+					ne = newBalanceEntry(e.Time, znum, e.TempF, e.PrecipIn, e.EtIn, wb)
+				case e.Kind == IrrigationEntry:
+					ne = newIrrigationEntry(e.Time, znum, e.Runtime, vwc, z.MaxVWC)
+				case e.Kind == ManualEntry || e.Kind == InterruptedEntry:
+					gain, err := runVWCGain(alg, e.Runtime, z)
+					if err != nil {
+						return nil, fmt.Errorf("zone %d %s: %s", znum, dateStr(e.Time), err)
+					}
+					ne = newGainEntry(e.Kind, e.Time, znum, e.Runtime, vwc, gain, z.MaxVWC)
+				default:
+					continue
+				}
+				ne.RecomputedAt = &now
+				vwc = ne.EndVWC
+				out = append(out, ne)
+			}
+		}
+	}
+	return out, nil
+}
+
+// ApplyRecompute appends the entries returned by Recompute to the ledger and
+// sets the current VWC in kv of each zone to the end VWC of its last entry.
+func (l *Ledger) ApplyRecompute(kv KVStore, entries []*LedgerEntry) error {
+	last := make(map[int]*LedgerEntry)
+	for _, e := range entries {
+		if err := l.Append(e); err != nil {
+			return err
+		}
+		last[e.Zone] = e
+	}
+	for znum, e := range last {
+		if err := SetVWC(kv, znum, float64(e.EndVWC)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestEntries returns the entries from the most recent recompute, or the
+// entries written by runs if there are none.
+func latestEntries(es []*LedgerEntry) []*LedgerEntry {
+	var latest time.Time
+	for _, e := range es {
+		if e.RecomputedAt != nil && e.RecomputedAt.After(latest) {
+			latest = *e.RecomputedAt
+		}
+	}
+	var out []*LedgerEntry
+	for _, e := range es {
+		var t time.Time
+		if e.RecomputedAt != nil {
+			t = *e.RecomputedAt
+		}
+		if t.Equal(latest) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package control
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func pctsEqual(a, b Pct) bool {
+	return math.Abs(float64(a-b)) < 1e-9
+}
+
+func TestLedgerRecompute(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	day1 := time.Date(2019, 3, 1, 9, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	l := NewLedger(root)
+	alg := NewETAlgorithmETo(0.02)
+	old := &ZoneConfig{Number: 0, MaxVWC: 20, CropCoefficient: 0.5}
+	for _, e := range []struct {
+		t                 time.Time
+		etIn, precipIn    float64
+		startVWC          Pct
+		irrigationRuntime time.Duration
+	}{
+		{t: day1, etIn: 0.1, startVWC: 15},
+		// A retry after a failed run recomputes the balance.
+		{t: day1.Add(time.Hour), etIn: 0.1, startVWC: 10},
+		{t: day1.Add(time.Hour), startVWC: 5, irrigationRuntime: 10 * time.Minute},
+		{t: day2, etIn: 0.1, precipIn: 0.02, startVWC: 20},
+	} {
+		var le *LedgerEntry
+		if e.irrigationRuntime != 0 {
+			le = newIrrigationEntry(e.t, 0, e.irrigationRuntime, e.startVWC, old.MaxVWC)
+		} else {
+			wb, err := alg.WaterBalance(e.startVWC, 0, e.etIn, e.precipIn, e.t, old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			le = newBalanceEntry(e.t, 0, 0, e.precipIn, e.etIn, wb)
+		}
+		if err := l.Append(le); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := l.Read(0, day1, day2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || got[2].Kind != IrrigationEntry || got[2].Runtime != 10*time.Minute || !pctsEqual(got[3].EndVWC, 17) {
+		t.Errorf("Read: got %d entries, want 4 ending with VWC 17", len(got))
+	}
+
+	// A higher crop coefficient and MaxVWC, where ET and rain are only counted
+	// once per day.
+	sc := &SystemConfig{ZoneConfigs: map[int]*ZoneConfig{0: {Number: 0, MaxVWC: 25, CropCoefficient: 1}}}
+	now := day2.Add(time.Hour)
+	es, err := l.Recompute(day1, day2, sc, alg, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Pct{5, 25, 17}
+	if len(es) != len(want) {
+		t.Fatalf("Recompute: got %d entries, want %d", len(es), len(want))
+	}
+	for i, e := range es {
+		if !pctsEqual(e.EndVWC, want[i]) || e.RecomputedAt == nil || !e.RecomputedAt.Equal(now) {
+			t.Errorf("Recompute %d: got %+v, want EndVWC %3.2f", i, e, want[i])
+		}
+	}
+	if !pctsEqual(es[1].IrrigationAdded, 20) {
+		t.Errorf("Recompute: got IrrigationAdded %3.2f, want 20", es[1].IrrigationAdded)
+	}
+
+	kv := NewTestKVStore()
+	if err := l.ApplyRecompute(kv, es); err != nil {
+		t.Fatal(err)
+	}
+	if vwc, err := GetVWC(kv, 0); err != nil || vwc != 17 {
+		t.Errorf("GetVWC after ApplyRecompute: got %3.2f / %v, want 17", vwc, err)
+	}
+
+	// Recomputing again starts from the most recent recompute.
+	sc.ZoneConfigs[0] = old
+	es, err = l.Recompute(day2, day2, sc, alg, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || !pctsEqual(es[0].StartVWC, 25) || !pctsEqual(es[0].Clamped, -2) || !pctsEqual(es[0].EndVWC, 20) {
+		t.Errorf("second Recompute: got %+v, want start 25, clamped -2, end 20", es)
+	}
+}
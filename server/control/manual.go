@@ -0,0 +1,106 @@
+package control
+
+import (
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// ManualRunner runs zones on request and credits the water they get to VWC,
+// so that the next automatic run doesn't over water.
+type ManualRunner struct {
+	rparam *RunParams
+	kv     KVStore
+	zc     *ZoneController
+	clock  Clock
+}
+
+// NewManualRunner returns a ptr to an initialized ManualRunner, which reads the
+// config and writes the logs given in rparam.
+func NewManualRunner(rparam *RunParams, kv KVStore, zc *ZoneController) *ManualRunner {
+	return &ManualRunner{
+		rparam: rparam,
+		kv:     kv,
+		zc:     zc,
+		clock:  rparam.clock(),
+	}
+}
+
+// Start opens valve n and runs it for duration d in the background, with run,
+// which must have the valves. When the time is up or run is cancelled, the
+// valve is closed, the VWC of zone n is increased by the gain for the time it
+// ran, and run is released. The returned channel receives the result of the
+// run. If the valve can't be opened, run is released and an error returned.
+func (m *ManualRunner) Start(run *RunHandle, n int, d time.Duration) (<-chan error, error) {
+	sc, alg, err := readConfig(m.rparam)
+	if err != nil {
+		run.Release()
+		return nil, err
+	}
+	mr, err := m.zc.StartManual(n, d)
+	if err != nil {
+		run.Release()
+		return nil, err
+	}
+	log.Infof("Manual run of zone %d for %s.", n, d)
+	run.SetZone(n, d)
+
+	done := make(chan error, 1)
+	go func() {
+		defer run.Release()
+		// Cancellation only stops the run early.
+		m.clock.Sleep(run.Context(), d)
+		ran, err := m.zc.FinishManual(n, mr)
+		run.ClearZone()
+		errs := NewErrs(err)
+		if ran > 0 {
+			errs = AppendErr(errs, m.credit(n, ran, sc, alg))
+		}
+		if errs != nil {
+			done <- errs
+			return
+		}
+		done <- nil
+	}()
+	return done, nil
+}
+
+// credit increases the VWC of zone n by the gain for running for ran, and logs
+// the run in the ledger and runtimes log.
+func (m *ManualRunner) credit(n int, ran time.Duration, sc *SystemConfig, alg ETAlgorithm) error {
+	z, ok := sc.ZoneConfigs[n]
+	if !ok {
+		log.Infof("Zone %d not in config, VWC not updated.", n)
+		return nil
+	}
+	vwc, err := GetVWC(m.kv, n)
+	if err != nil {
+		return err
+	}
+	gain, err := runVWCGain(alg, ran, z)
+	if err != nil {
+		return err
+	}
+	now := m.clock.Now()
+	e := newManualEntry(now, n, ran, Pct(vwc), gain, z.MaxVWC)
+	log.Infof("Zone %d ran manually for %s, VWC %3.2f -> %3.2f.", n, ran, vwc, e.EndVWC)
+	if err := SetVWC(m.kv, n, float64(e.EndVWC)); err != nil {
+		return err
+	}
+	errs := NewErrs(NewLedger(m.rparam.DataLogPath).Append(e))
+	errs = AppendErr(errs, NewDataLogger(m.rparam.DataLogPath).AddManualRuntime(now, sc.NumZones(), n, ran))
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// runVWCGain returns the VWC gain from running zone z for runtime, allowing
+// for the run time multiplier that is applied to automatic runs. It is used
+// for runs that aren't to a target VWC, i.e. manual and interrupted runs.
+func runVWCGain(alg ETAlgorithm, runtime time.Duration, z *ZoneConfig) (Pct, error) {
+	if z.RunTimeMultiplier > 0 {
+		runtime = time.Duration(float64(runtime) / z.RunTimeMultiplier)
+	}
+	return alg.CalculateVWCGain(runtime, z)
+}
@@ -0,0 +1,149 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const manualTestConfig = `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 2,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+
+func TestManualRunner(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	start := time.Date(2019, 3, 17, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc    string
+		clock   Clock
+		wantRan time.Duration
+		wantVWC float64
+	}{
+		{
+			desc:  "complete",
+			clock: NewFakeClock(start),
+			// 6 mins with a multiplier of 2 is 3 nominal mins, which adds 6%.
+			wantRan: 6 * time.Minute,
+			wantVWC: 16,
+		},
+		{
+			desc:    "cancelled",
+			clock:   &interruptingClock{FakeClock: NewFakeClock(start), after: 2 * time.Minute},
+			wantRan: 2 * time.Minute,
+			wantVWC: 12,
+		},
+	}
+	for _, tt := range tests {
+		kv := NewTestKVStore()
+		tvc := &TestValveController{log: &TestLogger{}}
+		zc := NewZoneController(tvc, kv, tt.clock)
+		rc := NewRunCoordinator(tt.clock)
+		dataLogPath := root + "/" + tt.desc
+		m := NewManualRunner(&RunParams{Config: manualTestConfig, DataLogPath: dataLogPath, Clock: tt.clock}, kv, zc)
+		if err := SetVWC(kv, 0, 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := zc.SetState(0, Complete); err != nil {
+			t.Fatal(err)
+		}
+
+		run, err := rc.Acquire(context.Background(), ManualRun, Reject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, err := m.Start(run, 0, 6*time.Minute)
+		if err != nil {
+			t.Fatalf("%s: Start: %s", tt.desc, err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("%s: run: %s", tt.desc, err)
+		}
+
+		if rc.Busy() {
+			t.Errorf("%s: got valves still held after run", tt.desc)
+		}
+		if got := tvc.ops; len(got) != 2 || got[0] != (ValveOperation{0, true}) || got[1] != (ValveOperation{0, false}) {
+			t.Errorf("%s: got valve ops %v, want open and close of 0", tt.desc, got)
+		}
+		if s, err := zc.State(0); err != nil || s != Complete {
+			t.Errorf("%s: got state %s / %v, want state before the run %s", tt.desc, s, err, Complete)
+		}
+		if vwc, err := GetVWC(kv, 0); err != nil || vwc != tt.wantVWC {
+			t.Errorf("%s: got VWC %3.2f / %v, want %3.2f", tt.desc, vwc, err, tt.wantVWC)
+		}
+		es, err := NewLedger(dataLogPath).Read(0, start, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(es) != 1 || es[0].Kind != ManualEntry || es[0].Runtime != tt.wantRan || es[0].EndVWC != Pct(tt.wantVWC) {
+			t.Errorf("%s: got ledger %+v, want one %s entry", tt.desc, es, ManualEntry)
+		}
+		re, err := NewDataLogger(dataLogPath).readRuntimesOneDay(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(re.ManualRuntimes) != 1 || re.ManualRuntimes[0] != tt.wantRan.Minutes() {
+			t.Errorf("%s: got manual runtimes %v, want [%v]", tt.desc, re.ManualRuntimes, tt.wantRan.Minutes())
+		}
+	}
+}
+
+func TestRecoverManualRuns(t *testing.T) {
+	kv := NewTestKVStore()
+	tvc := &TestValveController{log: &TestLogger{}}
+	zc := NewZoneController(tvc, kv, NewFakeClock(time.Time{}))
+	if err := zc.SetState(1, Complete); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zc.StartManual(1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := zc.State(1); err != nil || s != ManualRunning {
+		t.Fatalf("State after StartManual: got %s / %v, want %s", s, err, ManualRunning)
+	}
+
+	// As if after a crash.
+	got, err := zc.RecoverManualRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != 1 {
+		t.Errorf("RecoverManualRuns: got %v, want [1]", got)
+	}
+	if s, err := zc.State(1); err != nil || s != Complete {
+		t.Errorf("State after recovery: got %s / %v, want %s", s, err, Complete)
+	}
+	if ops := tvc.ops; len(ops) != 2 || ops[1] != (ValveOperation{1, false}) {
+		t.Errorf("valve ops: got %v, want valve 1 closed", ops)
+	}
+	if got, err := zc.RecoverManualRuns(); err != nil || len(got) != 0 {
+		t.Errorf("second RecoverManualRuns: got %v / %v, want none", got, err)
+	}
+}
@@ -0,0 +1,432 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Notification sink types, used in NotificationConfig.Type.
+const (
+	LogSinkType     = "log"
+	SMTPSinkType    = "smtp"
+	WebhookSinkType = "webhook"
+	PushSinkType    = "push"
+)
+
+// Push formats, used in NotificationConfig.Format for PushSinkType.
+const (
+	NtfyFormat   = "ntfy"
+	GotifyFormat = "gotify"
+)
+
+const (
+	// notifyTimeout is the time an SMTP, webhook or push server has to respond.
+	notifyTimeout = 10 * time.Second
+	// defaultSubject is the subject for errors that aren't incidents.
+	defaultSubject = "irctl error"
+)
+
+// NotificationConfig is the config for a notification sink.
+type NotificationConfig struct {
+	// Name identifies the sink in the secrets file and in environment
+	// variables. It must be unique.
+	Name string
+	// Type is one of LogSinkType, SMTPSinkType, WebhookSinkType or
+	// PushSinkType.
+	Type string
+	// MinSeverity is the least severe error that is sent. If empty, all are
+	// sent.
+	MinSeverity Severity
+	// MaxPerHour is the most notifications sent in any hour. Any more are
+	// dropped. If 0, there is no limit.
+	MaxPerHour int
+
+	// SMTPServer and SMTPPort are the SMTP server to send mail with.
+	SMTPServer string
+	SMTPPort   uint
+	// From and To are the sender and recipient addresses.
+	From     string
+	To       string
+	UserName string
+
+	// URL is the webhook URL, the ntfy topic URL or the Gotify server URL.
+	URL string
+	// Format is NtfyFormat or GotifyFormat for PushSinkType.
+	Format string
+
+	// Password is the SMTP password and Token is the webhook bearer token or
+	// push access token. They are secrets, and must be set with
+	// LoadNotificationSecrets.
+	Password string `json:"-"`
+	Token    string `json:"-"`
+}
+
+// notificationSecrets are the secrets for a sink in the secrets file.
+type notificationSecrets struct {
+	Password string
+	Token    string
+}
+
+// LoadNotificationSecrets sets the passwords and tokens in ncs from the JSON
+// file at path, which has the form
+// {"Notifications": {"name": {"Password": "...", "Token": "..."}}}, and then
+// from environment variables of the form IRCTL_NOTIFY_NAME_PASSWORD and
+// IRCTL_NOTIFY_NAME_TOKEN, which take precedence. A missing secrets file is not
+// an error.
+func LoadNotificationSecrets(ncs []*NotificationConfig, path string) error {
+	var secrets struct {
+		Notifications map[string]*notificationSecrets
+	}
+	j, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("could not read secrets file at %s: %s", path, err)
+	default:
+		if err := json.Unmarshal(j, &secrets); err != nil {
+			return fmt.Errorf("could not parse secrets file at %s: %s", path, err)
+		}
+	}
+	for _, nc := range ncs {
+		if s, ok := secrets.Notifications[nc.Name]; ok && s != nil {
+			nc.Password, nc.Token = s.Password, s.Token
+		}
+		if v := os.Getenv(notifyEnvVar(nc.Name, "PASSWORD")); v != "" {
+			nc.Password = v
+		}
+		if v := os.Getenv(notifyEnvVar(nc.Name, "TOKEN")); v != "" {
+			nc.Token = v
+		}
+	}
+	return nil
+}
+
+// notifyEnvVar returns the name of the environment variable for the secret
+// field of the named sink.
+func notifyEnvVar(name, field string) string {
+	return "IRCTL_NOTIFY_" + strings.ToUpper(name) + "_" + field
+}
+
+// verifyNotificationConfigs returns an error if any of ncs is not valid.
+func verifyNotificationConfigs(ncs []*NotificationConfig) error {
+	names := make(map[string]bool)
+	for _, nc := range ncs {
+		if nc.Name == "" {
+			return fmt.Errorf("must specify notification Name")
+		}
+		if names[nc.Name] {
+			return fmt.Errorf("duplicate notification %s", nc.Name)
+		}
+		names[nc.Name] = true
+		if _, ok := severityRank[nc.MinSeverity]; nc.MinSeverity != "" && !ok {
+			return fmt.Errorf("notification %s: unknown MinSeverity %s", nc.Name, nc.MinSeverity)
+		}
+		if nc.MaxPerHour < 0 {
+			return fmt.Errorf("notification %s: MaxPerHour cannot be negative, have %d", nc.Name, nc.MaxPerHour)
+		}
+		switch nc.Type {
+		case LogSinkType:
+		case SMTPSinkType:
+			if nc.SMTPServer == "" || nc.SMTPPort == 0 || nc.From == "" || nc.To == "" {
+				return fmt.Errorf("notification %s: must specify SMTPServer, SMTPPort, From and To", nc.Name)
+			}
+		case WebhookSinkType:
+			if nc.URL == "" {
+				return fmt.Errorf("notification %s: must specify URL", nc.Name)
+			}
+		case PushSinkType:
+			if nc.URL == "" {
+				return fmt.Errorf("notification %s: must specify URL", nc.Name)
+			}
+			if nc.Format != NtfyFormat && nc.Format != GotifyFormat {
+				return fmt.Errorf("notification %s: Format must be %s or %s, have %q", nc.Name, NtfyFormat, GotifyFormat, nc.Format)
+			}
+		default:
+			return fmt.Errorf("notification %s: unknown Type %q, choices are %v", nc.Name, nc.Type,
+				[]string{LogSinkType, SMTPSinkType, WebhookSinkType, PushSinkType})
+		}
+	}
+	return nil
+}
+
+// NewNotifier returns an ErrorReporter that sends to all sinks in ncs, each
+// with its severity filter and rate limit. If ncs is empty, it returns a
+// LogErrorReporter.
+func NewNotifier(ncs []*NotificationConfig, clock Clock) (ErrorReporter, error) {
+	if err := verifyNotificationConfigs(ncs); err != nil {
+		return nil, err
+	}
+	if len(ncs) == 0 {
+		return NewLogErrorReporter()
+	}
+	var sinks []ErrorReporter
+	for _, nc := range ncs {
+		var er ErrorReporter
+		switch nc.Type {
+		case LogSinkType:
+			er = &LogErrorReporter{}
+		case SMTPSinkType:
+			er = NewSMTPErrorReporter(nc.SMTPServer, nc.SMTPPort, nc.From, nc.To, nc.UserName, nc.Password)
+		case WebhookSinkType:
+			er = NewWebhookErrorReporter(nc.URL, nc.Token, clock)
+		case PushSinkType:
+			er = NewPushErrorReporter(nc.URL, nc.Format, nc.Token)
+		}
+		sinks = append(sinks, NewFilteredErrorReporter(nc.Name, er, nc.MinSeverity, nc.MaxPerHour, clock))
+	}
+	return NewMultiErrorReporter(sinks...), nil
+}
+
+// MultiErrorReporter is an ErrorReporter that reports to several others.
+type MultiErrorReporter struct {
+	reporters []ErrorReporter
+}
+
+// NewMultiErrorReporter returns a ptr to a MultiErrorReporter that reports to
+// all of reporters.
+func NewMultiErrorReporter(reporters ...ErrorReporter) *MultiErrorReporter {
+	return &MultiErrorReporter{
+		reporters: reporters,
+	}
+}
+
+// Report implements ErrorReporter#Report.
+func (er *MultiErrorReporter) Report(sendErr error) error {
+	for _, r := range er.reporters {
+		r.Report(sendErr)
+	}
+	return sendErr
+}
+
+// FilteredErrorReporter is an ErrorReporter that only passes errors of at
+// least a minimum severity to another ErrorReporter, and no more than a
+// maximum number per hour.
+type FilteredErrorReporter struct {
+	name        string
+	er          ErrorReporter
+	minSeverity Severity
+	maxPerHour  int
+	clock       Clock
+
+	mu sync.Mutex
+	// sent are the times of notifications sent in the last hour.
+	sent []time.Time
+}
+
+// NewFilteredErrorReporter returns a ptr to a FilteredErrorReporter for the
+// sink er called name. If minSeverity is empty or maxPerHour is 0, errors
+// aren't filtered by severity or rate.
+func NewFilteredErrorReporter(name string, er ErrorReporter, minSeverity Severity, maxPerHour int, clock Clock) *FilteredErrorReporter {
+	return &FilteredErrorReporter{
+		name:        name,
+		er:          er,
+		minSeverity: minSeverity,
+		maxPerHour:  maxPerHour,
+		clock:       clock,
+	}
+}
+
+// Report implements ErrorReporter#Report.
+func (er *FilteredErrorReporter) Report(sendErr error) error {
+	if severityRank[severityOf(sendErr)] < severityRank[er.minSeverity] {
+		return sendErr
+	}
+	if !er.allow() {
+		log.Warningf("Notification to %s dropped, more than %d in the last hour: %s", er.name, er.maxPerHour, sendErr)
+		return sendErr
+	}
+	return er.er.Report(sendErr)
+}
+
+// allow returns true and records a notification if one can be sent now.
+func (er *FilteredErrorReporter) allow() bool {
+	if er.maxPerHour == 0 {
+		return true
+	}
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	now := er.clock.Now()
+	var recent []time.Time
+	for _, t := range er.sent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	er.sent = recent
+	if len(er.sent) >= er.maxPerHour {
+		return false
+	}
+	er.sent = append(er.sent, now)
+	return true
+}
+
+// severityOf returns the severity of err, e.g. that of the incident for an
+// IncidentNotice.
+func severityOf(err error) Severity {
+	if s, ok := err.(interface{ Severity() Severity }); ok {
+		return s.Severity()
+	}
+	_, sev, _ := classify(err)
+	return sev
+}
+
+// subjectOf returns a short summary of err.
+func subjectOf(err error) string {
+	if s, ok := err.(interface{ Subject() string }); ok {
+		return s.Subject()
+	}
+	return defaultSubject
+}
+
+// WebhookPayload is the JSON body posted by a WebhookErrorReporter.
+type WebhookPayload struct {
+	Time     time.Time
+	Severity Severity
+	Subject  string
+	Message  string
+	// Incident is set if the error is an incident notice.
+	Incident *Incident `json:",omitempty"`
+	// Report is set if the error is a report notice.
+	Report *DailyReport `json:",omitempty"`
+}
+
+// WebhookErrorReporter is an ErrorReporter that posts a WebhookPayload to a
+// URL.
+type WebhookErrorReporter struct {
+	url    string
+	token  string
+	clock  Clock
+	client *http.Client
+}
+
+// NewWebhookErrorReporter returns a ptr to a WebhookErrorReporter that posts to
+// url, with token as a bearer token if set.
+func NewWebhookErrorReporter(url, token string, clock Clock) *WebhookErrorReporter {
+	return &WebhookErrorReporter{
+		url:    url,
+		token:  token,
+		clock:  clock,
+		client: &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+// Report implements ErrorReporter#Report.
+func (er *WebhookErrorReporter) Report(sendErr error) error {
+	p := &WebhookPayload{
+		Time:     er.clock.Now(),
+		Severity: severityOf(sendErr),
+		Subject:  subjectOf(sendErr),
+		Message:  sendErr.Error(),
+	}
+	switch n := sendErr.(type) {
+	case *IncidentNotice:
+		p.Incident = n.Incident
+	case *ReportNotice:
+		p.Report = n.Report
+	}
+	j, err := json.Marshal(p)
+	if err != nil {
+		log.Errorf("Webhook: %s", err)
+		return sendErr
+	}
+	header := map[string]string{"Content-Type": "application/json"}
+	if er.token != "" {
+		header["Authorization"] = "Bearer " + er.token
+	}
+	if err := post(er.client, er.url, header, j); err != nil {
+		log.Errorf("Webhook: %s", err)
+	}
+	return sendErr
+}
+
+// PushErrorReporter is an ErrorReporter that sends push notifications through
+// an ntfy or Gotify server.
+type PushErrorReporter struct {
+	url    string
+	format string
+	token  string
+	client *http.Client
+}
+
+// NewPushErrorReporter returns a ptr to a PushErrorReporter that sends to url
+// in format, which is NtfyFormat or GotifyFormat, with the access token token.
+// For ntfy, url is the topic URL and token is optional. For Gotify, url is the
+// server URL and token is the application token.
+func NewPushErrorReporter(url, format, token string) *PushErrorReporter {
+	return &PushErrorReporter{
+		url:    url,
+		format: format,
+		token:  token,
+		client: &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+// ntfyPriorities and gotifyPriorities map severities to push priorities.
+var (
+	ntfyPriorities   = map[Severity]string{SeverityInfo: "default", SeverityWarning: "high", SeverityCritical: "urgent"}
+	gotifyPriorities = map[Severity]int{SeverityInfo: 2, SeverityWarning: 5, SeverityCritical: 8}
+)
+
+// Report implements ErrorReporter#Report.
+func (er *PushErrorReporter) Report(sendErr error) error {
+	sev := severityOf(sendErr)
+	var err error
+	switch er.format {
+	case GotifyFormat:
+		var j []byte
+		j, err = json.Marshal(map[string]interface{}{
+			"title":    subjectOf(sendErr),
+			"message":  sendErr.Error(),
+			"priority": gotifyPriorities[sev],
+		})
+		if err == nil {
+			err = post(er.client, strings.TrimSuffix(er.url, "/")+"/message",
+				map[string]string{"Content-Type": "application/json", "X-Gotify-Key": er.token}, j)
+		}
+	default:
+		header := map[string]string{
+			"Title":    subjectOf(sendErr),
+			"Priority": ntfyPriorities[sev],
+			"Tags":     strings.ToLower(string(sev)),
+		}
+		if er.token != "" {
+			header["Authorization"] = "Bearer " + er.token
+		}
+		err = post(er.client, er.url, header, []byte(sendErr.Error()))
+	}
+	if err != nil {
+		log.Errorf("Push to %s: %s", er.format, err)
+	}
+	return sendErr
+}
+
+// post posts body to url with the headers in header, and returns an error if
+// it fails or the response is not a 2xx.
+func post(client *http.Client, url string, header map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: %s: %s", url, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is a local stand-in SMTP server that accepts mail without AUTH
+// and keeps the messages.
+type smtpServer struct {
+	l    net.Listener
+	mu   sync.Mutex
+	msgs []string
+	done chan struct{}
+}
+
+// newSMTPServer returns a running smtpServer on a local port.
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{l: l, done: make(chan struct{}, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+// port returns the port s listens on.
+func (s *smtpServer) port() uint {
+	return uint(s.l.Addr().(*net.TCPAddr).Port)
+}
+
+// serve handles one SMTP session on c.
+func (s *smtpServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(msg string) { c.Write([]byte(msg + "\r\n")) }
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg.String())
+			s.mu.Unlock()
+			reply("250 ok")
+			s.done <- struct{}{}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPErrorReporter(t *testing.T) {
+	s := newSMTPServer(t)
+	defer s.l.Close()
+	er := NewSMTPErrorReporter("127.0.0.1", s.port(), "irctl@example.com", "me@example.com", "", "")
+	inc := &Incident{ID: 3, Source: SourceValve, Severity: SeverityCritical, Message: "valve stuck", Count: 1}
+	er.Report(&IncidentNotice{Incident: inc})
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for mail")
+	}
+	msg := s.msgs[0]
+	for _, want := range []string{
+		"From: irctl@example.com\r\n",
+		"To: me@example.com\r\n",
+		"Subject: irctl: Critical valve incident\r\n",
+		"X-Irctl-Severity: Critical\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"Date: ",
+		"\r\n\r\nCritical valve incident 3: valve stuck\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q does not contain %q", msg, want)
+		}
+	}
+}
+
+func TestSMTPErrorReporterTimeout(t *testing.T) {
+	// A server that accepts connections but never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	er := NewSMTPErrorReporter("127.0.0.1", uint(l.Addr().(*net.TCPAddr).Port), "irctl@example.com", "me@example.com", "", "")
+	er.timeout = 100 * time.Millisecond
+	start := time.Now()
+	if err := er.sendMail(l.Addr().String(), nil, []byte("x")); err == nil {
+		t.Errorf("sendMail: got nil error from silent server")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sendMail took %s, want about the timeout", d)
+	}
+}
+
+// httpRecorder is a local stand-in HTTP server that keeps the requests.
+type httpRecorder struct {
+	*httptest.Server
+	mu     sync.Mutex
+	reqs   []*http.Request
+	bodies []string
+}
+
+// newHTTPRecorder returns a running httpRecorder.
+func newHTTPRecorder() *httpRecorder {
+	h := &httpRecorder{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.reqs = append(h.reqs, r)
+		h.bodies = append(h.bodies, string(b))
+	}))
+	return h
+}
+
+func TestWebhookErrorReporter(t *testing.T) {
+	h := newHTTPRecorder()
+	defer h.Close()
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	er := NewWebhookErrorReporter(h.URL+"/hook", "tok", NewFakeClock(now))
+	er.Report(Tag(SourceWeather, SeverityWarning, errors.New("no forecast")))
+
+	if len(h.reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(h.reqs))
+	}
+	r := h.reqs[0]
+	if r.URL.Path != "/hook" || r.Header.Get("Authorization") != "Bearer tok" || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got request %s %v, want POST to /hook with token", r.URL, r.Header)
+	}
+	var p WebhookPayload
+	if err := json.Unmarshal([]byte(h.bodies[0]), &p); err != nil {
+		t.Fatal(err)
+	}
+	want := WebhookPayload{Time: now, Severity: SeverityWarning, Subject: defaultSubject, Message: "no forecast"}
+	if p != want {
+		t.Errorf("got payload %+v, want %+v", p, want)
+	}
+}
+
+func TestPushErrorReporter(t *testing.T) {
+	h := newHTTPRecorder()
+	defer h.Close()
+	notice := &IncidentNotice{Incident: &Incident{ID: 1, Source: SourceKV, Severity: SeverityCritical, Message: "disk full", Count: 1}}
+
+	NewPushErrorReporter(h.URL+"/irctl", NtfyFormat, "").Report(notice)
+	NewPushErrorReporter(h.URL+"/", GotifyFormat, "app").Report(notice)
+	if len(h.reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(h.reqs))
+	}
+
+	ntfy := h.reqs[0]
+	if ntfy.URL.Path != "/irctl" || ntfy.Header.Get("Title") != "irctl: Critical kv incident" || ntfy.Header.Get("Priority") != "urgent" ||
+		ntfy.Header.Get("Authorization") != "" || h.bodies[0] != notice.Error() {
+		t.Errorf("ntfy: got %s %v %q", ntfy.URL, ntfy.Header, h.bodies[0])
+	}
+
+	gotify := h.reqs[1]
+	if gotify.URL.Path != "/message" || gotify.Header.Get("X-Gotify-Key") != "app" {
+		t.Errorf("gotify: got %s %v", gotify.URL, gotify.Header)
+	}
+	var m struct {
+		Title    string
+		Message  string
+		Priority int
+	}
+	if err := json.Unmarshal([]byte(h.bodies[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Title != "irctl: Critical kv incident" || m.Message != notice.Error() || m.Priority != 8 {
+		t.Errorf("gotify: got message %+v", m)
+	}
+}
+
+func TestFilteredErrorReporter(t *testing.T) {
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	rec := &recordingReporter{}
+	er := NewFilteredErrorReporter("test", rec, SeverityWarning, 2, clock)
+
+	er.Report(Tag(SourceWeather, SeverityInfo, errors.New("info")))
+	er.Report(errors.New("untagged warning"))
+	er.Report(&IncidentNotice{Incident: &Incident{Severity: SeverityCritical, Message: "critical"}})
+	er.Report(Tag(SourceValve, SeverityCritical, errors.New("rate limited")))
+	if len(rec.errs) != 2 {
+		t.Errorf("got %v, want untagged warning and critical", rec.errs)
+	}
+	clock.Set(now.Add(time.Hour))
+	er.Report(Tag(SourceValve, SeverityCritical, errors.New("after an hour")))
+	if len(rec.errs) != 3 {
+		t.Errorf("got %v after an hour, want 3", rec.errs)
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	h := newHTTPRecorder()
+	defer h.Close()
+	clock := NewFakeClock(time.Now())
+	er, err := NewNotifier([]*NotificationConfig{
+		{Name: "log", Type: LogSinkType},
+		{Name: "hook", Type: WebhookSinkType, URL: h.URL + "/hook"},
+		{Name: "phone", Type: PushSinkType, URL: h.URL + "/topic", Format: NtfyFormat, MinSeverity: SeverityCritical},
+	}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	er.Report(errors.New("warning"))
+	er.Report(Tag(SourceValve, SeverityCritical, errors.New("critical")))
+	var paths []string
+	for _, r := range h.reqs {
+		paths = append(paths, r.URL.Path)
+	}
+	if got, want := strings.Join(paths, ","), "/hook,/hook,/topic"; got != want {
+		t.Errorf("got requests to %s, want %s", got, want)
+	}
+
+	if er, err := NewNotifier(nil, clock); err != nil {
+		t.Error(err)
+	} else if _, ok := er.(*LogErrorReporter); !ok {
+		t.Errorf("no sinks: got %T, want *LogErrorReporter", er)
+	}
+
+	for _, bad := range [][]*NotificationConfig{
+		{{Type: LogSinkType}},
+		{{Name: "a", Type: LogSinkType}, {Name: "a", Type: LogSinkType}},
+		{{Name: "a", Type: "pager"}},
+		{{Name: "a", Type: SMTPSinkType, SMTPServer: "localhost"}},
+		{{Name: "a", Type: WebhookSinkType}},
+		{{Name: "a", Type: PushSinkType, URL: h.URL, Format: "pushover"}},
+		{{Name: "a", Type: LogSinkType, MinSeverity: "Bad"}},
+		{{Name: "a", Type: LogSinkType, MaxPerHour: -1}},
+	} {
+		if _, err := NewNotifier(bad, clock); err == nil {
+			t.Errorf("%+v: got nil error", bad[len(bad)-1])
+		}
+	}
+}
+
+func TestLoadNotificationSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.json")
+	secrets := `{"AccuWeather": {"APIKey": "key"}, "Notifications": {"mail": {"Password": "pw"}, "phone": {"Token": "file"}}}`
+	if err := ioutil.WriteFile(path, []byte(secrets), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("IRCTL_NOTIFY_PHONE_TOKEN", "env")
+	defer os.Unsetenv("IRCTL_NOTIFY_PHONE_TOKEN")
+
+	ncs := []*NotificationConfig{{Name: "mail"}, {Name: "phone"}, {Name: "hook"}}
+	if err := LoadNotificationSecrets(ncs, path); err != nil {
+		t.Fatal(err)
+	}
+	if ncs[0].Password != "pw" || ncs[1].Token != "env" || ncs[2].Token != "" {
+		t.Errorf("got %+v %+v %+v", ncs[0], ncs[1], ncs[2])
+	}
+	if err := LoadNotificationSecrets(ncs, filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("missing secrets file: got %s", err)
+	}
+}
@@ -0,0 +1,248 @@
+package control
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIOperation describes an HTTP API endpoint, for an OpenAPI document.
+type APIOperation struct {
+	Method string
+	// Path is the path of the endpoint, with path parameters in braces,
+	// e.g. /zones/{n}.
+	Path    string
+	Summary string
+	// Role is the role needed to use the endpoint, if users are configured.
+	Role   Role
+	Params []*APIParam
+	// Request and Response are values of the request and response body
+	// types, or nil if there is no body.
+	Request  interface{}
+	Response interface{}
+	// Status is the status code for success, http.StatusOK if 0.
+	Status int
+}
+
+// APIParam is a query or path parameter of an APIOperation. Path parameters
+// are always required.
+type APIParam struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+	// Type is the JSON schema type, string if empty.
+	Type string
+}
+
+// APIError is the body of an HTTP API error response.
+type APIError struct {
+	Status int
+	Error  string
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textType      = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	pathParamRE   = regexp.MustCompile(`{([^}]+)}`)
+)
+
+// OpenAPI returns an OpenAPI 3 document for ops, served under basePath.
+// Request and response schemas are generated from the Go types of the bodies,
+// as encoded by encoding/json.
+func OpenAPI(title, version, basePath string, ops []*APIOperation) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	errRef := schemaFor(reflect.TypeOf(APIError{}), schemas)
+	paths := make(map[string]interface{})
+	for _, op := range ops {
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation(op, errRef, schemas)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": basePath}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"basic": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+		},
+	}
+}
+
+// operation returns the OpenAPI operation object for op.
+func operation(op *APIOperation, errRef map[string]interface{}, schemas map[string]interface{}) map[string]interface{} {
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		ok["content"] = jsonContent(schemaFor(reflect.TypeOf(op.Response), schemas))
+	}
+	errResp := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(errRef),
+	}
+	o := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(op),
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): ok,
+			"default":            errResp,
+		},
+	}
+	if op.Role != "" {
+		o["x-irctl-role"] = op.Role
+	}
+	var params []interface{}
+	inPath := make(map[string]bool)
+	for _, m := range pathParamRE.FindAllStringSubmatch(op.Path, -1) {
+		inPath[m[1]] = true
+	}
+	for _, p := range op.Params {
+		typ := p.Type
+		if typ == "" {
+			typ = "string"
+		}
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			"required":    p.Required || p.In == "path",
+			"schema":      map[string]interface{}{"type": typ},
+		})
+		delete(inPath, p.Name)
+	}
+	// Path parameters that aren't described are still required.
+	var rest []string
+	for n := range inPath {
+		rest = append(rest, n)
+	}
+	sort.Strings(rest)
+	for _, n := range rest {
+		params = append(params, map[string]interface{}{
+			"name":     n,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	if params != nil {
+		o["parameters"] = params
+	}
+	if op.Request != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(schemaFor(reflect.TypeOf(op.Request), schemas)),
+		}
+	}
+	return o
+}
+
+// operationID returns a unique ID for op from its method and path, e.g.
+// getZonesN for GET /zones/{n}.
+func operationID(op *APIOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, f := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '.' }) {
+		id += strings.ToUpper(f[:1]) + f[1:]
+	}
+	return id
+}
+
+// jsonContent returns an OpenAPI content object for JSON with schema.
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// schemaFor returns the JSON schema for values of t encoded by encoding/json.
+// Named struct types are added to schemas and referenced.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType):
+		// The encoding is up to the type.
+		return map[string]interface{}{}
+	case t.Implements(textType) || reflect.PtrTo(t).Implements(textType):
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Add a placeholder first, for recursive types.
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the JSON schema for the struct type t.
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		props[name] = schemaFor(f.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
@@ -0,0 +1,100 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	Name     string `json:"name"`
+	Secret   string `json:"-"`
+	When     time.Time
+	Children []*testNode
+	Tags     map[string]int
+	Raw      json.RawMessage
+	Data     []byte
+	hidden   int
+}
+
+func TestOpenAPISchema(t *testing.T) {
+	schemas := make(map[string]interface{})
+	got := schemaFor(reflect.TypeOf(&testNode{}), schemas)
+	if want := map[string]interface{}{"$ref": "#/components/schemas/testNode"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	want := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":     map[string]interface{}{"type": "string"},
+			"When":     map[string]interface{}{"type": "string", "format": "date-time"},
+			"Children": map[string]interface{}{"type": "array", "items": map[string]interface{}{"$ref": "#/components/schemas/testNode"}},
+			"Tags":     map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "integer"}},
+			"Raw":      map[string]interface{}{},
+			"Data":     map[string]interface{}{"type": "string", "format": "byte"},
+		},
+	}
+	if !reflect.DeepEqual(schemas["testNode"], want) {
+		t.Errorf("got schema %v, want %v", schemas["testNode"], want)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	ops := []*APIOperation{
+		{Method: http.MethodGet, Path: "/zones/{n}", Summary: "Get a zone.", Role: ReadOnlyRole, Response: &ZoneConfig{}},
+		{
+			Method: http.MethodPost, Path: "/zones/{n}/run", Role: OperatorRole,
+			Params:  []*APIParam{{Name: "n", In: "path", Type: "integer"}, {Name: "dry", In: "query"}},
+			Request: struct{ Mins int }{},
+			Status:  http.StatusAccepted,
+		},
+	}
+	doc := OpenAPI("irctl", "1", "/api/v1", ops)
+	// The document must be valid JSON.
+	j, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d struct {
+		Paths map[string]map[string]struct {
+			OperationID string
+			Parameters  []struct {
+				Name     string
+				In       string
+				Required bool
+				Schema   struct{ Type string }
+			}
+			RequestBody map[string]interface{}
+			Responses   map[string]interface{}
+			Role        Role `json:"x-irctl-role"`
+		}
+		Components struct {
+			Schemas map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(j, &d); err != nil {
+		t.Fatal(err)
+	}
+	get := d.Paths["/zones/{n}"]["get"]
+	if get.OperationID != "getZonesN" || get.Role != ReadOnlyRole || get.Responses["200"] == nil || get.Responses["default"] == nil {
+		t.Errorf("got GET %+v, want getZonesN with 200 and default responses", get)
+	}
+	// n isn't described, but is still a required path parameter.
+	if len(get.Parameters) != 1 || get.Parameters[0].Name != "n" || get.Parameters[0].In != "path" || !get.Parameters[0].Required {
+		t.Errorf("got GET parameters %+v, want required path parameter n", get.Parameters)
+	}
+	post := d.Paths["/zones/{n}/run"]["post"]
+	if post.Responses["202"] == nil || post.RequestBody == nil || post.Role != OperatorRole {
+		t.Errorf("got POST %+v, want 202 response and a request body", post)
+	}
+	if len(post.Parameters) != 2 || post.Parameters[0].Schema.Type != "integer" || post.Parameters[1].Required {
+		t.Errorf("got POST parameters %+v, want integer n and optional dry", post.Parameters)
+	}
+	for _, n := range []string{"ZoneConfig", "SoilConfig", "APIError"} {
+		if d.Components.Schemas[n] == nil {
+			t.Errorf("no schema for %s", n)
+		}
+	}
+}
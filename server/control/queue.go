@@ -0,0 +1,430 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// RunQueueKey is the KV store key for the persisted RunQueue.
+	RunQueueKey = "RunQueue"
+	// queueRetention is how long finished jobs are kept for inspection.
+	queueRetention = 7 * 24 * time.Hour
+)
+
+// ErrJobFinished is returned by CancelJob for a job with no queued or running
+// items left to cancel.
+var ErrJobFinished = errors.New("job already finished")
+
+// QueueItemState is the state of a QueueItem.
+type QueueItemState string
+
+const (
+	// ItemQueued is an item that is waiting to run.
+	ItemQueued QueueItemState = "Queued"
+	// ItemRunning is the item that is running.
+	ItemRunning QueueItemState = "Running"
+	// ItemDone is an item that ran for its full duration.
+	ItemDone QueueItemState = "Done"
+	// ItemCancelled is an item that was cancelled before or while running.
+	ItemCancelled QueueItemState = "Cancelled"
+	// ItemFailed is an item that couldn't be run.
+	ItemFailed QueueItemState = "Failed"
+)
+
+// ZoneRun is a request to run a zone for a duration.
+type ZoneRun struct {
+	Zone     int
+	Duration time.Duration
+}
+
+// QueueItem is one zone run in a Job.
+type QueueItem struct {
+	ID       int64
+	JobID    int64
+	Zone     int
+	Duration time.Duration
+	State    QueueItemState
+	// Started is when the item started running, if it did.
+	Started time.Time
+	// Ran is how long the item ran, once it is finished.
+	Ran   time.Duration
+	Error string `json:",omitempty"`
+}
+
+// Job is a list of zone runs that were queued together.
+type Job struct {
+	ID      int64
+	Created time.Time
+	Items   []*QueueItem
+}
+
+// queueState is the persisted state of a RunQueue.
+type queueState struct {
+	NextID int64
+	Jobs   map[int64]time.Time
+	// Items are all items of all jobs, in the order they run.
+	Items []*QueueItem
+}
+
+// RunQueue is a persisted queue of manual zone runs. Runs are done in order,
+// one at a time, whenever the RunCoordinator allows. The queue is saved in the
+// KV store after every change, so queued runs survive restarts.
+type RunQueue struct {
+	kv     KVStore
+	rc     *RunCoordinator
+	runner *ManualRunner
+	clock  Clock
+	// wake is signalled when items are added.
+	wake chan struct{}
+
+	mu    sync.Mutex
+	state queueState
+	// current is the handle of the running item, if any.
+	current *RunHandle
+}
+
+// NewRunQueue returns a ptr to a RunQueue loaded from kv, which runs items with
+// runner when rc allows. Any item that was running when the queue was last
+// saved is marked as failed, since it's not known how long it ran.
+func NewRunQueue(kv KVStore, rc *RunCoordinator, runner *ManualRunner, clock Clock) (*RunQueue, error) {
+	q := &RunQueue{
+		kv:     kv,
+		rc:     rc,
+		runner: runner,
+		clock:  clock,
+		wake:   make(chan struct{}, 1),
+		state:  queueState{NextID: 1, Jobs: make(map[int64]time.Time)},
+	}
+	s, ok, err := kv.Get(RunQueueKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok && s != "" {
+		if err := json.Unmarshal([]byte(s), &q.state); err != nil {
+			return nil, fmt.Errorf("bad run queue %s: %s", s, err)
+		}
+	}
+	for _, it := range q.state.Items {
+		if it.State == ItemRunning {
+			it.State, it.Error = ItemFailed, "interrupted by restart"
+		}
+	}
+	return q, nil
+}
+
+// Add queues runs as a new job and returns it.
+func (q *RunQueue) Add(runs []ZoneRun) (*Job, error) {
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("no zones to run")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id := q.nextID()
+	now := q.clock.Now()
+	q.state.Jobs[id] = now
+	for _, r := range runs {
+		q.state.Items = append(q.state.Items, &QueueItem{
+			ID:       q.nextID(),
+			JobID:    id,
+			Zone:     r.Zone,
+			Duration: r.Duration,
+			State:    ItemQueued,
+		})
+	}
+	if err := q.save(); err != nil {
+		return nil, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return q.job(id), nil
+}
+
+// Jobs returns all jobs in the order they were added.
+func (q *RunQueue) Jobs() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ids []int64
+	for id := range q.state.Jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var out []*Job
+	for _, id := range ids {
+		out = append(out, q.job(id))
+	}
+	return out
+}
+
+// Job returns the job with the given ID, or nil if there is none.
+func (q *RunQueue) Job(id int64) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.job(id)
+}
+
+// Queued returns the items that are waiting to run, in the order they run.
+func (q *RunQueue) Queued() []*QueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []*QueueItem
+	for _, it := range q.state.Items {
+		if it.State == ItemQueued {
+			c := *it
+			out = append(out, &c)
+		}
+	}
+	return out
+}
+
+// Move moves the queued item with the given ID to position pos among the
+// queued items, where 0 runs next.
+func (q *RunQueue) Move(itemID int64, pos int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var moved *QueueItem
+	var rest []*QueueItem
+	for _, it := range q.state.Items {
+		if it.ID == itemID {
+			moved = it
+			continue
+		}
+		rest = append(rest, it)
+	}
+	if moved == nil {
+		return fmt.Errorf("no item %d", itemID)
+	}
+	if moved.State != ItemQueued {
+		return fmt.Errorf("item %d is %s, not %s", itemID, moved.State, ItemQueued)
+	}
+	if pos < 0 {
+		return fmt.Errorf("bad position %d", pos)
+	}
+	// Insert before the pos-th queued item, or at the end.
+	i, n := 0, 0
+	for ; i < len(rest); i++ {
+		if rest[i].State != ItemQueued {
+			continue
+		}
+		if n == pos {
+			break
+		}
+		n++
+	}
+	q.state.Items = append(rest[:i], append([]*QueueItem{moved}, rest[i:]...)...)
+	return q.save()
+}
+
+// CancelItem cancels the item with the given ID if it is queued or running.
+func (q *RunQueue) CancelItem(itemID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range q.state.Items {
+		if it.ID == itemID {
+			q.cancel(it)
+			return q.save()
+		}
+	}
+	return fmt.Errorf("no item %d", itemID)
+}
+
+// CancelJob cancels all items of the job with the given ID that are queued or
+// running. It returns ErrJobFinished if there are none.
+func (q *RunQueue) CancelJob(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.state.Jobs[id]; !ok {
+		return fmt.Errorf("no job %d", id)
+	}
+	cancelled := false
+	for _, it := range q.state.Items {
+		if it.JobID == id && q.cancel(it) {
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		return ErrJobFinished
+	}
+	return q.save()
+}
+
+// Run runs queued items in order until ctx is done. An item that is stopped
+// by ctx is queued again for the time it didn't run, so that it resumes after
+// a restart.
+func (q *RunQueue) Run(ctx context.Context) {
+	for {
+		if !q.hasQueued() {
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		run, err := q.rc.Acquire(ctx, ManualRun, Queue)
+		if err != nil {
+			return
+		}
+		// The queue may have changed while waiting.
+		it, err := q.startNext(run)
+		if err != nil {
+			log.Error(err)
+		}
+		if it == nil {
+			run.Release()
+			continue
+		}
+		log.Infof("Running queued item %d of job %d, zone %d for %s.", it.ID, it.JobID, it.Zone, it.Duration)
+		done, err := q.runner.Start(run, it.Zone, it.Duration)
+		if err == nil {
+			err = <-done
+		}
+		if err := q.finish(ctx, it.ID, err); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// hasQueued reports whether any item is waiting to run.
+func (q *RunQueue) hasQueued() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range q.state.Items {
+		if it.State == ItemQueued {
+			return true
+		}
+	}
+	return false
+}
+
+// startNext marks the next queued item as running with run and returns a copy
+// of it, or nil if there is none.
+func (q *RunQueue) startNext(run *RunHandle) (*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range q.state.Items {
+		if it.State == ItemQueued {
+			it.State, it.Started = ItemRunning, q.clock.Now()
+			q.current = run
+			c := *it
+			return &c, q.save()
+		}
+	}
+	return nil, nil
+}
+
+// finish records the result err of running the item with the given ID.
+func (q *RunQueue) finish(ctx context.Context, itemID int64, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current = nil
+	for i, it := range q.state.Items {
+		if it.ID != itemID {
+			continue
+		}
+		ran := q.clock.Now().Sub(it.Started)
+		if ran > it.Duration {
+			ran = it.Duration
+		}
+		it.Ran = ran
+		switch {
+		case it.State == ItemCancelled:
+		case err != nil:
+			it.State, it.Error = ItemFailed, err.Error()
+		case ctx.Err() != nil && ran < it.Duration:
+			// Queue the rest to run first after a restart.
+			log.Infof("Item %d stopped after %s, queueing the rest.", it.ID, ran)
+			rest := &QueueItem{ID: q.nextID(), JobID: it.JobID, Zone: it.Zone, Duration: it.Duration - ran, State: ItemQueued}
+			it.State = ItemDone
+			q.state.Items = append(q.state.Items[:i+1], append([]*QueueItem{rest}, q.state.Items[i+1:]...)...)
+		default:
+			it.State = ItemDone
+		}
+		break
+	}
+	q.prune()
+	return q.save()
+}
+
+// cancel cancels it if it is queued or running, and reports whether it did.
+// It must be called with mu held.
+func (q *RunQueue) cancel(it *QueueItem) bool {
+	switch it.State {
+	case ItemQueued:
+		it.State = ItemCancelled
+	case ItemRunning:
+		it.State = ItemCancelled
+		if q.current != nil {
+			q.rc.Cancel(q.current.ID)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// job returns a copy of the job with the given ID, or nil if there is none. It
+// must be called with mu held.
+func (q *RunQueue) job(id int64) *Job {
+	created, ok := q.state.Jobs[id]
+	if !ok {
+		return nil
+	}
+	j := &Job{ID: id, Created: created}
+	for _, it := range q.state.Items {
+		if it.JobID == id {
+			c := *it
+			j.Items = append(j.Items, &c)
+		}
+	}
+	return j
+}
+
+// prune removes jobs with no queued or running items that were added more than
+// queueRetention ago. It must be called with mu held.
+func (q *RunQueue) prune() {
+	cutoff := q.clock.Now().Add(-queueRetention)
+	active := make(map[int64]bool)
+	for _, it := range q.state.Items {
+		if it.State == ItemQueued || it.State == ItemRunning {
+			active[it.JobID] = true
+		}
+	}
+	var items []*QueueItem
+	for _, it := range q.state.Items {
+		if active[it.JobID] || !q.state.Jobs[it.JobID].Before(cutoff) {
+			items = append(items, it)
+		}
+	}
+	for id, created := range q.state.Jobs {
+		if !active[id] && created.Before(cutoff) {
+			delete(q.state.Jobs, id)
+		}
+	}
+	q.state.Items = items
+}
+
+// nextID returns a new job or item ID. It must be called with mu held.
+func (q *RunQueue) nextID() int64 {
+	id := q.state.NextID
+	q.state.NextID++
+	return id
+}
+
+// save writes the queue to the KV store. It must be called with mu held.
+func (q *RunQueue) save() error {
+	j, err := json.Marshal(&q.state)
+	if err != nil {
+		return err
+	}
+	return q.kv.Set(RunQueueKey, string(j))
+}
@@ -0,0 +1,161 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// cancellingClock is a FakeClock where Sleep advances the time by after and
+// then cancels, as if the process was shutting down. If cancel is nil, it
+// sleeps as a FakeClock.
+type cancellingClock struct {
+	*FakeClock
+	after  time.Duration
+	cancel context.CancelFunc
+}
+
+func (c *cancellingClock) Sleep(ctx context.Context, d time.Duration) error {
+	if c.cancel == nil {
+		return c.FakeClock.Sleep(ctx, d)
+	}
+	c.FakeClock.Sleep(ctx, c.after)
+	c.cancel()
+	return context.Canceled
+}
+
+// newTestRunQueue returns a RunQueue that uses kv and clock, and its valve
+// controller.
+func newTestRunQueue(t *testing.T, kv KVStore, clock Clock, dataLogPath string) (*RunQueue, *TestValveController) {
+	tvc := &TestValveController{log: &TestLogger{}}
+	zc := NewZoneController(tvc, kv, clock)
+	m := NewManualRunner(&RunParams{Config: manualTestConfig, DataLogPath: dataLogPath, Clock: clock}, kv, zc)
+	q, err := NewRunQueue(kv, NewRunCoordinator(clock), m, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, tvc
+}
+
+// waitForIdle runs q until no items are queued, then stops it.
+func waitForIdle(t *testing.T, q *RunQueue) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.hasQueued() || q.rc.Busy() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for queue to run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-stopped
+}
+
+func TestRunQueue(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	kv := NewTestKVStore()
+	clock := NewFakeClock(time.Date(2019, 3, 17, 12, 0, 0, 0, time.UTC))
+	q, tvc := newTestRunQueue(t, kv, clock, root)
+	j1, err := q.Add([]ZoneRun{{Zone: 0, Duration: 2 * time.Minute}, {Zone: 1, Duration: 3 * time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j2, err := q.Add([]ZoneRun{{Zone: 2, Duration: time.Minute}, {Zone: 3, Duration: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Add(nil); err == nil {
+		t.Errorf("Add with no runs: got no error")
+	}
+
+	// Zone 2 first, then zone 0, and zone 3 is cancelled.
+	if err := q.Move(j2.Items[0].ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.CancelItem(j2.Items[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Move(j2.Items[1].ID, 0); err == nil {
+		t.Errorf("Move of cancelled item: got no error")
+	}
+	var got []int
+	for _, it := range q.Queued() {
+		got = append(got, it.Zone)
+	}
+	if len(got) != 3 || got[0] != 2 || got[1] != 0 || got[2] != 1 {
+		t.Errorf("Queued zones: got %v, want [2 0 1]", got)
+	}
+
+	// The queue survives a restart.
+	q, tvc = newTestRunQueue(t, kv, clock, root)
+	if jobs := q.Jobs(); len(jobs) != 2 || jobs[0].ID != j1.ID || len(jobs[1].Items) != 2 || jobs[1].Items[1].State != ItemCancelled {
+		t.Fatalf("Jobs after reload: got %+v, want both jobs", jobs)
+	}
+
+	waitForIdle(t, q)
+	want := []ValveOperation{{2, true}, {2, false}, {0, true}, {0, false}, {1, true}, {1, false}}
+	if len(tvc.ops) != len(want) {
+		t.Fatalf("valve ops: got %v, want %v", tvc.ops, want)
+	}
+	for i := range want {
+		if tvc.ops[i] != want[i] {
+			t.Errorf("valve ops: got %v, want %v", tvc.ops, want)
+			break
+		}
+	}
+	j := q.Job(j1.ID)
+	for _, it := range j.Items {
+		if it.State != ItemDone || it.Ran != it.Duration {
+			t.Errorf("item %d: got %s after %s, want %s after %s", it.ID, it.State, it.Ran, ItemDone, it.Duration)
+		}
+	}
+	if err := q.CancelJob(j1.ID + 100); err == nil {
+		t.Errorf("CancelJob of unknown job: got no error")
+	}
+	if err := q.CancelJob(j1.ID); err != ErrJobFinished {
+		t.Errorf("CancelJob of finished job: got %v, want %v", err, ErrJobFinished)
+	}
+}
+
+func TestRunQueueShutdown(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	kv := NewTestKVStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := &cancellingClock{FakeClock: NewFakeClock(time.Date(2019, 3, 17, 12, 0, 0, 0, time.UTC)), after: 4 * time.Minute, cancel: cancel}
+	q, _ := newTestRunQueue(t, kv, clock, root)
+	j, err := q.Add([]ZoneRun{{Zone: 0, Duration: 10 * time.Minute}, {Zone: 1, Duration: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Run(ctx)
+
+	// The rest of the stopped item runs first after a restart.
+	q, _ = newTestRunQueue(t, kv, clock.FakeClock, root)
+	items := q.Job(j.ID).Items
+	if len(items) != 3 || items[0].State != ItemDone || items[0].Ran != 4*time.Minute {
+		t.Fatalf("items: got %+v, want the first done after 4m", items)
+	}
+	if it := items[1]; it.State != ItemQueued || it.Zone != 0 || it.Duration != 6*time.Minute {
+		t.Errorf("rest: got %+v, want zone 0 queued for 6m", it)
+	}
+	if it := q.Queued(); len(it) != 2 || it[0].ID != items[1].ID {
+		t.Errorf("Queued: got %+v, want the rest first", it)
+	}
+}
@@ -0,0 +1,250 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	htemplate "html/template"
+	"text/template"
+	"time"
+)
+
+const (
+	// rollupDays is the number of days in the weekly rollup.
+	rollupDays = 7
+)
+
+// ZoneReport is what happened to a zone on the day of a DailyReport.
+type ZoneReport struct {
+	Number int
+	Name   string
+	// StartVWC is the VWC before the daily water balance, and BalanceVWC is
+	// the VWC after it. EndVWC is the VWC at the end of the day's runs.
+	StartVWC   Pct
+	BalanceVWC Pct
+	EndVWC     Pct
+	// RuntimeMins is the total time the zone ran, including manual runs.
+	RuntimeMins float64
+	// Gallons is the estimated water use, if the zone has a FlowGPM.
+	Gallons float64
+	// SkipReason says why the zone didn't run, if it didn't.
+	SkipReason string `json:",omitempty"`
+}
+
+// ZoneRollup is the total run time and water use of a zone over the rollup.
+type ZoneRollup struct {
+	Number  int
+	Name    string
+	Minutes float64
+	Gallons float64
+}
+
+// DailyReport summarizes a day of watering.
+type DailyReport struct {
+	Date time.Time
+	// Yesterday is yesterday's conditions, and EtIn is the measured reference
+	// ET, or unknownET.
+	Yesterday *ConditionsEntry
+	EtIn      float64
+	// Today and Tomorrow are the forecasts, if they were logged.
+	Today    *ConditionsEntry
+	Tomorrow *ConditionsEntry
+	Zones    []*ZoneReport
+	// Rollup is the total for each zone over the last rollupDays days, up to
+	// and including Date.
+	RollupFrom    time.Time
+	Rollup        []*ZoneRollup
+	RollupMinutes float64
+	RollupGallons float64
+}
+
+// NewDailyReport returns the DailyReport for the date in t, from the ledger
+// and conditions logged by the control loop.
+func NewDailyReport(t time.Time, sc *SystemConfig, ledger *Ledger, dl *DataLogger) (*DailyReport, error) {
+	day := dateOnly(t)
+	r := &DailyReport{Date: day, EtIn: unknownET, RollupFrom: day.AddDate(0, 0, 1-rollupDays)}
+	conds, _ := dl.ReadConditions(yesterday(day), tomorrow(day))
+	for _, c := range conds {
+		switch {
+		case datesAreEqual(c.Date, yesterday(day)):
+			r.Yesterday = c
+		case datesAreEqual(c.Date, day):
+			r.Today = c
+		case datesAreEqual(c.Date, tomorrow(day)):
+			r.Tomorrow = c
+		}
+	}
+
+	for znum := 0; znum < sc.NumZones(); znum++ {
+		z, ok := sc.ZoneConfigs[znum]
+		if !ok {
+			continue
+		}
+		zr := &ZoneReport{Number: znum, Name: z.Name}
+		zroll := &ZoneRollup{Number: znum, Name: z.Name}
+		for d := r.RollupFrom; !d.After(day); d = d.AddDate(0, 0, 1) {
+			es, err := ledger.Read(znum, d, d)
+			if err != nil {
+				return nil, err
+			}
+			es = latestEntries(es)
+			for _, e := range es {
+				if e.Kind == IrrigationEntry || e.Kind == ManualEntry || e.Kind == InterruptedEntry {
+					zroll.Minutes += e.Runtime.Minutes()
+				}
+			}
+			if datesAreEqual(d, day) {
+				r.addZoneEntries(zr, z, es)
+			}
+		}
+		zr.Gallons = zr.RuntimeMins * z.FlowGPM
+		zroll.Gallons = zroll.Minutes * z.FlowGPM
+		r.Zones = append(r.Zones, zr)
+		r.Rollup = append(r.Rollup, zroll)
+		r.RollupMinutes += zroll.Minutes
+		r.RollupGallons += zroll.Gallons
+	}
+	return r, nil
+}
+
+// addZoneEntries sets the VWCs, runtime and skip reason in zr from the ledger
+// entries es for zone z on the report day.
+func (r *DailyReport) addZoneEntries(zr *ZoneReport, z *ZoneConfig, es []*LedgerEntry) {
+	var balance *LedgerEntry
+	irrigated := false
+	for i, e := range es {
+		if i == 0 {
+			zr.StartVWC = e.StartVWC
+		}
+		zr.EndVWC = e.EndVWC
+		switch e.Kind {
+		case BalanceEntry:
+			balance = e
+			zr.BalanceVWC = e.EndVWC
+			if r.Yesterday == nil {
+				r.Yesterday = &ConditionsEntry{Date: yesterday(r.Date), Temp: e.TempF, Precip: e.PrecipIn}
+			}
+			r.EtIn = e.EtIn
+		case IrrigationEntry, InterruptedEntry:
+			irrigated = true
+			zr.RuntimeMins += e.Runtime.Minutes()
+		case ManualEntry:
+			zr.RuntimeMins += e.Runtime.Minutes()
+		}
+	}
+	switch {
+	case irrigated:
+	case balance == nil:
+		zr.SkipReason = "no water balance was calculated, see incidents"
+	case balance.EndVWC >= z.MinVWC:
+		zr.SkipReason = fmt.Sprintf("VWC %s is at or above the minimum of %s", fmtPct(balance.EndVWC), fmtPct(z.MinVWC))
+	default:
+		zr.SkipReason = fmt.Sprintf("VWC %s is below the minimum of %s but the zone didn't run, see incidents", fmtPct(balance.EndVWC), fmtPct(z.MinVWC))
+	}
+}
+
+// fmtPct formats p as a percentage.
+func fmtPct(p Pct) string {
+	return fmt.Sprintf("%.1f%%", p)
+}
+
+// Text returns the report as plain text.
+func (r *DailyReport) Text() string {
+	var b bytes.Buffer
+	if err := reportTextTemplate.Execute(&b, r); err != nil {
+		return err.Error()
+	}
+	return b.String()
+}
+
+// HTML returns the report as an HTML document.
+func (r *DailyReport) HTML() string {
+	var b bytes.Buffer
+	if err := reportHTMLTemplate.Execute(&b, r); err != nil {
+		return htemplate.HTMLEscapeString(err.Error())
+	}
+	return b.String()
+}
+
+// ReportNotice is the error passed to the notification sinks for a
+// DailyReport.
+type ReportNotice struct {
+	Report *DailyReport
+}
+
+// Error implements error#Error.
+func (n *ReportNotice) Error() string {
+	return n.Report.Text()
+}
+
+// Subject returns the subject for the report notification.
+func (n *ReportNotice) Subject() string {
+	return "irctl: watering report for " + n.Report.Date.Format(reportDateFormat)
+}
+
+// HTML returns the report as HTML.
+func (n *ReportNotice) HTML() string {
+	return n.Report.HTML()
+}
+
+// Severity returns the severity of the notification, which is always
+// SeverityInfo.
+func (n *ReportNotice) Severity() Severity {
+	return SeverityInfo
+}
+
+const (
+	// reportDateFormat is the format of dates in reports.
+	reportDateFormat = "Mon Jan 2, 2006"
+)
+
+// reportFuncs are the functions used in the report templates.
+var reportFuncs = map[string]interface{}{
+	"date": func(t time.Time) string { return t.Format(reportDateFormat) },
+	"pct":  fmtPct,
+	"et": func(et float64) string {
+		if et == unknownET {
+			return "not measured"
+		}
+		return fmt.Sprintf("%.2f In", et)
+	},
+	"f0": func(f float64) string { return fmt.Sprintf("%.0f", f) },
+	"f1": func(f float64) string { return fmt.Sprintf("%.1f", f) },
+	"f2": func(f float64) string { return fmt.Sprintf("%.2f", f) },
+}
+
+var reportTextTemplate = template.Must(template.New("text").Funcs(reportFuncs).Parse(
+	`Watering report for {{date .Date}}
+
+{{with .Yesterday}}Yesterday: {{.Icon}} {{f1 .Temp}} degF, {{f2 .Precip}} In rain{{else}}Yesterday: no conditions{{end}}, ET {{et .EtIn}}
+{{with .Today}}Today: {{.Icon}} {{f1 .Temp}} degF, {{f2 .Precip}} In rain
+{{end}}{{with .Tomorrow}}Tomorrow: {{.Icon}} {{f1 .Temp}} degF, {{f2 .Precip}} In rain
+{{end}}
+{{range .Zones}}Zone {{.Number}} {{.Name}}: VWC {{pct .StartVWC}} -> {{pct .BalanceVWC}} -> {{pct .EndVWC}}, {{f1 .RuntimeMins}} mins{{if .Gallons}}, {{f0 .Gallons}} gal{{end}}{{with .SkipReason}}
+  not run: {{.}}{{end}}
+{{end}}
+Since {{date .RollupFrom}}: {{f1 .RollupMinutes}} mins{{if .RollupGallons}}, {{f0 .RollupGallons}} gal{{end}}
+{{range .Rollup}}  Zone {{.Number}} {{.Name}}: {{f1 .Minutes}} mins{{if .Gallons}}, {{f0 .Gallons}} gal{{end}}
+{{end}}`))
+
+var reportHTMLTemplate = htemplate.Must(htemplate.New("html").Funcs(reportFuncs).Parse(
+	`<html><body>
+<h2>Watering report for {{date .Date}}</h2>
+<table>
+<tr><th></th><th>Conditions</th><th>Temp (degF)</th><th>Rain (In)</th></tr>
+{{with .Yesterday}}<tr><td>Yesterday</td><td>{{.Icon}}</td><td>{{f1 .Temp}}</td><td>{{f2 .Precip}}</td></tr>{{end}}
+{{with .Today}}<tr><td>Today</td><td>{{.Icon}}</td><td>{{f1 .Temp}}</td><td>{{f2 .Precip}}</td></tr>{{end}}
+{{with .Tomorrow}}<tr><td>Tomorrow</td><td>{{.Icon}}</td><td>{{f1 .Temp}}</td><td>{{f2 .Precip}}</td></tr>{{end}}
+</table>
+<p>Yesterday's ET: {{et .EtIn}}</p>
+<table>
+<tr><th>Zone</th><th>Start VWC</th><th>After balance</th><th>End VWC</th><th>Runtime (mins)</th><th>Gallons</th><th>Not run because</th></tr>
+{{range .Zones}}<tr><td>{{.Number}} {{.Name}}</td><td>{{pct .StartVWC}}</td><td>{{pct .BalanceVWC}}</td><td>{{pct .EndVWC}}</td><td>{{f1 .RuntimeMins}}</td><td>{{f0 .Gallons}}</td><td>{{.SkipReason}}</td></tr>
+{{end}}</table>
+<h3>Since {{date .RollupFrom}}</h3>
+<table>
+<tr><th>Zone</th><th>Minutes</th><th>Gallons</th></tr>
+{{range .Rollup}}<tr><td>{{.Number}} {{.Name}}</td><td>{{f1 .Minutes}}</td><td>{{f0 .Gallons}}</td></tr>
+{{end}}<tr><td>Total</td><td>{{f1 .RollupMinutes}}</td><td>{{f0 .RollupGallons}}</td></tr>
+</table>
+</body></html>
+`))
@@ -0,0 +1,139 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reportTestConfig = `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1,
+      "DepthIn": 8,
+      "FlowGPM": 2,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "lawn",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    },
+    "1": {
+      "CropCoefficient": 1,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "<beds>",
+      "Number": 1,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    },
+    "2": {
+      "CropCoefficient": 1,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "trees",
+      "Number": 2,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+
+func TestDailyReport(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sc := &SystemConfig{}
+	if err := sc.Parse(reportTestConfig); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	dl := NewDataLogger(root)
+	for i, icon := range []string{"sunny", "cloudy", "rain"} {
+		if err := dl.WriteConditions(day.AddDate(0, 0, i-1), icon, 70+float64(i), 0.5*float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := NewLedger(root)
+	wb := &WaterBalance{StartVWC: 12, ETRemoved: 4, EndVWC: 8}
+	for _, e := range []*LedgerEntry{
+		// Earlier in the week, only in the rollup.
+		newIrrigationEntry(day.AddDate(0, 0, -3), 0, 30*time.Minute, 9, 20),
+		newManualEntry(day.AddDate(0, 0, -7), 0, 60*time.Minute, 9, 5, 20),
+		// Zone 0 ran, zone 1 didn't need to and zone 2 should have.
+		newBalanceEntry(day, 0, 70, 0, 0.2, wb),
+		newIrrigationEntry(day, 0, 10*time.Minute, 8, 20),
+		newBalanceEntry(day, 1, 70, 0, 0.2, &WaterBalance{StartVWC: 18, ETRemoved: 4, EndVWC: 14}),
+		newBalanceEntry(day, 2, 70, 0, 0.2, wb),
+	} {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewDailyReport(day, sc, l, dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Yesterday == nil || r.Yesterday.Icon != "sunny" || r.Tomorrow == nil || r.Tomorrow.Icon != "rain" || r.EtIn != 0.2 {
+		t.Errorf("got conditions %+v %+v ET %.2f, want sunny, rain and 0.2", r.Yesterday, r.Tomorrow, r.EtIn)
+	}
+	want := []ZoneReport{
+		{Number: 0, Name: "lawn", StartVWC: 12, BalanceVWC: 8, EndVWC: 20, RuntimeMins: 10, Gallons: 20},
+		{Number: 1, Name: "<beds>", StartVWC: 18, BalanceVWC: 14, EndVWC: 14, SkipReason: "VWC 14.0% is at or above the minimum of 10.0%"},
+		{Number: 2, Name: "trees", StartVWC: 12, BalanceVWC: 8, EndVWC: 8, SkipReason: "VWC 8.0% is below the minimum of 10.0% but the zone didn't run, see incidents"},
+	}
+	for i, w := range want {
+		if *r.Zones[i] != w {
+			t.Errorf("zone %d: got %+v, want %+v", i, r.Zones[i], w)
+		}
+	}
+	if got := r.Rollup[0]; got.Minutes != 40 || got.Gallons != 80 || r.RollupMinutes != 40 || r.RollupGallons != 80 {
+		t.Errorf("got rollup %+v, total %.1f mins %.1f gal, want 40 mins, 80 gal", got, r.RollupMinutes, r.RollupGallons)
+	}
+
+	text := r.Text()
+	for _, w := range []string{
+		"Watering report for Sun Mar 17, 2019",
+		"Yesterday: sunny 70.0 degF, 0.00 In rain, ET 0.20 In",
+		"Tomorrow: rain 72.0 degF, 1.00 In rain",
+		"Zone 0 lawn: VWC 12.0% -> 8.0% -> 20.0%, 10.0 mins, 20 gal",
+		"Zone 1 <beds>: VWC 18.0% -> 14.0% -> 14.0%, 0.0 mins\n  not run: VWC 14.0% is at or above",
+		"Since Mon Mar 11, 2019: 40.0 mins, 80 gal",
+	} {
+		if !strings.Contains(text, w) {
+			t.Errorf("text %q does not contain %q", text, w)
+		}
+	}
+	html := r.HTML()
+	if !strings.Contains(html, "<td>1 &lt;beds&gt;</td>") || !strings.Contains(html, "<td>Total</td><td>40.0</td><td>80</td>") {
+		t.Errorf("HTML is not escaped or missing the total: %s", html)
+	}
+
+	n := &ReportNotice{Report: r}
+	if severityOf(n) != SeverityInfo || n.Subject() != "irctl: watering report for Sun Mar 17, 2019" || n.Error() != text {
+		t.Errorf("got notice %s %q, want Info with the report subject and text", severityOf(n), n.Subject())
+	}
+	msg := string(NewSMTPErrorReporter("localhost", 25, "a@example.com", "b@example.com", "", "").message(n))
+	for _, w := range []string{"multipart/alternative", "Content-Type: text/plain", "Content-Type: text/html", "--" + mimeBoundary + "--"} {
+		if !strings.Contains(msg, w) {
+			t.Errorf("mail does not contain %q", w)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package control
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// SimulationParams are the parameters for Simulate.
+type SimulationParams struct {
+	// Config is the config to simulate.
+	Config string
+	// ConditionsLogPath is the root path of the data logs with the conditions
+	// to replay.
+	ConditionsLogPath string
+	// From and To are the first and last days to simulate.
+	From, To time.Time
+	// InitialVWC is the VWC for each zone on the first day. Zones that are not
+	// in the map start at their MaxVWC.
+	InitialVWC map[int]Pct
+}
+
+// SimulationDay is the result of simulating one day.
+type SimulationDay struct {
+	Date time.Time
+	// TempF and PrecipIn are yesterday's conditions, which are used for the
+	// run. They are zero if there is no logged value.
+	TempF    float64
+	PrecipIn float64
+	// Runtimes are the run times in minutes, indexed by zone.
+	Runtimes []float64
+	// VWC is the VWC after the run, indexed by zone.
+	VWC []float64
+	// Ran reports whether the valve was opened, indexed by zone.
+	Ran []bool
+	// Errors are the errors reported during the day.
+	Errors []string
+}
+
+// SimulationResult is the result of Simulate.
+type SimulationResult struct {
+	NumZones int
+	Days     []*SimulationDay
+}
+
+// Simulate runs the control loop every runInterval, as Run does, on a fake
+// clock from the start of the first to the end of the last day in the
+// simulation range, with the conditions replayed from the conditions logs.
+// The loop uses an in memory KV store and a valve controller that only records
+// operations, and all data logs are written to a temp dir that is removed
+// afterwards, so Simulate has no side effects.
+func Simulate(p *SimulationParams) (*SimulationResult, error) {
+	sc := &SystemConfig{}
+	if err := sc.Parse(p.Config); err != nil {
+		return nil, fmt.Errorf("could not parse config: %s", err)
+	}
+	tmpDir, err := ioutil.TempDir("", "irctl_sim")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	day := dateOnly(p.From)
+	end := dateOnly(p.To.AddDate(0, 0, 1))
+	clock := NewFakeClock(day)
+	kv := NewTestKVStore()
+	vc := NewRecordingValveController(sc.NumZones(), clock)
+	zc := NewZoneController(vc, kv, clock)
+	cg := NewReplayConditionsGetter(NewDataLogger(p.ConditionsLogPath), clock)
+	s := &simulation{
+		numZones:   sc.NumZones(),
+		kv:         kv,
+		vc:         vc,
+		er:         &recordingErrorReporter{},
+		conditions: cg.logger,
+		results:    NewDataLogger(tmpDir),
+	}
+	rparam := &RunParams{Config: p.Config, DataLogPath: tmpDir, Clock: clock}
+	ctrl := NewController(rparam, kv, cg, *zc, s.er)
+
+	for znum := 0; znum < sc.NumZones(); znum++ {
+		z, ok := sc.ZoneConfigs[znum]
+		if !ok {
+			continue
+		}
+		vwc, ok := p.InitialVWC[znum]
+		if !ok {
+			vwc = z.MaxVWC
+		}
+		if err := SetVWC(kv, znum, float64(vwc)); err != nil {
+			return nil, err
+		}
+	}
+
+	out := &SimulationResult{NumZones: sc.NumZones()}
+	for clock.Now().Before(end) {
+		if err := ctrl.RunOnce(context.Background(), clock.Now()); err != nil {
+			s.er.Report(err)
+		}
+		clock.Sleep(context.Background(), runInterval)
+		for ; day.Before(end) && !clock.Now().Before(day.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+			d, err := s.endDay(day)
+			if err != nil {
+				return nil, err
+			}
+			out.Days = append(out.Days, d)
+		}
+	}
+	return out, nil
+}
+
+// simulation is the state of a running Simulate.
+type simulation struct {
+	numZones   int
+	kv         KVStore
+	vc         *RecordingValveController
+	er         *recordingErrorReporter
+	conditions *DataLogger
+	results    *DataLogger
+	// numOps is the number of valve operations at the start of the day.
+	numOps int
+}
+
+// endDay returns the result for the day with the date in d, and resets the
+// per day state.
+func (s *simulation) endDay(d time.Time) (*SimulationDay, error) {
+	day := &SimulationDay{
+		Date:     d,
+		Runtimes: make([]float64, s.numZones),
+		VWC:      make([]float64, s.numZones),
+		Ran:      make([]bool, s.numZones),
+		Errors:   ToStringSlice(s.er.errs),
+	}
+	if ce, err := s.conditions.readConditionsOneDay(yesterday(d)); err == nil {
+		day.TempF, day.PrecipIn = ce.Temp, ce.Precip
+	}
+	if re, err := s.results.readRuntimesOneDay(d); err == nil {
+		copy(day.Runtimes, re.Runtimes)
+	}
+	for znum := range day.VWC {
+		vwc, err := GetVWC(s.kv, znum)
+		if err != nil {
+			return nil, err
+		}
+		day.VWC[znum] = vwc
+	}
+	for _, op := range s.vc.Ops[s.numOps:] {
+		if op.Open && op.Num < len(day.Ran) {
+			day.Ran[op.Num] = true
+		}
+	}
+	s.numOps = len(s.vc.Ops)
+	s.er.errs = nil
+	return day, nil
+}
+
+// WriteCSV writes r to w as CSV, with one row per day and a runtime and VWC
+// column for each zone.
+func (r *SimulationResult) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"date", "temp_f", "precip_in"}
+	for znum := 0; znum < r.NumZones; znum++ {
+		header = append(header, fmt.Sprintf("zone%d_runtime_mins", znum), fmt.Sprintf("zone%d_vwc", znum))
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, d := range r.Days {
+		row := []string{d.Date.Format("2006-01-02"), fmt.Sprintf("%.1f", d.TempF), fmt.Sprintf("%.2f", d.PrecipIn)}
+		for znum := 0; znum < r.NumZones; znum++ {
+			row = append(row, fmt.Sprintf("%.1f", d.Runtimes[znum]), fmt.Sprintf("%.2f", d.VWC[znum]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReplayConditionsGetter is a ConditionsGetter that returns conditions from
+// the conditions logs, relative to the time on clock. The forecast is
+// what actually happened.
+type ReplayConditionsGetter struct {
+	logger *DataLogger
+	clock  Clock
+}
+
+// NewReplayConditionsGetter returns a ptr to an initialized
+// ReplayConditionsGetter that reads conditions from logger.
+func NewReplayConditionsGetter(logger *DataLogger, clock Clock) *ReplayConditionsGetter {
+	return &ReplayConditionsGetter{
+		logger: logger,
+		clock:  clock,
+	}
+}
+
+// GetForecast implements ConditionsGetter#GetForecast. If there are no
+// conditions for tomorrow, today's are used.
+func (w *ReplayConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	now := w.clock.Now()
+	ct, err := w.logger.readConditionsOneDay(now)
+	if err != nil {
+		return "", 0.0, 0.0, "", 0.0, 0.0, fmt.Errorf("no conditions for %s: %s", dateStr(now), err)
+	}
+	cm, err := w.logger.readConditionsOneDay(tomorrow(now))
+	if err != nil {
+		cm = ct
+	}
+	return ct.Icon, ct.Temp, ct.Precip, cm.Icon, cm.Temp, cm.Precip, nil
+}
+
+// GetYesterday implements ConditionsGetter#GetYesterday.
+func (w *ReplayConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	y := yesterday(w.clock.Now())
+	c, err := w.logger.readConditionsOneDay(y)
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("no conditions for %s: %s", dateStr(y), err)
+	}
+	return c.Icon, c.Temp, c.Precip, nil
+}
+
+// ValveOp is a valve operation recorded by RecordingValveController.
+type ValveOp struct {
+	Time time.Time
+	Num  int
+	Open bool
+}
+
+// RecordingValveController is a ValveController that only records the valve
+// operations, at the time on clock.
+type RecordingValveController struct {
+	numValves int
+	clock     Clock
+	// Ops are the recorded open and close operations, in order.
+	Ops []*ValveOp
+}
+
+// NewRecordingValveController returns a ptr to an initialized
+// RecordingValveController with numValves valves.
+func NewRecordingValveController(numValves int, clock Clock) *RecordingValveController {
+	return &RecordingValveController{
+		numValves: numValves,
+		clock:     clock,
+	}
+}
+
+// OpenValve implements ValveController method.
+func (vc *RecordingValveController) OpenValve(n int) error {
+	vc.Ops = append(vc.Ops, &ValveOp{Time: vc.clock.Now(), Num: n, Open: true})
+	return nil
+}
+
+// CloseValve implements ValveController method.
+func (vc *RecordingValveController) CloseValve(n int) error {
+	vc.Ops = append(vc.Ops, &ValveOp{Time: vc.clock.Now(), Num: n})
+	return nil
+}
+
+// CloseAllValves implements ValveController method.
+func (vc *RecordingValveController) CloseAllValves() error {
+	return nil
+}
+
+// NumValves implements ValveController method.
+func (vc *RecordingValveController) NumValves() int {
+	return vc.numValves
+}
+
+// recordingErrorReporter is an ErrorReporter that logs and keeps the errors.
+type recordingErrorReporter struct {
+	errs Errors
+}
+
+// Report implements ErrorReporter#Report.
+func (er *recordingErrorReporter) Report(err error) error {
+	log.Error(err)
+	er.errs = AppendErr(er.errs, err)
+	return err
+}
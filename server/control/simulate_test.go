@@ -0,0 +1,102 @@
+package control
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	config := `
+{
+  "ETAlgorithmEToConfig": {
+    "DefaultEtIn": 0.1
+  },
+  "GlobalConfig": {
+    "AirportCode": "KSJC",
+    "RunTimeAM": "0000-01-01T09:00:00Z"
+  },
+  "ZoneConfigs": {
+    "0": {
+      "CropCoefficient": 1,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 0",
+      "Number": 0,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    },
+    "1": {
+      "CropCoefficient": 1.5,
+      "DepthIn": 8,
+      "MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "zone 1",
+      "Number": 1,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+    }
+  }
+}
+`
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	from := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	dl := NewDataLogger(root)
+	// There are no conditions for the last day.
+	for d := from.AddDate(0, 0, -1); d.Before(from.AddDate(0, 0, 3)); d = d.AddDate(0, 0, 1) {
+		if err := dl.WriteConditions(d, "sunny", 70, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := Simulate(&SimulationParams{Config: config, ConditionsLogPath: root, From: from, To: from.AddDate(0, 0, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Days) != 4 {
+		t.Fatalf("got %d days, want 4", len(res.Days))
+	}
+	// Zone 0 loses 10% a day, so it is at MinVWC after the first day and runs
+	// for 10 minutes from 0 back to MaxVWC after the second.
+	wantZone0 := []struct {
+		runtime float64
+		vwc     float64
+	}{{0, 10}, {10, 20}, {0, 10}}
+	for i, d := range res.Days[:3] {
+		if !d.Date.Equal(from.AddDate(0, 0, i)) || d.TempF != 70 || len(d.Errors) != 0 {
+			t.Errorf("day %d: got %s / %3.1f / %v, want %s / 70 / no errors", i, d.Date, d.TempF, d.Errors, from.AddDate(0, 0, i))
+		}
+		if w := wantZone0[i]; d.Runtimes[0] != w.runtime || d.Ran[0] != (w.runtime != 0) || d.VWC[0] != w.vwc {
+			t.Errorf("day %d: got zone 0 runtime %v, ran %t, VWC %v, want %v mins to VWC %v", i, d.Runtimes[0], d.Ran[0], d.VWC[0], w.runtime, w.vwc)
+		}
+		// Zone 1 loses 15% a day and runs for (20-5)/20*10 minutes to get
+		// back to MaxVWC.
+		if d.Runtimes[1] != 7 || !d.Ran[1] || d.VWC[1] != 20 {
+			t.Errorf("day %d: got runtimes %v, ran %v, VWC %v, want zone 1 to run for 7 mins to VWC 20", i, d.Runtimes, d.Ran, d.VWC)
+		}
+	}
+	if len(res.Days[3].Errors) == 0 {
+		t.Errorf("day 3: got no errors for missing conditions")
+	}
+
+	var b bytes.Buffer
+	if err := res.WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	if got, want := lines[0], "date,temp_f,precip_in,zone0_runtime_mins,zone0_vwc,zone1_runtime_mins,zone1_vwc"; got != want {
+		t.Errorf("CSV header: got %s, want %s", got, want)
+	}
+	if got, want := lines[1], "2019-03-01,70.0,0.00,0.0,10.00,7.0,20.00"; got != want {
+		t.Errorf("CSV first row: got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+package control
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ZoneStatus is the current state of a zone.
+type ZoneStatus struct {
+	Number int
+	Name   string
+	State  ZoneState
+	VWC    float64
+}
+
+// Status is a snapshot of what the controller is doing.
+type Status struct {
+	Time time.Time
+	// Active is the run that has the valves, or nil if there is none.
+	Active *ActiveRun `json:",omitempty"`
+	// RemainingMins is the time left for the running zone, if any.
+	RemainingMins float64
+	// LastRunDate is the date of the last complete auto run, if any.
+	LastRunDate string
+	// NextRun is when the next auto run is scheduled. It is in the past if
+	// today's run is overdue, e.g. because it was postponed for rain, in which
+	// case it is retried every loop.
+	NextRun   time.Time
+	RainDelay *RainDelay `json:",omitempty"`
+	Zones     []*ZoneStatus
+}
+
+// GetStatus returns the Status at time now, from the state in kv, the zone
+// states in zc, the active run in rc and the zones and run time in sc.
+func GetStatus(now time.Time, kv KVStore, zc *ZoneController, rc *RunCoordinator, sc *SystemConfig) (*Status, error) {
+	s := &Status{Time: now, Active: rc.Active()}
+	if s.Active != nil && s.Active.Zone >= 0 && s.Active.Until.After(now) {
+		s.RemainingMins = s.Active.Until.Sub(now).Minutes()
+	}
+
+	lr, _, err := kv.Get(LastRunDateKey)
+	if err != nil {
+		return nil, err
+	}
+	s.LastRunDate = lr
+	var ran bool
+	s.NextRun, ran, err = nextRun(now, kv, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	if rd, ok, err := kv.Get(RainDelayKey); err != nil {
+		return nil, err
+	} else if ok && rd != "" {
+		s.RainDelay = &RainDelay{}
+		if err := json.Unmarshal([]byte(rd), s.RainDelay); err != nil {
+			return nil, err
+		}
+		// Only a delay of today's run is current.
+		if ran || !datesAreEqual(s.RainDelay.Time, now) {
+			s.RainDelay = nil
+		}
+	}
+
+	for znum := 0; znum < sc.NumZones(); znum++ {
+		z, ok := sc.ZoneConfigs[znum]
+		if !ok {
+			continue
+		}
+		state, err := zc.State(znum)
+		if err != nil {
+			return nil, err
+		}
+		vwc, err := GetVWC(kv, znum)
+		if err != nil {
+			return nil, err
+		}
+		s.Zones = append(s.Zones, &ZoneStatus{Number: znum, Name: z.Name, State: state, VWC: vwc})
+	}
+	return s, nil
+}
+
+// nextRun returns when the next auto run is scheduled at time now, and
+// whether today's run is done.
+func nextRun(now time.Time, kv KVStore, sc *SystemConfig) (time.Time, bool, error) {
+	ran, err := checkIfRanToday(kv, now)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	rt := sc.GlobalConfig.RunTimeAM
+	next := time.Date(now.Year(), now.Month(), now.Day(), rt.Hour(), rt.Minute(), rt.Second(), 0, now.Location())
+	if ran {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, ran, nil
+}
@@ -0,0 +1,60 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetStatus(t *testing.T) {
+	sc := &SystemConfig{}
+	if err := sc.Parse(manualTestConfig); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 3, 17, 8, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	kv := NewTestKVStore()
+	zc := NewZoneController(&TestValveController{log: &TestLogger{}}, kv, clock)
+	rc := NewRunCoordinator(clock)
+	if err := SetVWC(kv, 0, 15); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := GetStatus(now, kv, zc, rc, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active != nil || s.LastRunDate != "" || !s.NextRun.Equal(now.Add(time.Hour)) {
+		t.Errorf("idle: got %+v, want next run at 9:00 today", s)
+	}
+	if len(s.Zones) != 1 || s.Zones[0].Name != "zone 0" || s.Zones[0].State != Idle || s.Zones[0].VWC != 15 {
+		t.Errorf("idle zones: got %+v, want zone 0 Idle at 15", s.Zones)
+	}
+
+	run, err := rc.Acquire(context.Background(), ManualRun, Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.Release()
+	run.SetZone(0, 10*time.Minute)
+	if err := zc.SetState(0, ManualRunning); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set(LastRunDateKey, now.Format(dateFormat)); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(4 * time.Minute)
+	s, err = GetStatus(later, kv, zc, rc, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active == nil || s.Active.Zone != 0 || s.RemainingMins != 6 {
+		t.Errorf("running: got active %+v, %3.1f mins remaining, want zone 0 with 6", s.Active, s.RemainingMins)
+	}
+	if s.Zones[0].State != ManualRunning {
+		t.Errorf("running: got zone state %s, want %s", s.Zones[0].State, ManualRunning)
+	}
+	if want := now.AddDate(0, 0, 1).Add(time.Hour); s.LastRunDate == "" || !s.NextRun.Equal(want) {
+		t.Errorf("ran today: got last run %q, next run %s, want next run %s", s.LastRunDate, s.NextRun, want)
+	}
+}
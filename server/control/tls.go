@@ -0,0 +1,108 @@
+package control
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// selfSignedValidity is how long a generated self-signed certificate is valid.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// EnsureSelfSignedCert writes a self-signed certificate for hosts, which are
+// host names or IP addresses, and its private key to certPath and keyPath, if
+// either is missing. It returns true if it wrote them. If both exist but
+// aren't a matching pair, it returns an error rather than replace them.
+func EnsureSelfSignedCert(certPath, keyPath string, hosts []string, clock Clock) (bool, error) {
+	certExists, err := fileExists(certPath)
+	if err != nil {
+		return false, err
+	}
+	keyExists, err := fileExists(keyPath)
+	if err != nil {
+		return false, err
+	}
+	if certExists && keyExists {
+		if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+			return false, fmt.Errorf("bad TLS certificate %s or key %s, remove both to generate new ones: %s", certPath, keyPath, err)
+		}
+		return false, nil
+	}
+	certPEM, keyPEM, err := SelfSignedCert(hosts, clock.Now())
+	if err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return false, fmt.Errorf("could not write TLS key to %s: %s", keyPath, err)
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return false, fmt.Errorf("could not write TLS certificate to %s: %s", certPath, err)
+	}
+	return true, nil
+}
+
+// fileExists reports whether there is a file at path.
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	}
+	return false, err
+}
+
+// SelfSignedCert returns a PEM encoded self-signed certificate for hosts,
+// valid from now, and its PEM encoded ECDSA private key.
+func SelfSignedCert(hosts []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("no hosts for self-signed certificate")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"irctl"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,85 @@
+package control
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	clock := NewFakeClock(now)
+
+	if _, err := EnsureSelfSignedCert(certPath, keyPath, nil, clock); err == nil {
+		t.Errorf("got nil error with no hosts")
+	}
+	wrote, err := EnsureSelfSignedCert(certPath, keyPath, []string{"irctl.local", "192.168.1.10", "::1"}, clock)
+	if err != nil || !wrote {
+		t.Fatalf("got %t, %v, want a new certificate", wrote, err)
+	}
+	kp, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"irctl.local", "192.168.1.10", "::1"} {
+		if err := cert.VerifyHostname(h); err != nil {
+			t.Errorf("VerifyHostname(%s): %s", h, err)
+		}
+	}
+	if cert.NotAfter.Before(now.Add(365 * 24 * time.Hour)) {
+		t.Errorf("got NotAfter %s, want years from now", cert.NotAfter)
+	}
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode: got %v, %v, want 0600", fi.Mode(), err)
+	}
+
+	// An existing certificate is kept.
+	before, _ := ioutil.ReadFile(certPath)
+	if wrote, err := EnsureSelfSignedCert(certPath, keyPath, []string{"other"}, clock); err != nil || wrote {
+		t.Errorf("second call: got %t, %v, want existing certificate kept", wrote, err)
+	}
+	if after, _ := ioutil.ReadFile(certPath); string(after) != string(before) {
+		t.Errorf("certificate was replaced")
+	}
+
+	// A certificate without its key is replaced.
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if wrote, err := EnsureSelfSignedCert(certPath, keyPath, []string{"other"}, clock); err != nil || !wrote {
+		t.Errorf("missing key: got %t, %v, want a new certificate", wrote, err)
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Errorf("new pair: %s", err)
+	}
+
+	// A key that doesn't match the certificate is an error, and both are kept.
+	otherCert, otherKey := filepath.Join(dir, "other-cert.pem"), filepath.Join(dir, "other-key.pem")
+	if _, err := EnsureSelfSignedCert(otherCert, otherKey, []string{"other"}, clock); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(otherKey, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	before, _ = ioutil.ReadFile(certPath)
+	if wrote, err := EnsureSelfSignedCert(certPath, keyPath, []string{"other"}, clock); err == nil || wrote {
+		t.Errorf("mismatched key: got %t, %v, want an error", wrote, err)
+	}
+	if after, _ := ioutil.ReadFile(certPath); string(after) != string(before) {
+		t.Errorf("certificate with mismatched key was replaced")
+	}
+}
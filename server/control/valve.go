@@ -122,7 +122,7 @@ func (vc *PhysicalValveController) valveCommand(cmdStr string, zoneNum, repeat i
 			return nil
 		}
 		out = string(outB)
-		log.Errorf(cmd + ":" + out + ":" + err.Error())
+		log.Errorf("%s:%s:%s", cmd, out, err)
 		time.Sleep(commandRetryInterval)
 	}
 	return errors.New(out)
@@ -3,6 +3,7 @@ package weather
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	log "github.com/golang/glog"
 )
@@ -45,26 +46,30 @@ type AccuWeatherConditionsGetter struct {
 }
 
 // NewAccuWeatherConditionsGetter returns a ptr to an initialized
-// AccuWeatherConditionsGetter.
-func NewAccuWeatherConditionsGetter() *AccuWeatherConditionsGetter {
+// AccuWeatherConditionsGetter. pc must have APIKey and LocationKey set.
+func NewAccuWeatherConditionsGetter(pc *ProviderConfig) (*AccuWeatherConditionsGetter, error) {
 	// forecast
-	// http://dataservice.accuweather.com/forecasts/v1/daily/5day/331979?apikey=ERwBwIsOlAoQ7qIwxpdgBJpBQxXd6ARX
+	// http://dataservice.accuweather.com/forecasts/v1/daily/5day/331979?apikey=<apiKey>
 	// yesterday
-	// http://dataservice.accuweather.com/currentconditions/v1/331979/historical/24?apikey=ERwBwIsOlAoQ7qIwxpdgBJpBQxXd6ARX&details=true
-	apiKeyStr := `ERwBwIsOlAoQ7qIwxpdgBJpBQxXd6ARX`
-	locationKeyStr := `331979`
-	return &AccuWeatherConditionsGetter{
-		apiKey:  apiKeyStr,
-		locationKeyStr: locationKeyStr,
-		urlBase: `http://dataservice.accuweather.com/`,
+	// http://dataservice.accuweather.com/currentconditions/v1/331979/historical/24?apikey=<apiKey>&details=true
+	if pc.APIKey == "" {
+		return nil, errMissingAPIKey(AccuWeatherName)
+	}
+	if pc.LocationKey == "" {
+		return nil, fmt.Errorf("%s: LocationKey is not set in the provider config", AccuWeatherName)
 	}
+	return &AccuWeatherConditionsGetter{
+		apiKey:         pc.APIKey,
+		locationKeyStr: pc.LocationKey,
+		urlBase:        urlOrDefault(pc.BaseURL, `http://dataservice.accuweather.com/`),
+	}, nil
 }
 
 // GetForecast implements ConditionsGetter#GetForecast.
 func (w *AccuWeatherConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
-	// http://dataservice.accuweather.com/forecasts/v1/daily/5day/331979?apikey=ERwBwIsOlAoQ7qIwxpdgBJpBQxXd6ARX&details=true
+	// http://dataservice.accuweather.com/forecasts/v1/daily/5day/331979?apikey=<apiKey>&details=true
 	url := w.urlBase + "forecasts/v1/daily/5day/" + w.locationKeyStr + "?details=true&apikey=" + w.apiKey
-	log.Infof("GetForecast send request %s", url)
+	log.Infof("GetForecast send request %s", strings.Replace(url, w.apiKey, "<apiKey>", 1))
 	resp, err := GetURL(url)
 	if err != nil {
 		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
@@ -79,9 +84,9 @@ func (w *AccuWeatherConditionsGetter) GetForecast(airportCode string) (icon stri
 
 // GetYesterday implements ConditionsGetter#GetYesterday.
 func (w *AccuWeatherConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
-	// http://dataservice.accuweather.com/currentconditions/v1/331979/historical/24?apikey=ERwBwIsOlAoQ7qIwxpdgBJpBQxXd6ARX&details=true
+	// http://dataservice.accuweather.com/currentconditions/v1/331979/historical/24?apikey=<apiKey>&details=true
 	url := w.urlBase + "currentconditions/v1/" + w.locationKeyStr + "/historical/24?details=true&apikey=" + w.apiKey
-	log.Infof("GetYesterday send request %s", url)
+	log.Infof("GetYesterday send request %s", strings.Replace(url, w.apiKey, "<apiKey>", 1))
 	resp, err := GetURL(url)
 	if err != nil {
 		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
@@ -0,0 +1,197 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// cimisDataItems are the daily data items requested from CIMIS.
+	cimisDataItems = "day-air-tmp-max,day-precip,day-asce-eto"
+	// cimisDateFormat is the date format used by CIMIS.
+	cimisDateFormat = "2006-01-02"
+)
+
+// CIMISConditionsGetter is an ETConditionsGetter for the California Irrigation
+// Management Information System (CIMIS) station network. CIMIS only reports
+// measured data, so forecasts are delegated to another ConditionsGetter.
+// The station is set at construction and airportCode is only passed through
+// to the forecaster.
+type CIMISConditionsGetter struct {
+	appKey     string
+	station    string
+	urlBase    string
+	forecaster ConditionsGetter
+	// now returns the current time, used to determine which day is yesterday.
+	now func() time.Time
+}
+
+// cimisResponse is the subset of a CIMIS data response that is used.
+type cimisResponse struct {
+	Data struct {
+		Providers []struct {
+			Records []*cimisRecord
+		}
+	}
+}
+
+// cimisRecord is a single daily record for a station.
+type cimisRecord struct {
+	Date         string
+	Station      string
+	DayAirTmpMax *cimisValue
+	DayPrecip    *cimisValue
+	DayAsceEto   *cimisValue
+}
+
+// cimisValue is a CIMIS data value. Value is empty if the value is missing.
+type cimisValue struct {
+	Value string
+	Qc    string
+	Unit  string
+}
+
+// NewCIMISConditionsGetter returns a ptr to an initialized
+// CIMISConditionsGetter, which uses forecaster for forecasts. pc must have
+// APIKey (the CIMIS app key) and Station (the CIMIS station number) set.
+func NewCIMISConditionsGetter(pc *ProviderConfig, forecaster ConditionsGetter) (*CIMISConditionsGetter, error) {
+	// yesterday
+	// https://et.water.ca.gov/api/data?appKey=...&targets=211&startDate=2019-03-16&endDate=2019-03-16&dataItems=day-air-tmp-max,day-precip,day-asce-eto&unitOfMeasure=E
+	if pc.APIKey == "" {
+		return nil, errMissingAPIKey(CIMISName)
+	}
+	if pc.Station == "" {
+		return nil, fmt.Errorf("%s: Station is not set in the provider config", CIMISName)
+	}
+	return &CIMISConditionsGetter{
+		appKey:     pc.APIKey,
+		station:    pc.Station,
+		urlBase:    urlOrDefault(pc.BaseURL, `https://et.water.ca.gov/api/`),
+		forecaster: forecaster,
+		now:        time.Now,
+	}, nil
+}
+
+// GetForecast implements ConditionsGetter#GetForecast.
+func (w *CIMISConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	return w.forecaster.GetForecast(airportCode)
+}
+
+// GetYesterday implements ConditionsGetter#GetYesterday. CIMIS has no
+// sky conditions, so the icon is always "unknown".
+func (w *CIMISConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	y, err := w.getYesterday()
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
+	}
+	return y.Icon, y.TempF, y.PrecipIn, nil
+}
+
+// GetYesterdayET implements ETConditionsGetter#GetYesterdayET.
+func (w *CIMISConditionsGetter) GetYesterdayET(airportCode string) (etIn float64, err error) {
+	y, err := w.getYesterday()
+	if err != nil {
+		return 0.0, fmt.Errorf("GetYesterdayET: %s", err)
+	}
+	return y.ETIn, nil
+}
+
+// GetHistory implements HistoricalConditionsGetter#GetHistory.
+func (w *CIMISConditionsGetter) GetHistory(airportCode string, from, to time.Time) ([]*DailyConditions, error) {
+	days, err := w.getDays(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("GetHistory: %s", err)
+	}
+	return days, nil
+}
+
+// getYesterday returns the conditions for yesterday.
+func (w *CIMISConditionsGetter) getYesterday() (*DailyConditions, error) {
+	y := w.now().AddDate(0, 0, -1)
+	days, err := w.getDays(y, y)
+	if err != nil {
+		return nil, err
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("no data for station %s on %s", w.station, y.Format(cimisDateFormat))
+	}
+	return days[0], nil
+}
+
+// getDays returns the conditions for the days from "from" to "to".
+func (w *CIMISConditionsGetter) getDays(from, to time.Time) ([]*DailyConditions, error) {
+	q := url.Values{}
+	q.Set("appKey", w.appKey)
+	q.Set("targets", w.station)
+	q.Set("startDate", from.Format(cimisDateFormat))
+	q.Set("endDate", to.Format(cimisDateFormat))
+	q.Set("dataItems", cimisDataItems)
+	q.Set("unitOfMeasure", "E")
+	url := w.urlBase + "data?" + q.Encode()
+	log.Infof("CIMIS send request %s", strings.Replace(url, w.appKey, "<appKey>", 1))
+	resp, err := GetURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return w.ParseDaily(resp)
+}
+
+// ParseDaily parses a daily data response from CIMIS. Days that are missing
+// any of the values are omitted.
+func (w *CIMISConditionsGetter) ParseDaily(resp []byte) ([]*DailyConditions, error) {
+	var r cimisResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		return nil, fmt.Errorf("%s: \n\n%s", err, string(resp))
+	}
+	if len(r.Data.Providers) == 0 {
+		return nil, fmt.Errorf("no providers in response:\n%s", string(resp))
+	}
+
+	var out []*DailyConditions
+	for _, rec := range r.Data.Providers[0].Records {
+		date, err := time.Parse(cimisDateFormat, rec.Date)
+		if err != nil {
+			return nil, fmt.Errorf("bad date %s: %s", rec.Date, err)
+		}
+		t, terr := rec.DayAirTmpMax.float()
+		p, perr := rec.DayPrecip.float()
+		et, eterr := rec.DayAsceEto.float()
+		if terr != nil || perr != nil || eterr != nil {
+			log.Infof("CIMIS station %s has incomplete data for %s, skipping", rec.Station, rec.Date)
+			continue
+		}
+		out = append(out, &DailyConditions{
+			Date:     date,
+			Icon:     "unknown",
+			TempF:    t,
+			PrecipIn: p,
+			ETIn:     et,
+		})
+	}
+	return out, nil
+}
+
+// float returns the value of v as a float64 in English units, or an error if
+// the value is missing.
+func (v *cimisValue) float() (float64, error) {
+	if v == nil || v.Value == "" {
+		return 0.0, fmt.Errorf("missing value")
+	}
+	f, err := strconv.ParseFloat(v.Value, 64)
+	if err != nil {
+		return 0.0, fmt.Errorf("bad float value %s", v.Value)
+	}
+	switch v.Unit {
+	case "(mm)":
+		f /= mmPerIn
+	case "(C)":
+		f = cToF(f)
+	}
+	return f, nil
+}
@@ -0,0 +1,124 @@
+package weather
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	cimisSubdir = "cimis"
+)
+
+// testForecaster is a ConditionsGetter that returns fixed forecast values.
+type testForecaster struct{}
+
+func (w *testForecaster) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	return "sunny", 75, 0, "rain", 60, 0.5, nil
+}
+
+func (w *testForecaster) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	return "sunny", 72, 0, nil
+}
+
+// newCIMISTestServer returns a server that serves the recorded CIMIS response
+// in testdata, filtered to the requested date range.
+func newCIMISTestServer(t *testing.T) *httptest.Server {
+	return newTestdataServer(t, cimisSubdir, func(r *http.Request) (string, int) {
+		if r.URL.Path != "/data" {
+			return "", 0
+		}
+		if r.FormValue("appKey") != "test-key" || r.FormValue("targets") != "211" {
+			return "", http.StatusForbidden
+		}
+		if got, want := r.FormValue("dataItems"), cimisDataItems; got != want {
+			t.Errorf("dataItems: got %s, want %s", got, want)
+		}
+		if r.FormValue("startDate") > "2019-03-17" {
+			return "empty.json", 0
+		}
+		return "data.json", 0
+	})
+}
+
+func newTestCIMISConditionsGetter(t *testing.T, urlBase string, now time.Time) *CIMISConditionsGetter {
+	w, err := NewCIMISConditionsGetter(&ProviderConfig{BaseURL: urlBase, APIKey: "test-key", Station: "211"}, &testForecaster{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.now = func() time.Time { return now }
+	return w
+}
+
+func TestCIMISParseDaily(t *testing.T) {
+	j, err := ioutil.ReadFile(filepath.Join(testRoot, cimisSubdir, "data.json"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile: could not open file: %v", err)
+	}
+
+	wcg := &CIMISConditionsGetter{}
+	got, err := wcg.ParseDaily(j)
+	if err != nil {
+		t.Fatalf("ParseDaily: %v", err)
+	}
+
+	// The last day has missing values and is omitted.
+	want := []*DailyConditions{
+		{Date: time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC), Icon: "unknown", TempF: 66.2, PrecipIn: 0.0, ETIn: 0.13},
+		{Date: time.Date(2019, 3, 16, 0, 0, 0, 0, time.UTC), Icon: "unknown", TempF: 70.5, PrecipIn: 0.04, ETIn: 0.16},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ParseDaily: got %d days, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Errorf("ParseDaily day %d: got %+v, want %+v", i, *got[i], *want[i])
+		}
+	}
+}
+
+func TestCIMISGetYesterday(t *testing.T) {
+	ts := newCIMISTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestCIMISConditionsGetter(t, ts.URL, time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC))
+	var cg ETConditionsGetter = wcg
+	icon, tF, pIn, err := cg.GetYesterday("KSJC")
+	if err != nil {
+		t.Fatalf("GetYesterday: %v", err)
+	}
+	// The recorded response holds several days. Only the first is used.
+	if icon != "unknown" || tF != 66.2 || pIn != 0.0 {
+		t.Errorf("GetYesterday: got %s / %3.2f / %3.2f, want unknown / 66.2 / 0.0", icon, tF, pIn)
+	}
+	et, err := cg.GetYesterdayET("KSJC")
+	if err != nil {
+		t.Fatalf("GetYesterdayET: %v", err)
+	}
+	if et != 0.13 {
+		t.Errorf("GetYesterdayET: got %3.2f, want 0.13", et)
+	}
+
+	icon, tF, pIn, iconTom, tFTom, pInTom, err := cg.GetForecast("KSJC")
+	if err != nil || icon != "sunny" || tF != 75 || pIn != 0 || iconTom != "rain" || tFTom != 60 || pInTom != 0.5 {
+		t.Errorf("GetForecast: got %s / %3.2f / %3.2f / %s / %3.2f / %3.2f / %v, want forecaster values", icon, tF, pIn, iconTom, tFTom, pInTom, err)
+	}
+}
+
+func TestCIMISGetYesterdayNoData(t *testing.T) {
+	ts := newCIMISTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestCIMISConditionsGetter(t, ts.URL, time.Date(2019, 3, 20, 9, 0, 0, 0, time.UTC))
+	if _, err := wcg.GetYesterdayET("KSJC"); err == nil {
+		t.Error("GetYesterdayET: got nil error with no data, want error")
+	}
+
+	wcg.appKey = "bad-key"
+	if _, _, _, err := wcg.GetYesterday("KSJC"); err == nil {
+		t.Error("GetYesterday: got nil error with bad key, want error")
+	}
+}
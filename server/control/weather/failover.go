@@ -0,0 +1,299 @@
+package weather
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// defaultProviderTimeout is the time a provider has to respond before the
+	// next provider is tried.
+	defaultProviderTimeout = 30 * time.Second
+	// cacheKeyPrefix is the prefix for all cache keys.
+	cacheKeyPrefix = "ConditionsCache"
+	// cacheDateFormat is the format of the period that a cached value of daily
+	// data is used within.
+	cacheDateFormat = "2006-01-02"
+	// cacheHourFormat is the format of the period for hourly data, which is
+	// only reused within the hour.
+	cacheHourFormat = "2006-01-02T15"
+)
+
+// ErrNotSupported is returned when no provider supports the requested call.
+var ErrNotSupported = errors.New("not supported by any provider")
+
+// Cache is a string key value store used to cache provider responses.
+// control.KVStore satisfies this interface.
+type Cache interface {
+	// Get returns the value of the given key. It returns false if the key
+	// is not found.
+	Get(key string) (string, bool, error)
+	// Set sets the given key with the given value.
+	Set(key, value string) error
+}
+
+// Provider is a named ConditionsGetter in a failover chain.
+type Provider struct {
+	Name   string
+	Getter ConditionsGetter
+	// Timeout is the time the provider has to respond. If zero,
+	// defaultProviderTimeout is used.
+	Timeout time.Duration
+}
+
+// FailoverConditionsGetter is an ETConditionsGetter that tries each of an
+// ordered list of providers in turn until one succeeds. Successful responses
+// are cached for the current day (or hour, for hourly forecasts), so that
+// repeated calls don't call the providers again.
+type FailoverConditionsGetter struct {
+	providers []*Provider
+	cache     Cache
+	ttl       time.Duration
+	// now returns the current time, used for cache keys and expiry.
+	now func() time.Time
+}
+
+// cacheEntry is a cached response, stored as JSON.
+type cacheEntry struct {
+	// Period is the day or hour the response is for. There is one entry per
+	// method and airport code, which is overwritten for a new period.
+	Period   string
+	Expires  time.Time
+	Provider string
+	Value    json.RawMessage
+}
+
+// forecastValues are the return values of GetForecast.
+type forecastValues struct {
+	Icon, IconTom         string
+	TempF, TempFTom       float64
+	PrecipIn, PrecipInTom float64
+}
+
+// yesterdayValues are the return values of GetYesterday.
+type yesterdayValues struct {
+	Icon     string
+	TempF    float64
+	PrecipIn float64
+}
+
+// NewFailoverConditionsGetter returns a ptr to an initialized
+// FailoverConditionsGetter that tries providers in the given order. Responses
+// are cached in cache for ttl. If cache is nil, responses are not cached.
+func NewFailoverConditionsGetter(cache Cache, ttl time.Duration, providers ...*Provider) *FailoverConditionsGetter {
+	return &FailoverConditionsGetter{
+		providers: providers,
+		cache:     cache,
+		ttl:       ttl,
+		now:       time.Now,
+	}
+}
+
+// GetForecast implements ConditionsGetter#GetForecast.
+func (w *FailoverConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	var v forecastValues
+	err = w.get("Forecast", airportCode, cacheDateFormat, &v, func(cg ConditionsGetter) (interface{}, error) {
+		var v forecastValues
+		var err error
+		v.Icon, v.TempF, v.PrecipIn, v.IconTom, v.TempFTom, v.PrecipInTom, err = cg.GetForecast(airportCode)
+		return &v, err
+	})
+	if err != nil {
+		return "", 0.0, 0.0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	return v.Icon, v.TempF, v.PrecipIn, v.IconTom, v.TempFTom, v.PrecipInTom, nil
+}
+
+// GetYesterday implements ConditionsGetter#GetYesterday.
+func (w *FailoverConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	var v yesterdayValues
+	err = w.get("Yesterday", airportCode, cacheDateFormat, &v, func(cg ConditionsGetter) (interface{}, error) {
+		var v yesterdayValues
+		var err error
+		v.Icon, v.TempF, v.PrecipIn, err = cg.GetYesterday(airportCode)
+		return &v, err
+	})
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
+	}
+	return v.Icon, v.TempF, v.PrecipIn, nil
+}
+
+// GetYesterdayET implements ETConditionsGetter#GetYesterdayET. Only providers
+// that are ETConditionsGetters are tried. It returns ErrNotSupported if there
+// are none.
+func (w *FailoverConditionsGetter) GetYesterdayET(airportCode string) (etIn float64, err error) {
+	if !w.supports(func(cg ConditionsGetter) bool {
+		_, ok := cg.(ETConditionsGetter)
+		return ok
+	}) {
+		return 0.0, ErrNotSupported
+	}
+
+	err = w.get("YesterdayET", airportCode, cacheDateFormat, &etIn, func(cg ConditionsGetter) (interface{}, error) {
+		etcg, ok := cg.(ETConditionsGetter)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		et, err := etcg.GetYesterdayET(airportCode)
+		return et, err
+	})
+	if err != nil {
+		return 0.0, fmt.Errorf("GetYesterdayET: %s", err)
+	}
+	return etIn, nil
+}
+
+// GetHourlyPrecip implements HourlyForecastGetter#GetHourlyPrecip. Only
+// providers that are HourlyForecastGetters are tried. It returns
+// ErrNotSupported if there are none.
+func (w *FailoverConditionsGetter) GetHourlyPrecip(airportCode string) ([]*HourlyPrecip, error) {
+	if !w.supports(func(cg ConditionsGetter) bool {
+		_, ok := cg.(HourlyForecastGetter)
+		return ok
+	}) {
+		return nil, ErrNotSupported
+	}
+
+	var out []*HourlyPrecip
+	err := w.get("HourlyPrecip", airportCode, cacheHourFormat, &out, func(cg ConditionsGetter) (interface{}, error) {
+		hfg, ok := cg.(HourlyForecastGetter)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		return hfg.GetHourlyPrecip(airportCode)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetHourlyPrecip: %s", err)
+	}
+	return out, nil
+}
+
+// supports reports whether isSupported is true for the getter of any
+// provider.
+func (w *FailoverConditionsGetter) supports(isSupported func(ConditionsGetter) bool) bool {
+	for _, p := range w.providers {
+		if isSupported(p.Getter) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the cached value for the given method and airportCode in out if
+// there is one. Otherwise, it calls fn for each provider in turn and caches
+// and returns the first successful result. A cached value is only used within
+// the period of the current time in periodFormat.
+func (w *FailoverConditionsGetter) get(method, airportCode, periodFormat string, out interface{}, fn func(ConditionsGetter) (interface{}, error)) error {
+	now := w.now()
+	key := strings.Join([]string{cacheKeyPrefix, method, airportCode}, "/")
+	period := now.Format(periodFormat)
+	if w.readCache(key, period, now, out) {
+		return nil
+	}
+
+	var errs []string
+	for _, p := range w.providers {
+		v, err := w.call(p, fn)
+		if err == ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Provider %s failed, trying next: %s", p.Name, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", p.Name, err))
+			continue
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.writeCache(key, period, now, p.Name, j)
+		return json.Unmarshal(j, out)
+	}
+	if len(errs) == 0 {
+		return ErrNotSupported
+	}
+	return fmt.Errorf("all providers failed: %s", strings.Join(errs, "; "))
+}
+
+// call calls fn with the getter for p, and returns an error if it takes
+// longer than the timeout for p.
+func (w *FailoverConditionsGetter) call(p *Provider, fn func(ConditionsGetter) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		v   interface{}
+		err error
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = defaultProviderTimeout
+	}
+	// Buffered so that the goroutine can exit after a timeout.
+	rc := make(chan result, 1)
+	go func() {
+		v, err := fn(p.Getter)
+		rc <- result{v, err}
+	}()
+	select {
+	case r := <-rc:
+		return r.v, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// readCache reads the unexpired value for key and period into out and returns
+// true if one exists.
+func (w *FailoverConditionsGetter) readCache(key, period string, now time.Time, out interface{}) bool {
+	if w.cache == nil {
+		return false
+	}
+	s, ok, err := w.cache.Get(key)
+	if err != nil {
+		log.Errorf("cache Get %s: %s", key, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	var ce cacheEntry
+	if err := json.Unmarshal([]byte(s), &ce); err != nil {
+		log.Errorf("bad cache entry for %s: %s", key, err)
+		return false
+	}
+	if ce.Period != period || now.After(ce.Expires) {
+		return false
+	}
+	if err := json.Unmarshal(ce.Value, out); err != nil {
+		log.Errorf("bad cache value for %s: %s", key, err)
+		return false
+	}
+	log.Infof("Using cached %s from %s.", key, ce.Provider)
+	return true
+}
+
+// writeCache writes the value j for period from the named provider to the
+// cache, replacing the value for any earlier period.
+func (w *FailoverConditionsGetter) writeCache(key, period string, now time.Time, provider string, j []byte) {
+	if w.cache == nil {
+		return
+	}
+	ce, err := json.Marshal(&cacheEntry{
+		Period:   period,
+		Expires:  now.Add(w.ttl),
+		Provider: provider,
+		Value:    j,
+	})
+	if err != nil {
+		log.Errorf("cache entry for %s: %s", key, err)
+		return
+	}
+	// A failed write only means the next call goes to the provider.
+	if err := w.cache.Set(key, string(ce)); err != nil {
+		log.Errorf("cache Set %s: %s", key, err)
+	}
+}
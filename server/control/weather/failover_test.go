@@ -0,0 +1,215 @@
+package weather
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapCache is an in memory Cache.
+type mapCache map[string]string
+
+func (c mapCache) Get(key string) (string, bool, error) {
+	v, ok := c[key]
+	return v, ok, nil
+}
+
+func (c mapCache) Set(key, value string) error {
+	c[key] = value
+	return nil
+}
+
+// stubGetter is an ETConditionsGetter that returns fixed values, or err if
+// set, after delay. It counts the number of calls.
+type stubGetter struct {
+	tempF float64
+	etIn  float64
+	err   error
+	delay time.Duration
+
+	mu    sync.Mutex
+	calls int
+}
+
+// call counts a call and sleeps for the delay.
+func (w *stubGetter) call() {
+	w.mu.Lock()
+	w.calls++
+	w.mu.Unlock()
+	time.Sleep(w.delay)
+}
+
+// numCalls returns the number of calls.
+func (w *stubGetter) numCalls() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.calls
+}
+
+func (w *stubGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	w.call()
+	return "sunny", w.tempF, 0.1, "rain", w.tempF + 1, 0.2, w.err
+}
+
+func (w *stubGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	w.call()
+	return "cloudy", w.tempF, 0.3, w.err
+}
+
+func (w *stubGetter) GetYesterdayET(airportCode string) (etIn float64, err error) {
+	w.call()
+	return w.etIn, w.err
+}
+
+func TestFailoverGetYesterday(t *testing.T) {
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc      string
+		getters   []*stubGetter
+		wantTempF float64
+		wantCalls []int
+		wantErr   bool
+	}{
+		{
+			desc:      "first succeeds",
+			getters:   []*stubGetter{{tempF: 70}, {tempF: 60}},
+			wantTempF: 70,
+			wantCalls: []int{1, 0},
+		},
+		{
+			desc:      "first fails",
+			getters:   []*stubGetter{{err: fmt.Errorf("down")}, {tempF: 60}},
+			wantTempF: 60,
+			wantCalls: []int{1, 1},
+		},
+		{
+			desc:      "first times out",
+			getters:   []*stubGetter{{tempF: 70, delay: 200 * time.Millisecond}, {tempF: 60}},
+			wantTempF: 60,
+			wantCalls: []int{1, 1},
+		},
+		{
+			desc:      "all fail",
+			getters:   []*stubGetter{{err: fmt.Errorf("down")}, {err: fmt.Errorf("down")}},
+			wantCalls: []int{1, 1},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var providers []*Provider
+			for i, g := range tt.getters {
+				providers = append(providers, &Provider{Name: fmt.Sprint(i), Getter: g, Timeout: 50 * time.Millisecond})
+			}
+			wcg := NewFailoverConditionsGetter(mapCache{}, time.Hour, providers...)
+			wcg.now = func() time.Time { return now }
+
+			_, tF, _, err := wcg.GetYesterday("KSJC")
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("GetYesterday: got error %v, want error %t", err, tt.wantErr)
+			}
+			if tF != tt.wantTempF {
+				t.Errorf("GetYesterday: got temp %3.1f, want %3.1f", tF, tt.wantTempF)
+			}
+			for i, g := range tt.getters {
+				if g.numCalls() != tt.wantCalls[i] {
+					t.Errorf("provider %d: got %d calls, want %d", i, g.numCalls(), tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFailoverCache(t *testing.T) {
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	g := &stubGetter{tempF: 70, etIn: 0.2}
+	cache := mapCache{}
+	wcg := NewFailoverConditionsGetter(cache, time.Hour, &Provider{Name: "stub", Getter: g})
+	wcg.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		icon, tF, pIn, iconTom, tFTom, pInTom, err := wcg.GetForecast("KSJC")
+		if err != nil || icon != "sunny" || tF != 70 || pIn != 0.1 || iconTom != "rain" || tFTom != 71 || pInTom != 0.2 {
+			t.Errorf("GetForecast %d: got %s / %3.2f / %3.2f / %s / %3.2f / %3.2f / %v", i, icon, tF, pIn, iconTom, tFTom, pInTom, err)
+		}
+		if et, err := wcg.GetYesterdayET("KSJC"); err != nil || et != 0.2 {
+			t.Errorf("GetYesterdayET %d: got %3.2f / %v, want 0.2", i, et, err)
+		}
+	}
+	if g.numCalls() != 2 {
+		t.Errorf("got %d provider calls with cache, want 2", g.numCalls())
+	}
+
+	// After the TTL, the provider is called again.
+	g.tempF = 50
+	wcg.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if _, tF, _, _, _, _, err := wcg.GetForecast("KSJC"); err != nil || tF != 50 {
+		t.Errorf("GetForecast after TTL: got %3.1f / %v, want 50", tF, err)
+	}
+	// A value for another day isn't used, even within the TTL.
+	wcg.ttl = 48 * time.Hour
+	wcg.now = func() time.Time { return now.Add(14 * time.Hour) }
+	if _, _, _, _, _, _, err := wcg.GetForecast("KSJC"); err != nil {
+		t.Errorf("GetForecast: %v", err)
+	}
+	g.tempF = 40
+	wcg.now = func() time.Time { return now.Add(16 * time.Hour) }
+	if _, tF, _, _, _, _, err := wcg.GetForecast("KSJC"); err != nil || tF != 40 {
+		t.Errorf("GetForecast next day: got %3.1f / %v, want 40", tF, err)
+	}
+	if g.numCalls() != 5 {
+		t.Errorf("got %d provider calls, want 5", g.numCalls())
+	}
+	// Each method has one key, which is overwritten.
+	if len(cache) != 2 {
+		t.Errorf("got %d cache keys, want 2: %v", len(cache), cache)
+	}
+}
+
+func TestFailoverETNotSupported(t *testing.T) {
+	wcg := NewFailoverConditionsGetter(nil, time.Hour, &Provider{Name: "forecaster", Getter: &testForecaster{}})
+	if _, err := wcg.GetYesterdayET("KSJC"); err != ErrNotSupported {
+		t.Errorf("GetYesterdayET: got %v, want ErrNotSupported", err)
+	}
+}
+
+// hourlyStubGetter is a stubGetter that also reports an hourly forecast.
+type hourlyStubGetter struct {
+	stubGetter
+	hourly []*HourlyPrecip
+}
+
+func (w *hourlyStubGetter) GetHourlyPrecip(airportCode string) ([]*HourlyPrecip, error) {
+	w.call()
+	return w.hourly, w.err
+}
+
+func TestFailoverGetHourlyPrecip(t *testing.T) {
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	hourly := []*HourlyPrecip{{Time: now, PrecipIn: 0.1}, {Time: now.Add(time.Hour), PrecipIn: 0.2}}
+	daily := &stubGetter{tempF: 70}
+	g := &hourlyStubGetter{hourly: hourly}
+	wcg := NewFailoverConditionsGetter(mapCache{}, time.Hour, &Provider{Name: "daily", Getter: daily}, &Provider{Name: "hourly", Getter: g})
+
+	// The cached value is only used within the same hour.
+	for _, d := range []time.Duration{0, 30 * time.Minute, 70 * time.Minute} {
+		wcg.now = func() time.Time { return now.Add(d) }
+		got, err := wcg.GetHourlyPrecip("KSJC")
+		if err != nil {
+			t.Fatalf("GetHourlyPrecip: %v", err)
+		}
+		if len(got) != 2 || !got[1].Time.Equal(hourly[1].Time) || got[1].PrecipIn != 0.2 {
+			t.Errorf("GetHourlyPrecip: got %v, want %v", got, hourly)
+		}
+	}
+	if daily.numCalls() != 0 || g.numCalls() != 2 {
+		t.Errorf("got %d daily and %d hourly provider calls, want 0 and 2", daily.numCalls(), g.numCalls())
+	}
+
+	wcg = NewFailoverConditionsGetter(nil, time.Hour, &Provider{Name: "daily", Getter: daily})
+	if _, err := wcg.GetHourlyPrecip("KSJC"); err != ErrNotSupported {
+		t.Errorf("GetHourlyPrecip with no hourly provider: got %v, want ErrNotSupported", err)
+	}
+}
@@ -0,0 +1,550 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// mmPerIn is the number of millimeters in an inch.
+	mmPerIn = 25.4
+)
+
+var (
+	// nwsIconMap maps the NWS icon names to the normalized icon names used by
+	// the web UI.
+	nwsIconMap = map[string]string{
+		"skc":             "sunny",
+		"few":             "mostlysunny",
+		"sct":             "partlysunny",
+		"bkn":             "mostlycloudy",
+		"ovc":             "cloudy",
+		"snow":            "snow",
+		"blizzard":        "snow",
+		"rain_snow":       "sleet",
+		"rain_sleet":      "sleet",
+		"snow_sleet":      "sleet",
+		"fzra":            "sleet",
+		"rain_fzra":       "sleet",
+		"snow_fzra":       "sleet",
+		"sleet":           "sleet",
+		"rain":            "rain",
+		"rain_showers":    "rain",
+		"rain_showers_hi": "rain",
+		"tsra":            "tstorms",
+		"tsra_sct":        "tstorms",
+		"tsra_hi":         "tstorms",
+		"tornado":         "tstorms",
+		"hurricane":       "tstorms",
+		"tropical_storm":  "tstorms",
+		"dust":            "hazy",
+		"smoke":           "hazy",
+		"haze":            "hazy",
+		"hot":             "sunny",
+		"cold":            "sunny",
+		"fog":             "fog",
+	}
+
+	// isoDurationRe matches the subset of ISO 8601 durations used by NWS
+	// validTime intervals e.g. P1DT6H.
+	isoDurationRe = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?)?$`)
+)
+
+// NWSConditionsGetter is a ConditionsGetter for the US National Weather
+// Service API. The airport code is used as the NWS observation station
+// identifier, e.g. KSJC.
+type NWSConditionsGetter struct {
+	urlBase   string
+	userAgent string
+	// now returns the current time, used to determine which days are today and
+	// yesterday at the station location.
+	now func() time.Time
+	// mu guards station, which lookups that outlive a failover timeout may
+	// still write.
+	mu sync.Mutex
+	// station caches the station metadata from the most recent lookup.
+	station *nwsStation
+}
+
+// nwsStation is the metadata for an NWS observation station.
+type nwsStation struct {
+	id     string
+	loc    *time.Location
+	gridID string
+	gridX  int
+	gridY  int
+}
+
+// NewNWSConditionsGetter returns a ptr to an initialized NWSConditionsGetter.
+// NWS needs no API key, so only BaseURL in pc is used.
+func NewNWSConditionsGetter(pc *ProviderConfig) *NWSConditionsGetter {
+	// station
+	// https://api.weather.gov/stations/KSJC
+	// forecast
+	// https://api.weather.gov/gridpoints/MTR/99,83/forecast
+	// quantitative precip forecast
+	// https://api.weather.gov/gridpoints/MTR/99,83
+	// yesterday
+	// https://api.weather.gov/stations/KSJC/observations?start=...&end=...
+	return &NWSConditionsGetter{
+		// NWS asks that clients identify themselves in the User-Agent.
+		userAgent: `irctl (github.com/maoghub/irctl)`,
+		urlBase:   urlOrDefault(pc.BaseURL, `https://api.weather.gov/`),
+		now:       time.Now,
+	}
+}
+
+// GetForecast implements ConditionsGetter#GetForecast.
+func (w *NWSConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	st, err := w.lookupStation(airportCode)
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	gridURL := w.urlBase + "gridpoints/" + st.gridID + "/" + fmt.Sprintf("%d,%d", st.gridX, st.gridY)
+	log.Infof("GetForecast send request %s", gridURL+"/forecast")
+	fresp, err := w.get(gridURL + "/forecast")
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	log.Infof("GetForecast send request %s", gridURL)
+	gresp, err := w.get(gridURL)
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+
+	today := w.now().In(st.loc)
+	ic, t, err := w.ParseForecast(fresp, today)
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	p, err := w.ParsePrecipForecast(gresp, today)
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	tom := today.AddDate(0, 0, 1)
+	ict, tt, err := w.ParseForecast(fresp, tom)
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	pt, err := w.ParsePrecipForecast(gresp, tom)
+	return ic, t, p, ict, tt, pt, err
+}
+
+// GetHourlyPrecip implements HourlyForecastGetter#GetHourlyPrecip.
+func (w *NWSConditionsGetter) GetHourlyPrecip(airportCode string) ([]*HourlyPrecip, error) {
+	st, err := w.lookupStation(airportCode)
+	if err != nil {
+		return nil, fmt.Errorf("GetHourlyPrecip: %s", err)
+	}
+	gridURL := w.urlBase + "gridpoints/" + st.gridID + "/" + fmt.Sprintf("%d,%d", st.gridX, st.gridY)
+	log.Infof("GetHourlyPrecip send request %s", gridURL)
+	gresp, err := w.get(gridURL)
+	if err != nil {
+		return nil, fmt.Errorf("GetHourlyPrecip: %s", err)
+	}
+	return w.ParseHourlyPrecip(gresp)
+}
+
+// GetYesterday implements ConditionsGetter#GetYesterday.
+func (w *NWSConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	st, err := w.lookupStation(airportCode)
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
+	}
+	now := w.now().In(st.loc)
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, st.loc)
+	start := end.AddDate(0, 0, -1)
+	q := url.Values{}
+	q.Set("start", start.Format(time.RFC3339))
+	q.Set("end", end.Format(time.RFC3339))
+	u := w.urlBase + "stations/" + st.id + "/observations?" + q.Encode()
+	log.Infof("GetYesterday send request %s", u)
+	resp, err := w.get(u)
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
+	}
+	return w.ParseYesterday(resp)
+}
+
+// lookupStation returns the metadata for the station with the given id,
+// querying the station and points endpoints if it is not already cached.
+func (w *NWSConditionsGetter) lookupStation(id string) (*nwsStation, error) {
+	w.mu.Lock()
+	st := w.station
+	w.mu.Unlock()
+	if st != nil && st.id == id {
+		return st, nil
+	}
+	sresp, err := w.get(w.urlBase + "stations/" + id)
+	if err != nil {
+		return nil, err
+	}
+	lat, lon, loc, err := w.ParseStation(sresp)
+	if err != nil {
+		return nil, err
+	}
+	presp, err := w.get(w.urlBase + fmt.Sprintf("points/%.4f,%.4f", lat, lon))
+	if err != nil {
+		return nil, err
+	}
+	gridID, gridX, gridY, err := w.ParsePoint(presp)
+	if err != nil {
+		return nil, err
+	}
+	st = &nwsStation{
+		id:     id,
+		loc:    loc,
+		gridID: gridID,
+		gridX:  gridX,
+		gridY:  gridY,
+	}
+	w.mu.Lock()
+	w.station = st
+	w.mu.Unlock()
+	return st, nil
+}
+
+// get returns the response for a GET to url with the headers NWS expects.
+func (w *NWSConditionsGetter) get(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", w.userAgent)
+	req.Header.Set("Accept", "application/geo+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s: %s", url, resp.Status, string(body))
+	}
+	return body, nil
+}
+
+// ParseStation parses a station response from NWS and returns the station
+// coordinates and time zone.
+func (w *NWSConditionsGetter) ParseStation(resp []byte) (lat, lon float64, loc *time.Location, err error) {
+	var jt map[string]interface{}
+	if err := json.Unmarshal(resp, &jt); err != nil {
+		return 0.0, 0.0, nil, err
+	}
+	// GeoJSON coordinates are in lon, lat order.
+	loni, err := GetPath(jt, "geometry/coordinates/0")
+	if err != nil {
+		return 0.0, 0.0, nil, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	lati, err := GetPath(jt, "geometry/coordinates/1")
+	if err != nil {
+		return 0.0, 0.0, nil, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	loc = time.Local
+	if tzi, err := GetPath(jt, "properties/timeZone"); err == nil {
+		if tz, ok := tzi.(string); ok {
+			if l, err := time.LoadLocation(tz); err == nil {
+				loc = l
+			} else {
+				log.Errorf("unknown station time zone %s, using local time: %s", tz, err)
+			}
+		}
+	}
+	return getFloat(lati), getFloat(loni), loc, nil
+}
+
+// ParsePoint parses a points response from NWS and returns the forecast grid
+// office and coordinates.
+func (w *NWSConditionsGetter) ParsePoint(resp []byte) (gridID string, gridX, gridY int, err error) {
+	var jt map[string]interface{}
+	if err := json.Unmarshal(resp, &jt); err != nil {
+		return "", 0, 0, err
+	}
+	idi, err := GetPath(jt, "properties/gridId")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	xi, err := GetPath(jt, "properties/gridX")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	yi, err := GetPath(jt, "properties/gridY")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	gridID, ok := idi.(string)
+	if !ok {
+		return "", 0, 0, fmt.Errorf("gridId value has type %T, expect string", idi)
+	}
+	return gridID, getInt(xi), getInt(yi), nil
+}
+
+// ParseForecast parses a gridpoint forecast response from NWS and returns the
+// icon and high temperature for the date of day. The daytime period is used if
+// present, otherwise the overnight period is used.
+func (w *NWSConditionsGetter) ParseForecast(resp []byte, day time.Time) (icon string, tempF float64, err error) {
+	var jt map[string]interface{}
+	if err := json.Unmarshal(resp, &jt); err != nil {
+		return "", 0.0, err
+	}
+	psi, err := GetPath(jt, "properties/periods")
+	if err != nil {
+		return "", 0.0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	ps, ok := psi.([]interface{})
+	if !ok {
+		return "", 0.0, fmt.Errorf("periods not a slice in response:\n%s", string(resp))
+	}
+
+	var found map[string]interface{}
+	for _, pi := range ps {
+		p, ok := pi.(map[string]interface{})
+		if !ok {
+			return "", 0.0, fmt.Errorf("not a slice of maps in response:\n%s", string(resp))
+		}
+		st, err := time.Parse(time.RFC3339, fmt.Sprint(p["startTime"]))
+		if err != nil {
+			return "", 0.0, fmt.Errorf("bad period startTime: %s", err)
+		}
+		if !sameDate(st.In(day.Location()), day) {
+			continue
+		}
+		if found == nil {
+			found = p
+		}
+		if isDay, _ := p["isDaytime"].(bool); isDay {
+			found = p
+			break
+		}
+	}
+	if found == nil {
+		return "", 0.0, fmt.Errorf("no forecast period for %s in response:\n%s", day.Format("2006-01-02"), string(resp))
+	}
+
+	tempF = getFloat(found["temperature"])
+	if found["temperatureUnit"] == "C" {
+		tempF = cToF(tempF)
+	}
+	icon, _ = found["icon"].(string)
+	return w.normalizeIcon(icon), tempF, nil
+}
+
+// ParsePrecipForecast parses a raw gridpoint response from NWS and returns the
+// total quantitative precipitation forecast for the date of day.
+func (w *NWSConditionsGetter) ParsePrecipForecast(resp []byte, day time.Time) (precipIn float64, err error) {
+	var jt map[string]interface{}
+	if err := json.Unmarshal(resp, &jt); err != nil {
+		return 0.0, err
+	}
+	hp, err := w.hourlyQPF(jt)
+	if err != nil {
+		return 0.0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	for t, p := range hp {
+		if sameDate(t.In(day.Location()), day) {
+			precipIn += p
+		}
+	}
+	return precipIn, nil
+}
+
+// ParseHourlyPrecip parses a gridpoint response from NWS and returns the
+// forecast precip for each hour, sorted by time.
+func (w *NWSConditionsGetter) ParseHourlyPrecip(resp []byte) ([]*HourlyPrecip, error) {
+	var jt map[string]interface{}
+	if err := json.Unmarshal(resp, &jt); err != nil {
+		return nil, err
+	}
+	hp, err := w.hourlyQPF(jt)
+	if err != nil {
+		return nil, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	var out []*HourlyPrecip
+	for t, p := range hp {
+		out = append(out, &HourlyPrecip{Time: t, PrecipIn: p})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// hourlyQPF returns the quantitative precipitation forecast in the gridpoint
+// tree jt, in inches, keyed by the start of each hour. Values that span
+// multiple hours are spread evenly across them.
+func (w *NWSConditionsGetter) hourlyQPF(jt map[string]interface{}) (map[time.Time]float64, error) {
+	vsi, err := GetPath(jt, "properties/quantitativePrecipitation/values")
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := vsi.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("quantitativePrecipitation values has type %T, expect slice", vsi)
+	}
+	toIn := 1.0 / mmPerIn
+	if uom, err := GetPath(jt, "properties/quantitativePrecipitation/uom"); err == nil && !strings.HasSuffix(fmt.Sprint(uom), "mm") {
+		toIn = 1.0
+	}
+
+	out := make(map[time.Time]float64)
+	for _, vi := range vs {
+		v, ok := vi.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("quantitativePrecipitation value has type %T, expect map", vi)
+		}
+		start, d, err := parseValidTime(fmt.Sprint(v["validTime"]))
+		if err != nil {
+			return nil, err
+		}
+		hours := int(d / time.Hour)
+		if hours < 1 {
+			hours = 1
+		}
+		perHour := getFloat(v["value"]) * toIn / float64(hours)
+		for h := 0; h < hours; h++ {
+			out[start.Add(time.Duration(h)*time.Hour)] += perHour
+		}
+	}
+	return out, nil
+}
+
+// ParseYesterday parses a station observations response from NWS. It returns
+// the most common icon, the maximum temperature and the total precipitation
+// over all the observations.
+func (w *NWSConditionsGetter) ParseYesterday(resp []byte) (icon string, tempF float64, precipIn float64, err error) {
+	var jt map[string]interface{}
+	if err := json.Unmarshal(resp, &jt); err != nil {
+		return "", 0.0, 0.0, err
+	}
+	fsi, err := GetPath(jt, "features")
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+	}
+	fs, ok := fsi.([]interface{})
+	if !ok {
+		return "", 0.0, 0.0, fmt.Errorf("bad features array: \n%s\n", string(resp))
+	}
+
+	icons := make(map[string]int)
+	// Routine observations report the precip since the previous routine
+	// observation, and special observations in between report the precip since
+	// the last routine one. Taking the max in each hour avoids double counting.
+	hourPrecipMM := make(map[time.Time]float64)
+	maxTempC, haveTemp := 0.0, false
+	for _, fi := range fs {
+		f, ok := fi.(map[string]interface{})
+		if !ok {
+			return "", 0.0, 0.0, fmt.Errorf("not a slice of maps in response:\n%s", string(resp))
+		}
+		tsi, err := GetPath(f, "properties/timestamp")
+		if err != nil {
+			return "", 0.0, 0.0, fmt.Errorf("%v: \n\n%s", err, string(resp))
+		}
+		ts, err := time.Parse(time.RFC3339, fmt.Sprint(tsi))
+		if err != nil {
+			return "", 0.0, 0.0, fmt.Errorf("bad observation timestamp: %s", err)
+		}
+		if ti, err := GetPath(f, "properties/temperature/value"); err == nil && ti != nil {
+			if t := getFloat(ti); !haveTemp || t > maxTempC {
+				maxTempC, haveTemp = t, true
+			}
+		}
+		if pi, err := GetPath(f, "properties/precipitationLastHour/value"); err == nil && pi != nil {
+			// Routine observations are made just before the hour, so bucket
+			// by the hour the observation period ends.
+			h := ts.Add(30 * time.Minute).Truncate(time.Hour)
+			if p := getFloat(pi); p > hourPrecipMM[h] {
+				hourPrecipMM[h] = p
+			}
+		}
+		if ici, err := GetPath(f, "properties/icon"); err == nil && ici != nil {
+			icons[w.normalizeIcon(fmt.Sprint(ici))]++
+		}
+	}
+	if !haveTemp {
+		return "", 0.0, 0.0, fmt.Errorf("no temperature observations in response:\n%s", string(resp))
+	}
+	for _, p := range hourPrecipMM {
+		precipIn += p / mmPerIn
+	}
+	icon = stringMapMode(icons)
+	if icon == "" {
+		icon = "unknown"
+	}
+	return icon, cToF(maxTempC), precipIn, nil
+}
+
+// normalizeIcon returns the normalized icon name for an NWS icon URL, e.g.
+// https://api.weather.gov/icons/land/day/rain,40/tsra,60?size=medium returns
+// "rain".
+func (w *NWSConditionsGetter) normalizeIcon(iconURL string) string {
+	u, err := url.Parse(iconURL)
+	if err != nil {
+		return "unknown"
+	}
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, p := range path {
+		if p != "day" && p != "night" || i+1 >= len(path) {
+			continue
+		}
+		name := strings.TrimPrefix(strings.Split(path[i+1], ",")[0], "wind_")
+		if ret, ok := nwsIconMap[name]; ok {
+			return ret
+		}
+		break
+	}
+	return "unknown"
+}
+
+// parseValidTime parses an ISO 8601 interval of the form start/duration, e.g.
+// 2019-03-17T12:00:00+00:00/PT6H.
+func parseValidTime(s string) (time.Time, time.Duration, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("bad validTime %s", s)
+	}
+	start, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("bad validTime %s: %s", s, err)
+	}
+	m := isoDurationRe.FindStringSubmatch(parts[1])
+	if m == nil {
+		return time.Time{}, 0, fmt.Errorf("bad validTime duration %s", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute} {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("bad validTime duration %s: %s", s, err)
+		}
+		d += time.Duration(n) * unit
+	}
+	return start, d, nil
+}
+
+// cToF converts degrees Celsius to Fahrenheit.
+func cToF(c float64) float64 {
+	return c*9.0/5.0 + 32.0
+}
+
+// sameDate reports whether the date components of t1 and t2 are equal.
+func sameDate(t1, t2 time.Time) bool {
+	y1, m1, d1 := t1.Date()
+	y2, m2, d2 := t2.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
@@ -0,0 +1,189 @@
+package weather
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	nwsSubdir = "nws"
+)
+
+// newNWSTestServer returns a server that serves the recorded NWS responses in
+// testdata.
+func newNWSTestServer(t *testing.T) *httptest.Server {
+	files := map[string]string{
+		"/stations/KSJC":                 "station.json",
+		"/points/37.3591,-121.9244":      "points.json",
+		"/gridpoints/MTR/99,83/forecast": "forecast.json",
+		"/gridpoints/MTR/99,83":          "gridpoint.json",
+		"/stations/KSJC/observations":    "observations.json",
+	}
+	return newTestdataServer(t, nwsSubdir, func(r *http.Request) (string, int) {
+		if r.Header.Get("User-Agent") == "" {
+			return "", http.StatusForbidden
+		}
+		f := files[r.URL.Path]
+		if f == "observations.json" {
+			if got, want := r.FormValue("start"), "2019-03-16T00:00:00-07:00"; got != want {
+				t.Errorf("observations start: got %s, want %s", got, want)
+			}
+			if got, want := r.FormValue("end"), "2019-03-17T00:00:00-07:00"; got != want {
+				t.Errorf("observations end: got %s, want %s", got, want)
+			}
+		}
+		return f, 0
+	})
+}
+
+func newTestNWSConditionsGetter(urlBase string) *NWSConditionsGetter {
+	w := NewNWSConditionsGetter(&ProviderConfig{BaseURL: urlBase})
+	w.now = func() time.Time {
+		return time.Date(2019, 3, 17, 15, 0, 0, 0, time.UTC)
+	}
+	return w
+}
+
+func floatsEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestNWSGetForecast(t *testing.T) {
+	ts := newNWSTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestNWSConditionsGetter(ts.URL)
+	icon, tF, pIn, iconTom, tFTom, pInTom, err := wcg.GetForecast("KSJC")
+	if err != nil {
+		t.Fatalf("GetForecast: %v", err)
+	}
+
+	// Today gets 0.01 in from 11:00-17:00 plus 7/12 of 0.05 in from 17:00-05:00.
+	if wantP := 0.01 + 0.05*7.0/12.0; icon != "mostlysunny" || tF != 74.0 || !floatsEqual(pIn, wantP) {
+		t.Errorf("GetForecast today: got %s / %3.2f / %3.4f, want mostlysunny / 74.0 / %3.4f", icon, tF, pIn, wantP)
+	}
+	if wantP := 0.2 + 0.1 + 0.05*5.0/12.0; iconTom != "rain" || tFTom != 63.0 || !floatsEqual(pInTom, wantP) {
+		t.Errorf("GetForecast tomorrow: got %s / %3.2f / %3.4f, want rain / 63.0 / %3.4f", iconTom, tFTom, pInTom, wantP)
+	}
+}
+
+func TestNWSGetHourlyPrecip(t *testing.T) {
+	ts := newNWSTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestNWSConditionsGetter(ts.URL)
+	var hfg HourlyForecastGetter = wcg
+	got, err := hfg.GetHourlyPrecip("KSJC")
+	if err != nil {
+		t.Fatalf("GetHourlyPrecip: %v", err)
+	}
+	// The gridpoint values span 66 hours from 12:00 UTC.
+	if len(got) != 66 {
+		t.Fatalf("GetHourlyPrecip: got %d hours, want 66", len(got))
+	}
+	start := time.Date(2019, 3, 17, 12, 0, 0, 0, time.UTC)
+	for i, hp := range got {
+		if want := start.Add(time.Duration(i) * time.Hour); !hp.Time.Equal(want) {
+			t.Fatalf("hour %d: got time %s, want %s", i, hp.Time, want)
+		}
+	}
+	// 0.01 In over the 6 hours from 18:00.
+	if want := 0.01 / 6; got[5].PrecipIn != 0 || !floatsEqual(got[6].PrecipIn, want) {
+		t.Errorf("GetHourlyPrecip: got %3.4f at 17:00, %3.4f at 18:00, want 0 and %3.4f", got[5].PrecipIn, got[6].PrecipIn, want)
+	}
+}
+
+func TestNWSGetYesterday(t *testing.T) {
+	ts := newNWSTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestNWSConditionsGetter(ts.URL)
+	icon, tF, pIn, err := wcg.GetYesterday("KSJC")
+	if err != nil {
+		t.Fatalf("GetYesterday: %v", err)
+	}
+
+	// The special observation at 00:20 is included in the routine one at 23:53
+	// so only 0.5 + 0.8 mm are counted.
+	if wantT, wantP := cToF(21.1), 1.3/mmPerIn; icon != "mostlysunny" || !floatsEqual(tF, wantT) || !floatsEqual(pIn, wantP) {
+		t.Errorf("GetYesterday: got %s / %3.2f / %3.4f, want mostlysunny / %3.2f / %3.4f", icon, tF, pIn, wantT, wantP)
+	}
+}
+
+func TestNWSGetYesterdayNoStation(t *testing.T) {
+	ts := newNWSTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestNWSConditionsGetter(ts.URL)
+	if _, _, _, err := wcg.GetYesterday("KXXX"); err == nil {
+		t.Error("GetYesterday: got nil error for unknown station, want error")
+	}
+}
+
+func TestNWSStationTimeout(t *testing.T) {
+	ts := newNWSTestServer(t)
+	defer ts.Close()
+	// The first points request is held until after a second lookup, so that
+	// the first call times out with its lookup still in flight.
+	release := make(chan struct{})
+	var mu sync.Mutex
+	held := false
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/points/") {
+			mu.Lock()
+			hold := !held
+			held = true
+			mu.Unlock()
+			if hold {
+				<-release
+			}
+		}
+		http.Redirect(w, r, ts.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer slow.Close()
+
+	nws := newTestNWSConditionsGetter(slow.URL)
+	wcg := NewFailoverConditionsGetter(mapCache{}, time.Hour, &Provider{Name: "nws", Getter: nws, Timeout: 50 * time.Millisecond})
+	if _, _, _, err := wcg.GetYesterday("KSJC"); err == nil {
+		t.Fatal("GetYesterday: got nil error for timed out call, want error")
+	}
+	if _, err := nws.lookupStation("KSJC"); err != nil {
+		t.Fatalf("lookupStation: %v", err)
+	}
+	close(release)
+	// Give the timed out lookup time to finish.
+	time.Sleep(50 * time.Millisecond)
+	if st, err := nws.lookupStation("KSJC"); err != nil || st.gridID != "MTR" {
+		t.Errorf("lookupStation: got %v, %v, want grid MTR", st, err)
+	}
+}
+
+func TestParseValidTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "2019-03-17T12:00:00+00:00/PT6H", want: 6 * time.Hour},
+		{in: "2019-03-17T12:00:00+00:00/P1DT6H", want: 30 * time.Hour},
+		{in: "2019-03-17T12:00:00+00:00/PT1H30M", want: 90 * time.Minute},
+		{in: "2019-03-17T12:00:00+00:00/6H", wantErr: true},
+		{in: "2019-03-17T12:00:00+00:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, got, err := parseValidTime(tt.in)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// openMeteoDailyVars are the daily variables requested from Open-Meteo.
+	openMeteoDailyVars = "weathercode,temperature_2m_max,precipitation_sum,et0_fao_evapotranspiration"
+	// openMeteoHourlyVars are the hourly variables requested from Open-Meteo.
+	openMeteoHourlyVars = "precipitation"
+	// openMeteoDateFormat is the date format used by Open-Meteo.
+	openMeteoDateFormat = "2006-01-02"
+	// openMeteoHourFormat is the hourly time format used by Open-Meteo.
+	openMeteoHourFormat = "2006-01-02T15:04"
+)
+
+var (
+	// openMeteoIconMap maps WMO weather codes to the normalized icon names used
+	// by the web UI.
+	openMeteoIconMap = map[int]string{
+		0:  "sunny",
+		1:  "mostlysunny",
+		2:  "partlysunny",
+		3:  "cloudy",
+		45: "fog",
+		48: "fog",
+		51: "rain",
+		53: "rain",
+		55: "rain",
+		56: "sleet",
+		57: "sleet",
+		61: "rain",
+		63: "rain",
+		65: "rain",
+		66: "sleet",
+		67: "sleet",
+		71: "snow",
+		73: "snow",
+		75: "snow",
+		77: "flurries",
+		80: "rain",
+		81: "rain",
+		82: "rain",
+		85: "snow",
+		86: "snow",
+		95: "tstorms",
+		96: "tstorms",
+		99: "tstorms",
+	}
+)
+
+// OpenMeteoConditionsGetter is a ConditionsGetter for Open-Meteo. Open-Meteo
+// has no notion of airport codes, so the location is set at construction and
+// the airportCode arguments are ignored.
+type OpenMeteoConditionsGetter struct {
+	forecastURLBase string
+	archiveURLBase  string
+	latitude        float64
+	longitude       float64
+}
+
+// openMeteoResponse is the subset of an Open-Meteo forecast or archive
+// response that is used. Values are nil where Open-Meteo has no data.
+type openMeteoResponse struct {
+	Error      bool
+	Reason     string
+	DailyUnits map[string]string `json:"daily_units"`
+	Daily      struct {
+		Time        []string   `json:"time"`
+		WeatherCode []*float64 `json:"weathercode"`
+		TempMax     []*float64 `json:"temperature_2m_max"`
+		PrecipSum   []*float64 `json:"precipitation_sum"`
+		ET0         []*float64 `json:"et0_fao_evapotranspiration"`
+	} `json:"daily"`
+	HourlyUnits map[string]string `json:"hourly_units"`
+	Hourly      struct {
+		Time          []string   `json:"time"`
+		Precipitation []*float64 `json:"precipitation"`
+	} `json:"hourly"`
+}
+
+// NewOpenMeteoConditionsGetter returns a ptr to an initialized
+// OpenMeteoConditionsGetter for the location in pc. Open-Meteo needs no API
+// key.
+func NewOpenMeteoConditionsGetter(pc *ProviderConfig) (*OpenMeteoConditionsGetter, error) {
+	// forecast
+	// https://api.open-meteo.com/v1/forecast?latitude=37.36&longitude=-121.92&daily=weathercode,temperature_2m_max,precipitation_sum,et0_fao_evapotranspiration&past_days=1&forecast_days=2
+	// archive
+	// https://archive-api.open-meteo.com/v1/archive?latitude=37.36&longitude=-121.92&start_date=2019-03-01&end_date=2019-03-16&daily=...
+	if pc.Latitude == 0 && pc.Longitude == 0 {
+		return nil, fmt.Errorf("%s: Latitude and Longitude are not set in the provider config", OpenMeteoName)
+	}
+	return &OpenMeteoConditionsGetter{
+		forecastURLBase: urlOrDefault(pc.BaseURL, `https://api.open-meteo.com/v1/`),
+		archiveURLBase:  urlOrDefault(pc.HistoryBaseURL, `https://archive-api.open-meteo.com/v1/`),
+		latitude:        pc.Latitude,
+		longitude:       pc.Longitude,
+	}, nil
+}
+
+// GetForecast implements ConditionsGetter#GetForecast.
+func (w *OpenMeteoConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	days, err := w.getRecent()
+	if err != nil {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
+	}
+	// Index 0 is yesterday, 1 is today and 2 is tomorrow.
+	if len(days) != 3 {
+		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: got %d days, want 3", len(days))
+	}
+	return days[1].Icon, days[1].TempF, days[1].PrecipIn, days[2].Icon, days[2].TempF, days[2].PrecipIn, nil
+}
+
+// GetYesterday implements ConditionsGetter#GetYesterday.
+func (w *OpenMeteoConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	y, err := w.getYesterday()
+	if err != nil {
+		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
+	}
+	return y.Icon, y.TempF, y.PrecipIn, nil
+}
+
+// GetYesterdayET returns the FAO reference ET for the previous day in inches.
+func (w *OpenMeteoConditionsGetter) GetYesterdayET(airportCode string) (etIn float64, err error) {
+	y, err := w.getYesterday()
+	if err != nil {
+		return 0.0, fmt.Errorf("GetYesterdayET: %s", err)
+	}
+	return y.ETIn, nil
+}
+
+// GetHourlyPrecip implements HourlyForecastGetter#GetHourlyPrecip.
+func (w *OpenMeteoConditionsGetter) GetHourlyPrecip(airportCode string) ([]*HourlyPrecip, error) {
+	q := w.query()
+	q.Del("daily")
+	q.Set("hourly", openMeteoHourlyVars)
+	// Hourly times have no offset, so get them in UTC.
+	q.Set("timezone", "GMT")
+	q.Set("forecast_days", "2")
+	url := w.forecastURLBase + "forecast?" + q.Encode()
+	log.Infof("GetHourlyPrecip send request %s", url)
+	resp, err := GetURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("GetHourlyPrecip: %s", err)
+	}
+	hp, err := w.ParseHourly(resp)
+	if err != nil {
+		return nil, fmt.Errorf("GetHourlyPrecip: %s", err)
+	}
+	return hp, nil
+}
+
+// GetHistory implements HistoricalConditionsGetter#GetHistory using the
+// Open-Meteo archive, which typically lags the current date by several days.
+func (w *OpenMeteoConditionsGetter) GetHistory(airportCode string, from, to time.Time) ([]*DailyConditions, error) {
+	q := w.query()
+	q.Set("start_date", from.Format(openMeteoDateFormat))
+	q.Set("end_date", to.Format(openMeteoDateFormat))
+	url := w.archiveURLBase + "archive?" + q.Encode()
+	log.Infof("GetHistory send request %s", url)
+	resp, err := GetURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("GetHistory: %s", err)
+	}
+	days, err := w.ParseDaily(resp)
+	if err != nil {
+		return nil, fmt.Errorf("GetHistory: %s", err)
+	}
+	return days, nil
+}
+
+// getYesterday returns the conditions for yesterday.
+func (w *OpenMeteoConditionsGetter) getYesterday() (*DailyConditions, error) {
+	days, err := w.getRecent()
+	if err != nil {
+		return nil, err
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("no data for yesterday")
+	}
+	return days[0], nil
+}
+
+// getRecent returns the conditions for yesterday, today and tomorrow.
+func (w *OpenMeteoConditionsGetter) getRecent() ([]*DailyConditions, error) {
+	q := w.query()
+	q.Set("past_days", "1")
+	q.Set("forecast_days", "2")
+	url := w.forecastURLBase + "forecast?" + q.Encode()
+	log.Infof("Open-Meteo send request %s", url)
+	resp, err := GetURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return w.ParseDaily(resp)
+}
+
+// query returns the query parameters common to all requests.
+func (w *OpenMeteoConditionsGetter) query() url.Values {
+	q := url.Values{}
+	q.Set("latitude", fmt.Sprintf("%.4f", w.latitude))
+	q.Set("longitude", fmt.Sprintf("%.4f", w.longitude))
+	q.Set("daily", openMeteoDailyVars)
+	q.Set("temperature_unit", "fahrenheit")
+	q.Set("precipitation_unit", "inch")
+	q.Set("timezone", "auto")
+	return q
+}
+
+// ParseDaily parses a forecast or archive response from Open-Meteo. Days that
+// have no temperature or precip value are omitted.
+func (w *OpenMeteoConditionsGetter) ParseDaily(resp []byte) ([]*DailyConditions, error) {
+	var r openMeteoResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		return nil, err
+	}
+	if r.Error {
+		return nil, fmt.Errorf("Open-Meteo error: %s", r.Reason)
+	}
+
+	d := r.Daily
+	n := len(d.Time)
+	if len(d.WeatherCode) != n || len(d.TempMax) != n || len(d.PrecipSum) != n || len(d.ET0) != n {
+		return nil, fmt.Errorf("daily arrays have mismatched lengths in response:\n%s", string(resp))
+	}
+
+	var out []*DailyConditions
+	for i, ds := range d.Time {
+		date, err := time.Parse(openMeteoDateFormat, ds)
+		if err != nil {
+			return nil, fmt.Errorf("bad date %s: %s", ds, err)
+		}
+		if d.TempMax[i] == nil || d.PrecipSum[i] == nil {
+			log.Infof("Open-Meteo has no data for %s, skipping", ds)
+			continue
+		}
+		dc := &DailyConditions{
+			Date:     date,
+			Icon:     "unknown",
+			TempF:    *d.TempMax[i],
+			PrecipIn: *d.PrecipSum[i],
+		}
+		if d.WeatherCode[i] != nil {
+			dc.Icon = w.normalizeIcon(int(*d.WeatherCode[i]))
+		}
+		if d.ET0[i] != nil {
+			dc.ETIn = *d.ET0[i]
+		}
+		if r.DailyUnits["temperature_2m_max"] == "°C" {
+			dc.TempF = cToF(dc.TempF)
+		}
+		if r.DailyUnits["precipitation_sum"] == "mm" {
+			dc.PrecipIn /= mmPerIn
+		}
+		if r.DailyUnits["et0_fao_evapotranspiration"] == "mm" {
+			dc.ETIn /= mmPerIn
+		}
+		out = append(out, dc)
+	}
+	return out, nil
+}
+
+// ParseHourly parses an hourly forecast response from Open-Meteo with times in
+// UTC. Hours with no precip value are omitted.
+func (w *OpenMeteoConditionsGetter) ParseHourly(resp []byte) ([]*HourlyPrecip, error) {
+	var r openMeteoResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		return nil, err
+	}
+	if r.Error {
+		return nil, fmt.Errorf("Open-Meteo error: %s", r.Reason)
+	}
+
+	h := r.Hourly
+	if len(h.Precipitation) != len(h.Time) {
+		return nil, fmt.Errorf("hourly arrays have mismatched lengths in response:\n%s", string(resp))
+	}
+	var out []*HourlyPrecip
+	for i, ts := range h.Time {
+		t, err := time.Parse(openMeteoHourFormat, ts)
+		if err != nil {
+			return nil, fmt.Errorf("bad time %s: %s", ts, err)
+		}
+		if h.Precipitation[i] == nil {
+			continue
+		}
+		p := *h.Precipitation[i]
+		if r.HourlyUnits["precipitation"] == "mm" {
+			p /= mmPerIn
+		}
+		out = append(out, &HourlyPrecip{Time: t, PrecipIn: p})
+	}
+	return out, nil
+}
+
+func (w *OpenMeteoConditionsGetter) normalizeIcon(code int) string {
+	ret, ok := openMeteoIconMap[code]
+	if !ok {
+		return "unknown"
+	}
+	return ret
+}
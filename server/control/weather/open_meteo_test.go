@@ -0,0 +1,153 @@
+package weather
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	openMeteoSubdir = "openmeteo"
+)
+
+// newOpenMeteoTestServer returns a server that serves the recorded Open-Meteo
+// responses in testdata.
+func newOpenMeteoTestServer(t *testing.T) *httptest.Server {
+	return newTestdataServer(t, openMeteoSubdir, func(r *http.Request) (string, int) {
+		switch {
+		case r.URL.Path == "/v1/forecast" && r.FormValue("hourly") != "":
+			if got, want := r.FormValue("hourly"), openMeteoHourlyVars; got != want {
+				t.Errorf("hourly: got %s, want %s", got, want)
+			}
+			if r.FormValue("daily") != "" || r.FormValue("timezone") != "GMT" {
+				t.Errorf("hourly forecast: got %s, want no daily and timezone=GMT", r.URL.RawQuery)
+			}
+			return "hourly.json", 0
+		case r.FormValue("daily") != openMeteoDailyVars:
+			t.Errorf("daily: got %s, want %s", r.FormValue("daily"), openMeteoDailyVars)
+		case r.URL.Path == "/v1/forecast":
+			if r.FormValue("past_days") != "1" || r.FormValue("forecast_days") != "2" {
+				t.Errorf("forecast: got %s, want past_days=1 and forecast_days=2", r.URL.RawQuery)
+			}
+			return "forecast.json", 0
+		case r.URL.Path == "/v1/archive":
+			if r.FormValue("start_date") < "2019-03-01" {
+				return "error.json", http.StatusBadRequest
+			}
+			return "archive.json", 0
+		}
+		return "", 0
+	})
+}
+
+func newTestOpenMeteoConditionsGetter(t *testing.T, urlBase string) *OpenMeteoConditionsGetter {
+	w, err := NewOpenMeteoConditionsGetter(&ProviderConfig{
+		BaseURL:        urlBase + "/v1",
+		HistoryBaseURL: urlBase + "/v1",
+		Latitude:       37.36,
+		Longitude:      -121.92,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestOpenMeteoGetForecast(t *testing.T) {
+	ts := newOpenMeteoTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestOpenMeteoConditionsGetter(t, ts.URL)
+	icon, tF, pIn, iconTom, tFTom, pInTom, err := wcg.GetForecast("KSJC")
+	if err != nil {
+		t.Fatalf("GetForecast: %v", err)
+	}
+	if icon != "mostlysunny" || tF != 74.1 || pIn != 0.0 {
+		t.Errorf("GetForecast today: got %s / %3.2f / %3.2f, want mostlysunny / 74.1 / 0.0", icon, tF, pIn)
+	}
+	if iconTom != "tstorms" || tFTom != 63.2 || pInTom != 0.32 {
+		t.Errorf("GetForecast tomorrow: got %s / %3.2f / %3.2f, want tstorms / 63.2 / 0.32", iconTom, tFTom, pInTom)
+	}
+}
+
+func TestOpenMeteoGetYesterday(t *testing.T) {
+	ts := newOpenMeteoTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestOpenMeteoConditionsGetter(t, ts.URL)
+	icon, tF, pIn, err := wcg.GetYesterday("KSJC")
+	if err != nil {
+		t.Fatalf("GetYesterday: %v", err)
+	}
+	if icon != "rain" || tF != 68.4 || pIn != 0.05 {
+		t.Errorf("GetYesterday: got %s / %3.2f / %3.2f, want rain / 68.4 / 0.05", icon, tF, pIn)
+	}
+
+	// The fixture reports ET0 in mm.
+	et, err := wcg.GetYesterdayET("KSJC")
+	if err != nil {
+		t.Fatalf("GetYesterdayET: %v", err)
+	}
+	if !floatsEqual(et, 0.15) {
+		t.Errorf("GetYesterdayET: got %3.4f, want 0.15", et)
+	}
+}
+
+func TestOpenMeteoGetHistory(t *testing.T) {
+	ts := newOpenMeteoTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestOpenMeteoConditionsGetter(t, ts.URL)
+	from, to := time.Date(2019, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2019, 3, 13, 0, 0, 0, 0, time.UTC)
+	got, err := wcg.GetHistory("KSJC", from, to)
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+
+	// The last day has no data yet and is omitted.
+	want := []*DailyConditions{
+		{Date: from, Icon: "cloudy", TempF: 60.8, PrecipIn: 0.0, ETIn: 0.09},
+		{Date: from.AddDate(0, 0, 1), Icon: "rain", TempF: 57.2, PrecipIn: 0.41, ETIn: 0.04},
+		{Date: from.AddDate(0, 0, 2), Icon: "sunny", TempF: 64.0, PrecipIn: 0.0, ETIn: 0.12},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("GetHistory: got %d days, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Errorf("GetHistory day %d: got %+v, want %+v", i, *got[i], *want[i])
+		}
+	}
+
+	if _, err := wcg.GetHistory("KSJC", from.AddDate(-1, 0, 0), to); err == nil {
+		t.Error("GetHistory: got nil error for out of range dates, want error")
+	}
+}
+
+func TestOpenMeteoGetHourlyPrecip(t *testing.T) {
+	ts := newOpenMeteoTestServer(t)
+	defer ts.Close()
+
+	wcg := newTestOpenMeteoConditionsGetter(t, ts.URL)
+	var hfg HourlyForecastGetter = wcg
+	got, err := hfg.GetHourlyPrecip("KSJC")
+	if err != nil {
+		t.Fatalf("GetHourlyPrecip: %v", err)
+	}
+	// The last two hours have no data.
+	if len(got) != 46 {
+		t.Fatalf("GetHourlyPrecip: got %d hours, want 46", len(got))
+	}
+	start := time.Date(2019, 3, 17, 0, 0, 0, 0, time.UTC)
+	total := 0.0
+	for i, hp := range got {
+		if want := start.Add(time.Duration(i) * time.Hour); !hp.Time.Equal(want) {
+			t.Errorf("hour %d: got time %s, want %s", i, hp.Time, want)
+		}
+		total += hp.PrecipIn
+	}
+	if got[20].PrecipIn != 0.05 || !floatsEqual(total, 0.2) {
+		t.Errorf("GetHourlyPrecip: got %3.2f at 20:00 and %3.2f total, want 0.05 and 0.2", got[20].PrecipIn, total)
+	}
+}
@@ -0,0 +1,115 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Provider names, used as keys in ProviderConfigs and secrets.
+const (
+	AccuWeatherName  = "AccuWeather"
+	WundergroundName = "Wunderground"
+	NWSName          = "NWS"
+	OpenMeteoName    = "OpenMeteo"
+	CIMISName        = "CIMIS"
+)
+
+// ProviderConfig is the config for a weather provider. Fields that a provider
+// doesn't use are ignored.
+type ProviderConfig struct {
+	// BaseURL overrides the default API base URL, if set.
+	BaseURL string
+	// HistoryBaseURL overrides the default base URL for historical data, for
+	// providers that have a separate endpoint.
+	HistoryBaseURL string
+	// LocationKey is the provider location ID (AccuWeather).
+	LocationKey string
+	// Station is the provider station ID (CIMIS).
+	Station   string
+	Latitude  float64
+	Longitude float64
+	// APIKey is a secret. It is never read from the main config, which is
+	// served by the web server, and must be set with LoadSecrets.
+	APIKey string `json:"-"`
+}
+
+// ProviderConfigs maps provider name to config.
+type ProviderConfigs map[string]*ProviderConfig
+
+// providerSecrets are the secrets for a provider in the secrets file.
+type providerSecrets struct {
+	APIKey string
+}
+
+// Get returns the config for the named provider. It returns an empty config
+// if there is none.
+func (pcs ProviderConfigs) Get(name string) *ProviderConfig {
+	if pc, ok := pcs[name]; ok && pc != nil {
+		return pc
+	}
+	return &ProviderConfig{}
+}
+
+// LoadSecrets sets the API keys in pcs from the JSON file at path, which has
+// the form {"AccuWeather": {"APIKey": "..."}}, and then from environment
+// variables of the form IRCTL_ACCUWEATHER_API_KEY, which take precedence.
+// A missing secrets file is not an error, so that only environment variables
+// can be used.
+func (pcs ProviderConfigs) LoadSecrets(path string) error {
+	secrets := make(map[string]*providerSecrets)
+	j, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("could not read secrets file at %s: %s", path, err)
+	default:
+		if err := json.Unmarshal(j, &secrets); err != nil {
+			return fmt.Errorf("could not parse secrets file at %s: %s", path, err)
+		}
+	}
+
+	for _, name := range []string{AccuWeatherName, WundergroundName, NWSName, OpenMeteoName, CIMISName} {
+		key := ""
+		if s, ok := secrets[name]; ok && s != nil {
+			key = s.APIKey
+		}
+		if v := os.Getenv(APIKeyEnvVar(name)); v != "" {
+			key = v
+		}
+		if key == "" {
+			continue
+		}
+		if _, ok := pcs[name]; !ok || pcs[name] == nil {
+			pcs[name] = &ProviderConfig{}
+		}
+		pcs[name].APIKey = key
+	}
+	return nil
+}
+
+// APIKeyEnvVar returns the name of the environment variable for the API key of
+// the named provider.
+func APIKeyEnvVar(name string) string {
+	return "IRCTL_" + strings.ToUpper(name) + "_API_KEY"
+}
+
+// errMissingAPIKey returns an error for a missing API key for the named
+// provider.
+func errMissingAPIKey(name string) error {
+	return fmt.Errorf("%s: APIKey is not set, add it to the secrets file or set %s", name, APIKeyEnvVar(name))
+}
+
+// urlOrDefault returns u if it is set, or def otherwise. A trailing slash is
+// added to u if it has none.
+func urlOrDefault(u, def string) string {
+	if u == "" {
+		return def
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	return u
+}
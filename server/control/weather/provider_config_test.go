@@ -0,0 +1,111 @@
+package weather
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.json")
+	secrets := `{"AccuWeather": {"APIKey": "file-key"}, "CIMIS": {"APIKey": "file-cimis-key"}}`
+	if err := ioutil.WriteFile(path, []byte(secrets), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(APIKeyEnvVar(CIMISName), "env-cimis-key")
+	defer os.Unsetenv(APIKeyEnvVar(CIMISName))
+
+	pcs := ProviderConfigs{
+		AccuWeatherName: {LocationKey: "331979"},
+	}
+	if err := pcs.LoadSecrets(path); err != nil {
+		t.Fatalf("LoadSecrets: %v", err)
+	}
+	if got, want := pcs.Get(AccuWeatherName).APIKey, "file-key"; got != want {
+		t.Errorf("AccuWeather APIKey: got %s, want %s", got, want)
+	}
+	if got, want := pcs.Get(AccuWeatherName).LocationKey, "331979"; got != want {
+		t.Errorf("AccuWeather LocationKey: got %s, want %s", got, want)
+	}
+	// The environment takes precedence over the file.
+	if got, want := pcs.Get(CIMISName).APIKey, "env-cimis-key"; got != want {
+		t.Errorf("CIMIS APIKey: got %s, want %s", got, want)
+	}
+	if got := pcs.Get(WundergroundName).APIKey; got != "" {
+		t.Errorf("Wunderground APIKey: got %s, want empty", got)
+	}
+
+	// A missing file is not an error, bad JSON is.
+	if err := pcs.LoadSecrets(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("LoadSecrets with missing file: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := pcs.LoadSecrets(path); err == nil {
+		t.Error("LoadSecrets with bad JSON: got nil error, want error")
+	}
+}
+
+func TestMissingCredentials(t *testing.T) {
+	tests := []struct {
+		desc    string
+		newFunc func() error
+		wantErr string
+	}{
+		{
+			desc: "AccuWeather APIKey",
+			newFunc: func() error {
+				_, err := NewAccuWeatherConditionsGetter(&ProviderConfig{LocationKey: "331979"})
+				return err
+			},
+			wantErr: "IRCTL_ACCUWEATHER_API_KEY",
+		},
+		{
+			desc: "AccuWeather LocationKey",
+			newFunc: func() error {
+				_, err := NewAccuWeatherConditionsGetter(&ProviderConfig{APIKey: "key"})
+				return err
+			},
+			wantErr: "LocationKey",
+		},
+		{
+			desc: "Wunderground APIKey",
+			newFunc: func() error {
+				_, err := NewWundergroundConditionsGetter(&ProviderConfig{})
+				return err
+			},
+			wantErr: "IRCTL_WUNDERGROUND_API_KEY",
+		},
+		{
+			desc: "CIMIS Station",
+			newFunc: func() error {
+				_, err := NewCIMISConditionsGetter(&ProviderConfig{APIKey: "key"}, &testForecaster{})
+				return err
+			},
+			wantErr: "Station",
+		},
+		{
+			desc: "OpenMeteo location",
+			newFunc: func() error {
+				_, err := NewOpenMeteoConditionsGetter(&ProviderConfig{})
+				return err
+			},
+			wantErr: "Latitude",
+		},
+	}
+
+	for _, tt := range tests {
+		err := tt.newFunc()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want error containing %s", tt.desc, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package weather
+
+import (
+	"fmt"
+	"sort"
+)
+
+// newGetterFuncs maps provider name to a function that returns a new
+// ConditionsGetter for that provider. CIMIS is not included since it only
+// reports measured data and needs another provider for forecasts.
+var newGetterFuncs = map[string]func(pc *ProviderConfig) (ConditionsGetter, error){
+	AccuWeatherName: func(pc *ProviderConfig) (ConditionsGetter, error) {
+		w, err := NewAccuWeatherConditionsGetter(pc)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	},
+	WundergroundName: func(pc *ProviderConfig) (ConditionsGetter, error) {
+		w, err := NewWundergroundConditionsGetter(pc)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	},
+	NWSName: func(pc *ProviderConfig) (ConditionsGetter, error) {
+		return NewNWSConditionsGetter(pc), nil
+	},
+	OpenMeteoName: func(pc *ProviderConfig) (ConditionsGetter, error) {
+		w, err := NewOpenMeteoConditionsGetter(pc)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	},
+}
+
+// AvailableProviderNames returns the sorted names of all available providers.
+func AvailableProviderNames() []string {
+	var out []string
+	for name := range newGetterFuncs {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// NewConditionsGetter returns a ConditionsGetter for the provider with the
+// given name, configured with pc. It returns an error if there is no such
+// provider or pc is not valid for it.
+func NewConditionsGetter(name string, pc *ProviderConfig) (ConditionsGetter, error) {
+	f, ok := newGetterFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown weather provider %s, choices are %v", name, AvailableProviderNames())
+	}
+	return f(pc)
+}
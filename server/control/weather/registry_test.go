@@ -0,0 +1,46 @@
+package weather
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewConditionsGetter(t *testing.T) {
+	want := []string{AccuWeatherName, NWSName, OpenMeteoName, WundergroundName}
+	if got := AvailableProviderNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AvailableProviderNames: got %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name     string
+		pc       *ProviderConfig
+		wantType string
+		wantErr  bool
+	}{
+		{name: AccuWeatherName, pc: &ProviderConfig{APIKey: "key", LocationKey: "331979"}, wantType: "*weather.AccuWeatherConditionsGetter"},
+		{name: AccuWeatherName, pc: &ProviderConfig{}, wantErr: true},
+		{name: WundergroundName, pc: &ProviderConfig{APIKey: "key"}, wantType: "*weather.WundergroundConditionsGetter"},
+		{name: NWSName, pc: &ProviderConfig{}, wantType: "*weather.NWSConditionsGetter"},
+		{name: OpenMeteoName, pc: &ProviderConfig{Latitude: 37.36, Longitude: -121.92}, wantType: "*weather.OpenMeteoConditionsGetter"},
+		{name: OpenMeteoName, pc: &ProviderConfig{}, wantErr: true},
+		{name: "NoSuchProvider", pc: &ProviderConfig{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		cg, err := NewConditionsGetter(tt.name, tt.pc)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			// A typed nil in the interface would not compare equal to nil.
+			if cg != nil {
+				t.Errorf("%s: got %T with error, want nil", tt.name, cg)
+			}
+			continue
+		}
+		if got := reflect.TypeOf(cg).String(); got != tt.wantType {
+			t.Errorf("%s: got type %s, want %s", tt.name, got, tt.wantType)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package weather
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// observationsSubdir is the subdir where station observations are written.
+	observationsSubdir = "observations"
+	// stationDateFormat is the dateutc format used by the upload protocols.
+	stationDateFormat = "2006-01-02 15:04:05"
+	// defaultMaxObservationGap is the longest gap between observations for a
+	// day to still be considered complete.
+	defaultMaxObservationGap = 2 * time.Hour
+)
+
+// StationObservation is a single observation uploaded by a local weather
+// station. Values the station did not report are nil.
+type StationObservation struct {
+	Time time.Time
+	// TempF is the outdoor temperature.
+	TempF *float64 `json:",omitempty"`
+	// RainIn is the rain over the past hour.
+	RainIn *float64 `json:",omitempty"`
+	// DailyRainIn is the rain since local midnight.
+	DailyRainIn *float64 `json:",omitempty"`
+}
+
+// ParseStationUpload parses the query or form values of an upload in
+// Weather Underground (updateweatherstation.php) or Ecowitt format. now is used
+// if the upload has no timestamp.
+func ParseStationUpload(v url.Values, now time.Time) (*StationObservation, error) {
+	obs := &StationObservation{Time: now}
+	if ds := v.Get("dateutc"); ds != "" && ds != "now" {
+		t, err := time.Parse(stationDateFormat, ds)
+		if err != nil {
+			return nil, fmt.Errorf("bad dateutc %s: %s", ds, err)
+		}
+		obs.Time = t
+	}
+
+	var err error
+	if obs.TempF, err = optionalFloat(v, "tempf"); err != nil {
+		return nil, err
+	}
+	if obs.DailyRainIn, err = optionalFloat(v, "dailyrainin"); err != nil {
+		return nil, err
+	}
+	// WU reports the rain over the past hour as rainin, Ecowitt as hourlyrainin.
+	for _, k := range []string{"rainin", "hourlyrainin"} {
+		if obs.RainIn, err = optionalFloat(v, k); err != nil {
+			return nil, err
+		}
+		if obs.RainIn != nil {
+			break
+		}
+	}
+	if obs.TempF == nil && obs.RainIn == nil && obs.DailyRainIn == nil {
+		return nil, fmt.Errorf("upload has no temperature or rain values")
+	}
+	return obs, nil
+}
+
+// optionalFloat returns the float value of key k in v, or nil if k is not
+// present.
+func optionalFloat(v url.Values, k string) (*float64, error) {
+	s := v.Get(k)
+	if s == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s has bad float value %s", k, s)
+	}
+	return &f, nil
+}
+
+// StationLog is an on disk log of station observations, with one file of
+// JSON lines per local day e.g. ../data/observations/2019/3/17.log.
+type StationLog struct {
+	root string
+	loc  *time.Location
+	mu   sync.Mutex
+}
+
+// NewStationLog returns a ptr to an initialized StationLog that stores
+// observations under rootPath, grouped by day in the time zone loc.
+func NewStationLog(rootPath string, loc *time.Location) *StationLog {
+	return &StationLog{
+		root: rootPath,
+		loc:  loc,
+	}
+}
+
+// Append appends obs to the log for the day of the observation.
+func (l *StationLog) Append(obs *StationObservation) error {
+	j, err := json.Marshal(obs)
+	if err != nil {
+		return err
+	}
+	fp := l.filePath(obs.Time)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fp, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(j, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns all the observations for the day with the date in t, sorted by
+// time. It returns an empty slice if there are no observations for that day.
+func (l *StationLog) Read(t time.Time) ([]*StationObservation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.filePath(t))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*StationObservation
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		obs := &StationObservation{}
+		if err := json.Unmarshal(s.Bytes(), obs); err != nil {
+			// A partially written line from a crash shouldn't lose the day.
+			log.Errorf("bad station observation %s: %s", s.Text(), err)
+			continue
+		}
+		out = append(out, obs)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, s.Err()
+}
+
+// filePath returns the file path for observations on the local day of t.
+func (l *StationLog) filePath(t time.Time) string {
+	t = t.In(l.loc)
+	return filepath.Join(l.root, observationsSubdir, fmt.Sprint(t.Year()), fmt.Sprint(int(t.Month())), fmt.Sprint(t.Day())+".log")
+}
+
+// LocalStationConditionsGetter is a ConditionsGetter that computes yesterday's
+// conditions from the observations uploaded by a local weather station. If
+// the station data for yesterday has gaps, or for forecasts, it uses the
+// fallback ConditionsGetter instead.
+type LocalStationConditionsGetter struct {
+	log      *StationLog
+	fallback ConditionsGetter
+	// maxGap is the longest allowed gap between observations.
+	maxGap time.Duration
+	// now returns the current time, used to determine which day is yesterday.
+	now func() time.Time
+}
+
+// NewLocalStationConditionsGetter returns a ptr to an initialized
+// LocalStationConditionsGetter that reads observations from l.
+func NewLocalStationConditionsGetter(l *StationLog, fallback ConditionsGetter) *LocalStationConditionsGetter {
+	return &LocalStationConditionsGetter{
+		log:      l,
+		fallback: fallback,
+		maxGap:   defaultMaxObservationGap,
+		now:      time.Now,
+	}
+}
+
+// GetForecast implements ConditionsGetter#GetForecast.
+func (w *LocalStationConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
+	return w.fallback.GetForecast(airportCode)
+}
+
+// GetHourlyPrecip implements HourlyForecastGetter#GetHourlyPrecip using the
+// fallback, if it supports it.
+func (w *LocalStationConditionsGetter) GetHourlyPrecip(airportCode string) ([]*HourlyPrecip, error) {
+	hfg, ok := w.fallback.(HourlyForecastGetter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return hfg.GetHourlyPrecip(airportCode)
+}
+
+// GetYesterdayET implements ETConditionsGetter#GetYesterdayET using the
+// fallback, if it supports it.
+func (w *LocalStationConditionsGetter) GetYesterdayET(airportCode string) (etIn float64, err error) {
+	etcg, ok := w.fallback.(ETConditionsGetter)
+	if !ok {
+		return 0.0, ErrNotSupported
+	}
+	return etcg.GetYesterdayET(airportCode)
+}
+
+// GetYesterday implements ConditionsGetter#GetYesterday. The station reports
+// no sky conditions, so the icon is "rain" if it rained and "clear" otherwise.
+func (w *LocalStationConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
+	now := w.now().In(w.log.loc)
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, w.log.loc)
+	start := end.AddDate(0, 0, -1)
+	obs, err := w.log.Read(start)
+	if err == nil {
+		tempF, precipIn, err = w.Summarize(obs, start, end)
+	}
+	if err != nil {
+		log.Infof("Local station data for %s is incomplete, using fallback: %s", start.Format("2006-01-02"), err)
+		return w.fallback.GetYesterday(airportCode)
+	}
+	icon = "clear"
+	if precipIn > 0 {
+		icon = "rain"
+	}
+	return icon, tempF, precipIn, nil
+}
+
+// Summarize returns the maximum temperature and total rain for the sorted
+// observations obs covering the period from start to end. It returns an error
+// if any gap in the observations is longer than the allowed maximum.
+func (w *LocalStationConditionsGetter) Summarize(obs []*StationObservation, start, end time.Time) (tempF, precipIn float64, err error) {
+	var tobs, robs []*StationObservation
+	haveDaily := false
+	for _, o := range obs {
+		if o.TempF != nil {
+			tobs = append(tobs, o)
+		}
+		if o.DailyRainIn != nil || o.RainIn != nil {
+			robs = append(robs, o)
+			haveDaily = haveDaily || o.DailyRainIn != nil
+		}
+	}
+	if err := w.checkGaps(tobs, start, end); err != nil {
+		return 0.0, 0.0, fmt.Errorf("temperature: %s", err)
+	}
+	if err := w.checkGaps(robs, start, end); err != nil {
+		return 0.0, 0.0, fmt.Errorf("rain: %s", err)
+	}
+
+	tempF = *tobs[0].TempF
+	for _, o := range tobs {
+		if *o.TempF > tempF {
+			tempF = *o.TempF
+		}
+	}
+
+	if haveDaily {
+		// The daily counter resets at midnight so its max is the day total.
+		for _, o := range robs {
+			if o.DailyRainIn != nil && *o.DailyRainIn > precipIn {
+				precipIn = *o.DailyRainIn
+			}
+		}
+		return tempF, precipIn, nil
+	}
+	// Otherwise, the last past hour value in each hour approximates the rain
+	// in that hour.
+	lastInHour := make(map[time.Time]float64)
+	for _, o := range robs {
+		lastInHour[o.Time.Truncate(time.Hour)] = *o.RainIn
+	}
+	for _, r := range lastInHour {
+		precipIn += r
+	}
+	return tempF, precipIn, nil
+}
+
+// checkGaps returns an error if the sorted observations obs do not cover start
+// to end without a gap longer than maxGap.
+func (w *LocalStationConditionsGetter) checkGaps(obs []*StationObservation, start, end time.Time) error {
+	if len(obs) == 0 {
+		return fmt.Errorf("no observations")
+	}
+	prev := start
+	for _, o := range append(obs, &StationObservation{Time: end}) {
+		if gap := o.Time.Sub(prev); gap > w.maxGap {
+			return fmt.Errorf("gap of %s from %s", gap, prev.Format(time.RFC3339))
+		}
+		prev = o.Time
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package weather
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseStationUpload(t *testing.T) {
+	now := time.Date(2019, 3, 17, 12, 0, 0, 0, time.UTC)
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		desc    string
+		query   string
+		want    *StationObservation
+		wantErr bool
+	}{
+		{
+			desc:  "wunderground",
+			query: "ID=KCASANJO1&PASSWORD=x&dateutc=2019-03-17+21%3A23%3A00&tempf=68.2&rainin=0.01&dailyrainin=0.12&humidity=40&action=updateraw",
+			want:  &StationObservation{Time: time.Date(2019, 3, 17, 21, 23, 0, 0, time.UTC), TempF: f(68.2), RainIn: f(0.01), DailyRainIn: f(0.12)},
+		},
+		{
+			desc:  "wunderground now",
+			query: "ID=KCASANJO1&PASSWORD=x&dateutc=now&tempf=68.2",
+			want:  &StationObservation{Time: now, TempF: f(68.2)},
+		},
+		{
+			desc:  "ecowitt",
+			query: "PASSKEY=ABCD&stationtype=EasyWeatherV1.4.0&dateutc=2019-03-17+21:23:00&tempinf=72.1&tempf=66.0&hourlyrainin=0.020&dailyrainin=0.150&model=GW1000",
+			want:  &StationObservation{Time: time.Date(2019, 3, 17, 21, 23, 0, 0, time.UTC), TempF: f(66.0), RainIn: f(0.02), DailyRainIn: f(0.15)},
+		},
+		{
+			desc:    "bad temp",
+			query:   "dateutc=now&tempf=warm",
+			wantErr: true,
+		},
+		{
+			desc:    "no values",
+			query:   "dateutc=now&humidity=40",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		v, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseStationUpload(v, now)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.desc, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !got.Time.Equal(tt.want.Time) || !floatPtrsEqual(got.TempF, tt.want.TempF) || !floatPtrsEqual(got.RainIn, tt.want.RainIn) || !floatPtrsEqual(got.DailyRainIn, tt.want.DailyRainIn) {
+			t.Errorf("%s: got %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func floatPtrsEqual(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return floatsEqual(*a, *b)
+}
+
+// writeTestObservations appends an observation for every interval from start
+// to end to l, with temperature and rain values from tempF and rainIn.
+func writeTestObservations(t *testing.T, l *StationLog, start, end time.Time, interval time.Duration, tempF, rainIn func(time.Time) *float64) {
+	for ts := start; ts.Before(end); ts = ts.Add(interval) {
+		obs := &StationObservation{Time: ts, TempF: tempF(ts), RainIn: rainIn(ts)}
+		if err := l.Append(obs); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocalStationGetYesterday(t *testing.T) {
+	loc := time.FixedZone("PDT", -7*3600)
+	now := time.Date(2019, 3, 17, 9, 0, 0, 0, loc)
+	yStart := time.Date(2019, 3, 16, 0, 0, 0, 0, loc)
+	yEnd := yStart.AddDate(0, 0, 1)
+	temp := func(ts time.Time) *float64 {
+		v := 50.0 + float64(ts.Hour())
+		return &v
+	}
+	// 0.1 In per hour of rain from 10:00 to 12:00.
+	rain := func(ts time.Time) *float64 {
+		v := 0.0
+		if ts.Hour() == 10 || ts.Hour() == 11 {
+			v = 0.1
+		}
+		return &v
+	}
+
+	tests := []struct {
+		desc       string
+		write      func(l *StationLog)
+		wantIcon   string
+		wantTempF  float64
+		wantPrecip float64
+	}{
+		{
+			desc: "complete day",
+			write: func(l *StationLog) {
+				writeTestObservations(t, l, yStart, yEnd, 15*time.Minute, temp, rain)
+			},
+			wantIcon:   "rain",
+			wantTempF:  73,
+			wantPrecip: 0.2,
+		},
+		{
+			desc: "daily rain counter",
+			write: func(l *StationLog) {
+				daily := func(ts time.Time) *float64 {
+					v := 0.0
+					if ts.Hour() >= 12 {
+						v = 0.35
+					}
+					return &v
+				}
+				for ts := yStart; ts.Before(yEnd); ts = ts.Add(time.Hour) {
+					if err := l.Append(&StationObservation{Time: ts, TempF: temp(ts), DailyRainIn: daily(ts)}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			wantIcon:   "rain",
+			wantTempF:  73,
+			wantPrecip: 0.35,
+		},
+		{
+			desc: "gap falls back",
+			write: func(l *StationLog) {
+				writeTestObservations(t, l, yStart, yStart.Add(8*time.Hour), 15*time.Minute, temp, rain)
+				writeTestObservations(t, l, yStart.Add(12*time.Hour), yEnd, 15*time.Minute, temp, rain)
+			},
+			wantIcon:  "sunny",
+			wantTempF: 72,
+		},
+		{
+			desc:      "no data falls back",
+			write:     func(l *StationLog) {},
+			wantIcon:  "sunny",
+			wantTempF: 72,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "irctl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			l := NewStationLog(root, loc)
+			tt.write(l)
+			wcg := NewLocalStationConditionsGetter(l, &testForecaster{})
+			wcg.now = func() time.Time { return now }
+
+			icon, tF, pIn, err := wcg.GetYesterday("KSJC")
+			if err != nil {
+				t.Fatalf("GetYesterday: %v", err)
+			}
+			if icon != tt.wantIcon || tF != tt.wantTempF || !floatsEqual(pIn, tt.wantPrecip) {
+				t.Errorf("GetYesterday: got %s / %3.2f / %3.2f, want %s / %3.2f / %3.2f", icon, tF, pIn, tt.wantIcon, tt.wantTempF, tt.wantPrecip)
+			}
+		})
+	}
+}
+
+func TestLocalStationPassthrough(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	l := NewStationLog(root, time.UTC)
+
+	var cg ConditionsGetter = NewLocalStationConditionsGetter(l, &stubGetter{etIn: 0.2})
+	etcg, ok := cg.(ETConditionsGetter)
+	if !ok {
+		t.Fatalf("LocalStationConditionsGetter is not an ETConditionsGetter")
+	}
+	if et, err := etcg.GetYesterdayET("KSJC"); err != nil || et != 0.2 {
+		t.Errorf("GetYesterdayET: got %3.2f / %v, want 0.2", et, err)
+	}
+	if _, err := NewLocalStationConditionsGetter(l, &testForecaster{}).GetYesterdayET("KSJC"); err != ErrNotSupported {
+		t.Errorf("GetYesterdayET with no ET fallback: got %v, want ErrNotSupported", err)
+	}
+}
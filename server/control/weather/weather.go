@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ConditionsGetter reports conditions used in ET calculations.
@@ -19,6 +20,30 @@ type ConditionsGetter interface {
 	GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error)
 }
 
+// ETConditionsGetter is a ConditionsGetter that also reports a measured
+// reference evapotranspiration (ETo).
+type ETConditionsGetter interface {
+	ConditionsGetter
+	// GetYesterdayET reports the reference ET in inches for the previous day
+	// for the given airportCode.
+	GetYesterdayET(airportCode string) (etIn float64, err error)
+}
+
+// HourlyPrecip is the forecast precipitation for one hour.
+type HourlyPrecip struct {
+	// Time is the start of the hour.
+	Time     time.Time
+	PrecipIn float64
+}
+
+// HourlyForecastGetter reports an hourly precipitation forecast.
+type HourlyForecastGetter interface {
+	// GetHourlyPrecip reports the forecast precipitation for each hour that
+	// the provider has data for, sorted by time, for the given airportCode.
+	// It may include hours that are already past.
+	GetHourlyPrecip(airportCode string) ([]*HourlyPrecip, error)
+}
+
 // GetPath returns the value at the given path in the JSON tree jt.
 func GetPath(jt map[string]interface{}, pathStr string) (interface{}, error) {
 	path := strings.Split(pathStr, "/")
@@ -94,3 +119,20 @@ func stringMapMode(m map[string]int) string {
 
 	return maxK
 }
+
+// DailyConditions are the conditions for a single day.
+type DailyConditions struct {
+	Date     time.Time
+	Icon     string
+	TempF    float64
+	PrecipIn float64
+	// ETIn is the reference evapotranspiration in inches, or 0 if not known.
+	ETIn float64
+}
+
+// HistoricalConditionsGetter reports past conditions over a range of dates.
+type HistoricalConditionsGetter interface {
+	// GetHistory reports the conditions for each day from "from" to "to"
+	// inclusive for the given airportCode. Days with no data are omitted.
+	GetHistory(airportCode string, from, to time.Time) ([]*DailyConditions, error)
+}
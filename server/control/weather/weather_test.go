@@ -2,6 +2,8 @@ package weather
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"testing"
 )
@@ -11,6 +13,36 @@ const (
 	accuweatherSubdir = "accuweather"
 )
 
+// testdataRoute returns the file in a testdata subdir to serve for r, and
+// the status to serve it with, or 0 for http.StatusOK. If file is empty, only
+// the status is served, or http.StatusNotFound if that is 0 too.
+type testdataRoute func(r *http.Request) (file string, status int)
+
+// newTestdataServer returns a server that serves the recorded responses in the
+// testdata subdir for the requests that route maps to them.
+func newTestdataServer(t *testing.T, subdir string, route testdataRoute) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, status := route(r)
+		if f == "" {
+			if status == 0 {
+				status = http.StatusNotFound
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		j, err := ioutil.ReadFile(filepath.Join(testRoot, subdir, f))
+		if err != nil {
+			t.Errorf("ioutil.ReadFile: could not open file: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+		w.Write(j)
+	}))
+}
+
 func TestAccuWeatherParseForecast(t *testing.T) {
 	j, err := ioutil.ReadFile(filepath.Join(testRoot, accuweatherSubdir, "forecast.json"))
 	if err != nil {
@@ -44,3 +76,32 @@ func TestAccuWeatherParseYesterday(t *testing.T) {
 		t.Errorf("ParseYesterday: got %s / %3.2f / %3.2f, want unknown / 71.0 / 0.0", icon, tF, pIn)
 	}
 }
+
+func TestAccuWeatherGetConditions(t *testing.T) {
+	ts := newTestdataServer(t, accuweatherSubdir, func(r *http.Request) (string, int) {
+		if r.FormValue("apikey") != "test-key" {
+			return "", http.StatusUnauthorized
+		}
+		switch r.URL.Path {
+		case "/forecasts/v1/daily/5day/331979":
+			return "forecast.json", 0
+		case "/currentconditions/v1/331979/historical/24":
+			return "yesterday.json", 0
+		}
+		return "", 0
+	})
+	defer ts.Close()
+
+	wcg, err := NewAccuWeatherConditionsGetter(&ProviderConfig{BaseURL: ts.URL, APIKey: "test-key", LocationKey: "331979"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	icon, tF, pIn, _, _, _, err := wcg.GetForecast("KSJC")
+	if err != nil || icon != "mostlysunny" || tF != 74.0 || pIn != 0.0 {
+		t.Errorf("GetForecast: got %s / %3.2f / %3.2f / %v, want mostlysunny / 74.0 / 0.0", icon, tF, pIn, err)
+	}
+	icon, tF, pIn, err = wcg.GetYesterday("KSJC")
+	if err != nil || icon != "unknown" || tF != 71.0 || pIn != 0.0 {
+		t.Errorf("GetYesterday: got %s / %3.2f / %3.2f / %v, want unknown / 71.0 / 0.0", icon, tF, pIn, err)
+	}
+}
@@ -3,6 +3,7 @@ package weather
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	log "github.com/golang/glog"
 )
@@ -14,23 +15,25 @@ type WundergroundConditionsGetter struct {
 }
 
 // NewWundergroundConditionsGetter returns a ptr to an initialized
-// WundergroundConditionsGetter.
-func NewWundergroundConditionsGetter() *WundergroundConditionsGetter {
+// WundergroundConditionsGetter. pc must have APIKey set.
+func NewWundergroundConditionsGetter(pc *ProviderConfig) (*WundergroundConditionsGetter, error) {
 	// forecast
-	//http://api.wunderground.com/api/4f746c425fb69966/geolookup/conditions/forecast/q/KSJC.json
+	//http://api.wunderground.com/api/<apiKey>/geolookup/conditions/forecast/q/KSJC.json
 	// yesterady
-	//http://api.wunderground.com/api/4f746c425fb69966/geolookup/conditions/yesterday/q/KSJC.json
-	apiKeyStr := `4f746c425fb69966`
-	return &WundergroundConditionsGetter{
-		apiKey:  apiKeyStr,
-		urlBase: `http://api.wunderground.com/api/` + apiKeyStr + `/geolookup/conditions/`,
+	//http://api.wunderground.com/api/<apiKey>/geolookup/conditions/yesterday/q/KSJC.json
+	if pc.APIKey == "" {
+		return nil, errMissingAPIKey(WundergroundName)
 	}
+	return &WundergroundConditionsGetter{
+		apiKey:  pc.APIKey,
+		urlBase: urlOrDefault(pc.BaseURL, `http://api.wunderground.com/api/`) + pc.APIKey + `/geolookup/conditions/`,
+	}, nil
 }
 
 // GetForecast implements ConditionsGetter#GetForecast.
 func (w *WundergroundConditionsGetter) GetForecast(airportCode string) (icon string, tempF float64, precipIn float64, iconTom string, tempFTom float64, precipInTom float64, err error) {
 	url := w.urlBase + "forecast/q/" + airportCode + ".json"
-	log.Infof("GetForecast send request %s", url)
+	log.Infof("GetForecast send request %s", strings.Replace(url, w.apiKey, "<apiKey>", 1))
 	resp, err := GetURL(url)
 	if err != nil {
 		return "", 0, 0, "", 0.0, 0.0, fmt.Errorf("GetForecast: %s", err)
@@ -46,7 +49,7 @@ func (w *WundergroundConditionsGetter) GetForecast(airportCode string) (icon str
 // GetYesterday implements ConditionsGetter#GetYesterday.
 func (w *WundergroundConditionsGetter) GetYesterday(airportCode string) (icon string, tempF float64, precipIn float64, err error) {
 	url := w.urlBase + "yesterday/q/" + airportCode + ".json"
-	log.Infof("GetYesterday send request %s", url)
+	log.Infof("GetYesterday send request %s", strings.Replace(url, w.apiKey, "<apiKey>", 1))
 	resp, err := GetURL(url)
 	if err != nil {
 		return "", 0.0, 0.0, fmt.Errorf("GetYesterday: %s", err)
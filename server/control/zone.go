@@ -1,6 +1,8 @@
 package control
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -13,26 +15,70 @@ type ZoneState string
 
 const (
 	// Unknown is an unknown state.
-	Unknown  ZoneState = "Unknown"
+	Unknown ZoneState = "Unknown"
 	// Idle is the idle state.
-	Idle     ZoneState = "Idle"
+	Idle ZoneState = "Idle"
 	// Running is the running state.
-	Running  ZoneState = "Running"
+	Running ZoneState = "Running"
 	// Complete is the completed state.
 	Complete ZoneState = "Complete"
+	// Interrupted is the state of a zone whose run was stopped by shutdown.
+	// Its valve was closed, so it can be run again for the remaining time.
+	Interrupted ZoneState = "Interrupted"
+	// ManualRunning is the state of a zone that is being run manually. The
+	// previous state is restored when the run ends.
+	ManualRunning ZoneState = "ManualRunning"
 )
 
+// InterruptedRunKey is the KV store key prefix for the InterruptedRun of a
+// zone.
+const InterruptedRunKey = "InterruptedRun"
+
+// InterruptedRun is a record of a zone run that was stopped by shutdown.
+type InterruptedRun struct {
+	Time time.Time
+	// Ran is the total time the zone ran today before it was interrupted.
+	Ran time.Duration
+	// Uncredited is the time the zone ran that hasn't yet been added to its
+	// VWC. See TakeUncredited.
+	Uncredited time.Duration `json:",omitempty"`
+}
+
+// RunStartKey is the KV store key prefix for the zoneRun of a zone, so that
+// the time it ran is known if it is still running at shutdown.
+const RunStartKey = "RunStart"
+
+// zoneRun is a record of the start of a zone run.
+type zoneRun struct {
+	Start    time.Time
+	Duration time.Duration
+}
+
+// ManualRunKey is the KV store key prefix for the ManualRunRecord of a zone.
+const ManualRunKey = "ManualRun"
+
+// ManualRunRecord is a record of a manual zone run in progress.
+type ManualRunRecord struct {
+	Start    time.Time
+	Duration time.Duration
+	// PrevState is the zone state before the run.
+	PrevState ZoneState
+}
+
 // ZoneController is a controller of a zone.
 type ZoneController struct {
-	vc ValveController
-	kv KVStore
+	vc    ValveController
+	kv    KVStore
+	clock Clock
 }
 
-// NewZoneController returns a ptr to an intialized ZoneController.
-func NewZoneController(vc ValveController, kv KVStore) *ZoneController {
+// NewZoneController returns a ptr to an intialized ZoneController, which uses
+// clock to time runs.
+func NewZoneController(vc ValveController, kv KVStore, clock Clock) *ZoneController {
 	return &ZoneController{
-		vc: vc,
-		kv: kv,
+		vc:    vc,
+		kv:    kv,
+		clock: clock,
 	}
 }
 
@@ -75,23 +121,296 @@ func (zc *ZoneController) ResetZones(numZones int) error {
 	return nil
 }
 
+// ResetInterruptedZones sets any of the numZones zones that are in Interrupted
+// state from a run that was stopped before the day of now to Idle, so that
+// they only run again if they need water.
+func (zc *ZoneController) ResetInterruptedZones(numZones int, now time.Time) error {
+	for n := 0; n < numZones; n++ {
+		s, err := zc.State(n)
+		if err != nil {
+			return err
+		}
+		if s == Interrupted && !zc.interruptedOn(n, now) {
+			log.Infof("Zone %d was interrupted on an earlier day, setting to Idle.", n)
+			if err := zc.SetState(n, Idle); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Run runs zone number n for duration d.
 // This comprises:
 //   1. updating state to Running + opening valve number n
-//   2. sleeping for duration d
+//   2. sleeping for duration d on the zone controller clock
 //   3. closing valve number n and updating state to Complete.
-// If dontSleep is set, it skips step 2.
-func (zc *ZoneController) Run(n int, d time.Duration, dontSleep bool) error {
+// If ctx is cancelled during step 2, valve number n is closed, the state is
+// updated to Interrupted with a record of how long it ran, and the ctx error
+// is returned.
+func (zc *ZoneController) Run(ctx context.Context, n int, d time.Duration) error {
 	log.Infof("RunZone %d for %d mins.", n, int(d.Minutes()))
+	prevRan := zc.RanBeforeInterrupt(n)
 	if err := zc.TurnOn(n); err != nil {
 		return err
 	}
-	if !dontSleep {
-		time.Sleep(d)
+	start := zc.clock.Now()
+	if err := zc.setRunStart(n, &zoneRun{Start: start, Duration: d}); err != nil {
+		log.Errorf("Zone %d: %s", n, err)
+	}
+	if err := zc.clock.Sleep(ctx, d); err != nil {
+		ran := zc.clock.Now().Sub(start)
+		if ierr := zc.interrupt(n, prevRan+ran, ran); ierr != nil {
+			return fmt.Errorf("%s, then %s", err, ierr)
+		}
+		return err
 	}
 	return zc.TurnOff(n)
 }
 
+// interrupt closes valve n and records that it ran for ran, and a total of
+// total today, before being interrupted.
+func (zc *ZoneController) interrupt(n int, total, ran time.Duration) error {
+	log.Infof("Zone %d interrupted after %s.", n, total)
+	if err := zc.vc.CloseValve(n); err != nil {
+		return fmt.Errorf("CloseValve %d: %s", n, err)
+	}
+	return zc.recordInterrupt(n, total, ran)
+}
+
+// recordInterrupt records that zone n ran for ran, and a total of total today,
+// before being interrupted, and sets it to Interrupted.
+func (zc *ZoneController) recordInterrupt(n int, total, ran time.Duration) error {
+	ir := &InterruptedRun{Time: zc.clock.Now(), Ran: total, Uncredited: ran}
+	prev, err := zc.InterruptedRun(n)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		ir.Uncredited += prev.Uncredited
+	}
+	if err := zc.setInterruptedRun(n, ir); err != nil {
+		return err
+	}
+	return zc.SetState(n, Interrupted)
+}
+
+// setInterruptedRun sets the InterruptedRun record of zone n.
+func (zc *ZoneController) setInterruptedRun(n int, ir *InterruptedRun) error {
+	j, err := json.Marshal(ir)
+	if err != nil {
+		return err
+	}
+	return zc.kv.Set(fmt.Sprintf("%s%d", InterruptedRunKey, n), string(j))
+}
+
+// TakeUncredited returns the time that zone n ran before being interrupted
+// that hasn't been added to its VWC, and resets it to zero.
+func (zc *ZoneController) TakeUncredited(n int) (time.Duration, error) {
+	ir, err := zc.InterruptedRun(n)
+	if err != nil || ir == nil || ir.Uncredited == 0 {
+		return 0, err
+	}
+	ran := ir.Uncredited
+	ir.Uncredited = 0
+	return ran, zc.setInterruptedRun(n, ir)
+}
+
+// InterruptedRun returns the record of the last interrupted run of zone n, or
+// nil if there is none.
+func (zc *ZoneController) InterruptedRun(n int) (*InterruptedRun, error) {
+	s, ok, err := zc.kv.Get(fmt.Sprintf("%s%d", InterruptedRunKey, n))
+	if err != nil || !ok {
+		return nil, err
+	}
+	ir := &InterruptedRun{}
+	if err := json.Unmarshal([]byte(s), ir); err != nil {
+		return nil, fmt.Errorf("InterruptedRun zone %d: %s", n, err)
+	}
+	return ir, nil
+}
+
+// RanBeforeInterrupt returns how long zone n ran today before it was
+// interrupted, if it is in Interrupted state, or zero otherwise.
+func (zc *ZoneController) RanBeforeInterrupt(n int) time.Duration {
+	if s, err := zc.State(n); err != nil || s != Interrupted {
+		return 0
+	}
+	ir, err := zc.InterruptedRun(n)
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+	if ir == nil || !datesAreEqual(ir.Time, zc.clock.Now()) {
+		return 0
+	}
+	return ir.Ran
+}
+
+// interruptedOn reports whether zone n is in Interrupted state from a run that
+// was stopped on the day of t.
+func (zc *ZoneController) interruptedOn(n int, t time.Time) bool {
+	if s, err := zc.State(n); err != nil || s != Interrupted {
+		return false
+	}
+	ir, err := zc.InterruptedRun(n)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return ir != nil && datesAreEqual(ir.Time, t)
+}
+
+// Shutdown closes all valves and sets any of the numZones zones that are in
+// Running state to Interrupted, with the time they ran, so that they can be
+// run again after a restart. It is called when the process is stopping.
+func (zc *ZoneController) Shutdown(numZones int) error {
+	var errs Errors
+	errs = AppendErr(errs, zc.vc.CloseAllValves())
+	for n := 0; n < numZones; n++ {
+		s, err := zc.State(n)
+		if err != nil {
+			errs = AppendErr(errs, err)
+			continue
+		}
+		if s == Running {
+			ran, err := zc.ranSinceStart(n)
+			errs = AppendErr(errs, err)
+			log.Infof("Zone %d was running for %s at shutdown, setting to Interrupted.", n, ran)
+			errs = AppendErr(errs, zc.recordInterrupt(n, zc.ranToday(n)+ran, ran))
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// ranToday returns the total time zone n ran today in runs that were
+// interrupted.
+func (zc *ZoneController) ranToday(n int) time.Duration {
+	ir, err := zc.InterruptedRun(n)
+	if err != nil || ir == nil || !datesAreEqual(ir.Time, zc.clock.Now()) {
+		return 0
+	}
+	return ir.Ran
+}
+
+// setRunStart records the start of a run of zone n.
+func (zc *ZoneController) setRunStart(n int, r *zoneRun) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return zc.kv.Set(fmt.Sprintf("%s%d", RunStartKey, n), string(j))
+}
+
+// ranSinceStart returns how long zone n has run since the start of its
+// current run, up to the run duration, or zero if it's not known.
+func (zc *ZoneController) ranSinceStart(n int) (time.Duration, error) {
+	s, ok, err := zc.kv.Get(fmt.Sprintf("%s%d", RunStartKey, n))
+	if err != nil || !ok {
+		return 0, err
+	}
+	var r zoneRun
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return 0, fmt.Errorf("RunStart zone %d: %s", n, err)
+	}
+	ran := zc.clock.Now().Sub(r.Start)
+	if ran < 0 {
+		return 0, nil
+	}
+	if ran > r.Duration {
+		ran = r.Duration
+	}
+	return ran, nil
+}
+
+// StartManual records a manual run of zone n for duration d and opens valve
+// number n. The zone is in ManualRunning state until FinishManual is called
+// with the returned record, including after a crash.
+func (zc *ZoneController) StartManual(n int, d time.Duration) (*ManualRunRecord, error) {
+	prev, err := zc.State(n)
+	if err != nil {
+		return nil, err
+	}
+	mr := &ManualRunRecord{Start: zc.clock.Now(), Duration: d, PrevState: prev}
+	j, err := json.Marshal(mr)
+	if err != nil {
+		return nil, err
+	}
+	if err := zc.kv.Set(zc.manualRunKey(n), string(j)); err != nil {
+		return nil, err
+	}
+	if err := zc.SetState(n, ManualRunning); err != nil {
+		return nil, err
+	}
+	if err := zc.vc.OpenValve(n); err != nil {
+		return nil, fmt.Errorf("OpenValve %d: %s", n, AppendErr(NewErrs(err), zc.endManual(n, mr)))
+	}
+	return mr, nil
+}
+
+// FinishManual closes valve number n, restores the zone state from before
+// manual run mr and returns how long the zone ran.
+func (zc *ZoneController) FinishManual(n int, mr *ManualRunRecord) (time.Duration, error) {
+	ran := zc.clock.Now().Sub(mr.Start)
+	if ran > mr.Duration {
+		ran = mr.Duration
+	}
+	if err := zc.vc.CloseValve(n); err != nil {
+		return ran, fmt.Errorf("CloseValve %d: %s", n, err)
+	}
+	return ran, zc.endManual(n, mr)
+}
+
+// endManual restores the zone state from before manual run mr and clears the
+// record.
+func (zc *ZoneController) endManual(n int, mr *ManualRunRecord) error {
+	if err := zc.SetState(n, mr.PrevState); err != nil {
+		return err
+	}
+	return zc.kv.Set(zc.manualRunKey(n), "")
+}
+
+// RecoverManualRuns closes the valve of any zone still in ManualRunning state,
+// which means the process stopped during a manual run, and restores its
+// previous state. It returns the recovered zone numbers. Since it's not known
+// how long these zones ran, VWC is not updated.
+func (zc *ZoneController) RecoverManualRuns() ([]int, error) {
+	var out []int
+	var errs Errors
+	for n := 0; n < zc.vc.NumValves(); n++ {
+		s, err := zc.State(n)
+		if err != nil {
+			errs = AppendErr(errs, err)
+			continue
+		}
+		if s != ManualRunning {
+			continue
+		}
+		log.Infof("Zone %d is still in %s, recovering.", n, s)
+		mr := &ManualRunRecord{PrevState: Idle}
+		if v, ok, err := zc.kv.Get(zc.manualRunKey(n)); err != nil {
+			errs = AppendErr(errs, err)
+		} else if ok && v != "" {
+			errs = AppendErr(errs, json.Unmarshal([]byte(v), mr))
+		}
+		errs = AppendErr(errs, zc.vc.CloseValve(n))
+		errs = AppendErr(errs, zc.endManual(n, mr))
+		out = append(out, n)
+	}
+	if errs != nil {
+		return out, errs
+	}
+	return out, nil
+}
+
+// manualRunKey returns the KV store key for the ManualRunRecord of zone n.
+func (zc *ZoneController) manualRunKey(n int) string {
+	return fmt.Sprintf("%s%d", ManualRunKey, n)
+}
+
 // TurnOn sets the zone state n to Running and opens valve n.
 func (zc *ZoneController) TurnOn(n int) error {
 	err := zc.SetState(n, Running)
@@ -0,0 +1,123 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// interruptingClock is a FakeClock where Sleep advances the time by after and
+// then returns an error, as if the ctx was cancelled.
+type interruptingClock struct {
+	*FakeClock
+	after time.Duration
+}
+
+func (c *interruptingClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.FakeClock.Sleep(ctx, c.after)
+	return context.Canceled
+}
+
+func TestZoneControllerInterrupt(t *testing.T) {
+	start := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	clock := &interruptingClock{FakeClock: NewFakeClock(start), after: 5 * time.Minute}
+	kv := NewTestKVStore()
+	tvc := &TestValveController{log: &TestLogger{}}
+	zc := NewZoneController(tvc, kv, clock)
+
+	if err := zc.Run(context.Background(), 0, 20*time.Minute); err != context.Canceled {
+		t.Fatalf("Run: got error %v, want %v", err, context.Canceled)
+	}
+	if s, err := zc.State(0); err != nil || s != Interrupted {
+		t.Errorf("State: got %s / %v, want %s", s, err, Interrupted)
+	}
+	if got, want := tvc.ops, []ValveOperation{{0, true}, {0, false}}; len(got) != len(want) || got[1] != want[1] {
+		t.Errorf("valve ops: got %v, want %v", got, want)
+	}
+	if got := zc.RanBeforeInterrupt(0); got != 5*time.Minute {
+		t.Errorf("RanBeforeInterrupt: got %s, want 5m", got)
+	}
+	if got, err := zc.TakeUncredited(0); err != nil || got != 5*time.Minute {
+		t.Errorf("TakeUncredited: got %s / %v, want 5m", got, err)
+	}
+	if got, err := zc.TakeUncredited(0); err != nil || got != 0 {
+		t.Errorf("second TakeUncredited: got %s / %v, want 0", got, err)
+	}
+
+	// A second interruption adds to the time that the zone already ran.
+	if err := zc.Run(context.Background(), 0, 15*time.Minute); err != context.Canceled {
+		t.Fatalf("second Run: got error %v, want %v", err, context.Canceled)
+	}
+	if got := zc.RanBeforeInterrupt(0); got != 10*time.Minute {
+		t.Errorf("second RanBeforeInterrupt: got %s, want 10m", got)
+	}
+
+	// The time that ran is not carried over to the next day.
+	clock.Set(start.AddDate(0, 0, 1))
+	if got := zc.RanBeforeInterrupt(0); got != 0 {
+		t.Errorf("RanBeforeInterrupt next day: got %s, want 0", got)
+	}
+}
+
+func TestZoneControllerShutdown(t *testing.T) {
+	start := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	kv := NewTestKVStore()
+	tvc := &TestValveController{log: &TestLogger{}}
+	clock := NewFakeClock(start)
+	zc := NewZoneController(tvc, kv, clock)
+	for n, s := range []ZoneState{Running, Complete, Idle} {
+		if err := zc.SetState(n, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zc.setRunStart(0, &zoneRun{Start: start, Duration: 10 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(start.Add(4 * time.Minute))
+
+	if err := zc.Shutdown(3); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range []ZoneState{Interrupted, Complete, Idle} {
+		if s, err := zc.State(n); err != nil || s != want {
+			t.Errorf("zone %d: got state %s / %v, want %s", n, s, err, want)
+		}
+	}
+	if got := tvc.log.Contents(); got != "INFO: CloseAllValves." {
+		t.Errorf("valve log: got %q, want CloseAllValves", got)
+	}
+	// The time the running zone ran is recorded, so it can be credited.
+	if got, err := zc.TakeUncredited(0); err != nil || got != 4*time.Minute {
+		t.Errorf("TakeUncredited: got %s / %v, want 4m", got, err)
+	}
+	if got := zc.RanBeforeInterrupt(0); got != 4*time.Minute {
+		t.Errorf("RanBeforeInterrupt: got %s, want 4m", got)
+	}
+}
+
+func TestResetInterruptedZones(t *testing.T) {
+	start := time.Date(2019, 3, 17, 9, 0, 0, 0, time.UTC)
+	kv := NewTestKVStore()
+	zc := NewZoneController(&TestValveController{log: &TestLogger{}}, kv, NewFakeClock(start))
+	for n, s := range []ZoneState{Interrupted, Interrupted, Complete} {
+		if err := zc.SetState(n, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zc.setInterruptedRun(0, &InterruptedRun{Time: start.AddDate(0, 0, -1), Ran: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := zc.setInterruptedRun(1, &InterruptedRun{Time: start.Add(-time.Hour), Ran: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zc.ResetInterruptedZones(3, start); err != nil {
+		t.Fatal(err)
+	}
+	// Only the zone interrupted on an earlier day is reset.
+	for n, want := range []ZoneState{Idle, Interrupted, Complete} {
+		if s, err := zc.State(n); err != nil || s != want {
+			t.Errorf("zone %d: got state %s / %v, want %s", n, s, err, want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// zoneHistoryDays is the number of days of history in a ZoneView.
+	zoneHistoryDays = 30
+	// predictionDays is the number of days of ET that is averaged to predict
+	// the next runtime.
+	predictionDays = 7
+)
+
+// ZoneDay is a day of a zone's history.
+type ZoneDay struct {
+	Date time.Time
+	// VWC is the VWC at the end of the day, or nil if there are no ledger
+	// entries for the day.
+	VWC *Pct `json:",omitempty"`
+	// Minutes is the time the zone ran, automatically or manually.
+	Minutes float64
+}
+
+// ZoneView is a zone's config, current state and recent history.
+type ZoneView struct {
+	Number int
+	Config *ZoneConfig
+	State  ZoneState
+	VWC    float64
+	// LastRun is when the zone last ran in the history, or nil if it didn't.
+	LastRun     *time.Time `json:",omitempty"`
+	LastRunMins float64
+	// NextRun is when the next auto run is scheduled, and NextRunMins is the
+	// predicted runtime of the zone then, assuming the average ET of the last
+	// predictionDays days and no rain.
+	NextRun     time.Time
+	NextRunMins float64
+	// History is the last zoneHistoryDays days, oldest first.
+	History []*ZoneDay
+}
+
+// NewZoneViews returns a ZoneView at time now for each zone in sc.
+func NewZoneViews(now time.Time, sc *SystemConfig, kv KVStore, zc *ZoneController, ledger *Ledger) ([]*ZoneView, error) {
+	var out []*ZoneView
+	for znum := 0; znum < sc.NumZones(); znum++ {
+		if _, ok := sc.ZoneConfigs[znum]; !ok {
+			continue
+		}
+		v, err := NewZoneView(now, znum, sc, kv, zc, ledger)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// NewZoneView returns the ZoneView of zone znum at time now, from the config
+// in sc, the state in kv and zc and the history in ledger.
+func NewZoneView(now time.Time, znum int, sc *SystemConfig, kv KVStore, zc *ZoneController, ledger *Ledger) (*ZoneView, error) {
+	z, ok := sc.ZoneConfigs[znum]
+	if !ok {
+		return nil, fmt.Errorf("no zone %d", znum)
+	}
+	v := &ZoneView{Number: znum, Config: z}
+	var err error
+	if v.State, err = zc.State(znum); err != nil {
+		return nil, err
+	}
+	if v.VWC, err = GetVWC(kv, znum); err != nil {
+		return nil, err
+	}
+	if v.NextRun, _, err = nextRun(now, kv, sc); err != nil {
+		return nil, err
+	}
+
+	today := dateOnly(now)
+	var etRemoved Pct
+	etDays := 0
+	for d := today.AddDate(0, 0, 1-zoneHistoryDays); !d.After(today); d = d.AddDate(0, 0, 1) {
+		es, err := ledger.Read(znum, d, d)
+		if err != nil {
+			return nil, err
+		}
+		day := &ZoneDay{Date: d}
+		for _, e := range latestEntries(es) {
+			vwc := e.EndVWC
+			day.VWC = &vwc
+			switch e.Kind {
+			case IrrigationEntry, ManualEntry, InterruptedEntry:
+				day.Minutes += e.Runtime.Minutes()
+				t := e.Time
+				v.LastRun, v.LastRunMins = &t, e.Runtime.Minutes()
+			case BalanceEntry:
+				if today.Sub(d) < predictionDays*24*time.Hour {
+					etRemoved += e.ETRemoved
+					etDays++
+				}
+			}
+		}
+		v.History = append(v.History, day)
+	}
+
+	// Predict as calculateRuntimes would.
+	predicted := Pct(v.VWC)
+	if etDays > 0 {
+		predicted -= etRemoved / Pct(etDays)
+	}
+	if predicted < z.MinVWC {
+		alg, err := NewETAlgorithm(sc)
+		if err != nil {
+			return nil, err
+		}
+		d, err := alg.CalculateRuntime(predicted, z.MaxVWC, 0, z)
+		if err != nil {
+			return nil, err
+		}
+		v.NextRunMins = d.Minutes() * z.RunTimeMultiplier
+	}
+	return v, nil
+}
+
+// PatchZone returns the config conf with the fields in patch, a JSON object
+// of ZoneConfig fields, replacing those of zone znum. Only the patched values
+// change, the rest of conf keeps its formatting and order. The new config is
+// checked with SystemConfig#Parse.
+func PatchZone(conf []byte, znum int, patch []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, fmt.Errorf("bad zone patch: %s", err)
+	}
+	zt := reflect.TypeOf(ZoneConfig{})
+	var keys []string
+	for k, f := range fields {
+		if _, ok := zt.FieldByName(k); !ok || strings.ToLower(k[:1]) == k[:1] {
+			return nil, fmt.Errorf("unknown zone field %s", k)
+		}
+		if k == "Number" && string(f) != fmt.Sprint(znum) {
+			return nil, fmt.Errorf("zone Number can't be changed")
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	zcs, ok, err := findMember(conf, 0, "ZoneConfigs")
+	if err != nil {
+		return nil, err
+	}
+	var zone jsonMember
+	if ok {
+		zone, ok, err = findMember(conf, zcs.start, strconv.Itoa(znum))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no zone %d", znum)
+	}
+	z, err := patchObject(conf[zone.start:zone.end], keys, fields)
+	if err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte(nil), conf[:zone.start]...), z...), conf[zone.end:]...)
+
+	var sc SystemConfig
+	if err := sc.Parse(string(out)); err != nil {
+		return nil, fmt.Errorf("Error in config: %s", err)
+	}
+	return out, nil
+}
+
+// jsonMember is a member of a JSON object, with the offsets of its value.
+type jsonMember struct {
+	key        string
+	start, end int
+}
+
+// jsonMembers returns the members of the JSON object that starts at offset in
+// b, in order. The offsets are in b.
+func jsonMembers(b []byte, offset int) ([]jsonMember, error) {
+	d := json.NewDecoder(bytes.NewReader(b[offset:]))
+	if t, err := d.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, fmt.Errorf("got %v, want a JSON object", t)
+	}
+	var ms []jsonMember
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		end := offset + int(d.InputOffset())
+		ms = append(ms, jsonMember{key: fmt.Sprint(t), start: end - len(v), end: end})
+	}
+	return ms, nil
+}
+
+// findMember returns the member key of the JSON object that starts at offset
+// in b, and false if there is none.
+func findMember(b []byte, offset int, key string) (jsonMember, bool, error) {
+	ms, err := jsonMembers(b, offset)
+	if err != nil {
+		return jsonMember{}, false, err
+	}
+	for _, m := range ms {
+		if m.key == key {
+			return m, true, nil
+		}
+	}
+	return jsonMember{}, false, nil
+}
+
+// patchObject returns the JSON object obj with the values of keys replaced by
+// those in fields, or added after the last member if they aren't in obj. In
+// an object with members on their own lines, new members get their own lines
+// with the indent of the last member, and values are indented to match. In an
+// object on one line, values are compact.
+func patchObject(obj []byte, keys []string, fields map[string]json.RawMessage) ([]byte, error) {
+	ms, err := jsonMembers(obj, 0)
+	if err != nil {
+		return nil, err
+	}
+	multiline := len(ms) > 0 && bytes.IndexByte(obj[:ms[0].start], '\n') >= 0
+	have := make(map[string]bool)
+	out := append([]byte(nil), obj...)
+	// Replace from the end, so that the offsets of earlier members stay valid.
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		have[m.key] = true
+		f, ok := fields[m.key]
+		if !ok {
+			continue
+		}
+		v, err := formatJSON(f, multiline, lineIndent(obj, m.start))
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(append([]byte(nil), out[:m.start]...), v...), out[m.end:]...)
+	}
+
+	indent, sep := "", ", "
+	if multiline {
+		indent = lineIndent(obj, ms[len(ms)-1].start)
+		sep = ",\n" + indent
+	}
+	var add []byte
+	for _, k := range keys {
+		if have[k] {
+			continue
+		}
+		v, err := formatJSON(fields[k], multiline, indent)
+		if err != nil {
+			return nil, err
+		}
+		if len(ms) > 0 || add != nil {
+			add = append(add, sep...)
+		}
+		add = append(add, fmt.Sprintf("%q: %s", k, v)...)
+	}
+	if add == nil {
+		return out, nil
+	}
+	// New members go after the last one, before any white space and the
+	// closing brace.
+	end := len(bytes.TrimRight(out[:bytes.LastIndexByte(out, '}')], " \t\r\n"))
+	return append(append(append([]byte(nil), out[:end]...), add...), out[end:]...), nil
+}
+
+// lineIndent returns the white space at the start of the line of b that
+// offset is on.
+func lineIndent(b []byte, offset int) string {
+	line := b[bytes.LastIndexByte(b[:offset], '\n')+1:]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// formatJSON returns the JSON value v indented for a member line with
+// indent, or compact if not multiline.
+func formatJSON(v []byte, multiline bool, indent string) ([]byte, error) {
+	var b bytes.Buffer
+	var err error
+	if multiline {
+		err = json.Indent(&b, v, indent, "  ")
+	} else {
+		err = json.Compact(&b, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
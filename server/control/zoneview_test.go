@@ -0,0 +1,267 @@
+package control
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewZoneView(t *testing.T) {
+	root, err := ioutil.TempDir("", "irctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sc := &SystemConfig{}
+	if err := sc.Parse(reportTestConfig); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 3, 17, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	kv := NewTestKVStore()
+	zc := NewZoneController(&TestValveController{log: &TestLogger{}}, kv, clock)
+	if err := SetVWC(kv, 0, 12); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set(LastRunDateKey, now.Format(dateFormat)); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLedger(root)
+	for _, e := range []*LedgerEntry{
+		// Before the history.
+		newManualEntry(now.AddDate(0, 0, -40), 0, 60*time.Minute, 9, 5, 20),
+		newBalanceEntry(now.AddDate(0, 0, -2), 0, 70, 0, 0.2, &WaterBalance{StartVWC: 19, ETRemoved: 3, EndVWC: 16}),
+		newBalanceEntry(now.AddDate(0, 0, -1), 0, 70, 0, 0.2, &WaterBalance{StartVWC: 16, ETRemoved: 5, EndVWC: 11}),
+		newManualEntry(now.AddDate(0, 0, -1), 0, 5*time.Minute, 11, 1, 20),
+		newBalanceEntry(now, 0, 70, 0, 0.2, &WaterBalance{StartVWC: 12, ETRemoved: 4, EndVWC: 8}),
+		newIrrigationEntry(now, 0, 20*time.Minute, 8, 20),
+	} {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewZoneView(now, 5, sc, kv, zc, l); err == nil {
+		t.Errorf("got nil error for missing zone")
+	}
+	v, err := NewZoneView(now, 0, sc, kv, zc, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Config.Name != "lawn" || v.State != Idle || v.VWC != 12 {
+		t.Errorf("got %s %s VWC %.1f, want lawn Idle VWC 12", v.Config.Name, v.State, v.VWC)
+	}
+	if v.LastRun == nil || !v.LastRun.Equal(now) || v.LastRunMins != 20 {
+		t.Errorf("got last run %v for %.1f mins, want now for 20 mins", v.LastRun, v.LastRunMins)
+	}
+	// Today's run is done, so the next is tomorrow. The average ET removed is
+	// 4, so VWC is predicted to be 8, below the minimum of 10.
+	if want := time.Date(2019, 3, 18, 9, 0, 0, 0, time.UTC); !v.NextRun.Equal(want) {
+		t.Errorf("got next run %s, want %s", v.NextRun, want)
+	}
+	if want := runtimeForVWC(8, 20, 0, v.Config).Minutes(); v.NextRunMins != want || want == 0 {
+		t.Errorf("got next run %.1f mins, want %.1f", v.NextRunMins, want)
+	}
+
+	if len(v.History) != zoneHistoryDays {
+		t.Fatalf("got %d days of history, want %d", len(v.History), zoneHistoryDays)
+	}
+	if d := v.History[0]; !d.Date.Equal(dateOnly(now.AddDate(0, 0, 1-zoneHistoryDays))) || d.VWC != nil || d.Minutes != 0 {
+		t.Errorf("got first day %+v, want no entries", d)
+	}
+	yd, td := v.History[zoneHistoryDays-2], v.History[zoneHistoryDays-1]
+	if yd.VWC == nil || *yd.VWC != 12 || yd.Minutes != 5 {
+		t.Errorf("got yesterday %+v, want VWC 12 and 5 mins", yd)
+	}
+	if td.VWC == nil || *td.VWC != 20 || td.Minutes != 20 {
+		t.Errorf("got today %+v, want VWC 20 and 20 mins", td)
+	}
+
+	// A zone that is well watered isn't predicted to run.
+	if err := SetVWC(kv, 2, 18); err != nil {
+		t.Fatal(err)
+	}
+	vs, err := NewZoneViews(now, sc, kv, zc, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 3 || vs[2].Number != 2 || vs[2].LastRun != nil || vs[2].NextRunMins != 0 {
+		t.Errorf("got %d views, last %+v, want 3 with zone 2 not run", len(vs), vs[len(vs)-1])
+	}
+}
+
+func TestPatchZone(t *testing.T) {
+	conf := []byte(reportTestConfig)
+	out, err := PatchZone(conf, 1, []byte(`{"MaxVWC": 25, "Name": "beds", "SoilConfig": {"Name": "loam", "MaxVWC": 30}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &SystemConfig{}
+	if err := sc.Parse(string(out)); err != nil {
+		t.Fatal(err)
+	}
+	z := sc.ZoneConfigs[1]
+	if z.MaxVWC != 25 || z.Name != "beds" || z.SoilConfig == nil || z.SoilConfig.Name != "loam" || z.MinVWC != 10 || z.DepthIn != 8 {
+		t.Errorf("got zone %+v, want patched fields and the rest unchanged", z)
+	}
+	if sc.ZoneConfigs[0].Name != "lawn" || sc.GlobalConfig.AirportCode != "KSJC" {
+		t.Errorf("other config changed: %s", out)
+	}
+
+	// Only the patched lines change, and new fields are added at the end.
+	out, err = PatchZone(conf, 1, []byte(`{"MaxVWC": 25, "FlowGPM": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(reportTestConfig, `"MaxVWC": 20,
+      "MinVWC": 10,
+      "Name": "<beds>"`, `"MaxVWC": 25,
+      "MinVWC": 10,
+      "Name": "<beds>"`, 1)
+	want = strings.Replace(want, `"Number": 1,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1
+`, `"Number": 1,
+      "RunTimeMultiplier": 1,
+      "ZoneETRate": 0.1,
+      "FlowGPM": 3
+`, 1)
+	if string(out) != want {
+		t.Errorf("got config\n%s\nwant\n%s", out, want)
+	}
+
+	for _, tt := range []struct {
+		znum  int
+		patch string
+		want  string
+	}{
+		{1, `{"MaxVWC": 101}`, "MaxVWC must be in the range"},
+		{1, `{"Name": ""}`, "must specify zone name"},
+		{1, `{"MaxVwc": 25}`, "unknown zone field MaxVwc"},
+		{1, `{"Number": 2}`, "Number can't be changed"},
+		{1, `[1]`, "bad zone patch"},
+		{7, `{"MaxVWC": 25}`, "no zone 7"},
+	} {
+		if _, err := PatchZone(conf, tt.znum, []byte(tt.patch)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("PatchZone(%d, %s): got %v, want %s", tt.znum, tt.patch, err, tt.want)
+		}
+	}
+	if _, err := PatchZone(conf, 1, []byte(`{"Number": 1}`)); err != nil {
+		t.Errorf("PatchZone with the same Number: %s", err)
+	}
+}
+
+func TestPatchObject(t *testing.T) {
+	for _, tt := range []struct {
+		desc, obj, patch, want string
+	}{
+		{
+			"replace",
+			"{\n  \"a\": 1,\n  \"b\": \"x\"\n}",
+			`{"b": "y"}`,
+			"{\n  \"a\": 1,\n  \"b\": \"y\"\n}",
+		},
+		{
+			"replace nested",
+			"{\n    \"a\": {\"x\": 1},\n    \"b\": 2\n  }",
+			`{"a": {"x": 2, "y": [1, 2]}}`,
+			"{\n    \"a\": {\n      \"x\": 2,\n      \"y\": [\n        1,\n        2\n      ]\n    },\n    \"b\": 2\n  }",
+		},
+		{
+			"add",
+			"{\n  \"a\": 1\n}",
+			`{"c": 3, "b": {"x": true}}`,
+			"{\n  \"a\": 1,\n  \"b\": {\n    \"x\": true\n  },\n  \"c\": 3\n}",
+		},
+		{
+			"replace and add",
+			"{\n  \"a\": 1,\n  \"b\": 2\n}",
+			`{"a": 5, "c": 3}`,
+			"{\n  \"a\": 5,\n  \"b\": 2,\n  \"c\": 3\n}",
+		},
+		{
+			"one line",
+			`{"a": 1, "b": {"x": 1}}`,
+			`{"b": {"x": 2}, "c": [1, 2]}`,
+			`{"a": 1, "b": {"x":2}, "c": [1,2]}`,
+		},
+		{
+			"empty",
+			`{}`,
+			`{"b": 2, "a": 1}`,
+			`{"a": 1, "b": 2}`,
+		},
+		{
+			"empty with space",
+			"{ }",
+			`{"a": 1}`,
+			`{"a": 1 }`,
+		},
+		{
+			"no change",
+			"{\n  \"a\": 1\n}",
+			`{}`,
+			"{\n  \"a\": 1\n}",
+		},
+		{
+			"string with brace",
+			"{\n  \"a\": \"}\"\n}",
+			`{"b": 1}`,
+			"{\n  \"a\": \"}\",\n  \"b\": 1\n}",
+		},
+	} {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(tt.patch), &fields); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		got, err := patchObject([]byte(tt.obj), keys, fields)
+		if err != nil {
+			t.Errorf("%s: %s", tt.desc, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.desc, got, tt.want)
+		}
+		if !json.Valid(got) {
+			t.Errorf("%s: got invalid JSON %s", tt.desc, got)
+		}
+	}
+	if _, err := patchObject([]byte(`[1]`), nil, nil); err == nil {
+		t.Errorf("got nil error for an array")
+	}
+}
+
+func TestJSONMembers(t *testing.T) {
+	b := []byte(` {"a": 1, "b": {"c": [1, "x"]}, "d": "e"}`)
+	ms, err := jsonMembers(b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range ms {
+		got = append(got, m.key+"="+string(b[m.start:m.end]))
+	}
+	if want := []string{`a=1`, `b={"c": [1, "x"]}`, `d="e"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got members %q, want %q", got, want)
+	}
+	m, ok, err := findMember(b, ms[1].start, "c")
+	if err != nil || !ok || string(b[m.start:m.end]) != `[1, "x"]` {
+		t.Errorf("findMember nested: got %+v %t %v", m, ok, err)
+	}
+	if _, ok, err := findMember(b, 0, "z"); ok || err != nil {
+		t.Errorf("findMember missing key: got %t %v", ok, err)
+	}
+	if _, err := jsonMembers([]byte(`{"a": `), 0); err == nil {
+		t.Errorf("got nil error for truncated object")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"irctl/server/control"
+)
+
+// incidentsHandler returns unresolved incidents, most recently seen first, or
+// all incidents if all=true.
+func incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	incs, err := incidentStore.List(r.FormValue("all") == "true")
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, struct{ Incidents []*control.Incident }{Incidents: incs})
+}
+
+// incidentAckHandler acknowledges the incident with ID id and returns it.
+func incidentAckHandler(w http.ResponseWriter, r *http.Request) {
+	updateIncident(w, r, incidentStore.Acknowledge)
+}
+
+// incidentResolveHandler resolves the incident with ID id and returns it.
+func incidentResolveHandler(w http.ResponseWriter, r *http.Request) {
+	updateIncident(w, r, incidentStore.Resolve)
+}
+
+// updateIncident calls update with the incident ID in the request and writes
+// the updated incident.
+func updateIncident(w http.ResponseWriter, r *http.Request, update func(int64) (*control.Incident, error)) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, r, "id: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	inc, err := update(id)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, r, inc)
+}
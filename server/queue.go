@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"irctl/server/control"
+)
+
+// queueHandler returns all jobs in the run queue for GET, or the job with ID
+// job if set. For POST, it queues a new job and returns it. The job runs the
+// zones in zones in order, e.g. zones=0:10,2:5 runs zone 0 for 10 mins and
+// then zone 2 for 5 mins, or today's computed runtimes if schedule=true.
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		if idStr := r.FormValue("job"); idStr != "" {
+			id, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil {
+				httpError(w, r, "job: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			j := runQueue.Job(id)
+			if j == nil {
+				httpError(w, r, fmt.Sprintf("no job %d", id), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, r, j)
+			return
+		}
+		writeJSON(w, r, struct{ Jobs []*control.Job }{Jobs: runQueue.Jobs()})
+		return
+	}
+
+	var runs []control.ZoneRun
+	var err error
+	switch {
+	case r.FormValue("schedule") == "true":
+		runs, err = scheduledRuns(time.Now())
+	case r.FormValue("zones") != "":
+		runs, err = parseZoneRuns(r.FormValue("zones"))
+	default:
+		err = fmt.Errorf("zones or schedule must be set")
+	}
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := runQueue.Add(runs)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, j)
+}
+
+// queueMoveHandler moves the queued item with ID item to position pos among
+// the queued items, where 0 runs next.
+func queueMoveHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("item"), 10, 64)
+	if err != nil {
+		httpError(w, r, "item: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pos, err := strconv.Atoi(r.FormValue("pos"))
+	if err != nil {
+		httpError(w, r, "pos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := runQueue.Move(id, pos); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, r, struct{ Queued []*control.QueueItem }{Queued: runQueue.Queued()})
+}
+
+// queueCancelHandler cancels the queued or running items of the job with ID
+// job, or the item with ID item.
+func queueCancelHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch {
+	case r.FormValue("job") != "":
+		var id int64
+		if id, err = strconv.ParseInt(r.FormValue("job"), 10, 64); err == nil {
+			err = runQueue.CancelJob(id)
+		}
+	case r.FormValue("item") != "":
+		var id int64
+		if id, err = strconv.ParseInt(r.FormValue("item"), 10, 64); err == nil {
+			err = runQueue.CancelItem(id)
+		}
+	default:
+		err = fmt.Errorf("job or item must be set")
+	}
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// parseZoneRuns parses a comma separated list of zone:mins pairs.
+func parseZoneRuns(s string) ([]control.ZoneRun, error) {
+	var out []control.ZoneRun
+	for _, p := range strings.Split(s, ",") {
+		zm := strings.Split(p, ":")
+		if len(zm) != 2 {
+			return nil, fmt.Errorf("bad zone run %s, want zone:mins", p)
+		}
+		num, err := strconv.Atoi(strings.TrimSpace(zm[0]))
+		if err != nil {
+			return nil, fmt.Errorf("zone: %s", err)
+		}
+		mins, err := strconv.Atoi(strings.TrimSpace(zm[1]))
+		if err != nil {
+			return nil, fmt.Errorf("mins: %s", err)
+		}
+		zr, err := newZoneRun(num, mins)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, zr)
+	}
+	return out, nil
+}
+
+// newZoneRun returns a run of zone num for mins minutes, checking that both
+// are in range.
+func newZoneRun(num, mins int) (control.ZoneRun, error) {
+	if num < 0 || num >= valveController.NumValves() {
+		return control.ZoneRun{}, fmt.Errorf("zone value %d out of range [0,%d]", num, valveController.NumValves())
+	}
+	if mins <= 0 || mins > maxRunMins {
+		return control.ZoneRun{}, fmt.Errorf("mins value %d out of range [1,%d]", mins, maxRunMins)
+	}
+	return control.ZoneRun{Zone: num, Duration: time.Duration(mins) * time.Minute}, nil
+}
+
+// scheduledRuns returns runs for the computed runtimes for the date in now.
+func scheduledRuns(now time.Time) ([]control.ZoneRun, error) {
+	rts, errs := dataLogger.ReadRuntimes(now, now)
+	if errs != nil || len(rts) == 0 {
+		return nil, fmt.Errorf("no computed runtimes for today: %s", errs)
+	}
+	var out []control.ZoneRun
+	for znum, mins := range rts[0].Runtimes {
+		if mins > 0 {
+			out = append(out, control.ZoneRun{Zone: znum, Duration: time.Duration(mins * float64(time.Minute))})
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no zones are scheduled to run today")
+	}
+	return out, nil
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s", string(j))
+}
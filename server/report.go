@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"irctl/server/control"
+)
+
+// reportHandler returns the DailyReport for date, or today if not set, as
+// HTML, or as text with format=text or JSON with format=json.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	t := time.Now()
+	if ds := r.FormValue("date"); ds != "" {
+		var err error
+		if t, err = strToDate(ds); err != nil {
+			httpError(w, r, "date: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sc, _, err := configStore.Current()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rep, err := control.NewDailyReport(t, sc, ledger, dataLogger)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch r.FormValue("format") {
+	case "json":
+		writeJSON(w, r, rep)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, rep.Text())
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, rep.HTML())
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/golang/glog"
@@ -31,26 +37,165 @@ const (
 	// errLogPath is the path for error log file, which can be checked by HTTP
 	// clients.
 	errLogPath = "../../errlog"
+	// secretsPath is the path for the weather provider API keys and notification
+	// secrets. It must not be under wwwRoot.
+	secretsPath = "../../secrets.json"
+	// usersPath is the path for the users and API tokens, with hashed
+	// credentials. It must not be under wwwRoot.
+	usersPath = "../../users.json"
+	// configRevisionsPath is the dir where each version of the config file is
+	// kept.
+	configRevisionsPath = "../../config_revisions"
+	// tlsCertPath and tlsKeyPath are the default paths for a self-signed TLS
+	// certificate and its key. The key must not be under wwwRoot.
+	tlsCertPath = "../../tls_cert.pem"
+	tlsKeyPath  = "../../tls_key.pem"
+	// conditionsCacheTTL is how long weather provider responses are cached.
+	conditionsCacheTTL = 6 * time.Hour
+	// shutdownTimeout is how long to wait for HTTP requests and the control
+	// loop to finish on shutdown.
+	shutdownTimeout = 30 * time.Second
 )
 
 var (
 	// Instance variables to share with HTTP handlers.
 	valveController control.ValveController
 	dataLogger      *control.DataLogger
+	ledger          *control.Ledger
+	kvStore         control.KVStore
+	stationLog      *weather.StationLog
+	// stationKey is the PASSWORD or PASSKEY that station uploads must match, if
+	// set.
+	stationKey string
+	// serverCtx is cancelled when the server is shutting down.
+	serverCtx context.Context
+	// runCoordinator controls access to the valves for manual and auto runs.
+	runCoordinator *control.RunCoordinator
+	// manualRunner runs zones manually.
+	manualRunner *control.ManualRunner
+	// runQueue is the queue of manual runs.
+	runQueue *control.RunQueue
+	// events receives valve and control loop events for /status/events.
+	events *control.EventBus
+	// zoneController is the controller for all zones.
+	zoneController *control.ZoneController
+	// alarmStore keeps errors reported by the control loop until cleared.
+	alarmStore *control.AlarmStore
+	// incidentStore keeps deduplicated errors reported by the control loop.
+	incidentStore *control.IncidentStore
+	// userStore has the users and API tokens that can use the HTTP API.
+	userStore *control.UserStore
+	// configStore has the config and its revisions.
+	configStore *control.ConfigStore
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		os.Exit(users(os.Args[2:]))
+	}
+
 	dataLogger = control.NewDataLogger(dataLogPath)
+	ledger = control.NewLedger(dataLogPath)
+	stationLog = weather.NewStationLog(dataLogPath, time.Local)
 
-	var valveControllerStr, portNameStr string
-	var runControlLoop, init bool
+	var valveControllerStr, portNameStr, weatherStr string
+	var listenAddr, redirectAddr, tlsCert, tlsKey, tlsHosts string
+	var runControlLoop, init, localStation, weatherCheck, tlsSelfSigned bool
+	var backfillDays int
 	acn := fmt.Sprint(control.AvailableControllerNames())
 	flag.StringVar(&valveControllerStr, "controller", "console", "Valve controller to use (default console). Choose from "+acn)
 	flag.StringVar(&portNameStr, "port_name", "", "Serial port to valve controller. Must be set.")
 	flag.BoolVar(&runControlLoop, "runloop", false, "Run the control loop (false runs server only).")
 	flag.BoolVar(&init, "init", false, "Erase the keystore state (reset) and assume that all zones are fully watered.")
+	flag.IntVar(&backfillDays, "backfill_days", 0, "Fill in any missing conditions for this many past days from the Open-Meteo archive, then exit.")
+	flag.BoolVar(&localStation, "local_station", false, "Use uploads from a local weather station for yesterday's conditions, if complete.")
+	flag.StringVar(&stationKey, "station_key", "", "Local weather station uploads must have this PASSWORD or PASSKEY. Required with -local_station.")
+	flag.StringVar(&weatherStr, "weather", "", "Comma separated, ordered list of weather providers to use, overriding the config. Choose from "+fmt.Sprint(weather.AvailableProviderNames()))
+	flag.BoolVar(&weatherCheck, "weather_check", false, "Get and print the forecast and yesterday's conditions from each weather provider, then exit.")
+	flag.StringVar(&listenAddr, "listen", ":8080", "Address to serve HTTP, or HTTPS with TLS, on.")
+	flag.StringVar(&tlsCert, "tls_cert", "", "TLS certificate file. If set with -tls_key, serve HTTPS.")
+	flag.StringVar(&tlsKey, "tls_key", "", "TLS private key file.")
+	flag.BoolVar(&tlsSelfSigned, "tls_self_signed", false, "Serve HTTPS, generating a self-signed certificate at -tls_cert and -tls_key, or "+tlsCertPath+" and "+tlsKeyPath+", if there isn't one.")
+	flag.StringVar(&tlsHosts, "tls_hosts", "", "Comma separated host names or IP addresses to add to a generated self-signed certificate.")
+	flag.StringVar(&redirectAddr, "http_redirect", "", "With TLS, also listen for plain HTTP on this address, e.g. :80, and redirect to HTTPS. Station uploads are served, not redirected.")
 	flag.Parse()
 
+	// Station uploads can't authenticate as a user, so the key is all that
+	// stops anyone from feeding the control loop observations.
+	if stationKey == "" {
+		if localStation {
+			log.Error("-local_station needs -station_key to be set.")
+			return
+		}
+		log.Warning("No -station_key, local weather station uploads are accepted from anyone.")
+	}
+
+	tlsCert, tlsKey, err := prepareTLS(tlsCert, tlsKey, tlsSelfSigned, tlsHosts)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	configStore, err = control.NewConfigStore(confFilePath, configRevisionsPath, control.RealClock{})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	// Weather providers are only configured at startup. If the config doesn't
+	// parse, the server still starts so that it can be fixed, with the default
+	// weather providers, and the control loop reports the bad config.
+	sc, _, err := configStore.Current()
+	if err != nil {
+		log.Errorf("%s\nUsing the default weather providers until the config is fixed and the server restarted.", err)
+		sc = &control.SystemConfig{}
+	}
+	pcs := sc.WeatherProviders
+	if pcs == nil {
+		pcs = make(weather.ProviderConfigs)
+	}
+	if err := pcs.LoadSecrets(secretsPath); err != nil {
+		log.Error(err)
+		return
+	}
+	weatherNames := sc.GlobalConfig.WeatherProviderNames()
+	if weatherStr != "" {
+		weatherNames = strings.Split(weatherStr, ",")
+		if err := control.VerifyWeatherProviderNames(weatherNames); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	providers, err := newWeatherProviders(weatherNames, pcs)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if weatherCheck {
+		checkWeatherProviders(providers, sc.GlobalConfig.AirportCode)
+		return
+	}
+
+	if backfillDays > 0 {
+		now := time.Now()
+		hg, err := weather.NewOpenMeteoConditionsGetter(pcs.Get(weather.OpenMeteoName))
+		if err != nil {
+			log.Error(err)
+			log.Flush()
+			return
+		}
+		// Open-Meteo uses the location rather than the airport code.
+		n, err := dataLogger.BackfillConditions(hg, "", now.AddDate(0, 0, -backfillDays), now.AddDate(0, 0, -1))
+		log.Infof("Backfilled conditions for %d days.", n)
+		if err != nil {
+			log.Error(err)
+		}
+		log.Flush()
+		return
+	}
+
 	if portNameStr == "" {
 		log.Error("port_name must be set")
 		return
@@ -59,15 +204,39 @@ func main() {
 		log.Infof("Removing keystore...: %s", os.RemoveAll(kVStorePath))
 	}
 
-	var err error
-	valveController, err = control.NewValveController(valveControllerStr, portNameStr)
+	clock := control.RealClock{}
+	events = control.NewEventBus()
+	vc, err := control.NewValveController(valveControllerStr, portNameStr)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	valveController = control.NewEventValveController(vc, events, clock)
 	log.Infof("Using controller %s.\n", valveControllerStr)
 
-	kv, err := control.NewBadgerKVStore(kVStorePath)
+	kv, err := control.NewBadgerKVStore(kVStorePath, clock)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	kvStore = kv
+	runCoordinator = control.NewRunCoordinator(clock)
+
+	userStore, err = control.NewUserStore(usersPath, clock)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !userStore.Enabled() {
+		log.Warningf("No users in %s, the HTTP API is not authenticated. Add one with: server users add NAME operator", usersPath)
+	}
+
+	// Notification sinks are only configured at startup.
+	if err := control.LoadNotificationSecrets(sc.Notifications, secretsPath); err != nil {
+		log.Error(err)
+		return
+	}
+	notifier, err := control.NewNotifier(sc.Notifications, clock)
 	if err != nil {
 		log.Error(err)
 		return
@@ -75,33 +244,207 @@ func main() {
 
 	rparam := control.RunParams{
 		ConfigPath:  confFilePath,
+		ConfigStore: configStore,
 		DataLogPath: dataLogPath,
-	}
-
-	zc := *control.NewZoneController(valveController, kv)
-	cg := weather.NewAccuWeatherConditionsGetter()
-	er, err := control.NewLogErrorReporter()
+		// The failover chain already tries every provider, so only retry
+		// once in case the network is briefly down.
+		ConditionsRetries:       1,
+		ConditionsRetryInterval: time.Minute,
+		Clock:                   clock,
+		Coordinator:             runCoordinator,
+		Events:                  events,
+		Reports:                 notifier,
+	}
+
+	zc := *control.NewZoneController(valveController, kv, clock)
+	zoneController = &zc
+	manualRunner = control.NewManualRunner(&rparam, kv, &zc)
+	runQueue, err = control.NewRunQueue(kv, runCoordinator, manualRunner, clock)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	var cg weather.ConditionsGetter = weather.NewFailoverConditionsGetter(kv, conditionsCacheTTL, providers...)
+	if localStation {
+		log.Info("Using local weather station for yesterday's conditions.")
+		cg = weather.NewLocalStationConditionsGetter(stationLog, cg)
+	}
+	alarmStore = control.NewAlarmStore(kv, clock, errLogPath)
+	incidentStore = control.NewIncidentStore(kv, clock)
+	// Every error is an alarm, but only new or escalated incidents notify.
+	er := control.NewAlarmErrorReporter(control.NewIncidentErrorReporter(incidentStore, notifier), alarmStore)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	serverCtx = ctx
+	loopDone := make(chan struct{})
 	if runControlLoop {
-		go control.Run(&rparam, kv, cg, zc, er)
+		go func() {
+			control.Run(ctx, &rparam, kv, cg, zc, er)
+			close(loopDone)
+		}()
 	} else {
 		log.Info("Not running control loop, HTTP server only.")
+		close(loopDone)
+	}
+	go runQueue.Run(ctx)
+
+	read, op := control.ReadOnlyRole, control.OperatorRole
+	http.Handle("/", loggingHandler(withRole(read, http.FileServer(http.Dir(wwwRoot)).ServeHTTP)))
+	http.HandleFunc("/runzone", withRole(op, runzoneHandler))
+	http.HandleFunc("/runzonestop", withRole(op, runzoneStopHandler))
+	http.HandleFunc("/conditions", withRole(read, conditionsHandler))
+	http.HandleFunc("/runtimes", withRole(read, runtimesHandler))
+	http.HandleFunc("/setconfig", withRole(op, setConfigHandler))
+	http.HandleFunc("/ledger", withRole(read, ledgerHandler))
+	http.HandleFunc("/ledger/recompute", withRoleFunc(recomputeRole, ledgerRecomputeHandler))
+	http.HandleFunc("/report", withRole(read, reportHandler))
+	http.HandleFunc("/status", withRole(read, statusHandler))
+	http.HandleFunc("/status/events", withRole(read, statusEventsHandler))
+	http.HandleFunc("/alarms", withRole(read, alarmsHandler))
+	http.HandleFunc("/alarms/clear", withRole(op, alarmsClearHandler))
+	http.HandleFunc("/incidents", withRole(read, incidentsHandler))
+	http.HandleFunc("/incidents/ack", withRole(op, incidentAckHandler))
+	http.HandleFunc("/incidents/resolve", withRole(op, incidentResolveHandler))
+	http.HandleFunc("/servervar", withRole(read, serverVarHandler))
+	http.HandleFunc("/servercmd", withRole(op, serverCmdHandler))
+	http.HandleFunc("/logs/", withRole(read, logsHandler))
+	http.HandleFunc("/queue", withRoleFunc(writeRole, queueHandler))
+	http.HandleFunc("/queue/move", withRole(op, queueMoveHandler))
+	http.HandleFunc("/queue/cancel", withRole(op, queueCancelHandler))
+	http.HandleFunc(apiPrefix+"/", apiHandler(apiRoutes()))
+	handleStationUploads(http.DefaultServeMux)
+
+	srv := &http.Server{Addr: listenAddr, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	var redirectSrv *http.Server
+	switch {
+	case redirectAddr != "" && tlsCert == "":
+		log.Warning("Ignoring -http_redirect without TLS.")
+	case redirectAddr != "":
+		redirectSrv = &http.Server{Addr: redirectAddr, Handler: redirectMux(listenAddr)}
+		go func() {
+			log.Infof("Redirecting HTTP on %s to HTTPS.", redirectAddr)
+			if err := redirectSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Error(err)
+			}
+		}()
+	}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		log.Infof("Got %s, shutting down.", <-sigs)
+		cancel()
+		sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer scancel()
+		if redirectSrv != nil {
+			if err := redirectSrv.Shutdown(sctx); err != nil {
+				log.Error(err)
+			}
+		}
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	if tlsCert != "" {
+		log.Infof("Listening for HTTPS on %s...", listenAddr)
+		err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		log.Infof("Listening on %s...", listenAddr)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Error(err)
+		cancel()
 	}
+	shutdown(&zc, kv, loopDone)
+}
 
-	http.Handle("/", loggingHandler(http.FileServer(http.Dir(wwwRoot))))
-	http.HandleFunc("/runzone", runzoneHandler)
-	http.HandleFunc("/runzonestop", runzoneStopHandler)
-	http.HandleFunc("/conditions", conditionsHandler)
-	http.HandleFunc("/runtimes", runtimesHandler)
-	http.HandleFunc("/setconfig", setConfigHandler)
+// shutdown waits for the control loop and any manual run to stop, closes all
+// valves and records any running zones as interrupted, then closes the KV
+// store.
+func shutdown(zc *control.ZoneController, kv control.KVStore, loopDone <-chan struct{}) {
+	select {
+	case <-loopDone:
+	case <-time.After(shutdownTimeout):
+		log.Error("Timed out waiting for control loop to stop.")
+	}
+	// Manual runs are cancelled by serverCtx, but still update VWC.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if run, err := runCoordinator.Acquire(ctx, control.ManualRun, control.Queue); err != nil {
+		log.Errorf("Waiting for manual run to stop: %s", err)
+	} else {
+		run.Release()
+	}
+	if err := zc.Shutdown(valveController.NumValves()); err != nil {
+		log.Error(err)
+	}
+	if err := kv.Close(); err != nil {
+		log.Error(err)
+	}
+	log.Info("Shutdown complete.")
+	log.Flush()
+}
 
-	log.Info("Listening...")
-	err = http.ListenAndServe(":8080", nil)
-	log.Error(err)
+// newWeatherProviders returns the named weather providers, configured from
+// pcs. If CIMIS is configured, it is added first and uses the first named
+// provider for forecasts. Providers whose config is not valid e.g. is missing
+// credentials are skipped with a warning. It returns an error if none are
+// left.
+func newWeatherProviders(names []string, pcs weather.ProviderConfigs) ([]*weather.Provider, error) {
+	var providers []*weather.Provider
+	var used []string
+	for _, n := range names {
+		cg, err := weather.NewConditionsGetter(n, pcs.Get(n))
+		if err != nil {
+			log.Warningf("Skipping weather provider %s: %s", n, err)
+			continue
+		}
+		providers = append(providers, &weather.Provider{Name: n, Getter: cg})
+		used = append(used, n)
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no usable weather providers in %v", names)
+	}
+	if _, ok := pcs[weather.CIMISName]; ok {
+		cimis, err := weather.NewCIMISConditionsGetter(pcs.Get(weather.CIMISName), providers[0].Getter)
+		if err != nil {
+			log.Warningf("Skipping weather provider %s: %s", weather.CIMISName, err)
+		} else {
+			log.Infof("Using CIMIS station %s for yesterday's conditions and ETo.", pcs.Get(weather.CIMISName).Station)
+			providers = append([]*weather.Provider{{Name: weather.CIMISName, Getter: cimis}}, providers...)
+		}
+	}
+	log.Infof("Using weather providers %v.", used)
+	return providers, nil
+}
+
+// checkWeatherProviders gets and prints the forecast and yesterday's
+// conditions from each provider, to check that it's set up correctly.
+func checkWeatherProviders(providers []*weather.Provider, airportCode string) {
+	for _, p := range providers {
+		fmt.Printf("%s:\n", p.Name)
+		icon, tempF, precipIn, iconTom, tempFTom, precipInTom, err := p.Getter.GetForecast(airportCode)
+		if err != nil {
+			fmt.Printf("  forecast: error: %s\n", err)
+		} else {
+			fmt.Printf("  today: %s %3.1f degF / %1.2f In\n", icon, tempF, precipIn)
+			fmt.Printf("  tomorrow: %s %3.1f degF / %1.2f In\n", iconTom, tempFTom, precipInTom)
+		}
+		icon, tempF, precipIn, err = p.Getter.GetYesterday(airportCode)
+		if err != nil {
+			fmt.Printf("  yesterday: error: %s\n", err)
+		} else {
+			fmt.Printf("  yesterday: %s %3.1f degF / %1.2f In\n", icon, tempF, precipIn)
+		}
+		if etcg, ok := p.Getter.(weather.ETConditionsGetter); ok {
+			if et, err := etcg.GetYesterdayET(airportCode); err != nil {
+				fmt.Printf("  yesterday ET: error: %s\n", err)
+			} else {
+				fmt.Printf("  yesterday ET: %1.2f In\n", et)
+			}
+		}
+	}
 }
 
 // conditionsHandler returns the conditions for the specified "from" to "to" URL
@@ -114,20 +457,7 @@ func conditionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conditions, errs := dataLogger.ReadConditions(from, to)
-	if errs != nil {
-		log.Errorf(errs.Error())
-	}
-
-	resp := struct {
-		Conditions []*control.ConditionsEntry
-		Errors     []string
-	}{
-		Conditions: conditions,
-		Errors:     control.ToStringSlice(errs),
-	}
-
-	j, err := json.Marshal(resp)
+	j, err := json.Marshal(readConditions(from, to))
 	if err != nil {
 		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
@@ -147,17 +477,164 @@ func runtimesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	j, err := json.Marshal(readRuntimes(from, to))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("return value: %s", string(j))
+	fmt.Fprintf(w, "%s", string(j))
+}
+
+// conditionsResponse is the response for conditions requests.
+type conditionsResponse struct {
+	Conditions []*control.ConditionsEntry
+	Errors     []string
+}
+
+// readConditions returns the logged conditions from from to to.
+func readConditions(from, to time.Time) *conditionsResponse {
+	conditions, errs := dataLogger.ReadConditions(from, to)
+	if errs != nil {
+		log.Error(errs)
+	}
+	return &conditionsResponse{
+		Conditions: conditions,
+		Errors:     control.ToStringSlice(errs),
+	}
+}
+
+// runtimesResponse is the response for runtimes requests.
+type runtimesResponse struct {
+	Runtimes []*control.RuntimesEntry
+	Errors   []string
+}
+
+// readRuntimes returns the logged runtimes from from to to.
+func readRuntimes(from, to time.Time) *runtimesResponse {
 	runtimes, errs := dataLogger.ReadRuntimes(from, to)
 	if errs != nil {
-		log.Errorf(errs.Error())
+		log.Error(errs)
+	}
+	return &runtimesResponse{
+		Runtimes: runtimes,
+		Errors:   control.ToStringSlice(errs),
+	}
+}
+
+// ledgerHandler returns the VWC ledger entries for the specified "from" to "to"
+// URL param range as a serialized struct of []*control.LedgerEntry. If the
+// "zone" URL param is set, only entries for that zone are returned, otherwise
+// entries for all zones in the config are returned.
+func ledgerHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("ledgerHandler: %s", r.URL.String())
+	from, to, err := getToFromRange(w, r)
+	if err != nil {
+		return
+	}
+	sc, _, err := configStore.Current()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	zones := make([]int, sc.NumZones())
+	for i := range zones {
+		zones[i] = i
+	}
+	if zoneStr := r.FormValue("zone"); zoneStr != "" {
+		znum, err := strconv.Atoi(zoneStr)
+		if err != nil {
+			httpError(w, r, "zone: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		zones = []int{znum}
+	}
+
+	var entries []*control.LedgerEntry
+	for _, znum := range zones {
+		es, err := ledger.Read(znum, from, to)
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, es...)
+	}
+	writeLedgerEntries(w, r, entries)
+}
+
+// ledgerRecomputeHandler recomputes VWC from the "from" URL param date to today
+// from the ledger, and returns the recomputed entries as a serialized struct of
+// []*control.LedgerEntry. The config in the POST body is used if there is one,
+// otherwise the current config. If the "apply" URL param is "true", the
+// entries are added to the ledger and the current VWC of each zone is updated.
+func ledgerRecomputeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("ledgerRecomputeHandler: %s", r.URL.String())
+	fromStr := r.FormValue("from")
+	if fromStr == "" {
+		httpError(w, r, "from parameter not specified", http.StatusBadRequest)
+		return
+	}
+	from, err := strToDate(fromStr)
+	if err != nil {
+		httpError(w, r, "from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body []byte
+	if r.Method == http.MethodPost {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			httpError(w, r, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+	}
+	sc := &control.SystemConfig{}
+	if len(body) != 0 {
+		err = sc.Parse(string(body))
+	} else {
+		sc, _, err = configStore.Current()
+	}
+	if err != nil {
+		httpError(w, r, "Error in config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	alg, err := control.NewETAlgorithm(sc)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	now := time.Now()
+	entries, err := ledger.Recompute(from, now, sc, alg, now)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("apply") == "true" {
+		// Don't change VWC while a run may be updating it.
+		run, err := runCoordinator.Acquire(r.Context(), control.ManualRun, control.Reject)
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = ledger.ApplyRecompute(kvStore, entries)
+		run.Release()
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Applied recompute from %s.", fromStr)
+	}
+	writeLedgerEntries(w, r, entries)
+}
+
+// writeLedgerEntries writes entries to w as a serialized struct.
+func writeLedgerEntries(w http.ResponseWriter, r *http.Request, entries []*control.LedgerEntry) {
 	resp := struct {
-		Runtimes []*control.RuntimesEntry
-		Errors   []string
+		Entries []*control.LedgerEntry
 	}{
-		Runtimes: runtimes,
-		Errors:   control.ToStringSlice(errs),
+		Entries: entries,
 	}
 
 	j, err := json.Marshal(resp)
@@ -165,8 +642,6 @@ func runtimesHandler(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	log.Infof("return value: %s", string(j))
 	fmt.Fprintf(w, "%s", string(j))
 }
 
@@ -174,29 +649,58 @@ func runtimesHandler(w http.ResponseWriter, r *http.Request) {
 func setConfigHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		httpError(w, r, "Error reading request body", http.StatusInternalServerError)
 		return
 	}
+	if _, err := writeConfig(r, body); err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// writeConfig checks that body is a valid config and writes it as a new
+// revision by the user that made r.
+func writeConfig(r *http.Request, body []byte) (*control.ConfigRevision, error) {
+	return updateConfig(r, "", func([]byte) ([]byte, error) { return body, nil })
+}
+
+// updateConfig writes the config returned by update, which is called with the
+// current config, as a new revision by the user that made r.
+func updateConfig(r *http.Request, comment string, update func(conf []byte) ([]byte, error)) (*control.ConfigRevision, error) {
+	rev, err := configStore.Update(requestUser(r), comment, update)
+	if _, ok := err.(*control.InvalidConfigError); ok {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	return rev, err
+}
 
-	j := make(map[string]interface{})
-	if err := json.Unmarshal(body, &j); err != nil {
-		http.Error(w, "Error unmarshaling body: "+err.Error(), http.StatusInternalServerError)
+// stationUploadHandler logs an observation uploaded by a local weather station
+// in Weather Underground (GET) or Ecowitt (POST) format.
+func stationUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var sc control.SystemConfig
-	if err := sc.Parse(string(body)); err != nil {
-		http.Error(w, "Error in config: "+err.Error(), http.StatusInternalServerError)
+	if stationKey != "" && r.Form.Get("PASSWORD") != stationKey && r.Form.Get("PASSKEY") != stationKey {
+		// Don't log the URL, it has the key.
+		log.Errorf("stationUploadHandler: bad station key from %s", r.RemoteAddr)
+		http.Error(w, "bad station key", http.StatusUnauthorized)
 		return
 	}
-
-	js, err := json.MarshalIndent(j, "", "  ")
-	if err := ioutil.WriteFile(confFilePath, js, 0644); err != nil {
-		http.Error(w, "Error writing file: "+err.Error(), http.StatusInternalServerError)
+	obs, err := weather.ParseStationUpload(r.Form, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Errorf("stationUploadHandler: %s", err)
 		return
 	}
-
-	log.Infof("setConfHandler succeeded with \n%s\n", js)
-	fmt.Fprintf(w, "OK")
+	if err := stationLog.Append(obs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Errorf("stationUploadHandler: %s", err)
+		return
+	}
+	// WU stations expect this exact response.
+	fmt.Fprintf(w, "success\n")
 }
 
 // runzoneHandler runs a zone for a number of minutes.
@@ -214,60 +718,85 @@ func runzoneHandler(w http.ResponseWriter, r *http.Request) {
 
 	num, err := strconv.ParseInt(numStr, 10, 32)
 	if err != nil {
-		httpError(w, r, "num: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if num < 0 || int(num) >= valveController.NumValves() {
-		httpError(w, r, fmt.Sprintf("num value %d out of range [0,%d]", num, valveController.NumValves()), http.StatusBadRequest)
+		httpError(w, r, "num: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	mins, err := strconv.ParseInt(minsStr, 10, 32)
 	if err != nil {
-		httpError(w, r, "mins: "+err.Error(), http.StatusInternalServerError)
+		httpError(w, r, "mins: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if mins < 0 || mins > maxRunMins {
-		httpError(w, r, fmt.Sprintf("mins value %d out of range [0,%d]", num, maxRunMins), http.StatusBadRequest)
+	queue := r.FormValue("queue") == "true"
+	if err := startZoneRun(int(num), int(mins), queue); err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
 		return
 	}
-
-	// Only one manual command may run. Manual commands may not run during auto
-	// run.
-	if control.CommandRunning {
-		// There's an unavoidable race here, but worst that can happen is
-		// command from UI will time out. We just want to avoid that happening
-		// most of the time if it's due to something already running.
-		httpError(w, r, "Another manual or auto run is currently in progress.", http.StatusInternalServerError)
+	if queue {
+		fmt.Fprintf(w, "OK - queued zone %d for %d mins.", num, mins)
 		return
 	}
+	fmt.Fprintf(w, "OK - running zone %d for %d mins.", num, mins)
+}
 
-	control.CommandRunning = true
-
-	err = valveController.OpenValve(int(num))
+// startZoneRun runs zone num for mins minutes.
+func startZoneRun(num, mins int, queue bool) error {
+	zr, err := newZoneRun(num, mins)
 	if err != nil {
-		control.CommandRunning = false
-		httpError(w, r, err.Error(), http.StatusInternalServerError)
-		return
+		return withStatus(http.StatusBadRequest, err)
 	}
 
-	go func() {
-		time.Sleep(time.Duration(mins) * time.Minute)
-		control.CommandRunning = false
+	// Only one manual command may run. Manual commands may not run during auto
+	// run, unless queue is set, in which case the run starts once the valves
+	// are free.
+	d := zr.Duration
+	if queue {
+		go func() {
+			run, err := runCoordinator.Acquire(serverCtx, control.ManualRun, control.Queue)
+			if err != nil {
+				log.Errorf("Queued run of zone %d: %s", num, err)
+				return
+			}
+			if err := runManual(run, num, d); err != nil {
+				log.Errorf("Queued run of zone %d: %s", num, err)
+			}
+		}()
+		return nil
+	}
+
+	run, err := runCoordinator.Acquire(serverCtx, control.ManualRun, control.Reject)
+	if err == control.ErrBusy {
+		return withStatus(http.StatusConflict, err)
+	}
+	if err != nil {
+		return err
+	}
+	done, err := manualRunner.Start(run, num, d)
+	if err != nil {
+		return err
+	}
+	go logManualRun(num, done)
+	return nil
+}
 
-		err = valveController.CloseValve(int(num))
-		if err != nil {
-			// This is a tricky situation. We don't want to keep Running set to
-			// true since this will block everything. Rather, rely on
-			// periodic closer to take care of this eventually.
-			log.Errorf("CloseValve %d failed: %s", num, err)
-			return
-		}
-	}()
+// runManual runs zone num for duration d with run and waits for it to finish.
+func runManual(run *control.RunHandle, num int, d time.Duration) error {
+	done, err := manualRunner.Start(run, num, d)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
 
-	fmt.Fprintf(w, "OK - running zone %d for %d mins.", num, mins)
+// logManualRun logs the result of the manual run of zone num from done.
+func logManualRun(num int, done <-chan error) {
+	if err := <-done; err != nil {
+		// The valves are released anyway so that everything isn't blocked.
+		// Rely on the periodic closer to take care of any valve left open.
+		log.Errorf("Manual run of zone %d: %s", num, err)
+	}
 }
 
-// runzoneStopHandler runs a zone for a number of minutes.
+// runzoneStopHandler stops a zone.
 func runzoneStopHandler(w http.ResponseWriter, r *http.Request) {
 	numStr := r.FormValue("num")
 	if numStr == "" {
@@ -277,23 +806,35 @@ func runzoneStopHandler(w http.ResponseWriter, r *http.Request) {
 
 	num, err := strconv.ParseInt(numStr, 10, 32)
 	if err != nil {
-		httpError(w, r, "num: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if num < 0 || int(num) >= valveController.NumValves() {
-		httpError(w, r, fmt.Sprintf("num value %d out of range [0,%d]", num, valveController.NumValves()), http.StatusBadRequest)
+		httpError(w, r, "num: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = valveController.CloseValve(int(num))
-	if err != nil {
-		log.Errorf("CloseValve %d failed: %s", num, err)
+	if err := stopZone(int(num)); err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
 		return
 	}
-	control.CommandRunning = false
 
 	fmt.Fprintf(w, "OK")
 }
 
+// stopZone closes the valve of zone num, and cancels any manual run or an auto
+// run of the zone.
+func stopZone(num int) error {
+	if num < 0 || num >= valveController.NumValves() {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("num value %d out of range [0,%d]", num, valveController.NumValves()))
+	}
+	if err := valveController.CloseValve(num); err != nil {
+		return fmt.Errorf("CloseValve %d failed: %s", num, err)
+	}
+	// Release the valves if a manual run has them. An auto run of the zone is
+	// cancelled too, so that the zone is credited only for the time it ran and
+	// the rest of its runtime is run later.
+	if a := runCoordinator.Active(); a != nil && (a.Source == control.ManualRun || a.Zone == num) {
+		runCoordinator.Cancel(a.ID)
+	}
+	return nil
+}
+
 // loggingHandler adds a layer of logging to the regual HTTP handler.
 func loggingHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -305,30 +846,29 @@ func loggingHandler(h http.Handler) http.Handler {
 // getToFromRange extracts "to" and "from" URL params from the supplied request
 // and returns them as Time structs.
 func getToFromRange(w http.ResponseWriter, r *http.Request) (from, to time.Time, err error) {
+	if from, to, err = dateRange(r); err != nil {
+		err = httpError(w, r, err.Error(), http.StatusBadRequest)
+	}
+	return
+}
+
+// dateRange returns the "from" and "to" URL param dates of r.
+func dateRange(r *http.Request) (from, to time.Time, err error) {
 	fromStr := r.FormValue("from")
 	if fromStr == "" {
-		err = httpError(w, r, "from parameter not specified", http.StatusBadRequest)
-		return
+		return from, to, withStatus(http.StatusBadRequest, errors.New("from parameter not specified"))
 	}
 	toStr := r.FormValue("to")
 	if toStr == "" {
-		err = httpError(w, r, "to parameter not specified", http.StatusBadRequest)
-		return
+		return from, to, withStatus(http.StatusBadRequest, errors.New("to parameter not specified"))
 	}
-
-	from, err = strToDate(fromStr)
-	if err != nil {
-		err = httpError(w, r, "from: "+err.Error(), http.StatusInternalServerError)
-		return
+	if from, err = strToDate(fromStr); err != nil {
+		return from, to, withStatus(http.StatusBadRequest, fmt.Errorf("from: %s", err))
 	}
-
-	to, err = strToDate(toStr)
-	if err != nil {
-		err = httpError(w, r, "to: "+err.Error(), http.StatusInternalServerError)
-		return
+	if to, err = strToDate(toStr); err != nil {
+		return from, to, withStatus(http.StatusBadRequest, fmt.Errorf("to: %s", err))
 	}
-
-	return
+	return from, to, nil
 }
 
 // strToDate creates a time object from a date string, which has only the date
@@ -342,7 +882,11 @@ func strToDate(s string) (time.Time, error) {
 // an error.
 func httpError(w http.ResponseWriter, r *http.Request, msg string, status int) error {
 	e := fmt.Sprintf("%s: %s", r.URL.String(), msg)
-	log.Errorf(e)
-	http.Error(w, msg, status)
-	return fmt.Errorf(e)
+	log.Error(e)
+	if isAPIRequest(r) {
+		writeAPIResponse(w, r, status, &control.APIError{Status: status, Error: msg})
+	} else {
+		http.Error(w, msg, status)
+	}
+	return errors.New(e)
 }
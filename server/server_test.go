@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"irctl/server/control"
+	"irctl/server/control/weather"
+)
+
+func TestNewWeatherProviders(t *testing.T) {
+	pcs := weather.ProviderConfigs{
+		weather.AccuWeatherName: {LocationKey: "331979"},
+		weather.OpenMeteoName:   {Latitude: 37.3591, Longitude: -121.9244},
+		weather.CIMISName:       {Station: "211"},
+	}
+	for _, tt := range []struct {
+		desc    string
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{"all configured", []string{weather.NWSName, weather.OpenMeteoName}, []string{weather.NWSName, weather.OpenMeteoName}, false},
+		{"missing API keys skipped", []string{weather.AccuWeatherName, weather.OpenMeteoName}, []string{weather.OpenMeteoName}, false},
+		{"none left", []string{weather.AccuWeatherName}, nil, true},
+	} {
+		providers, err := newWeatherProviders(tt.names, pcs)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.desc, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, p := range providers {
+			got = append(got, p.Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got providers %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestStopZone(t *testing.T) {
+	clock := control.NewFakeClock(time.Now())
+	valveController = control.NewRecordingValveController(4, clock)
+	runCoordinator = control.NewRunCoordinator(clock)
+	run, err := runCoordinator.Acquire(context.Background(), control.AutoRun, control.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.Release()
+	run.SetZone(1, time.Hour)
+
+	// Stopping another zone leaves the auto run going.
+	if err := stopZone(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Context().Err(); err != nil {
+		t.Errorf("after stopping another zone: got auto run error %v, want nil", err)
+	}
+	if err := stopZone(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Context().Err(); err == nil {
+		t.Error("after stopping the running zone: got nil auto run error, want cancelled")
+	}
+}
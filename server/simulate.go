@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"irctl/server/control"
+)
+
+// simulate runs the simulate subcommand with the given args, which replays the
+// logged conditions through the control loop with a config and prints the
+// daily runtimes and VWC. It returns the exit code.
+//
+//	go run . simulate -from 2018-3-1 -to 2018-4-1 -config my_conf.json
+func simulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configPath := fs.String("config", confFilePath, "Config file to simulate.")
+	conditionsPath := fs.String("conditions", dataLogPath, "Root dir of the conditions logs to replay.")
+	fromStr := fs.String("from", "", "First day to simulate, as YYYY-M-D. Must be set.")
+	toStr := fs.String("to", "", "Last day to simulate, as YYYY-M-D. Must be set.")
+	initialVWC := fs.Float64("initial_vwc", -1, "VWC of all zones on the first day. If negative, zones start at their MaxVWC.")
+	format := fs.String("format", "csv", "Output format, csv or json.")
+	fs.Parse(args)
+	// The control loop logs with glog, which expects the command line to be
+	// parsed.
+	flag.CommandLine.Parse(nil)
+
+	if *fromStr == "" || *toStr == "" {
+		fmt.Fprintln(os.Stderr, "from and to must be set")
+		return 2
+	}
+	from, err := strToDate(*fromStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "from: %s\n", err)
+		return 2
+	}
+	to, err := strToDate(*toStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "to: %s\n", err)
+		return 2
+	}
+	if *format != "csv" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %s\n", *format)
+		return 2
+	}
+	config, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	p := &control.SimulationParams{
+		Config:            string(config),
+		ConditionsLogPath: *conditionsPath,
+		From:              from,
+		To:                to,
+	}
+	if *initialVWC >= 0 {
+		p.InitialVWC = make(map[int]control.Pct)
+		var sc control.SystemConfig
+		if err := sc.Parse(p.Config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for znum := 0; znum < sc.NumZones(); znum++ {
+			p.InitialVWC[znum] = control.Pct(*initialVWC)
+		}
+	}
+	res, err := control.Simulate(p)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *format == "json" {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(j))
+		return 0
+	}
+	if err := res.WriteCSV(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"irctl/server/control"
+)
+
+const (
+	// sseKeepalive is how often a comment is sent on an idle event stream so
+	// that proxies don't close it.
+	sseKeepalive = 30 * time.Second
+	// sseBufferSize is the number of events buffered for each stream.
+	sseBufferSize = 32
+)
+
+// statusHandler returns the current control.Status.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := currentStatus()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, s)
+}
+
+// statusEventsHandler streams Server-Sent Events until the client disconnects
+// or the server shuts down. It first sends a "status" event with the current
+// control.Status. Then for each control.Event, it sends an event named after
+// the event type, followed by a "status" event with the updated status.
+func statusEventsHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, unsubscribe := events.Subscribe(sseBufferSize)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := writeStatusEvent(w); err != nil {
+		log.Errorf("statusEventsHandler: %s", err)
+		return
+	}
+	f.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case e := <-ch:
+			if err = writeEvent(w, string(e.Type), e); err == nil {
+				err = writeStatusEvent(w)
+			}
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-serverCtx.Done():
+			return
+		}
+		if err != nil {
+			log.Errorf("statusEventsHandler: %s", err)
+			return
+		}
+		f.Flush()
+	}
+}
+
+// currentStatus returns the control.Status now.
+func currentStatus() (*control.Status, error) {
+	sc, _, err := configStore.Current()
+	if err != nil {
+		return nil, err
+	}
+	return control.GetStatus(time.Now(), kvStore, zoneController, runCoordinator, sc)
+}
+
+// writeStatusEvent writes a "status" event with the current status to w.
+func writeStatusEvent(w io.Writer) error {
+	s, err := currentStatus()
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, "status", s)
+}
+
+// writeEvent writes an event with the given name and v as JSON data to w.
+func writeEvent(w io.Writer, name string, v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, j)
+	return err
+}
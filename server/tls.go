@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"irctl/server/control"
+)
+
+// prepareTLS returns the certificate and key files to serve with, or empty
+// strings to serve plain HTTP. With selfSigned, a certificate for this host
+// and the comma separated extraHosts is generated if the certificate or key
+// is missing, at tlsCertPath and tlsKeyPath unless other files are given.
+func prepareTLS(certFile, keyFile string, selfSigned bool, extraHosts string) (string, string, error) {
+	if selfSigned && certFile == "" && keyFile == "" {
+		certFile, keyFile = tlsCertPath, tlsKeyPath
+	}
+	if (certFile == "") != (keyFile == "") {
+		return "", "", fmt.Errorf("both -tls_cert and -tls_key must be set for TLS")
+	}
+	if certFile == "" || !selfSigned {
+		return certFile, keyFile, nil
+	}
+	hosts := certHosts()
+	if extraHosts != "" {
+		hosts = append(strings.Split(extraHosts, ","), hosts...)
+	}
+	wrote, err := control.EnsureSelfSignedCert(certFile, keyFile, hosts, control.RealClock{})
+	if err != nil {
+		return "", "", err
+	}
+	if wrote {
+		log.Infof("Wrote self-signed certificate for %s to %s.", strings.Join(hosts, ", "), certFile)
+	}
+	return certFile, keyFile, nil
+}
+
+// certHosts returns the host name, localhost and the IP addresses of this
+// host, for a self-signed certificate.
+func certHosts() []string {
+	var hosts []string
+	if h, err := os.Hostname(); err == nil {
+		hosts = append(hosts, h)
+	}
+	hosts = append(hosts, "localhost")
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warningf("Couldn't get IP addresses for certificate: %s", err)
+		return append(hosts, "127.0.0.1", "::1")
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			hosts = append(hosts, ipn.IP.String())
+		}
+	}
+	return hosts
+}
+
+// redirectMux returns a handler for the plain HTTP listener when serving
+// TLS. It redirects to HTTPS on the port of listenAddr, except for station
+// uploads, as stations can't use HTTPS.
+func redirectMux(listenAddr string) http.Handler {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil || port == "443" {
+		port = ""
+	}
+	mux := http.NewServeMux()
+	handleStationUploads(mux)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			// Keep the method and body.
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+	return mux
+}
+
+// handleStationUploads registers the Weather Underground and Ecowitt station
+// upload paths with mux.
+func handleStationUploads(mux *http.ServeMux) {
+	mux.HandleFunc("/weatherstation/updateweatherstation.php", stationUploadHandler)
+	mux.HandleFunc("/data/report/", stationUploadHandler)
+}
@@ -1,3 +1,8 @@
+// serverVars has the values of server variables from getServerVar.
+var serverVars = {};
+// clearingAlarms is set while waiting for the server to clear alarms.
+var clearingAlarms = 0;
+
 
 /*-------------------------------------------------------------------------------------------------------------*/
 /**
@@ -93,7 +98,7 @@ function popupServerLog(data)
 
 function displayServerLog(logName)
 {
-	var url="http://"+server_ip+"/logs/"+logName;
+	var url=server_url+"/logs/"+logName;
 
 	writeStatus("Sending request for " + url);
 
@@ -26,6 +26,8 @@ var g = {
 
 var statusArea;
 var server_ip = location.host;
+// server_url is the base URL of the server, http or https as the page was loaded.
+var server_url = location.protocol + "//" + server_ip;
 var confFilename = "conf/irctl_conf.json"
 
 // /////////////////////// Member functions
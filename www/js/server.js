@@ -6,7 +6,7 @@
 /*----------------------------------------------------------------------------*/
 
 function getConfFile() {
-  var url = "http://" + server_ip + "/" + confFilename;
+  var url = server_url + "/" + confFilename;
 
   Debug("Sending request for " + url);
 
@@ -206,7 +206,7 @@ function log(msg) {
 /*----------------------------------------------------------------------------*/
 
 function sendRunZoneCmd(num, mins) {
-  url = "http://" + server_ip + "/runzone?num=" + num.toString() + "&mins=" + mins.toString();
+  url = server_url + "/runzone?num=" + num.toString() + "&mins=" + mins.toString();
   makeRequest(url, onSendRunZoneCmdDone);
 }
 
@@ -217,7 +217,7 @@ function onSendRunZoneCmdDone(data) {
 }
 
 function sendRunZoneStopCmd(num) {
-  url = "http://" + server_ip + "/runzonestop?num=" + num.toString();
+  url = server_url + "/runzonestop?num=" + num.toString();
   makeRequest(url, onSendRunZoneStopCmdDone);
 }
 
@@ -227,6 +227,38 @@ function onSendRunZoneStopCmdDone(data) {
   }
 }
 
+/*----------------------------------------------------------------------------*/
+/**
+ * @fn getServerVar
+ * @brief Get the value of a server variable e.g. NUM_ALARMS into serverVars.
+ */
+/*----------------------------------------------------------------------------*/
+
+function getServerVar(name) {
+  url = server_url + "/servervar?name=" + name;
+  makeRequest(url, function(data) {
+    serverVars[name] = parseInt(data, 10);
+  });
+}
+
+/*----------------------------------------------------------------------------*/
+/**
+ * @fn sendServerCmd
+ * @brief Send a command e.g. CLEAR_ALARMS to the server.
+ */
+/*----------------------------------------------------------------------------*/
+
+function sendServerCmd(cmd) {
+  url = server_url + "/servercmd?cmd=" + cmd;
+  makeRequest(url, onSendServerCmdDone);
+}
+
+function onSendServerCmdDone(data) {
+  if (!data.match(/OK/)) {
+    alert("Problem sending server command: " + data);
+  }
+}
+
 /*----------------------------------------------------------------------------*/
 /**
  * @fn getServerLogData
@@ -237,10 +269,10 @@ function onSendRunZoneStopCmdDone(data) {
 
 function getServerLogData(_fromDate, _toDate) {
   dateRange = "from=" + DateString(_fromDate) + "&to=" + DateString(_toDate);
-  url = "http://" + server_ip + "/conditions?" + dateRange;
+  url = server_url + "/conditions?" + dateRange;
   makeRequest(url, processConditionsResponse);
 
-  url = "http://" + server_ip + "/runtimes?" + dateRange;
+  url = server_url + "/runtimes?" + dateRange;
   makeRequest(url, processRuntimesResponse);
 }
 
@@ -316,7 +348,7 @@ function makeRequest(url, callback) {
 /*----------------------------------------------------------------------------*/
 
 function postSave() {
-  var postUrl = "http://" + server_ip + "/setconfig";
+  var postUrl = server_url + "/setconfig";
   var str;
 
   log("Posting to " + postUrl);